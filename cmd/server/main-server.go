@@ -260,6 +260,17 @@ func main() {
 	log.Printf("wave version: %s (%s)\n", WaveVersion, BuildTime)
 	log.Printf("wave data dir: %s\n", wavebase.GetWaveDataDir())
 	log.Printf("wave config dir: %s\n", wavebase.GetWaveConfigDir())
+	filestore.WFS.OnFlush = func(stats filestore.FlushStats) {
+		wps.Broker.Publish(wps.WaveEvent{
+			Event: wps.Event_BlockStoreFlush,
+			Data: &wps.WSBlockStoreFlushData{
+				NumFlushed:   stats.NumCommitted,
+				BytesWritten: stats.BytesWritten,
+				DurationMs:   stats.FlushDuration.Milliseconds(),
+				NumErrors:    stats.NumErrors,
+			},
+		})
+	}
 	err = filestore.InitFilestore()
 	if err != nil {
 		log.Printf("error initializing filestore: %v\n", err)
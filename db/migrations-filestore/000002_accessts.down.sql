@@ -0,0 +1 @@
+ALTER TABLE db_wave_file DROP COLUMN accessts;
@@ -0,0 +1 @@
+ALTER TABLE db_wave_file ADD COLUMN accessts bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE db_file_data DROP COLUMN checksum;
+ALTER TABLE db_wave_file DROP COLUMN checksum;
@@ -0,0 +1,2 @@
+ALTER TABLE db_file_data ADD COLUMN checksum blob;
+ALTER TABLE db_wave_file ADD COLUMN checksum blob;
@@ -0,0 +1,2 @@
+INSERT INTO db_file_data (zoneid, name, partidx, data) SELECT zoneid, name, 0, inlinedata FROM db_wave_file WHERE inlinedata IS NOT NULL;
+ALTER TABLE db_wave_file DROP COLUMN inlinedata;
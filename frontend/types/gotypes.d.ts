@@ -374,6 +374,10 @@ declare global {
         circular?: boolean;
         ijson?: boolean;
         ijsonbudget?: number;
+        archiveoverflow?: boolean;
+        trimfront?: boolean;
+        linebuffered?: boolean;
+        writethrough?: boolean;
     };
 
     // wconfig.FullConfigType
@@ -672,6 +676,7 @@ declare global {
         event: string;
         scopes?: string[];
         allscopes?: boolean;
+        datafilter?: {[key: string]: any};
     };
 
     // waveobj.Tab
@@ -944,6 +949,14 @@ declare global {
         body?: string;
     };
 
+    // wps.WSBlockStoreFlushData
+    type WSBlockStoreFlushData = {
+        numflushed: number;
+        byteswritten: number;
+        durationms: number;
+        numerrors: number;
+    };
+
     type WSCommandType = {
         wscommand: string;
     } & ( SetBlockTermSizeWSCommand | BlockInputWSCommand | WSRpcCommand );
@@ -961,6 +974,7 @@ declare global {
         filename: string;
         fileop: string;
         data64: string;
+        seq?: number;
     };
 
     // webcmd.WSRpcCommand
@@ -1037,6 +1051,9 @@ declare global {
         createdts: number;
         size: number;
         modts: number;
+        accessts?: number;
+        startoffset?: number;
+        version?: number;
         meta: {[key: string]: any};
     };
 
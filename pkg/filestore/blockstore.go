@@ -8,14 +8,23 @@ package filestore
 // but all writes only go to the cache, and then the cache is periodically flushed to the DB
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/fs"
 	"log"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/wavetermdev/waveterm/pkg/ijson"
 	"github.com/wavetermdev/waveterm/pkg/panichandler"
 )
@@ -26,6 +35,45 @@ const (
 	IJsonIncrementalBytes = "ijson:incbytes"
 )
 
+// meta key holding the name of a validator registered with RegisterValidator
+const ValidatorMetaKey = "validator"
+
+// optional int meta key, files with a higher flush priority are flushed first (see FlushCache)
+const FlushPriorityMetaKey = "filestore:flushpriority"
+
+// int meta key, the total number of bytes the file's offsets have been shifted down by CompactCircular and
+// FreezeCircular.  readers that keep file offsets subtract the change since their last read (FileCursor does)
+const RebaseMetaKey = "filestore:rebase"
+
+// sidecar file (same zone) that receives the bytes overwritten in an ArchiveOverflow circular file
+const ArchiveSuffix = ".archive"
+
+// returned (wrapped) by WriteAtIfSize when the file size does not match the expected size
+var ErrSizeChanged = errors.New("file size changed")
+
+// returned (wrapped) by WriteAtIfVersion and WriteMetaIfVersion when the file's version is not the expected one
+var ErrVersionMismatch = errors.New("file version mismatch")
+
+// returned (wrapped) by SwapFiles when a file has unflushed changes
+var ErrPendingWrites = errors.New("file has pending writes")
+
+// returned (wrapped) by WriteAtInBounds when the write would extend the file
+var ErrWriteOutOfBounds = errors.New("write extends past the end of the file")
+
+// returned (wrapped) when flushing a file that was deleted and recreated (or had its opts changed) in the DB
+// underneath the cached changes, e.g. by another FileStore on the same DB.  the cached changes are dropped
+var ErrFileChanged = errors.New("file changed in the db")
+
+// returned (wrapped) by OpenCursor and FollowReader when the file already has MaxOpenReaders open
+var ErrTooManyReaders = errors.New("too many open readers")
+
+// write ops passed to validators
+const (
+	WriteOp_WriteFile = "writefile"
+	WriteOp_WriteAt   = "writeat"
+	WriteOp_Append    = "append"
+)
+
 const (
 	IJsonHighCommands = 100
 	IJsonHighRatio    = 3
@@ -35,29 +83,99 @@ const (
 
 const DefaultPartDataSize = 64 * 1024
 const DefaultFlushTime = 5 * time.Second
+const DefaultFlushBatchSize = 50  // parts per INSERT, see FileStore.FlushBatchSize
+const DefaultMaxPartIdx = 1 << 20 // 64GB with the default part size, see FileStore.MaxPartIdx
 const NoPartIdx = -1
+const InlineDataThreshold = 256 // files up to this size (that fit in one part) are stored in the file row, see canStoreInline
 
 // for unit tests
 var warningCount = &atomic.Int32{}
 var flushErrorCount = &atomic.Int32{}
+var partBytesWritten = &atomic.Int64{}
+var partWriteStatements = &atomic.Int64{}
+var partReadQueries = &atomic.Int64{}
 
 var partDataSize int64 = DefaultPartDataSize // overridden in tests
 var stopFlush = &atomic.Bool{}
+var dirtyGenCounter = &atomic.Int64{} // global so generations stay monotonic even when cache entries are dropped
+
+var WFS *FileStore = NewFileStore(FileStoreOpts{})
+
+// tunables for NewFileStore, zero values mean the defaults (see the matching FileStore fields)
+// the part size is not configurable per store, parts are persisted at partDataSize so it is a property of the DB
+type FileStoreOpts struct {
+	TrackAccessTime       bool
+	FlushBatchSize        int
+	MaxInFlightFlushBytes int64
+	MaxPartIdx            int
+	MaxAppendChunk        int64
+	SpillDir              string
+	SpillThreshold        int64
+	CircularCompactWraps  int
+	EagerMetaFlush        bool
+	OnFlush               func(FlushStats)
+	Tracer                Tracer
+	SoftDeleteGrace       time.Duration
+	PinLeakThreshold      time.Duration
+	DB                    *sqlx.DB // must already be migrated (see MigrateDB), nil means the global DB
+	Backend               Backend  // nil means a DBBackend on DB
+	MaxOpenReaders        int
+}
 
-var WFS *FileStore = &FileStore{
-	Lock:  &sync.Mutex{},
-	Cache: make(map[cacheKey]*CacheEntry),
+func NewFileStore(opts FileStoreOpts) *FileStore {
+	return &FileStore{
+		Lock:                  &sync.Mutex{},
+		Cache:                 make(map[cacheKey]*CacheEntry),
+		Validators:            make(map[string]FileValidator),
+		MetaSchemas:           make(map[cacheKey]MetaSchema),
+		TrackAccessTime:       opts.TrackAccessTime,
+		FlushBatchSize:        opts.FlushBatchSize,
+		MaxInFlightFlushBytes: opts.MaxInFlightFlushBytes,
+		MaxPartIdx:            opts.MaxPartIdx,
+		MaxAppendChunk:        opts.MaxAppendChunk,
+		SpillDir:              opts.SpillDir,
+		SpillThreshold:        opts.SpillThreshold,
+		CircularCompactWraps:  opts.CircularCompactWraps,
+		EagerMetaFlush:        opts.EagerMetaFlush,
+		OnFlush:               opts.OnFlush,
+		Tracer:                opts.Tracer,
+		SoftDeleteGrace:       opts.SoftDeleteGrace,
+		PinLeakThreshold:      opts.PinLeakThreshold,
+		DB:                    opts.DB,
+		Backend:               opts.Backend,
+		MaxOpenReaders:        opts.MaxOpenReaders,
+	}
 }
 
+// called before data is written to the cache, a non-nil error aborts the write
+// existing is a copy of the file before the write, op is one of the WriteOp_* constants
+type FileValidator func(existing *WaveFile, op string, data []byte) error
+
 type FileOptsType struct {
-	MaxSize     int64 `json:"maxsize,omitempty"`
-	Circular    bool  `json:"circular,omitempty"`
-	IJson       bool  `json:"ijson,omitempty"`
-	IJsonBudget int   `json:"ijsonbudget,omitempty"`
+	MaxSize         int64 `json:"maxsize,omitempty"`
+	Circular        bool  `json:"circular,omitempty"`
+	IJson           bool  `json:"ijson,omitempty"`
+	IJsonBudget     int   `json:"ijsonbudget,omitempty"`
+	ArchiveOverflow bool  `json:"archiveoverflow,omitempty"` // circular only, bytes that fall out of the window are appended to name + ArchiveSuffix
+	TrimFront       bool  `json:"trimfront,omitempty"`       // non-circular, whole leading parts are dropped to keep at most MaxSize bytes (see StartOffset)
+	LineBuffered    bool  `json:"linebuffered,omitempty"`    // non-ijson, appends only commit complete lines (see blockstore_linebuf.go)
+	WriteThrough    bool  `json:"writethrough,omitempty"`    // writes are flushed to the DB before they return (see flushWriteThrough)
 }
 
 type FileMeta = map[string]any
 
+// maps the allowed meta keys to their value type (one of the MetaType_* constants)
+type MetaSchema = map[string]string
+
+const (
+	MetaType_Any    = "any"
+	MetaType_String = "string"
+	MetaType_Number = "number"
+	MetaType_Bool   = "bool"
+	MetaType_Object = "object"
+	MetaType_Array  = "array"
+)
+
 type WaveFile struct {
 	// these fields are static (not updated)
 	ZoneId    string       `json:"zoneid"`
@@ -66,26 +184,36 @@ type WaveFile struct {
 	CreatedTs int64        `json:"createdts"`
 
 	//  these fields are mutable
-	Size  int64    `json:"size"`
-	ModTs int64    `json:"modts"`
-	Meta  FileMeta `json:"meta"` // only top-level keys can be updated (lower levels are immutable)
+	Size        int64    `json:"size"`
+	ModTs       int64    `json:"modts"`
+	AccessTs    int64    `json:"accessts,omitempty"`    // only persisted when FileStore.TrackAccessTime is set
+	StartOffset int64    `json:"startoffset,omitempty"` // TrimFront files only, offset of the first byte that has not been trimmed
+	Version     int64    `json:"version,omitempty"`     // incremented by every data or meta change (see WriteAtIfVersion)
+	Meta        FileMeta `json:"meta"`                  // only top-level keys can be updated (lower levels are immutable)
 }
 
 // for regular files this is just Size
 // for circular files this is min(Size, MaxSize)
+// for trimfront files this is Size - StartOffset
 func (f WaveFile) DataLength() int64 {
 	if f.Opts.Circular {
 		return minInt64(f.Size, f.Opts.MaxSize)
 	}
+	if f.Opts.TrimFront {
+		return f.Size - f.StartOffset
+	}
 	return f.Size
 }
 
 // for regular files this is just 0
-// for circular files this is the index of the first byte of data we have
+// for circular and trimfront files this is the index of the first byte of data we have
 func (f WaveFile) DataStartIdx() int64 {
 	if f.Opts.Circular && f.Size > f.Opts.MaxSize {
 		return f.Size - f.Opts.MaxSize
 	}
+	if f.Opts.TrimFront {
+		return f.StartOffset
+	}
 	return 0
 }
 
@@ -109,6 +237,29 @@ func (f *WaveFile) DeepCopy() *WaveFile {
 
 func (WaveFile) UseDBMap() {}
 
+// returned by StatExt
+// PartCount is the number of parts covering the file's data, CachedParts are the parts in the write cache,
+// DirtyParts are the cached parts that will be written on the next flush, Pinned is true if the file is
+// in use (by another call, an open cursor, or an outstanding ReadAtView).  StoredBytes is the number of bytes
+// stored in the file's parts (see GetPartLayout).  parts are stored uncompressed, so it only differs from DataLength
+// for sparse files and for circular and trimfront files (whose parts can hold bytes outside of the data range)
+type WaveFileExt struct {
+	*WaveFile
+	PartCount   int
+	CachedParts int
+	DirtyParts  int
+	Pinned      bool
+	StoredBytes int64
+}
+
+// returned by WriteAtInfo
+// PartsDirtied is the number of data parts the write modified (parts skipped for circular/trimfront files are not counted)
+type WriteInfo struct {
+	PartsDirtied int
+	SizeChanged  bool
+	NewSize      int64
+}
+
 type FileData struct {
 	ZoneId  string `json:"zoneid"`
 	Name    string `json:"name"`
@@ -118,59 +269,158 @@ type FileData struct {
 
 func (FileData) UseDBMap() {}
 
+// raw part data, used to replicate files part by part (see GetPartSnapshots)
+type PartSnapshot struct {
+	PartIdx  int    `json:"partidx"`
+	Data     []byte `json:"data"`
+	Checksum uint32 `json:"checksum"` // crc32 (IEEE) of Data
+}
+
+type Range struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// options for ReadAtWithOpts, the zero value reads like ReadAt
+type ReadAtOpts struct {
+	// reads past the end of the file are zero-filled (sparse semantics, e.g. a disk image with a fixed logical size),
+	// so the returned data always ends at offset+size
+	ZeroFillPastEOF bool `json:"zerofillpasteof,omitempty"`
+}
+
 // synchronous (does not interact with the cache)
 func (s *FileStore) MakeFile(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) error {
+	opts, err := normalizeFileOpts(opts)
+	if err != nil {
+		return err
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		return s.makeFile(ctx, entry, meta, opts)
+	})
+}
+
+// like MakeFile, but safe to retry: if the file already exists with identical opts (compared after the same
+// normalization MakeFile applies, e.g. rounding MaxSize) this returns nil and the existing file (and its meta)
+// is left unchanged.  if the existing file's opts differ, returns an error wrapping fs.ErrExist
+func (s *FileStore) MakeFileIdempotent(ctx context.Context, zoneId string, name string, meta FileMeta, opts FileOptsType) error {
+	opts, err := normalizeFileOpts(opts)
+	if err != nil {
+		return err
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := s.makeFile(ctx, entry, meta, opts)
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if file.Opts != opts {
+			return fmt.Errorf("file %s:%s exists with different opts: %w", zoneId, name, fs.ErrExist)
+		}
+		return nil
+	})
+}
+
+// validates opts, and rounds MaxSize up to a whole number of parts where the file type requires it
+func normalizeFileOpts(opts FileOptsType) (FileOptsType, error) {
 	if opts.MaxSize < 0 {
-		return fmt.Errorf("max size must be non-negative")
+		return opts, fmt.Errorf("max size must be non-negative")
 	}
 	if opts.Circular && opts.MaxSize <= 0 {
-		return fmt.Errorf("circular file must have a max size")
+		return opts, fmt.Errorf("circular file must have a max size")
 	}
 	if opts.Circular && opts.IJson {
-		return fmt.Errorf("circular file cannot be ijson")
+		return opts, fmt.Errorf("circular file cannot be ijson")
 	}
-	if opts.Circular {
+	if opts.ArchiveOverflow && !opts.Circular {
+		return opts, fmt.Errorf("archive overflow requires a circular file")
+	}
+	if opts.TrimFront && (opts.Circular || opts.IJson) {
+		return opts, fmt.Errorf("trimfront file cannot be circular or ijson")
+	}
+	if opts.TrimFront && opts.MaxSize <= 0 {
+		return opts, fmt.Errorf("trimfront file must have a max size")
+	}
+	if opts.TrimFront && opts.MaxSize%partDataSize != 0 {
+		// only whole parts are trimmed
+		opts.MaxSize = (opts.MaxSize/partDataSize + 1) * partDataSize
+	}
+	if opts.Circular && opts.MaxSize > partDataSize {
+		// circular files smaller than a part are stored in a single part (see partOffsetAtOffset)
 		if opts.MaxSize%partDataSize != 0 {
 			opts.MaxSize = (opts.MaxSize/partDataSize + 1) * partDataSize
 		}
 	}
+	if opts.LineBuffered && opts.IJson {
+		return opts, fmt.Errorf("ijson file cannot be line buffered")
+	}
 	if opts.IJsonBudget > 0 && !opts.IJson {
-		return fmt.Errorf("ijson budget requires ijson")
+		return opts, fmt.Errorf("ijson budget requires ijson")
 	}
 	if opts.IJsonBudget < 0 {
-		return fmt.Errorf("ijson budget must be non-negative")
+		return opts, fmt.Errorf("ijson budget must be non-negative")
 	}
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		if entry.File != nil {
-			return fs.ErrExist
-		}
-		now := time.Now().UnixMilli()
-		file := &WaveFile{
-			ZoneId:    zoneId,
-			Name:      name,
-			Size:      0,
-			CreatedTs: now,
-			ModTs:     now,
-			Opts:      opts,
-			Meta:      meta,
-		}
-		return dbInsertFile(ctx, file)
-	})
+	return opts, nil
+}
+
+// must be called with the entry lock held
+func (s *FileStore) makeFile(ctx context.Context, entry *CacheEntry, meta FileMeta, opts FileOptsType) error {
+	if entry.File != nil {
+		return fs.ErrExist
+	}
+	now := s.now()
+	file := &WaveFile{
+		ZoneId:    entry.ZoneId,
+		Name:      entry.Name,
+		Size:      0,
+		CreatedTs: now,
+		ModTs:     now,
+		Opts:      opts,
+		Meta:      meta,
+	}
+	return s.backend().InsertFile(ctx, file)
 }
 
+// deleting a file that does not exist is not an error (and is not reported to observers), use DeleteFileStrict
+// to find out if the file existed
 func (s *FileStore) DeleteFile(ctx context.Context, zoneId string, name string) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := dbDeleteFile(ctx, zoneId, name)
+	err := s.DeleteFileStrict(ctx, zoneId, name)
+	if err == fs.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// like DeleteFile, but returns fs.ErrNotExist if the file does not exist.
+// MakeFile and DeleteFileStrict both run under the entry lock (and check the DB in the same transaction as the
+// insert/delete), so when they race on the same name one of them fully completes first: either the file is
+// created and then deleted (both succeed), or the delete fails with fs.ErrNotExist and the file is created
+func (s *FileStore) DeleteFileStrict(ctx context.Context, zoneId string, name string) error {
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := s.backend().DeleteFile(ctx, zoneId, name)
+		if err == fs.ErrNotExist {
+			// a dirty entry always has a DB row (MakeFile inserts it), so there is nothing to clear
+			return err
+		}
 		if err != nil {
 			return fmt.Errorf("error deleting file: %v", err)
 		}
 		entry.clear()
+		s.setLineBuf(cacheKey{ZoneId: zoneId, Name: name}, nil)
+		s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: name})
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	s.notifyDelete(zoneId, name)
+	return nil
 }
 
 func (s *FileStore) DeleteZone(ctx context.Context, zoneId string) error {
-	fileNames, err := dbGetZoneFileNames(ctx, zoneId)
+	fileNames, err := s.backend().GetZoneFileNames(ctx, zoneId)
 	if err != nil {
 		return fmt.Errorf("error getting zone files: %v", err)
 	}
@@ -180,6 +430,179 @@ func (s *FileStore) DeleteZone(ctx context.Context, zoneId string) error {
 	return nil
 }
 
+// deletes every file in the listed zones in a single DB transaction, returns the number of files deleted.
+// the files are listed first and all of their entries are locked (in sorted order) for the delete, unflushed changes
+// are discarded.  a file created in one of the zones after the listing is not deleted.  errors listing a zone are
+// joined into the returned error (that zone is skipped), the other zones are still deleted
+func (s *FileStore) DeleteZones(ctx context.Context, zoneIds []string) (int, error) {
+	var errs []error
+	var keys []cacheKey
+	for _, zoneId := range zoneIds {
+		fileNames, err := s.backend().GetZoneFileNames(ctx, zoneId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error getting files for zone %s: %w", zoneId, err))
+			continue
+		}
+		for _, name := range fileNames {
+			keys = append(keys, cacheKey{ZoneId: zoneId, Name: name})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ZoneId != keys[j].ZoneId {
+			return keys[i].ZoneId < keys[j].ZoneId
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	keys = slices.Compact(keys) // zoneIds can have duplicates
+	entries := make([]*CacheEntry, 0, len(keys))
+	for _, key := range keys {
+		entry := s.getEntryAndPin(key.ZoneId, key.Name)
+		defer s.unpinEntryAndTryDelete(key.ZoneId, key.Name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		entries = append(entries, entry)
+	}
+	deleted, err := s.backend().DeleteFiles(ctx, keys)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error deleting files: %w", err))
+		return 0, errors.Join(errs...)
+	}
+	for idx, entry := range entries {
+		entry.clear()
+		s.setLineBuf(keys[idx], nil)
+		s.dropReadRegion(keys[idx])
+	}
+	for _, key := range deleted {
+		s.notifyDelete(key.ZoneId, key.Name)
+	}
+	return len(deleted), errors.Join(errs...)
+}
+
+// moves all of the files in oldZoneId to newZoneId (returns fs.ErrExist if newZoneId already has files)
+// dirty cache entries are flushed first (under their entry locks) so the move itself is a single DB transaction.
+// the old entries are left clean, so they are dropped from the cache when unpinned (no cache keys need to be rewritten)
+func (s *FileStore) MoveZone(ctx context.Context, oldZoneId string, newZoneId string) error {
+	if oldZoneId == newZoneId {
+		return fmt.Errorf("cannot move zone to itself")
+	}
+	fileNames, err := s.backend().GetZoneFileNames(ctx, oldZoneId)
+	if err != nil {
+		return fmt.Errorf("error getting zone files: %v", err)
+	}
+	sort.Strings(fileNames)
+	for _, name := range fileNames {
+		entry := s.getEntryAndPin(oldZoneId, name)
+		defer s.unpinEntryAndTryDelete(oldZoneId, name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		err = entry.unspill()
+		if err != nil {
+			return err
+		}
+		_, err = entry.flushToDB(ctx, false, s.getFlushBatch())
+		if err != nil {
+			return fmt.Errorf("error flushing file %q: %w", name, err)
+		}
+	}
+	err = s.backend().MoveZone(ctx, oldZoneId, newZoneId, fileNames)
+	if err != nil {
+		return err
+	}
+	s.moveZoneLineBufs(oldZoneId, newZoneId)
+	s.dropZoneReadRegions(oldZoneId)
+	s.dropZoneReadRegions(newZoneId)
+	return nil
+}
+
+// exchanges the contents of two files in the same zone (data parts, size, opts and checksums, plus meta if swapMeta)
+// in a single DB transaction.  opts move with the data since they describe its layout (e.g. circular files).
+// both entries are locked (in sorted order) for the swap and dropped from the cache after it.  fails with
+// ErrPendingWrites (without swapping) if either file has unflushed changes or a pending partial line
+func (s *FileStore) SwapFiles(ctx context.Context, zoneId string, nameA string, nameB string, swapMeta bool) error {
+	if nameA == nameB {
+		return fmt.Errorf("cannot swap file %q with itself", nameA)
+	}
+	names := []string{nameA, nameB}
+	sort.Strings(names)
+	entries := make(map[string]*CacheEntry)
+	for _, name := range names {
+		entry := s.getEntryAndPin(zoneId, name)
+		defer s.unpinEntryAndTryDelete(zoneId, name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		err := entry.unspill()
+		if err != nil {
+			return err
+		}
+		entries[name] = entry
+	}
+	sizes := make(map[string]int64)
+	for _, name := range names {
+		entry := entries[name]
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		if entry.DirtyGen != 0 || len(s.getLineBuf(cacheKey{ZoneId: zoneId, Name: name})) > 0 {
+			return fmt.Errorf("cannot swap file %s:%s: %w", zoneId, name, ErrPendingWrites)
+		}
+		sizes[name] = file.Size
+	}
+	err := s.backend().SwapFiles(ctx, zoneId, nameA, nameB, swapMeta, s.now())
+	if err != nil {
+		return err
+	}
+	entries[nameA].clear()
+	entries[nameB].clear()
+	s.notifyWrite(zoneId, nameA, 0, int(sizes[nameB]))
+	s.notifyWrite(zoneId, nameB, 0, int(sizes[nameA]))
+	return nil
+}
+
+// drops the cached entry for the file so the next access re-reads it from the DB (use after editing the DB directly)
+// entries with unflushed changes or that are in use are left alone, returns false if the entry was not dropped
+func (s *FileStore) InvalidateFile(zoneId string, name string) bool {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.invalidateEntry_nolock(cacheKey{ZoneId: zoneId, Name: name})
+}
+
+// like InvalidateFile for every cached file in the zone, returns the (sorted) names of the files that were not dropped
+func (s *FileStore) InvalidateZone(zoneId string) []string {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for key := range s.readRegions {
+		if key.ZoneId == zoneId {
+			delete(s.readRegions, key)
+		}
+	}
+	var skipped []string
+	for key := range s.Cache {
+		if key.ZoneId != zoneId {
+			continue
+		}
+		if !s.invalidateEntry_nolock(key) {
+			skipped = append(skipped, key.Name)
+		}
+	}
+	sort.Strings(skipped)
+	return skipped
+}
+
+// an unpinned entry can't be locked (entries are always pinned before they are locked), so it is safe to read here
+func (s *FileStore) invalidateEntry_nolock(key cacheKey) bool {
+	delete(s.readRegions, key)
+	entry := s.Cache[key]
+	if entry == nil {
+		return true
+	}
+	if entry.PinCount > 0 || entry.DirtyGen != 0 {
+		return false
+	}
+	delete(s.Cache, key)
+	return true
+}
+
 // if file doesn't exsit, returns fs.ErrNotExist
 func (s *FileStore) Stat(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
 	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (*WaveFile, error) {
@@ -190,12 +613,122 @@ func (s *FileStore) Stat(ctx context.Context, zoneId string, name string) (*Wave
 			}
 			return nil, fmt.Errorf("error getting file: %v", err)
 		}
-		return file.DeepCopy(), nil
+		s.recordAccess(ctx, entry)
+		rtn := file.DeepCopy()
+		if entry.AccessTs > rtn.AccessTs {
+			rtn.AccessTs = entry.AccessTs
+		}
+		return rtn, nil
+	})
+}
+
+// returns a copy of the file's meta.  only the meta is read (from the cache if the file has unflushed changes,
+// otherwise just the meta column from the DB), no data parts are loaded and the file is not loaded into the cache
+func (s *FileStore) GetFileMeta(ctx context.Context, zoneId string, name string) (FileMeta, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (FileMeta, error) {
+		if entry.File != nil {
+			return copyMeta(entry.File.Meta), nil
+		}
+		return s.backend().GetFileMeta(ctx, zoneId, name)
+	})
+}
+
+// like Stat, but also returns the storage layout and cache state of the file (for monitoring)
+func (s *FileStore) StatExt(ctx context.Context, zoneId string, name string) (*WaveFileExt, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (*WaveFileExt, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			if err == fs.ErrNotExist {
+				return nil, err
+			}
+			return nil, fmt.Errorf("error getting file: %v", err)
+		}
+		s.recordAccess(ctx, entry)
+		rtn := &WaveFileExt{WaveFile: file.DeepCopy()}
+		if entry.AccessTs > rtn.AccessTs {
+			rtn.AccessTs = entry.AccessTs
+		}
+		rtn.PartCount = len(file.computePartMap(file.DataStartIdx(), file.DataLength()))
+		rtn.CachedParts = len(entry.DataEntries)
+		for _, dce := range entry.DataEntries {
+			if !dce.canPatch() || dce.DirtyEnd > dce.DirtyStart {
+				rtn.DirtyParts++
+			}
+		}
+		rtn.Pinned = s.getPinCount(entry) > 1 // withLock holds one pin
+		layout, err := entry.getPartLayout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, partSize := range layout {
+			rtn.StoredBytes += int64(partSize)
+		}
+		return rtn, nil
+	})
+}
+
+// returns partIdx => number of bytes stored in the part, for every populated part (no data is read)
+// cached parts take precedence over the DB (the cache is always at least as new).  parts that were never
+// written (holes in sparse files) are left out, circular files can have parts outside of the current window
+func (s *FileStore) GetPartLayout(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (map[int]int, error) {
+		_, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return entry.getPartLayout(ctx)
+	})
+}
+
+// returns a copy of the bytes stored in the physical part partIdx (the cached part if there is one, otherwise the
+// DB part), with no circular or trimfront offset adjustment.  returns nil if the part does not exist.
+// this is a low-level diagnostic (see GetPartLayout), use ReadAt to read file data
+func (s *FileStore) ReadPart(ctx context.Context, zoneId string, name string, partIdx int) ([]byte, error) {
+	if partIdx < 0 {
+		return nil, fmt.Errorf("part index cannot be negative")
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]byte, error) {
+		_, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if dce := entry.DataEntries[partIdx]; dce != nil {
+			return bytes.Clone(dce.Data), nil
+		}
+		dbParts, err := s.backend().GetFileParts(ctx, zoneId, name, []int{partIdx})
+		if err != nil {
+			return nil, fmt.Errorf("error getting data part %d: %w", partIdx, err)
+		}
+		if dce := dbParts[partIdx]; dce != nil {
+			return bytes.Clone(dce.Data), nil
+		}
+		return nil, nil
 	})
 }
 
+func (entry *CacheEntry) getPartLayout(ctx context.Context) (map[int]int, error) {
+	layout, err := entry.backend().GetPartSizes(ctx, entry.ZoneId, entry.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting part sizes: %w", err)
+	}
+	for partIdx, dce := range entry.DataEntries {
+		layout[partIdx] = len(dce.Data)
+	}
+	return layout, nil
+}
+
+func (s *FileStore) getPinCount(entry *CacheEntry) int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return entry.PinCount
+}
+
+// returns the files in the zone (with un-flushed cache changes applied)
+// this is not a point-in-time snapshot: each file is read from the cache separately after the DB query,
+// so a file deleted concurrently may still be returned and a file created concurrently may be missed.
+// use ListFilesConsistent when the set of files must be consistent (e.g. for backups)
 func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
-	files, err := dbGetZoneFiles(ctx, zoneId)
+	files, err := s.backend().GetZoneFiles(ctx, zoneId)
 	if err != nil {
 		return nil, fmt.Errorf("error getting zone files: %v", err)
 	}
@@ -211,233 +744,1893 @@ func (s *FileStore) ListFiles(ctx context.Context, zoneId string) ([]*WaveFile,
 }
 
 func (s *FileStore) WriteMeta(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
-		if err != nil {
-			return err
-		}
-		if merge {
-			for k, v := range meta {
-				if v == nil {
-					delete(entry.File.Meta, k)
-					continue
-				}
-				entry.File.Meta[k] = v
-			}
-		} else {
-			entry.File.Meta = meta
-		}
-		entry.File.ModTs = time.Now().UnixMilli()
-		return nil
-	})
+	return s.writeMetaIfVersion(ctx, zoneId, name, meta, merge, -1)
 }
 
-func (s *FileStore) WriteFile(ctx context.Context, zoneId string, name string, data []byte) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
-		if err != nil {
-			return err
-		}
-		entry.writeAt(0, data, true)
-		// since WriteFile can *truncate* the file, we need to flush the file to the DB immediately
-		return entry.flushToDB(ctx, true)
-	})
+// like WriteMeta, but fails with ErrVersionMismatch (without writing) if the file's Version is not expectedVersion
+func (s *FileStore) WriteMetaIfVersion(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool, expectedVersion int64) error {
+	if expectedVersion < 0 {
+		return fmt.Errorf("expected version must be non-negative")
+	}
+	return s.writeMetaIfVersion(ctx, zoneId, name, meta, merge, expectedVersion)
 }
 
-func (s *FileStore) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) error {
-	if offset < 0 {
-		return fmt.Errorf("offset must be non-negative")
+func (s *FileStore) writeMetaIfVersion(ctx context.Context, zoneId string, name string, meta FileMeta, merge bool, expectedVersion int64) error {
+	err := s.validateMeta(zoneId, name, meta)
+	if err != nil {
+		return err
 	}
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+	err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
 			return err
 		}
-		file := entry.File
-		if offset > file.Size {
-			return fmt.Errorf("offset is past the end of the file")
-		}
-		partMap := file.computePartMap(offset, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
-		err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+		err = checkVersion(entry.File, expectedVersion)
 		if err != nil {
 			return err
 		}
-		entry.writeAt(offset, data, false)
-		return nil
+		entry.writeMeta(meta, merge)
+		s.writeMetaEager(ctx, entry)
+		return s.flushWriteThrough(ctx, entry)
 	})
+	if err != nil {
+		return err
+	}
+	s.notifyMeta(zoneId, name)
+	return nil
 }
 
-func (s *FileStore) AppendData(ctx context.Context, zoneId string, name string, data []byte) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+// applies the same meta update to each of the named files (each file is locked separately)
+// a failure on one file does not stop the others, the returned error joins the per-file errors
+func (s *FileStore) WriteMetaBatch(ctx context.Context, zoneId string, names []string, meta FileMeta, merge bool) error {
+	var errs []error
+	for _, name := range names {
+		err := s.validateMeta(zoneId, name, meta)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
-		partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
-		if len(incompleteParts) > 0 {
-			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+		err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
+			err := entry.loadFileIntoCache(ctx)
 			if err != nil {
 				return err
 			}
+			// each file gets its own copy so the files don't share a meta map
+			entry.writeMeta(copyMeta(meta), merge)
+			s.writeMetaEager(ctx, entry)
+			return s.flushWriteThrough(ctx, entry)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error writing meta for %s:%s: %w", zoneId, name, err))
+			continue
 		}
-		entry.writeAt(entry.File.Size, data, false)
-		return nil
-	})
+		s.notifyMeta(zoneId, name)
+	}
+	return errors.Join(errs...)
 }
 
-func metaIncrement(file *WaveFile, key string, amount int) int {
-	if file.Meta == nil {
-		file.Meta = make(FileMeta)
+// if EagerMetaFlush is set, writes the entry's meta to the DB right away so meta used as coordination state survives
+// a crash.  only the meta column is written (the entry stays dirty, the rest of the row and the data parts are
+// persisted by the next regular flush).  the in-memory meta is already updated, so a failure here is only logged
+func (s *FileStore) writeMetaEager(ctx context.Context, entry *CacheEntry) {
+	if !s.getEagerMetaFlush() {
+		return
 	}
-	val, ok := file.Meta[key].(int)
-	if !ok {
-		val = 0
+	err := s.backend().WriteFileMeta(ctx, entry.ZoneId, entry.Name, entry.File.Meta)
+	if err != nil {
+		log.Printf("error writing meta for %s:%s (will be retried on the next flush): %v\n", entry.ZoneId, entry.Name, err)
 	}
-	newVal := val + amount
-	file.Meta[key] = newVal
-	return newVal
 }
 
-func (s *FileStore) compactIJson(ctx context.Context, entry *CacheEntry) error {
-	// we don't need to lock the entry because we have the lock on the filestore
-	_, fullData, err := entry.readAt(ctx, 0, 0, true)
+// WriteThrough files are flushed to the DB (under the entry lock) before a write returns, so an acknowledged write
+// is durable.  the trade-off is that every write costs a DB transaction and nothing is coalesced, so this is only
+// meant for small, rarely written files.  the flush clears the entry, so reads go to the DB.  if the flush fails,
+// the write stays in the cache (to be retried by the background flusher) and the error is returned
+func (s *FileStore) flushWriteThrough(ctx context.Context, entry *CacheEntry) error {
+	if entry.File == nil || !entry.File.Opts.WriteThrough {
+		return nil
+	}
+	_, err := entry.flushToDB(ctx, false, s.getFlushBatch())
 	if err != nil {
-		return err
+		return fmt.Errorf("error writing through %s:%s: %w", entry.ZoneId, entry.Name, err)
+	}
+	return nil
+}
+
+func (s *FileStore) getEagerMetaFlush() bool {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.EagerMetaFlush
+}
+
+// updates ModTs without changing the file's data or meta (returns fs.ErrNotExist if the file does not exist)
+func (s *FileStore) Touch(ctx context.Context, zoneId string, name string) error {
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		entry.File.ModTs = s.now()
+		entry.markDirty()
+		return s.flushWriteThrough(ctx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyMeta(zoneId, name)
+	return nil
+}
+
+// replaces the contents of the file.  the write (including the flush to the DB) happens under the entry lock,
+// so concurrent WriteFile calls on the same file are serialized and never interleave: the last call to
+// acquire the lock wins (there is no conflict detection)
+func (s *FileStore) WriteFile(ctx context.Context, zoneId string, name string, data []byte) error {
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		err = s.checkWriteExtent(entry.File, 0, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		err = s.validateWrite(entry.File, WriteOp_WriteFile, data)
+		if err != nil {
+			return err
+		}
+		entry.writeAt(0, data, true)
+		// since WriteFile can *truncate* the file, we need to flush the file to the DB immediately
+		_, err = entry.flushToDB(ctx, true, s.getFlushBatch())
+		if err != nil {
+			return err
+		}
+		s.setLineBuf(cacheKey{ZoneId: zoneId, Name: name}, nil)
+		s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: name})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyWrite(zoneId, name, 0, len(data))
+	return nil
+}
+
+func (s *FileStore) WriteAt(ctx context.Context, zoneId string, name string, offset int64, data []byte) error {
+	_, err := s.WriteAtInfo(ctx, zoneId, name, offset, data)
+	return err
+}
+
+// like WriteAt, but also returns how much work the write created (for flush scheduling)
+func (s *FileStore) WriteAtInfo(ctx context.Context, zoneId string, name string, offset int64, data []byte) (WriteInfo, error) {
+	return s.writeAt(ctx, zoneId, name, offset, data, -1, -1, false)
+}
+
+// like WriteAt, but fails with ErrSizeChanged (without writing) if the file's size is not expectedSize
+// (optimistic concurrency for read-modify-write, e.g. to detect an append between a read and a write)
+func (s *FileStore) WriteAtIfSize(ctx context.Context, zoneId string, name string, offset int64, data []byte, expectedSize int64) error {
+	if expectedSize < 0 {
+		return fmt.Errorf("expected size must be non-negative")
+	}
+	_, err := s.writeAt(ctx, zoneId, name, offset, data, expectedSize, -1, false)
+	return err
+}
+
+// like WriteAt, but fails with ErrVersionMismatch (without writing) if the file's Version is not expectedVersion.
+// every data and meta change increments the version, so this detects any change since the caller's Stat
+func (s *FileStore) WriteAtIfVersion(ctx context.Context, zoneId string, name string, offset int64, data []byte, expectedVersion int64) error {
+	if expectedVersion < 0 {
+		return fmt.Errorf("expected version must be non-negative")
+	}
+	_, err := s.writeAt(ctx, zoneId, name, offset, data, -1, expectedVersion, false)
+	return err
+}
+
+// like WriteAt, but for pure overwrites: fails with ErrWriteOutOfBounds (without writing) if offset+len(data)
+// is past the end of the file, so the write can never grow the file
+func (s *FileStore) WriteAtInBounds(ctx context.Context, zoneId string, name string, offset int64, data []byte) error {
+	_, err := s.writeAt(ctx, zoneId, name, offset, data, -1, -1, true)
+	return err
+}
+
+func checkVersion(file *WaveFile, expectedVersion int64) error {
+	if expectedVersion >= 0 && file.Version != expectedVersion {
+		return fmt.Errorf("%w: %s:%s expected version %d, got %d", ErrVersionMismatch, file.ZoneId, file.Name, expectedVersion, file.Version)
+	}
+	return nil
+}
+
+// expectedSize and expectedVersion are checked under the entry lock (-1 means no check), as is inBounds (see WriteAtInBounds)
+func (s *FileStore) writeAt(ctx context.Context, zoneId string, name string, offset int64, data []byte, expectedSize int64, expectedVersion int64, inBounds bool) (rtnInfo WriteInfo, rtnErr error) {
+	ctx, span := s.startSpan(ctx, TraceOp_WriteAt, zoneId, name)
+	defer func() {
+		endSpan(span, int64(len(data)), rtnInfo.PartsDirtied, rtnErr)
+	}()
+	if offset < 0 {
+		return WriteInfo{}, fmt.Errorf("offset must be non-negative")
+	}
+	var needsCompact bool
+	var overflow bool
+	info, err := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (WriteInfo, error) {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return WriteInfo{}, err
+		}
+		file := entry.File
+		if expectedSize >= 0 && file.Size != expectedSize {
+			return WriteInfo{}, fmt.Errorf("%w: %s:%s expected size %d, got %d", ErrSizeChanged, zoneId, name, expectedSize, file.Size)
+		}
+		err = checkVersion(file, expectedVersion)
+		if err != nil {
+			return WriteInfo{}, err
+		}
+		err = s.checkWriteExtent(file, offset, int64(len(data)))
+		if err != nil {
+			return WriteInfo{}, err
+		}
+		if offset > file.Size {
+			return WriteInfo{}, fmt.Errorf("offset is past the end of the file")
+		}
+		if inBounds && offset+int64(len(data)) > file.Size {
+			return WriteInfo{}, fmt.Errorf("%w: %s:%s write %d:%d, size %d", ErrWriteOutOfBounds, zoneId, name, offset, len(data), file.Size)
+		}
+		err = s.validateWrite(file, WriteOp_WriteAt, data)
+		if err != nil {
+			return WriteInfo{}, err
+		}
+		incompleteParts := file.partsToLoadForWrite(offset, int64(len(data)))
+		err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+		if err != nil {
+			return WriteInfo{}, err
+		}
+		lostData, err := s.readOverflow(ctx, entry, offset+int64(len(data)))
+		if err != nil {
+			return WriteInfo{}, err
+		}
+		info := entry.writeAt(offset, data, false)
+		overflow = s.queueArchive(zoneId, name, lostData)
+		needsCompact = s.circularNeedsCompact(entry.File)
+		return info, s.flushWriteThrough(ctx, entry)
+	})
+	if overflow {
+		// also after a failed write-through flush (the write stays in the cache)
+		s.drainArchiveLogErr(ctx, zoneId, name)
+	}
+	if err != nil {
+		return info, err
+	}
+	s.notifyWrite(zoneId, name, offset, len(data))
+	if needsCompact {
+		s.startCompactCircular(zoneId, name)
+	}
+	return info, nil
+}
+
+func (s *FileStore) AppendData(ctx context.Context, zoneId string, name string, data []byte) error {
+	_, err := s.AppendDataReturnSize(ctx, zoneId, name, data)
+	return err
+}
+
+// like AppendData, but returns the file size right after the append (computed under the same lock as
+// the append, so it is exact even with concurrent appends)
+func (s *FileStore) AppendDataReturnSize(ctx context.Context, zoneId string, name string, data []byte) (int64, error) {
+	return s.appendData(ctx, zoneId, name, data, false)
+}
+
+// flushLine is only used for line buffered files, it commits the pending partial line along with data
+func (s *FileStore) appendData(ctx context.Context, zoneId string, name string, data []byte, flushLine bool) (rtnSize int64, rtnErr error) {
+	ctx, span := s.startSpan(ctx, TraceOp_AppendData, zoneId, name)
+	defer func() {
+		var numParts int
+		if rtnErr == nil {
+			numParts = spannedParts(rtnSize-int64(len(data)), int64(len(data)))
+		}
+		endSpan(span, int64(len(data)), numParts, rtnErr)
+	}()
+	var appendOffset int64
+	var needsCompact bool
+	var overflow bool
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		appendOffset = entry.File.Size
+		key := cacheKey{ZoneId: zoneId, Name: name}
+		var lineRest []byte
+		if entry.File.Opts.LineBuffered {
+			data, lineRest = splitLines(s.getLineBuf(key), data, flushLine)
+			if len(data) == 0 {
+				s.setLineBuf(key, lineRest)
+				return nil
+			}
+		} else if flushLine {
+			return nil
+		}
+		err = s.checkWriteExtent(entry.File, entry.File.Size, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		err = s.validateWrite(entry.File, WriteOp_Append, data)
+		if err != nil {
+			return err
+		}
+		incompleteParts := entry.File.partsToLoadForWrite(entry.File.Size, int64(len(data)))
+		if len(incompleteParts) > 0 {
+			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+			if err != nil {
+				return err
+			}
+		}
+		lostData, err := s.readOverflow(ctx, entry, entry.File.Size+int64(len(data)))
+		if err != nil {
+			return err
+		}
+		chunkSize := s.getMaxAppendChunk()
+		if chunkSize <= 0 || entry.File.Opts.Circular || entry.File.Opts.TrimFront {
+			// circular and trimfront files never keep more than MaxSize bytes, so they don't need chunking (and the
+			// parts trimmed by a chunk flush could not be restored if a later chunk failed)
+			entry.writeAt(entry.File.Size, data, false)
+			overflow = s.queueArchive(zoneId, name, lostData)
+			needsCompact = s.circularNeedsCompact(entry.File)
+		} else {
+			err = s.appendChunked(ctx, entry, data, chunkSize)
+			if err != nil {
+				return err
+			}
+		}
+		if entry.File != nil && entry.File.Opts.LineBuffered {
+			s.setLineBuf(key, lineRest)
+		}
+		return s.flushWriteThrough(ctx, entry)
+	})
+	if overflow {
+		// also after a failed write-through flush (the write stays in the cache)
+		s.drainArchiveLogErr(ctx, zoneId, name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > 0 {
+		s.notifyWrite(zoneId, name, appendOffset, len(data))
+	}
+	if needsCompact {
+		s.startCompactCircular(zoneId, name)
+	}
+	return appendOffset + int64(len(data)), nil
+}
+
+// writes data in chunks of about chunkSize bytes, flushing after each chunk but the last to bound the dirty memory.
+// chunks end on part boundaries so every flushed part is complete.  the data has already been validated as a whole.
+// the append is all or nothing: the entry is flushed first (so it only holds the append), and if a chunk flush fails
+// the file is rolled back to its size before the append (see rollbackAppend)
+func (s *FileStore) appendChunked(ctx context.Context, entry *CacheEntry, data []byte, chunkSize int64) error {
+	if int64(len(data)) > chunkSize {
+		_, err := entry.flushToDB(ctx, false, s.getFlushBatch())
+		if err != nil {
+			return fmt.Errorf("error flushing before chunked append: %w", err)
+		}
+	}
+	var origFile *WaveFile
+	var origLastPart []byte // the data of the part the append starts in (nil if it starts on a part boundary)
+	for len(data) > 0 {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		fileSize := entry.File.Size
+		writeLen := int64(len(data))
+		if writeLen > chunkSize {
+			endOffset := (fileSize + chunkSize) / partDataSize * partDataSize
+			if endOffset <= fileSize {
+				endOffset = (fileSize/partDataSize + 1) * partDataSize
+			}
+			writeLen = endOffset - fileSize
+		}
+		incompleteParts := entry.File.partsToLoadForWrite(fileSize, writeLen)
+		err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+		if err != nil {
+			return err
+		}
+		if origFile == nil {
+			origFile = entry.File.DeepCopy()
+			if dce := entry.DataEntries[origFile.partIdxAtOffset(fileSize)]; dce != nil && fileSize%partDataSize != 0 {
+				origLastPart = bytes.Clone(dce.Data[:min(int64(len(dce.Data)), fileSize%partDataSize)])
+			}
+		}
+		entry.writeAt(fileSize, data[:writeLen], false)
+		data = data[writeLen:]
+		if len(data) > 0 {
+			_, err = entry.flushToDB(ctx, false, s.getFlushBatch())
+			if err != nil {
+				return s.rollbackAppend(ctx, entry, origFile, origLastPart, fmt.Errorf("error flushing append chunk: %w", err))
+			}
+		}
+	}
+	return nil
+}
+
+// restores the file to origFile (with origLastPart as its last part) and flushes it, the flush drops the parts
+// written by the failed append (see WriteCacheEntry).  if the rollback flush fails, the restored state stays in
+// the cache (to be retried by the background flusher).  returns err
+func (s *FileStore) rollbackAppend(ctx context.Context, entry *CacheEntry, origFile *WaveFile, origLastPart []byte, err error) error {
+	if errors.Is(err, ErrFileChanged) {
+		// the file was deleted or replaced underneath us, there is nothing to roll back
+		return err
+	}
+	entry.clear()
+	entry.File = origFile
+	entry.hasFile.Store(true)
+	if origLastPart != nil {
+		dce := makeDataCacheEntry(origFile.partIdxAtOffset(origFile.Size))
+		dce.Data = append(dce.Data, origLastPart...)
+		entry.DataEntries[dce.PartIdx] = dce
+	}
+	entry.markDirty()
+	_, rollbackErr := entry.flushToDB(ctx, false, s.getFlushBatch())
+	if rollbackErr != nil {
+		return fmt.Errorf("%w (error rolling back the append: %v)", err, rollbackErr)
+	}
+	return err
+}
+
+// for circular files with ArchiveOverflow set, returns the bytes that a write ending at endWriteOffset will
+// push out of the circular window (nil if none).  must be called (under the entry lock) before the write, once the
+// write has been applied to the cache the bytes are queued with queueArchive (still under the lock, so the queue is
+// in write order) and appended to the archive with drainArchive after the lock is released, so the circular file's
+// lock is never held while writing the archive.  WriteFile replaces the whole file and does not archive.
+func (s *FileStore) readOverflow(ctx context.Context, entry *CacheEntry, endWriteOffset int64) ([]byte, error) {
+	file := entry.File
+	if !file.Opts.Circular || !file.Opts.ArchiveOverflow {
+		return nil, nil
+	}
+	oldStart := file.DataStartIdx()
+	newStart := minInt64(endWriteOffset-file.Opts.MaxSize, file.Size)
+	if newStart <= oldStart {
+		return nil, nil
+	}
+	_, lostData, err := entry.readAt(ctx, oldStart, newStart-oldStart, false)
+	return lostData, err
+}
+
+type archiveQueue struct {
+	pending  [][]byte
+	draining bool
+}
+
+// returns true if anything was queued
+func (s *FileStore) queueArchive(zoneId string, name string, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	key := cacheKey{ZoneId: zoneId, Name: name + ArchiveSuffix}
+	if s.archiveQueues == nil {
+		s.archiveQueues = make(map[cacheKey]*archiveQueue)
+	}
+	queue := s.archiveQueues[key]
+	if queue == nil {
+		queue = &archiveQueue{}
+		s.archiveQueues[key] = queue
+	}
+	queue.pending = append(queue.pending, data)
+	return true
+}
+
+// the write that queued the overflow has already been applied, so an archive error does not fail the write (the
+// overflow stays queued and is retried by the next overflowing write or flush, see drainArchives)
+func (s *FileStore) drainArchiveLogErr(ctx context.Context, zoneId string, name string) {
+	err := s.drainArchive(ctx, zoneId, name)
+	if err != nil {
+		log.Printf("error archiving overflow of %s:%s (will be retried on the next flush): %v\n", zoneId, name, err)
+	}
+}
+
+// drains every archive queue (called by FlushCache)
+func (s *FileStore) drainArchives(ctx context.Context) error {
+	s.Lock.Lock()
+	keys := make([]cacheKey, 0, len(s.archiveQueues))
+	for key := range s.archiveQueues {
+		keys = append(keys, key)
+	}
+	s.Lock.Unlock()
+	for _, key := range keys {
+		err := s.drainArchive(ctx, key.ZoneId, strings.TrimSuffix(key.Name, ArchiveSuffix))
+		if err != nil {
+			return fmt.Errorf("error archiving overflow: %w", err)
+		}
+	}
+	return nil
+}
+
+// appends the queued overflow of the circular file to its archive (created on first use), in queue order.
+// only one caller drains a queue at a time, if another caller is draining it also appends what was queued here.
+// on error the failed chunk stays at the head of the queue (it is retried by the next drain)
+func (s *FileStore) drainArchive(ctx context.Context, zoneId string, name string) error {
+	key := cacheKey{ZoneId: zoneId, Name: name + ArchiveSuffix}
+	for {
+		s.Lock.Lock()
+		queue := s.archiveQueues[key]
+		if queue == nil || queue.draining {
+			s.Lock.Unlock()
+			return nil
+		}
+		if len(queue.pending) == 0 {
+			delete(s.archiveQueues, key)
+			s.Lock.Unlock()
+			return nil
+		}
+		data := queue.pending[0]
+		queue.draining = true
+		s.Lock.Unlock()
+		err := s.appendArchive(ctx, key, data)
+		s.Lock.Lock()
+		queue.draining = false
+		if err == nil {
+			queue.pending = queue.pending[1:]
+		}
+		s.Lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FileStore) appendArchive(ctx context.Context, key cacheKey, data []byte) error {
+	err := s.MakeFile(ctx, key.ZoneId, key.Name, nil, FileOptsType{})
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("error creating archive file %s:%s: %w", key.ZoneId, key.Name, err)
+	}
+	err = s.AppendData(ctx, key.ZoneId, key.Name, data)
+	if err != nil {
+		return fmt.Errorf("error writing archive file %s:%s: %w", key.ZoneId, key.Name, err)
+	}
+	return nil
+}
+
+// registers a validator for files whose meta has ValidatorMetaKey set to name (nil fn removes the validator)
+func (s *FileStore) RegisterValidator(name string, fn FileValidator) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if fn == nil {
+		delete(s.Validators, name)
+		return
+	}
+	s.Validators[name] = fn
+}
+
+func (s *FileStore) getValidator(name string) FileValidator {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.Validators[name]
+}
+
+// registers a meta schema for a file (or for every file in the zone if name is ""), a nil schema removes it
+// once a schema is registered, WriteMeta rejects keys that are not in the schema and values of the wrong type
+// a file-level schema takes precedence over the zone-level schema
+func (s *FileStore) RegisterMetaSchema(zoneId string, name string, schema MetaSchema) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if schema == nil {
+		delete(s.MetaSchemas, cacheKey{ZoneId: zoneId, Name: name})
+		return
+	}
+	s.MetaSchemas[cacheKey{ZoneId: zoneId, Name: name}] = schema
+}
+
+func (s *FileStore) getMetaSchema(zoneId string, name string) MetaSchema {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if schema, ok := s.MetaSchemas[cacheKey{ZoneId: zoneId, Name: name}]; ok {
+		return schema
+	}
+	return s.MetaSchemas[cacheKey{ZoneId: zoneId, Name: ""}]
+}
+
+// nil values (key deletions) are always allowed so junk keys can be cleaned up
+func (s *FileStore) validateMeta(zoneId string, name string, meta FileMeta) error {
+	schema := s.getMetaSchema(zoneId, name)
+	if schema == nil {
+		return nil
+	}
+	for key, val := range meta {
+		if val == nil {
+			continue
+		}
+		metaType, ok := schema[key]
+		if !ok {
+			return fmt.Errorf("meta key %q is not allowed for file %s:%s", key, zoneId, name)
+		}
+		if !metaValueHasType(val, metaType) {
+			return fmt.Errorf("meta key %q for file %s:%s must be of type %s, got %T", key, zoneId, name, metaType, val)
+		}
+	}
+	return nil
+}
+
+func metaValueHasType(val any, metaType string) bool {
+	kind := reflect.TypeOf(val).Kind()
+	switch metaType {
+	case MetaType_Any, "":
+		return true
+	case MetaType_String:
+		return kind == reflect.String
+	case MetaType_Number:
+		return (kind >= reflect.Int && kind <= reflect.Uint64) || kind == reflect.Float32 || kind == reflect.Float64
+	case MetaType_Bool:
+		return kind == reflect.Bool
+	case MetaType_Object:
+		return kind == reflect.Map || kind == reflect.Struct
+	case MetaType_Array:
+		return kind == reflect.Slice || kind == reflect.Array
+	default:
+		return false
+	}
+}
+
+// ijson files are always validated (in addition to any registered validator)
+func (s *FileStore) validateWrite(file *WaveFile, op string, data []byte) error {
+	if file.Opts.IJson {
+		err := validateIJsonWrite(op, data)
+		if err != nil {
+			return fmt.Errorf("invalid write to ijson file %s:%s: %w", file.ZoneId, file.Name, err)
+		}
+	}
+	validatorName, _ := file.Meta[ValidatorMetaKey].(string)
+	if validatorName == "" {
+		return nil
+	}
+	validator := s.getValidator(validatorName)
+	if validator == nil {
+		return fmt.Errorf("file %s:%s has unknown validator %q", file.ZoneId, file.Name, validatorName)
+	}
+	return validator(file.DeepCopy(), op, data)
+}
+
+// ijson data must always consist of whole commands (so no writes at arbitrary offsets)
+func validateIJsonWrite(op string, data []byte) error {
+	if op == WriteOp_WriteAt {
+		return fmt.Errorf("cannot write at an offset")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if op == WriteOp_Append && data[len(data)-1] != '\n' {
+		return fmt.Errorf("appended data must end with a newline")
+	}
+	_, err := ijson.ParseIJson(bytes.TrimSuffix(data, []byte("\n")))
+	return err
+}
+
+// meta values read back from the DB are float64 (json)
+func getMetaInt64(meta FileMeta, key string) (int64, bool) {
+	switch val := meta[key].(type) {
+	case int64:
+		return val, true
+	case float64:
+		return int64(val), true
+	case int:
+		return int64(val), true
+	}
+	return 0, false
+}
+
+func metaIncrement(file *WaveFile, key string, amount int) int {
+	if file.Meta == nil {
+		file.Meta = make(FileMeta)
+	}
+	val, ok := file.Meta[key].(int)
+	if !ok {
+		val = 0
+	}
+	newVal := val + amount
+	file.Meta[key] = newVal
+	return newVal
+}
+
+func (s *FileStore) compactIJson(ctx context.Context, entry *CacheEntry) error {
+	// we don't need to lock the entry because we have the lock on the filestore
+	_, fullData, err := entry.readAt(ctx, 0, 0, true)
+	if err != nil {
+		return err
 	}
 	newBytes, err := ijson.CompactIJson(fullData, entry.File.Opts.IJsonBudget)
 	if err != nil {
-		return err
+		return err
+	}
+	entry.writeAt(0, newBytes, true)
+	return nil
+}
+
+func (s *FileStore) CompactIJson(ctx context.Context, zoneId string, name string) error {
+	var newSize int64
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if !entry.File.Opts.IJson {
+			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+		}
+		err = s.compactIJson(ctx, entry)
+		if err != nil {
+			return err
+		}
+		newSize = entry.File.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyWrite(zoneId, name, 0, int(newSize))
+	return nil
+}
+
+// converts a circular file into a normal file containing only the current circular window
+// the window is rewritten starting at offset 0 (Circular, MaxSize and ArchiveOverflow are cleared), the opts and data are replaced in a single transaction
+func (s *FileStore) FreezeCircular(ctx context.Context, zoneId string, name string) error {
+	return s.rewriteCircularWindow(ctx, zoneId, name, func(opts *FileOptsType) {
+		opts.Circular = false
+		opts.MaxSize = 0
+		opts.ArchiveOverflow = false
+	})
+}
+
+// rewrites the current circular window starting at offset 0 (the file stays circular), so Size goes back to at most MaxSize.
+// note that this rebases the file offsets (readers should use the offsets returned by ReadAt/ReadFile, or track
+// RebaseMetaKey).  the Version is bumped and observers get OnWrite for the whole window and OnMeta
+func (s *FileStore) CompactCircular(ctx context.Context, zoneId string, name string) error {
+	return s.rewriteCircularWindow(ctx, zoneId, name, func(opts *FileOptsType) {})
+}
+
+// replaces the circular file with its current window (written at offset 0) and the opts updated by updateOpts
+// the opts and data are replaced in a single transaction under the entry lock, so readers never see a partial rewrite
+func (s *FileStore) rewriteCircularWindow(ctx context.Context, zoneId string, name string, updateOpts func(*FileOptsType)) error {
+	var newSize int
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if !entry.File.Opts.Circular {
+			return fmt.Errorf("file %s:%s is not a circular file", zoneId, name)
+		}
+		_, windowData, err := entry.readAt(ctx, 0, 0, true)
+		if err != nil {
+			return err
+		}
+		oldFile := entry.File.DeepCopy()
+		oldDataEntries := entry.DataEntries
+		updateOpts(&entry.File.Opts)
+		if shift := oldFile.DataStartIdx(); shift > 0 {
+			if entry.File.Meta == nil {
+				entry.File.Meta = make(FileMeta)
+			}
+			rebase, _ := getMetaInt64(entry.File.Meta, RebaseMetaKey)
+			entry.File.Meta[RebaseMetaKey] = rebase + shift
+		}
+		entry.writeAt(0, windowData, true)
+		_, err = entry.flushToDB(ctx, true, s.getFlushBatch())
+		if err != nil && entry.File != nil {
+			// the db still has the old file, restore the cached state so it stays consistent with it
+			entry.File = oldFile
+			entry.DataEntries = oldDataEntries
+		}
+		newSize = len(windowData)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyWrite(zoneId, name, 0, newSize)
+	s.notifyMeta(zoneId, name)
+	return nil
+}
+
+// true if the circular file has wrapped more than CircularCompactWraps times (see startCompactCircular)
+func (s *FileStore) circularNeedsCompact(file *WaveFile) bool {
+	maxWraps := s.getCircularCompactWraps()
+	if maxWraps <= 0 || !file.Opts.Circular || file.Opts.MaxSize <= 0 {
+		return false
+	}
+	return file.Size/file.Opts.MaxSize > int64(maxWraps)
+}
+
+// runs CompactCircular in the background (at most one compaction per file at a time), so the write that
+// triggered it is not blocked
+func (s *FileStore) startCompactCircular(zoneId string, name string) {
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	s.Lock.Lock()
+	if s.compactingCircular == nil {
+		s.compactingCircular = make(map[cacheKey]bool)
+	}
+	if s.compactingCircular[key] {
+		s.Lock.Unlock()
+		return
+	}
+	s.compactingCircular[key] = true
+	s.Lock.Unlock()
+	go func() {
+		defer func() {
+			panichandler.PanicHandler("filestore compact circular", recover())
+		}()
+		defer func() {
+			s.Lock.Lock()
+			delete(s.compactingCircular, key)
+			s.Lock.Unlock()
+		}()
+		ctx, cancelFn := context.WithTimeout(context.Background(), DefaultFlushTime)
+		defer cancelFn()
+		err := s.CompactCircular(ctx, zoneId, name)
+		if err != nil {
+			log.Printf("error compacting circular file %s:%s: %v\n", zoneId, name, err)
+		}
+	}()
+}
+
+func (s *FileStore) getCircularCompactWraps() int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.CircularCompactWraps
+}
+
+func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string, command map[string]any) error {
+	data, err := ijson.ValidateAndMarshalCommand(command)
+	if err != nil {
+		return err
+	}
+	var appendOffset, compactedSize int64
+	err = withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return err
+		}
+		if !entry.File.Opts.IJson {
+			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+		}
+		appendOffset = entry.File.Size
+		incompleteParts := entry.File.partsToLoadForWrite(entry.File.Size, int64(len(data)))
+		if len(incompleteParts) > 0 {
+			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
+			if err != nil {
+				return err
+			}
+		}
+		oldSize := entry.File.Size
+		entry.writeAt(entry.File.Size, data, false)
+		entry.writeAt(entry.File.Size, []byte("\n"), false)
+		if oldSize == 0 {
+			return s.flushWriteThrough(ctx, entry)
+		}
+		// check if we should compact
+		numCmds := metaIncrement(entry.File, IJsonNumCommands, 1)
+		numBytes := metaIncrement(entry.File, IJsonIncrementalBytes, len(data)+1)
+		incRatio := float64(numBytes) / float64(entry.File.Size)
+		if numCmds > IJsonHighCommands || incRatio >= IJsonHighRatio || (numCmds > IJsonLowCommands && incRatio >= IJsonLowRatio) {
+			err := s.compactIJson(ctx, entry)
+			if err != nil {
+				return err
+			}
+			compactedSize = entry.File.Size
+		}
+		return s.flushWriteThrough(ctx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyWrite(zoneId, name, appendOffset, len(data)+1)
+	if compactedSize > 0 {
+		s.notifyWrite(zoneId, name, 0, int(compactedSize))
+	}
+	return nil
+}
+
+// returns up to count ijson records (commands), starting with record startRec (0-based)
+// records are newline delimited, a partial trailing record (no newline yet) is never returned.
+// the file is scanned from the start (there is no record index), but reading stops once count records are found
+func (s *FileStore) ReadIJsonRange(ctx context.Context, zoneId string, name string, startRec int, count int) ([]json.RawMessage, error) {
+	if startRec < 0 || count < 0 {
+		return nil, fmt.Errorf("startrec and count must be non-negative")
+	}
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]json.RawMessage, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !file.Opts.IJson {
+			return nil, fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+		}
+		rtn := make([]json.RawMessage, 0)
+		var curRec []byte
+		recIdx := 0
+		buf := make([]byte, partDataSize)
+		for offset := int64(0); offset < file.Size && len(rtn) < count; {
+			n, err := entry.readAtBuf(ctx, offset, buf)
+			if err != nil {
+				return nil, err
+			}
+			offset += int64(n)
+			chunk := buf[:n]
+			for len(chunk) > 0 && len(rtn) < count {
+				nlIdx := bytes.IndexByte(chunk, '\n')
+				if nlIdx == -1 {
+					if recIdx >= startRec {
+						curRec = append(curRec, chunk...)
+					}
+					break
+				}
+				if recIdx >= startRec {
+					// curRec is always a new allocation (never aliases buf, which is reused)
+					curRec = append(curRec, chunk[:nlIdx]...)
+					rtn = append(rtn, json.RawMessage(curRec))
+					curRec = nil
+				}
+				recIdx++
+				chunk = chunk[nlIdx+1:]
+			}
+		}
+		s.recordAccess(ctx, entry)
+		return rtn, nil
+	})
+}
+
+const ForEachFilePageSize = 100
+
+// calls fn for every file in the store (ordered by zone id, then name), stopping at the first error from fn
+// or when ctx is canceled.  files are read from the DB a page at a time and each file has its un-flushed cache
+// changes applied (like ListFiles, this is not a point-in-time snapshot).  fn is called without any locks held.
+func (s *FileStore) ForEachFileGlobal(ctx context.Context, fn func(*WaveFile) error) error {
+	var afterZoneId, afterName string
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		files, err := s.backend().GetFilesPage(ctx, afterZoneId, afterName, ForEachFilePageSize)
+		if err != nil {
+			return fmt.Errorf("error getting files: %w", err)
+		}
+		for _, file := range files {
+			withLock(s, file.ZoneId, file.Name, func(entry *CacheEntry) error {
+				if entry.File != nil {
+					file = entry.File.DeepCopy()
+				}
+				return nil
+			})
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err = fn(file)
+			if err != nil {
+				return err
+			}
+		}
+		if len(files) < ForEachFilePageSize {
+			return nil
+		}
+		lastFile := files[len(files)-1]
+		afterZoneId, afterName = lastFile.ZoneId, lastFile.Name
+	}
+}
+
+const listConsistentMaxAttempts = 5
+
+// like ListFiles, but the returned set is consistent with a single point in time.  every file in the zone is
+// locked (in sorted order, like MoveZone) while the files are read from the DB in a single transaction, so no
+// write, create or delete of a listed file can be in progress.  if a file is created between collecting the
+// names and the DB read, the listing is retried (an error is returned if the zone keeps changing)
+func (s *FileStore) ListFilesConsistent(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	for attempt := 0; attempt < listConsistentMaxAttempts; attempt++ {
+		files, ok, err := s.tryListFilesConsistent(ctx, zoneId)
+		if err != nil || ok {
+			return files, err
+		}
+	}
+	return nil, fmt.Errorf("zone %s kept changing while listing files", zoneId)
+}
+
+// returns ok=false if a file was created concurrently (caller should retry)
+func (s *FileStore) tryListFilesConsistent(ctx context.Context, zoneId string) ([]*WaveFile, bool, error) {
+	fileNames, err := s.backend().GetZoneFileNames(ctx, zoneId)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting zone files: %v", err)
+	}
+	sort.Strings(fileNames)
+	entries := make(map[string]*CacheEntry)
+	for _, name := range fileNames {
+		entry := s.getEntryAndPin(zoneId, name)
+		defer s.unpinEntryAndTryDelete(zoneId, name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		entries[name] = entry
+	}
+	dbFiles, err := s.backend().GetZoneFiles(ctx, zoneId)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting zone files: %v", err)
+	}
+	rtn := make([]*WaveFile, 0, len(dbFiles))
+	for _, file := range dbFiles {
+		entry := entries[file.Name]
+		if entry == nil {
+			// created after we collected the names (so it may have un-flushed changes we can't see)
+			return nil, false, nil
+		}
+		if entry.File != nil {
+			file = entry.File.DeepCopy()
+		}
+		rtn = append(rtn, file)
+	}
+	// locked files missing from dbFiles were deleted before we locked them, so they are (correctly) omitted
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Name < rtn[j].Name })
+	return rtn, true, nil
+}
+
+// returns every zone id in one query (for large DBs see GetAllZoneIdsPage)
+func (s *FileStore) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	return s.backend().GetAllZoneIds(ctx)
+}
+
+// returns up to limit zone ids (sorted) that sort after afterId, use "" to start from the beginning.
+// the second return value is the cursor to pass as afterId for the next page, "" once there are no more zone ids.
+// each page is a separate query, so zones created or deleted while paging may or may not be returned
+func (s *FileStore) GetAllZoneIdsPage(ctx context.Context, afterId string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("limit must be positive")
+	}
+	zoneIds, err := s.backend().GetZoneIdsPage(ctx, afterId, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(zoneIds) < limit {
+		return zoneIds, "", nil
+	}
+	return zoneIds, zoneIds[len(zoneIds)-1], nil
+}
+
+// returns the (sorted) zone ids that have at least one file with ModTs >= since
+// un-flushed changes in the cache are included
+func (s *FileStore) ListZonesModifiedSince(ctx context.Context, since int64) ([]string, error) {
+	zoneIds, err := s.backend().GetZoneIdsModifiedSince(ctx, since)
+	if err != nil {
+		return nil, fmt.Errorf("error getting modified zones: %v", err)
+	}
+	zoneSet := make(map[string]bool)
+	for _, zoneId := range zoneIds {
+		zoneSet[zoneId] = true
+	}
+	for _, key := range s.getDirtyCacheKeys() {
+		if zoneSet[key.ZoneId] {
+			continue
+		}
+		withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
+			if entry.File != nil && entry.File.ModTs >= since {
+				zoneSet[key.ZoneId] = true
+			}
+			return nil
+		})
+	}
+	rtn := make([]string, 0, len(zoneSet))
+	for zoneId := range zoneSet {
+		rtn = append(rtn, zoneId)
+	}
+	sort.Strings(rtn)
+	return rtn, nil
+}
+
+// loads the parts covering [offset, offset+size) into the cache (clean, so they are not rewritten on flush)
+// parts that are already cached are left alone.  only the parts are cached, not the file (the entry is not
+// dirty, so the flush does not rewrite the file row).  since the cache is a write cache, prefetched parts are only
+// kept until the next flush (see dropCleanEntries), so this is meant to be called right before the data is read
+func (s *FileStore) Prefetch(ctx context.Context, zoneId string, name string, offset int64, size int64) error {
+	if offset < 0 || size < 0 {
+		return fmt.Errorf("offset and size must be non-negative")
+	}
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return err
+		}
+		err = file.validateOpts()
+		if err != nil {
+			return err
+		}
+		offset, size = file.clampReadRange(offset, size)
+		if size <= 0 {
+			return nil
+		}
+		partMap := file.computePartMap(offset, size)
+		return entry.loadDataPartsIntoCache(ctx, getPartIdxsFromMap(partMap))
+	})
+}
+
+// returns (offset, data, error)
+// we return the offset because the offset may have been adjusted if the size was too big (for circular files)
+// the file is loaded under the entry lock, so a file deleted after a Stat returns fs.ErrNotExist (never stale data).
+// an empty read (e.g. an empty file) returns a non-nil zero-length slice
+func (s *FileStore) ReadAt(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	ctx, span := s.startSpan(ctx, TraceOp_ReadAt, zoneId, name)
+	defer func() {
+		endSpan(span, int64(len(rtnData)), spannedParts(rtnOffset, int64(len(rtnData))), rtnErr)
+	}()
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnOffset, rtnData, rtnErr = s.readAtWithRegion(ctx, entry, offset, size)
+		if rtnErr == nil {
+			s.recordAccess(ctx, entry)
+		}
+		return nil
+	})
+	return
+}
+
+// like ReadAt, but also returns the ranges (file offsets) that were zero-filled because their part does not exist
+// (holes in sparse files, e.g. from PutPartSnapshots), so real zeros can be told apart from hole zeros
+// returns (offset, data, holes, error)
+func (s *FileStore) ReadAtWithHoles(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, rtnHoles []Range, rtnErr error) {
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnOffset, rtnData, rtnHoles, rtnErr = entry.readAtWithHoles(ctx, offset, size, false)
+		if rtnErr == nil {
+			s.recordAccess(ctx, entry)
+		}
+		return nil
+	})
+	return
+}
+
+// like ReadAt, with options (see ReadAtOpts).  with ZeroFillPastEOF a read of size bytes returns exactly size
+// bytes, except for circular and trimfront files where the offset may still be moved forward to DataStartIdx
+// (the data before it is gone, not zero)
+// returns (offset, data, error)
+func (s *FileStore) ReadAtWithOpts(ctx context.Context, zoneId string, name string, offset int64, size int64, opts ReadAtOpts) (int64, []byte, error) {
+	rtnOffset, data, err := s.ReadAt(ctx, zoneId, name, offset, size)
+	if err != nil || !opts.ZeroFillPastEOF || size <= 0 {
+		return rtnOffset, data, err
+	}
+	if len(data) == 0 && rtnOffset < offset {
+		// the read was entirely past the end of a circular or trimfront file
+		rtnOffset = offset
+	}
+	if fillSize := offset + size - rtnOffset - int64(len(data)); fillSize > 0 {
+		data = append(data, make([]byte, fillSize)...)
+	}
+	return rtnOffset, data, nil
+}
+
+// like ReadAt, but reads into buf instead of allocating, returns (n, error)
+// returns io.EOF if offset is at or past the end of the file
+func (s *FileStore) ReadAtBuf(ctx context.Context, zoneId string, name string, offset int64, buf []byte) (rtnN int, rtnErr error) {
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnN, rtnErr = entry.readAtBuf(ctx, offset, buf)
+		if rtnErr == nil {
+			s.recordAccess(ctx, entry)
+		}
+		return nil
+	})
+	return
+}
+
+// returns (offset, data, error)
+func (s *FileStore) ReadFile(ctx context.Context, zoneId string, name string) (rtnOffset int64, rtnData []byte, rtnErr error) {
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, 0, 0, true)
+		if rtnErr == nil {
+			s.recordAccess(ctx, entry)
+		}
+		return nil
+	})
+	return
+}
+
+// reads several whole files from the same zone, returns name => data (files that do not exist are left out)
+// the files are locked together (in sorted order, like MoveZone) so the result is consistent across the files, and
+// the file rows and the uncached parts of all of the files are each fetched with a single DB query.
+// as with ReadFile, the data of circular and trimfront files starts at DataStartIdx
+func (s *FileStore) ReadFiles(ctx context.Context, zoneId string, names []string) (map[string][]byte, error) {
+	names = slices.Clone(names)
+	sort.Strings(names)
+	names = slices.Compact(names)
+	entries := make(map[string]*CacheEntry)
+	for _, name := range names {
+		entry := s.getEntryAndPin(zoneId, name)
+		defer s.unpinEntryAndTryDelete(zoneId, name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		err := entry.unspill()
+		if err != nil {
+			return nil, err
+		}
+		entries[name] = entry
+	}
+	files := make(map[string]*WaveFile)
+	var uncachedNames []string
+	for name, entry := range entries {
+		if entry.File != nil {
+			files[name] = entry.File
+		} else {
+			uncachedNames = append(uncachedNames, name)
+		}
+	}
+	if len(uncachedNames) > 0 {
+		dbFiles, err := s.backend().GetZoneFilesByName(ctx, zoneId, uncachedNames)
+		if err != nil {
+			return nil, fmt.Errorf("error getting files: %w", err)
+		}
+		for _, file := range dbFiles {
+			files[file.Name] = file
+		}
+	}
+	type readRange struct {
+		offset  int64
+		size    int64
+		partMap map[int]int
+	}
+	ranges := make(map[string]readRange)
+	neededParts := make(map[string][]int)
+	for name, file := range files {
+		err := file.validateOpts()
+		if err != nil {
+			return nil, err
+		}
+		offset, size := file.clampReadRange(0, file.Size)
+		rr := readRange{offset: offset, size: max(size, 0)}
+		if rr.size > 0 {
+			rr.partMap = file.computePartMap(offset, size)
+			parts := prunePartsWithCache(entries[name].DataEntries, getPartIdxsFromMap(rr.partMap))
+			if len(parts) > 0 {
+				neededParts[name] = parts
+			}
+		}
+		ranges[name] = rr
+	}
+	dbParts, err := s.backend().GetZoneFilesParts(ctx, zoneId, neededParts)
+	if err != nil {
+		return nil, fmt.Errorf("error getting data parts: %w", err)
+	}
+	rtn := make(map[string][]byte)
+	for name, file := range files {
+		entry := entries[name]
+		rr := ranges[name]
+		dataEntryMap := make(map[int]*DataCacheEntry)
+		for partIdx := range rr.partMap {
+			if cachePart := entry.DataEntries[partIdx]; cachePart != nil {
+				dataEntryMap[partIdx] = cachePart
+			} else if dbPart := dbParts[name][partIdx]; dbPart != nil {
+				dataEntryMap[partIdx] = dbPart
+			}
+		}
+		data := make([]byte, rr.size)
+		file.copyFromParts(dataEntryMap, rr.offset, data)
+		rtn[name] = data
+		s.recordAccess(ctx, entry)
+	}
+	return rtn, nil
+}
+
+// like ReadFile, but returns at most maxBytes (from the start of the data), so callers can't accidentally load a huge file
+// returns (offset, data, truncated, error), truncated is true if the file has more than maxBytes of data
+func (s *FileStore) ReadFileLimit(ctx context.Context, zoneId string, name string, maxBytes int64) (rtnOffset int64, rtnData []byte, rtnTruncated bool, rtnErr error) {
+	if maxBytes < 0 {
+		return 0, nil, false, fmt.Errorf("maxbytes must be non-negative")
+	}
+	withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			rtnErr = err
+			return nil
+		}
+		startIdx := file.DataStartIdx()
+		size := file.Size - startIdx
+		if size > maxBytes {
+			size = maxBytes
+			rtnTruncated = true
+		}
+		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, startIdx, size, false)
+		if rtnErr == nil {
+			s.recordAccess(ctx, entry)
+		}
+		return nil
+	})
+	return
+}
+
+// zero-copy version of ReadAt, returns (offset, data, releaseFn, error)
+// if the (clamped) range lies entirely within a single cached part, data aliases the cached part's memory,
+// otherwise this falls back to a copying ReadAt.  either way, the caller must:
+//   - never modify data
+//   - call releaseFn exactly once when done with data (the file stays pinned until then)
+//
+// writes to a part that has outstanding views are copy-on-write, so data never changes underneath the caller.
+func (s *FileStore) ReadAtView(ctx context.Context, zoneId string, name string, offset int64, size int64) (int64, []byte, func(), error) {
+	entry := s.getEntryAndPin(zoneId, name)
+	entry.Lock.Lock()
+	defer entry.Lock.Unlock()
+	unpinFn := func() {
+		s.unpinEntryAndTryDelete(zoneId, name)
+	}
+	err := entry.unspill()
+	if err != nil {
+		unpinFn()
+		return 0, nil, nil, err
+	}
+	rtnOffset, dce, viewData, err := entry.readAtView(ctx, offset, size)
+	if err != nil {
+		unpinFn()
+		return 0, nil, nil, err
+	}
+	if dce == nil {
+		unpinFn()
+		return rtnOffset, viewData, func() {}, nil
+	}
+	dce.ViewCount++
+	var releaseOnce sync.Once
+	releaseFn := func() {
+		releaseOnce.Do(func() {
+			entry.Lock.Lock()
+			dce.ViewCount--
+			entry.Lock.Unlock()
+			unpinFn()
+		})
+	}
+	return rtnOffset, viewData, releaseFn, nil
+}
+
+// max number of part-sized chunks whose bytes are fetched (from each file) at once by DiffFiles
+const diffFetchChunks = 32
+
+// returns the byte ranges (file offsets) where the two files differ, adjacent differences are merged
+// bytes that only exist in one of the files (past the end of the shorter file, or outside of a circular window) count as different.
+// the files are compared one part-sized chunk at a time.  a chunk is skipped (its bytes are never fetched) when it
+// sits at the same place in a part of each file and the two parts have the same checksum (stored part checksums,
+// dirty cached parts are hashed).  the remaining chunks are fetched in batches, so neither file is fully loaded into memory.
+// both files are pinned and locked (in sorted order) for the whole diff, so the result is consistent.  reads do not record access
+func (s *FileStore) DiffFiles(ctx context.Context, zoneIdA string, nameA string, zoneIdB string, nameB string) ([]Range, error) {
+	keyA, keyB := cacheKey{ZoneId: zoneIdA, Name: nameA}, cacheKey{ZoneId: zoneIdB, Name: nameB}
+	keys := []cacheKey{keyA, keyB}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ZoneId != keys[j].ZoneId {
+			return keys[i].ZoneId < keys[j].ZoneId
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	keys = slices.Compact(keys)
+	entries := make(map[cacheKey]*CacheEntry)
+	for _, key := range keys {
+		entry := s.getEntryAndPin(key.ZoneId, key.Name)
+		defer s.unpinEntryAndTryDelete(key.ZoneId, key.Name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		err := entry.unspill()
+		if err != nil {
+			return nil, err
+		}
+		entries[key] = entry
+	}
+	entryA, entryB := entries[keyA], entries[keyB]
+	fileA, err := entryA.loadFileForRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fileB, err := entryB.loadFileForRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if keyA == keyB {
+		return nil, nil
+	}
+	sumsA, err := entryA.getCurrentPartChecksums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sumsB, err := entryB.getCurrentPartChecksums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rtn []Range
+	addDiff := func(offset int64, size int64) {
+		if len(rtn) > 0 && rtn[len(rtn)-1].Offset+rtn[len(rtn)-1].Size == offset {
+			rtn[len(rtn)-1].Size += size
+			return
+		}
+		rtn = append(rtn, Range{Offset: offset, Size: size})
+	}
+	startA, startB := fileA.DataStartIdx(), fileB.DataStartIdx()
+	cmpStart := max(startA, startB)
+	endOffset := max(fileA.Size, fileB.Size)
+	if startA != startB {
+		addDiff(min(startA, startB), min(cmpStart, endOffset)-min(startA, startB))
+	}
+	var pending []Range
+	compareBatch := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		dataA, err := entryA.readRanges(ctx, pending)
+		if err != nil {
+			return err
+		}
+		dataB, err := entryB.readRanges(ctx, pending)
+		if err != nil {
+			return err
+		}
+		for chunkIdx, chunk := range pending {
+			for idx := int64(0); idx < chunk.Size; idx++ {
+				inA, inB := idx < int64(len(dataA[chunkIdx])), idx < int64(len(dataB[chunkIdx]))
+				if inA != inB || (inA && dataA[chunkIdx][idx] != dataB[chunkIdx][idx]) {
+					addDiff(chunk.Offset+idx, 1)
+				}
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+	for offset := cmpStart; offset < endOffset; {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		chunkEnd := minInt64((offset/partDataSize+1)*partDataSize, endOffset)
+		if !sameChunkParts(fileA, sumsA, fileB, sumsB, offset, chunkEnd-offset) {
+			pending = append(pending, Range{Offset: offset, Size: chunkEnd - offset})
+			if len(pending) >= diffFetchChunks {
+				err = compareBatch()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		offset = chunkEnd
+	}
+	err = compareBatch()
+	if err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+// true if [offset, offset+size) holds the same bytes in both files without reading them: the range covers the same
+// data in both files, and it sits at the same offset within a single part in each file and those parts have the same checksum
+func sameChunkParts(fileA *WaveFile, sumsA map[int][]byte, fileB *WaveFile, sumsB map[int][]byte, offset int64, size int64) bool {
+	offsetA, sizeA := fileA.clampReadRange(offset, size)
+	offsetB, sizeB := fileB.clampReadRange(offset, size)
+	if offsetA != offsetB || sizeA != sizeB || sizeA <= 0 {
+		return false
+	}
+	partOffsetA, partAvailA := fileA.partOffsetAtOffset(offsetA)
+	partOffsetB, partAvailB := fileB.partOffsetAtOffset(offsetB)
+	if partOffsetA != partOffsetB || sizeA > partAvailA || sizeB > partAvailB {
+		return false
+	}
+	sumA, sumB := sumsA[fileA.partIdxAtOffset(offsetA)], sumsB[fileB.partIdxAtOffset(offsetB)]
+	return sumA != nil && bytes.Equal(sumA, sumB)
+}
+
+// returns one []byte per range (in the same order as ranges)
+// each range is clamped the same way as ReadAt (so for circular files data before the window is dropped)
+// the file is only pinned once, and all needed parts are fetched from the DB in a single query
+func (s *FileStore) ReadRanges(ctx context.Context, zoneId string, name string, ranges []Range) ([][]byte, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([][]byte, error) {
+		rtn, err := entry.readRanges(ctx, ranges)
+		if err == nil {
+			s.recordAccess(ctx, entry)
+		}
+		return rtn, err
+	})
+}
+
+// updates the in-memory access time for the entry (called on successful reads and stats)
+// if TrackAccessTime is set, the access time is also queued to be persisted on the next flush.  reads never mark
+// the entry dirty, so they don't hold up SwapFiles/InvalidateFile or move the dirty generation
+func (s *FileStore) recordAccess(ctx context.Context, entry *CacheEntry) {
+	now := s.now()
+	entry.AccessTs = now
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if !s.TrackAccessTime {
+		return
+	}
+	if s.pendingAccess == nil {
+		s.pendingAccess = make(map[cacheKey]int64)
+	}
+	s.pendingAccess[cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}] = now
+}
+
+func (s *FileStore) takePendingAccess() map[cacheKey]int64 {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	rtn := s.pendingAccess
+	s.pendingAccess = nil
+	return rtn
+}
+
+// puts back access times that failed to flush (newer accesses recorded since take win)
+func (s *FileStore) restorePendingAccess(accessTimes map[cacheKey]int64) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.pendingAccess == nil {
+		s.pendingAccess = make(map[cacheKey]int64)
+	}
+	for key, accessTs := range accessTimes {
+		if accessTs > s.pendingAccess[key] {
+			s.pendingAccess[key] = accessTs
+		}
+	}
+}
+
+// access times are written after the dirty entries (and never move backwards), so a flush of an entry that was
+// loaded before the access can't overwrite it
+func (s *FileStore) flushPendingAccess(ctx context.Context) error {
+	accessTimes := s.takePendingAccess()
+	if len(accessTimes) == 0 {
+		return nil
+	}
+	err := s.backend().WriteAccessTimes(ctx, accessTimes)
+	if err != nil {
+		s.restorePendingAccess(accessTimes)
+		return fmt.Errorf("error writing access times: %w", err)
 	}
-	entry.writeAt(0, newBytes, true)
 	return nil
 }
 
-func (s *FileStore) CompactIJson(ctx context.Context, zoneId string, name string) error {
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		err := entry.loadFileIntoCache(ctx)
+// generations are used for non-blocking durability checks:
+//
+//	gen := WFS.DirtyGeneration(zoneId, name) // after a write
+//	...
+//	if WFS.FlushGeneration(zoneId, name) >= gen { /* the write has been persisted */ }
+//
+// both values are monotonically increasing (they come from a single global counter)
+
+// returns the generation of the latest change to the file (flushed or not)
+func (s *FileStore) DirtyGeneration(zoneId string, name string) int64 {
+	rtn, _ := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		if entry.DirtyGen == 0 {
+			return dirtyGenCounter.Load(), nil
+		}
+		return entry.DirtyGen, nil
+	})
+	return rtn
+}
+
+// returns the generation up to which all changes to the file have been flushed to the DB
+func (s *FileStore) FlushGeneration(zoneId string, name string) int64 {
+	rtn, _ := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (int64, error) {
+		if entry.DirtyGen == 0 {
+			return dirtyGenCounter.Load(), nil
+		}
+		return entry.FirstDirtyGen - 1, nil
+	})
+	return rtn
+}
+
+// returns the requested parts (merged from the cache and the DB like ReadAt)
+// parts that do not exist (holes, or past the end of the file) are not returned
+func (s *FileStore) GetPartSnapshots(ctx context.Context, zoneId string, name string, parts []int) ([]PartSnapshot, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]PartSnapshot, error) {
+		file, err := entry.loadFileForRead(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if !entry.File.Opts.IJson {
-			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+		err = file.validateOpts()
+		if err != nil {
+			return nil, err
+		}
+		dataEntryMap, err := entry.loadDataPartsForRead(ctx, parts)
+		if err != nil {
+			return nil, err
 		}
-		return s.compactIJson(ctx, entry)
+		var rtn []PartSnapshot
+		for _, partIdx := range parts {
+			dce := dataEntryMap[partIdx]
+			if dce == nil {
+				continue
+			}
+			data := make([]byte, len(dce.Data))
+			copy(data, dce.Data)
+			rtn = append(rtn, PartSnapshot{PartIdx: partIdx, Data: data, Checksum: crc32.ChecksumIEEE(data)})
+		}
+		return rtn, nil
 	})
 }
 
-func (s *FileStore) AppendIJson(ctx context.Context, zoneId string, name string, command map[string]any) error {
-	data, err := ijson.ValidateAndMarshalCommand(command)
-	if err != nil {
-		return err
+// writes parts from GetPartSnapshots into an existing file (the file should be created with the same opts as the source)
+// replaced parts are written whole, and the file size is set to fileSize.  every part must lie within the bytes the
+// file stores at fileSize (for circular files, the first min(fileSize, MaxSize) bytes of the ring), cached parts past
+// that are dropped
+func (s *FileStore) PutPartSnapshots(ctx context.Context, zoneId string, name string, fileSize int64, snaps []PartSnapshot) error {
+	if fileSize < 0 {
+		return fmt.Errorf("file size must be non-negative")
 	}
-	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+	for _, snap := range snaps {
+		if snap.PartIdx < 0 {
+			return fmt.Errorf("invalid part index %d", snap.PartIdx)
+		}
+		if int64(len(snap.Data)) > partDataSize {
+			return fmt.Errorf("part %d is larger than the part size", snap.PartIdx)
+		}
+		if crc32.ChecksumIEEE(snap.Data) != snap.Checksum {
+			return fmt.Errorf("checksum mismatch for part %d", snap.PartIdx)
+		}
+	}
+	err := withLock(s, zoneId, name, func(entry *CacheEntry) error {
 		err := entry.loadFileIntoCache(ctx)
 		if err != nil {
 			return err
 		}
-		if !entry.File.Opts.IJson {
-			return fmt.Errorf("file %s:%s is not an ijson file", zoneId, name)
+		err = entry.File.validateOpts()
+		if err != nil {
+			return err
 		}
-		partMap := entry.File.computePartMap(entry.File.Size, int64(len(data)))
-		incompleteParts := incompletePartsFromMap(partMap)
-		if len(incompleteParts) > 0 {
-			err = entry.loadDataPartsIntoCache(ctx, incompleteParts)
-			if err != nil {
-				return err
-			}
+		dataEnd := fileSize
+		if entry.File.Opts.Circular {
+			dataEnd = min(fileSize, entry.File.Opts.MaxSize)
 		}
-		oldSize := entry.File.Size
-		entry.writeAt(entry.File.Size, data, false)
-		entry.writeAt(entry.File.Size, []byte("\n"), false)
-		if oldSize == 0 {
-			return nil
+		for _, snap := range snaps {
+			partStart := int64(snap.PartIdx) * partDataSize
+			if partStart >= dataEnd || partStart+int64(len(snap.Data)) > dataEnd {
+				return fmt.Errorf("part %d extends past the end of the file (%d bytes stored at size %d)", snap.PartIdx, dataEnd, fileSize)
+			}
 		}
-		// check if we should compact
-		numCmds := metaIncrement(entry.File, IJsonNumCommands, 1)
-		numBytes := metaIncrement(entry.File, IJsonIncrementalBytes, len(data)+1)
-		incRatio := float64(numBytes) / float64(entry.File.Size)
-		if numCmds > IJsonHighCommands || incRatio >= IJsonHighRatio || (numCmds > IJsonLowCommands && incRatio >= IJsonLowRatio) {
-			err := s.compactIJson(ctx, entry)
+		if dataEnd%partDataSize != 0 {
+			// the part spanning dataEnd is truncated (in the cache, so the flush rewrites it), even if it is only in the DB
+			err = entry.loadDataPartsIntoCache(ctx, []int{int(dataEnd / partDataSize)})
 			if err != nil {
 				return err
 			}
 		}
-		return nil
-	})
-}
-
-func (s *FileStore) GetAllZoneIds(ctx context.Context) ([]string, error) {
-	return dbGetAllZoneIds(ctx)
-}
-
-// returns (offset, data, error)
-// we return the offset because the offset may have been adjusted if the size was too big (for circular files)
-func (s *FileStore) ReadAt(ctx context.Context, zoneId string, name string, offset int64, size int64) (rtnOffset int64, rtnData []byte, rtnErr error) {
-	withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, offset, size, false)
-		return nil
+		entry.trimDataEntries(dataEnd)
+		for _, snap := range snaps {
+			dce := makeDataCacheEntry(snap.PartIdx)
+			dce.Data = append(dce.Data, snap.Data...)
+			entry.DataEntries[snap.PartIdx] = dce
+		}
+		entry.File.Size = fileSize
+		entry.File.Version++
+		entry.File.ModTs = s.now()
+		entry.markDirty()
+		return s.flushWriteThrough(ctx, entry)
 	})
-	return
+	if err != nil {
+		return err
+	}
+	s.notifyWrite(zoneId, name, 0, int(fileSize))
+	return nil
 }
 
-// returns (offset, data, error)
-func (s *FileStore) ReadFile(ctx context.Context, zoneId string, name string) (rtnOffset int64, rtnData []byte, rtnErr error) {
-	withLock(s, zoneId, name, func(entry *CacheEntry) error {
-		rtnOffset, rtnData, rtnErr = entry.readAt(ctx, 0, 0, true)
-		return nil
-	})
-	return
+// drops the cached parts that start at or past dataEnd and truncates the part that spans it.  a truncated part is
+// no longer patchable, so the flush rewrites it whole
+func (entry *CacheEntry) trimDataEntries(dataEnd int64) {
+	for partIdx, dce := range entry.DataEntries {
+		partStart := int64(partIdx) * partDataSize
+		if partStart >= dataEnd {
+			delete(entry.DataEntries, partIdx)
+			continue
+		}
+		if partStart+int64(len(dce.Data)) > dataEnd {
+			if dce.ViewCount > 0 {
+				dce = dce.clone()
+				entry.DataEntries[partIdx] = dce
+			}
+			dce.Data = dce.Data[:dataEnd-partStart]
+			dce.FromDB = false
+		}
+	}
 }
 
 type FlushStats struct {
 	FlushDuration   time.Duration
 	NumDirtyEntries int
 	NumCommitted    int
+	BytesWritten    int64
+	NumErrors       int
+}
+
+func (s *FileStore) FlushCache(ctx context.Context) (FlushStats, error) {
+	return s.FlushCacheWithProgress(ctx, nil)
 }
 
-func (s *FileStore) FlushCache(ctx context.Context) (stats FlushStats, rtnErr error) {
+// like FlushCache, but calls progress (if not nil) with done=0 and the number of dirty entries at the start of the
+// flush, and again as each entry is done (also when flushing it failed, which ends the flush)
+func (s *FileStore) FlushCacheWithProgress(ctx context.Context, progress func(done int, total int)) (stats FlushStats, rtnErr error) {
 	wasFlushing := s.setUnlessFlushing()
 	if wasFlushing {
 		return stats, fmt.Errorf("flush already in progress")
 	}
 	defer s.setIsFlushing(false)
+	// registered first so it runs last (after FlushDuration is set)
+	defer func() {
+		if rtnErr != nil {
+			stats.NumErrors++
+		}
+		if onFlush := s.getOnFlush(); onFlush != nil {
+			onFlush(stats)
+		}
+	}()
 	startTime := time.Now()
 	defer func() {
 		stats.FlushDuration = time.Since(startTime)
 	}()
 
 	// get a copy of dirty keys so we can iterate without the lock
-	dirtyCacheKeys := s.getDirtyCacheKeys()
+	dirtyCacheKeys := s.getFlushOrderedCacheKeys()
 	stats.NumDirtyEntries = len(dirtyCacheKeys)
-	for _, key := range dirtyCacheKeys {
+	if progress != nil {
+		progress(0, len(dirtyCacheKeys))
+	}
+	for idx, key := range dirtyCacheKeys {
 		err := withLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) error {
-			return entry.flushToDB(ctx, false)
+			spanCtx, span := s.startSpan(ctx, TraceOp_FlushEntry, key.ZoneId, key.Name)
+			numParts := len(entry.DataEntries)
+			bytesWritten, err := entry.flushToDB(spanCtx, false, s.getFlushBatch())
+			endSpan(span, bytesWritten, numParts, err)
+			stats.BytesWritten += bytesWritten
+			return err
 		})
+		if progress != nil {
+			progress(idx+1, len(dirtyCacheKeys))
+		}
 		if ctx.Err() != nil {
 			// transient error (also must stop the loop)
 			return stats, ctx.Err()
 		}
 		if err != nil {
-			return stats, fmt.Errorf("error flushing cache entry[%v]: %v", key, err)
+			return stats, fmt.Errorf("error flushing cache entry[%v]: %w", key, err)
 		}
 		stats.NumCommitted++
 	}
+	err := s.flushPendingAccess(ctx)
+	if err != nil {
+		return stats, err
+	}
+	err = s.drainArchives(ctx)
+	if err != nil {
+		return stats, err
+	}
+	s.dropCleanEntries()
+	return stats, nil
+}
+
+// drops the entries that only hold clean parts (see Prefetch) and are not in use
+func (s *FileStore) dropCleanEntries() {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for key, entry := range s.Cache {
+		// like unpinEntryAndTryDelete, File can be read here since nothing holds the entry
+		if entry.PinCount <= 0 && entry.File == nil {
+			delete(s.Cache, key)
+		}
+	}
+}
+
+type VacuumStats struct {
+	Duration   time.Duration
+	SizeBefore int64
+	SizeAfter  int64
+	BytesFreed int64
+}
+
+// rebuilds the DB file to return the space freed by deleted files to the OS.
+// this rewrites the whole DB (it can be slow for a large DB and blocks all other DB access while it runs),
+// so it should be scheduled for idle periods.  the flusher is held off while vacuuming (using the same
+// IsFlushing flag as FlushCache), an error is returned if a flush is already in progress
+func (s *FileStore) Vacuum(ctx context.Context) (stats VacuumStats, rtnErr error) {
+	wasFlushing := s.setUnlessFlushing()
+	if wasFlushing {
+		return stats, fmt.Errorf("flush in progress")
+	}
+	defer s.setIsFlushing(false)
+	startTime := time.Now()
+	defer func() {
+		stats.Duration = time.Since(startTime)
+	}()
+	sizeBefore, err := s.backend().GetSize(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("error getting db size: %w", err)
+	}
+	stats.SizeBefore = sizeBefore
+	err = s.backend().Vacuum(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("error vacuuming db: %w", err)
+	}
+	sizeAfter, err := s.backend().GetSize(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("error getting db size: %w", err)
+	}
+	stats.SizeAfter = sizeAfter
+	stats.BytesFreed = max(sizeBefore-sizeAfter, 0)
 	return stats, nil
 }
 
+func (s *FileStore) getOnFlush() func(FlushStats) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.OnFlush
+}
+
 ///////////////////////////////////
 
+// catches malformed rows in the DB (MakeFile will never create these)
+func (f *WaveFile) validateOpts() error {
+	if f.Opts.TrimFront {
+		if f.Opts.MaxSize <= 0 || f.Opts.MaxSize%partDataSize != 0 {
+			return fmt.Errorf("invalid trimfront file %s:%s, maxsize %d is not a positive multiple of the part size %d", f.ZoneId, f.Name, f.Opts.MaxSize, partDataSize)
+		}
+		return nil
+	}
+	if !f.Opts.Circular {
+		return nil
+	}
+	if f.Opts.MaxSize <= 0 {
+		return fmt.Errorf("invalid circular file %s:%s, maxsize must be positive", f.ZoneId, f.Name)
+	}
+	if f.Opts.MaxSize > partDataSize && f.Opts.MaxSize%partDataSize != 0 {
+		return fmt.Errorf("invalid circular file %s:%s, maxsize %d is not a multiple of the part size %d", f.ZoneId, f.Name, f.Opts.MaxSize, partDataSize)
+	}
+	return nil
+}
+
+func (f *WaveFile) isSubPartCircular() bool {
+	return f.Opts.Circular && f.Opts.MaxSize > 0 && f.Opts.MaxSize < partDataSize
+}
+
+// the index of the last part of a non-circular file (-1 if the file is empty)
+func (f *WaveFile) lastPartIdx() int64 {
+	if f.Size <= 0 {
+		return -1
+	}
+	return (f.Size - 1) / partDataSize
+}
+
 func (f *WaveFile) partIdxAtOffset(offset int64) int {
 	partIdx := int(offset / partDataSize)
 	if f.Opts.Circular {
 		maxPart := int(f.Opts.MaxSize / partDataSize)
+		if maxPart <= 0 {
+			// circular windows smaller than a part live entirely in part 0
+			return 0
+		}
 		partIdx = partIdx % maxPart
 	}
 	return partIdx
 }
 
+// clamps a read to the data that is available in the file, returns (offset, size)
+// for circular and trimfront files the offset is moved forward to the start of the data (DataStartIdx)
+// size can be <= 0 if there is no data to read
+func (file *WaveFile) clampReadRange(offset int64, size int64) (int64, int64) {
+	if offset+size > file.Size {
+		size = file.Size - offset
+	}
+	realDataOffset := file.DataStartIdx()
+	if offset < realDataOffset {
+		truncateAmt := realDataOffset - offset
+		offset += truncateAmt
+		size -= truncateAmt
+	}
+	return offset, size
+}
+
+// guards against a single circular write mapping two of its own bytes to the same physical byte (which would
+// silently overwrite part of the write).  writes are truncated to the last MaxSize bytes, so this can only happen
+// when MaxSize is larger than the parts it maps onto (a corrupt MaxSize, see validateOpts)
+func (f *WaveFile) checkCircularWrap(offset int64, size int64) error {
+	physSize := f.Opts.MaxSize
+	if !f.isSubPartCircular() {
+		physSize = f.Opts.MaxSize / partDataSize * partDataSize
+	}
+	if min(size, f.Opts.MaxSize) > physSize {
+		return fmt.Errorf("write to circular file %s:%s at offset %d wraps onto itself (maxsize %d, parts hold %d bytes)", f.ZoneId, f.Name, offset, f.Opts.MaxSize, physSize)
+	}
+	return nil
+}
+
+// returns (partOffset, partAvail)
+// partAvail is the number of bytes from partOffset to the end of the part
+// for sub-part circular files the part ends (wraps) at MaxSize instead of partDataSize
+func (f *WaveFile) partOffsetAtOffset(offset int64) (int64, int64) {
+	if f.isSubPartCircular() {
+		partOffset := offset % f.Opts.MaxSize
+		return partOffset, f.Opts.MaxSize - partOffset
+	}
+	partOffset := offset % partDataSize
+	return partOffset, partDataSize - partOffset
+}
+
 func incompletePartsFromMap(partMap map[int]int) []int {
 	var incompleteParts []int
 	for partIdx, size := range partMap {
@@ -448,6 +2641,33 @@ func incompletePartsFromMap(partMap map[int]int) []int {
 	return incompleteParts
 }
 
+// returns the parts that must be loaded before writing [offset, offset+size): the parts that are only partly
+// written and have existing data (below Size) outside of the written range.  a boundary part whose existing data
+// is entirely overwritten (e.g. an aligned write or append that runs past the current end) is not loaded.
+// for circular files every partly written part is loaded (wrapped parts hold live data from the previous lap)
+func (file *WaveFile) partsToLoadForWrite(offset int64, size int64) []int {
+	partMap := file.computePartMap(offset, size)
+	if file.Opts.Circular {
+		return incompletePartsFromMap(partMap)
+	}
+	var rtn []int
+	endOffset := offset + size
+	for partIdx, writeSize := range partMap {
+		if writeSize == int(partDataSize) {
+			continue
+		}
+		partStart := int64(partIdx) * partDataSize
+		partEnd := partStart + partDataSize
+		dataEnd := minInt64(partEnd, file.Size)
+		keepsHead := offset > partStart && partStart < file.Size
+		keepsTail := minInt64(endOffset, partEnd) < dataEnd
+		if keepsHead || keepsTail {
+			rtn = append(rtn, partIdx)
+		}
+	}
+	return rtn
+}
+
 func getPartIdxsFromMap(partMap map[int]int) []int {
 	var partIdxs []int
 	for partIdx := range partMap {
@@ -459,6 +2679,12 @@ func getPartIdxsFromMap(partMap map[int]int) []int {
 // returns a map of partIdx to amount of data to write to that part
 func (file *WaveFile) computePartMap(startOffset int64, size int64) map[int]int {
 	partMap := make(map[int]int)
+	if file.isSubPartCircular() {
+		if size > 0 {
+			partMap[0] = int(minInt64(size, file.Opts.MaxSize))
+		}
+		return partMap
+	}
 	endOffset := startOffset + size
 	startFileOffset := startOffset - (startOffset % partDataSize)
 	for testOffset := startFileOffset; testOffset < endOffset; testOffset += partDataSize {
@@ -478,18 +2704,96 @@ func (file *WaveFile) computePartMap(startOffset int64, size int64) map[int]int
 	return partMap
 }
 
+func (s *FileStore) getMaxPartIdx() int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.MaxPartIdx <= 0 {
+		return DefaultMaxPartIdx
+	}
+	return s.MaxPartIdx
+}
+
+// rejects writes that would create a part past the max part index
+// the limit comes from MaxSize when it is set, otherwise from FileStore.MaxPartIdx
+// circular files always map into [0, MaxSize) and trimfront files drop leading parts, so they are never rejected
+// (circular writes are instead checked for wrapping onto themselves, see checkCircularWrap)
+func (s *FileStore) checkWriteExtent(file *WaveFile, offset int64, size int64) error {
+	if file.Opts.Circular {
+		return file.checkCircularWrap(offset, size)
+	}
+	if file.Opts.TrimFront || size <= 0 {
+		return nil
+	}
+	maxPartIdx := int64(s.getMaxPartIdx())
+	if file.Opts.MaxSize > 0 {
+		maxPartIdx = (file.Opts.MaxSize - 1) / partDataSize
+	}
+	lastPartIdx := (offset + size - 1) / partDataSize
+	if lastPartIdx > maxPartIdx {
+		return fmt.Errorf("write to %s:%s at offset %d (size %d) would extend to part %d, past the max part index %d", file.ZoneId, file.Name, offset, size, lastPartIdx, maxPartIdx)
+	}
+	return nil
+}
+
+func (s *FileStore) getMaxAppendChunk() int64 {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.MaxAppendChunk
+}
+
+func (s *FileStore) getFlushBatch() FlushBatch {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	batch := FlushBatch{MaxParts: s.FlushBatchSize, MaxBytes: s.MaxInFlightFlushBytes}
+	if batch.MaxParts <= 0 {
+		batch.MaxParts = DefaultFlushBatchSize
+	}
+	return batch
+}
+
 func (s *FileStore) getDirtyCacheKeys() []cacheKey {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
 	var dirtyCacheKeys []cacheKey
 	for key, entry := range s.Cache {
-		if entry.File != nil {
+		// File can't be read here, it is only synchronized with the entry lock
+		if entry.hasFile.Load() {
 			dirtyCacheKeys = append(dirtyCacheKeys, key)
 		}
 	}
 	return dirtyCacheKeys
 }
 
+// flush order: entries are flushed by FlushPriorityMetaKey (highest first, the default priority is 0), entries
+// with the same priority are flushed oldest-dirty first (by FirstDirtyTs), so when the flusher is behind the
+// longest-unflushed data lands first.  the priority is read from the cached meta when the entry is marked dirty
+func (s *FileStore) getFlushOrderedCacheKeys() []cacheKey {
+	type flushCandidate struct {
+		key      cacheKey
+		priority int64
+		dirtyTs  int64
+	}
+	var candidates []flushCandidate
+	s.Lock.Lock()
+	for key, entry := range s.Cache {
+		if entry.hasFile.Load() {
+			candidates = append(candidates, flushCandidate{key: key, priority: entry.flushPriority.Load(), dirtyTs: entry.firstDirtyTs.Load()})
+		}
+	}
+	s.Lock.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority > candidates[j].priority
+		}
+		return candidates[i].dirtyTs < candidates[j].dirtyTs
+	})
+	keys := make([]cacheKey, 0, len(candidates))
+	for _, cand := range candidates {
+		keys = append(keys, cand.key)
+	}
+	return keys
+}
+
 func (s *FileStore) setIsFlushing(flushing bool) {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
@@ -0,0 +1,116 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/panichandler"
+)
+
+// async appends (see AppendDataAsync)
+// appends are queued onto a fixed set of worker queues (bounded, started on first use) and applied in the background
+// with AppendData.  every append for a given file goes to the same worker, so appends to the same file are applied
+// in FIFO order (the order AppendDataAsync was called in).  there is no ordering across files.  since the caller
+// does not wait, errors are only logged (and counted, see AsyncAppendErrors).  DrainAsync waits for the queues to empty.
+
+const AsyncAppendWorkers = 4
+const AsyncAppendQueueSize = 1024 // per worker
+const AsyncAppendTimeout = 5 * time.Second
+
+// returned by AppendDataAsync when the file's worker queue is full
+var ErrAsyncQueueFull = errors.New("async append queue is full")
+
+type asyncAppend struct {
+	zoneId  string
+	name    string
+	data    []byte
+	drainCh chan struct{} // set for the DrainAsync barrier (no append), closed when the worker reaches it
+}
+
+func asyncWorkerIdx(zoneId string, name string) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(zoneId))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(name))
+	return int(hasher.Sum32() % AsyncAppendWorkers)
+}
+
+// returns the worker queues, starting the workers if needed
+func (s *FileStore) getAsyncQueues() []chan asyncAppend {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.asyncQueues == nil {
+		s.asyncQueues = make([]chan asyncAppend, AsyncAppendWorkers)
+		for idx := range s.asyncQueues {
+			s.asyncQueues[idx] = make(chan asyncAppend, AsyncAppendQueueSize)
+			go s.runAsyncWorker(s.asyncQueues[idx])
+		}
+	}
+	return s.asyncQueues
+}
+
+// queues an append (data is copied) and returns without waiting for the store lock, returns ErrAsyncQueueFull
+// (without queueing) if the file's queue is full.  appends to the same file are applied in order, see the notes above
+func (s *FileStore) AppendDataAsync(zoneId string, name string, data []byte) error {
+	queue := s.getAsyncQueues()[asyncWorkerIdx(zoneId, name)]
+	item := asyncAppend{zoneId: zoneId, name: name, data: append([]byte(nil), data...)}
+	select {
+	case queue <- item:
+		return nil
+	default:
+		return fmt.Errorf("cannot append to %s:%s: %w", zoneId, name, ErrAsyncQueueFull)
+	}
+}
+
+// waits until every append queued before the call has been applied (e.g. on shutdown, before the final flush)
+func (s *FileStore) DrainAsync(ctx context.Context) error {
+	var drainChs []chan struct{}
+	for _, queue := range s.getAsyncQueues() {
+		drainCh := make(chan struct{})
+		select {
+		case queue <- asyncAppend{drainCh: drainCh}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		drainChs = append(drainChs, drainCh)
+	}
+	for _, drainCh := range drainChs {
+		select {
+		case <-drainCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// returns the number of async appends that have failed
+func (s *FileStore) AsyncAppendErrors() int64 {
+	return s.asyncErrors.Load()
+}
+
+func (s *FileStore) runAsyncWorker(queue chan asyncAppend) {
+	defer func() {
+		panichandler.PanicHandler("filestore async append worker", recover())
+	}()
+	for item := range queue {
+		if item.drainCh != nil {
+			close(item.drainCh)
+			continue
+		}
+		ctx, cancelFn := context.WithTimeout(context.Background(), AsyncAppendTimeout)
+		err := s.AppendData(ctx, item.zoneId, item.name, item.data)
+		cancelFn()
+		if err != nil {
+			s.asyncErrors.Add(1)
+			log.Printf("filestore async append %s:%s error: %v\n", item.zoneId, item.name, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// storage backends
+// the FileStore keeps its write cache in memory and reads and flushes through a Backend (FileStore.Backend).
+// the default backend is DBBackend, the SQLite DB (the db* functions in blockstore_dbops.go), MemBackend keeps
+// everything in memory (see blockstore_memory.go).  a backend can store file rows and parts wherever it likes
+// (e.g. rows in SQLite and parts in an object store), but:
+//   - every call must be atomic (the DB backend runs each call in one transaction)
+//   - missing files are reported with fs.ErrNotExist (GetZoneFile returns nil, nil), existing ones with fs.ErrExist
+//   - WriteCacheEntry must store inline data and checksums the way the readers (GetFileParts, GetPartChecksums) expect,
+//     and must drop the parts past the end of non-circular files (and before StartOffset for trimfront files),
+//     and must return ErrFileChanged if the stored file's CreatedTs (or, unless replacing, Opts) differ from the file's
+
+// identifies a file (zone id + name)
+type FileKey = cacheKey
+
+// limits on the parts written per statement by WriteCacheEntry (see FileStore.FlushBatchSize and
+// FileStore.MaxInFlightFlushBytes), backends that don't batch writes can ignore it
+type FlushBatch struct {
+	MaxParts int
+	MaxBytes int64 // 0 means no limit
+}
+
+// returns how many of parts (at least 1) fit in one batch
+func (batch FlushBatch) numParts(parts []*DataCacheEntry) int {
+	var numBytes int64
+	for idx, part := range parts {
+		numBytes += int64(len(part.Data))
+		if idx > 0 && (idx >= batch.MaxParts || (batch.MaxBytes > 0 && numBytes > batch.MaxBytes)) {
+			return idx
+		}
+	}
+	return len(parts)
+}
+
+type Backend interface {
+	// file rows
+	InsertFile(ctx context.Context, file *WaveFile) error
+	DeleteFile(ctx context.Context, zoneId string, name string) error
+	DeleteFiles(ctx context.Context, keys []FileKey) ([]FileKey, error)
+	MoveZone(ctx context.Context, oldZoneId string, newZoneId string, expectedNames []string) error
+	RenameFile(ctx context.Context, zoneId string, oldName string, newName string, meta FileMeta, replace bool) error
+	SwapFiles(ctx context.Context, zoneId string, nameA string, nameB string, swapMeta bool, modTs int64) error
+	GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error)
+	GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error)
+	GetZoneFilesByName(ctx context.Context, zoneId string, names []string) ([]*WaveFile, error)
+	GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error)
+	GetFilesPage(ctx context.Context, afterZoneId string, afterName string, limit int) ([]*WaveFile, error)
+	GetFilesWithNamePrefix(ctx context.Context, namePrefix string) ([]*WaveFile, error)
+	GetFileMeta(ctx context.Context, zoneId string, name string) (FileMeta, error)
+	WriteFileMeta(ctx context.Context, zoneId string, name string, meta FileMeta) error
+	WriteAccessTimes(ctx context.Context, accessTimes map[FileKey]int64) error
+
+	// zones
+	GetAllZoneIds(ctx context.Context) ([]string, error)
+	GetZoneIdsPage(ctx context.Context, afterId string, limit int) ([]string, error)
+	GetZoneIdsModifiedSince(ctx context.Context, since int64) ([]string, error)
+
+	// parts
+	GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error)
+	GetZoneFilesParts(ctx context.Context, zoneId string, parts map[string][]int) (map[string]map[int]*DataCacheEntry, error)
+	GetPartSizes(ctx context.Context, zoneId string, name string) (map[int]int, error)
+	WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error)
+
+	// checksums (see blockstore_checksum.go)
+	GetFileChecksum(ctx context.Context, zoneId string, name string) ([]byte, error)
+	GetPartChecksums(ctx context.Context, zoneId string, name string) (map[int][]byte, error)
+
+	// maintenance (see Fsck and Vacuum)
+	GetOrphanParts(ctx context.Context) ([]FsckFile, error)
+	DeleteOrphanParts(ctx context.Context) error
+	GetFilesWithoutParts(ctx context.Context) ([]*WaveFile, error)
+	ResetPhantomFile(ctx context.Context, zoneId string, name string, size int64) error
+	GetSize(ctx context.Context) (int64, error)
+	Vacuum(ctx context.Context) error
+}
+
+// the default backend, DB must already be migrated (see MigrateDB), nil means the global DB set up by InitFilestore
+// (looked up on every call, since it is only set in InitFilestore)
+type DBBackend struct {
+	DB *sqlx.DB
+}
+
+func (b DBBackend) getDB() *sqlx.DB {
+	if b.DB != nil {
+		return b.DB
+	}
+	return globalDB
+}
+
+func (s *FileStore) backend() Backend {
+	if s.Backend != nil {
+		return s.Backend
+	}
+	return DBBackend{DB: s.DB}
+}
+
+func (entry *CacheEntry) backend() Backend {
+	if entry.backendFn != nil {
+		return entry.backendFn()
+	}
+	return DBBackend{}
+}
+
+func (b DBBackend) InsertFile(ctx context.Context, file *WaveFile) error {
+	return dbInsertFile(ctx, b.getDB(), file)
+}
+
+func (b DBBackend) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	return dbDeleteFile(ctx, b.getDB(), zoneId, name)
+}
+
+func (b DBBackend) DeleteFiles(ctx context.Context, keys []FileKey) ([]FileKey, error) {
+	return dbDeleteFiles(ctx, b.getDB(), keys)
+}
+
+func (b DBBackend) MoveZone(ctx context.Context, oldZoneId string, newZoneId string, expectedNames []string) error {
+	return dbMoveZone(ctx, b.getDB(), oldZoneId, newZoneId, expectedNames)
+}
+
+func (b DBBackend) RenameFile(ctx context.Context, zoneId string, oldName string, newName string, meta FileMeta, replace bool) error {
+	return dbRenameFile(ctx, b.getDB(), zoneId, oldName, newName, meta, replace)
+}
+
+func (b DBBackend) SwapFiles(ctx context.Context, zoneId string, nameA string, nameB string, swapMeta bool, modTs int64) error {
+	return dbSwapFiles(ctx, b.getDB(), zoneId, nameA, nameB, swapMeta, modTs)
+}
+
+func (b DBBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	return dbGetZoneFile(ctx, b.getDB(), zoneId, name)
+}
+
+func (b DBBackend) GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	return dbGetZoneFiles(ctx, b.getDB(), zoneId)
+}
+
+func (b DBBackend) GetZoneFilesByName(ctx context.Context, zoneId string, names []string) ([]*WaveFile, error) {
+	return dbGetZoneFilesByName(ctx, b.getDB(), zoneId, names)
+}
+
+func (b DBBackend) GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
+	return dbGetZoneFileNames(ctx, b.getDB(), zoneId)
+}
+
+func (b DBBackend) GetFilesPage(ctx context.Context, afterZoneId string, afterName string, limit int) ([]*WaveFile, error) {
+	return dbGetFilesPage(ctx, b.getDB(), afterZoneId, afterName, limit)
+}
+
+func (b DBBackend) GetFilesWithNamePrefix(ctx context.Context, namePrefix string) ([]*WaveFile, error) {
+	return dbGetFilesWithNamePrefix(ctx, b.getDB(), namePrefix)
+}
+
+func (b DBBackend) WriteAccessTimes(ctx context.Context, accessTimes map[FileKey]int64) error {
+	return dbWriteAccessTimes(ctx, b.getDB(), accessTimes)
+}
+
+func (b DBBackend) GetFileMeta(ctx context.Context, zoneId string, name string) (FileMeta, error) {
+	return dbGetFileMeta(ctx, b.getDB(), zoneId, name)
+}
+
+func (b DBBackend) WriteFileMeta(ctx context.Context, zoneId string, name string, meta FileMeta) error {
+	return dbWriteFileMeta(ctx, b.getDB(), zoneId, name, meta)
+}
+
+func (b DBBackend) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	return dbGetAllZoneIds(ctx, b.getDB())
+}
+
+func (b DBBackend) GetZoneIdsPage(ctx context.Context, afterId string, limit int) ([]string, error) {
+	return dbGetZoneIdsPage(ctx, b.getDB(), afterId, limit)
+}
+
+func (b DBBackend) GetZoneIdsModifiedSince(ctx context.Context, since int64) ([]string, error) {
+	return dbGetZoneIdsModifiedSince(ctx, b.getDB(), since)
+}
+
+func (b DBBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	return dbGetFileParts(ctx, b.getDB(), zoneId, name, parts)
+}
+
+func (b DBBackend) GetZoneFilesParts(ctx context.Context, zoneId string, parts map[string][]int) (map[string]map[int]*DataCacheEntry, error) {
+	return dbGetZoneFilesParts(ctx, b.getDB(), zoneId, parts)
+}
+
+func (b DBBackend) GetPartSizes(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	return dbGetPartSizes(ctx, b.getDB(), zoneId, name)
+}
+
+func (b DBBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	return dbWriteCacheEntry(ctx, b.getDB(), file, dataEntries, replace, batch)
+}
+
+func (b DBBackend) GetFileChecksum(ctx context.Context, zoneId string, name string) ([]byte, error) {
+	return dbGetFileChecksum(ctx, b.getDB(), zoneId, name)
+}
+
+func (b DBBackend) GetPartChecksums(ctx context.Context, zoneId string, name string) (map[int][]byte, error) {
+	return dbGetPartChecksums(ctx, b.getDB(), zoneId, name)
+}
+
+func (b DBBackend) GetOrphanParts(ctx context.Context) ([]FsckFile, error) {
+	return dbGetOrphanParts(ctx, b.getDB())
+}
+
+func (b DBBackend) DeleteOrphanParts(ctx context.Context) error {
+	return dbDeleteOrphanParts(ctx, b.getDB())
+}
+
+func (b DBBackend) GetFilesWithoutParts(ctx context.Context) ([]*WaveFile, error) {
+	return dbGetFilesWithoutParts(ctx, b.getDB())
+}
+
+func (b DBBackend) ResetPhantomFile(ctx context.Context, zoneId string, name string, size int64) error {
+	return dbResetPhantomFile(ctx, b.getDB(), zoneId, name, size)
+}
+
+func (b DBBackend) GetSize(ctx context.Context) (int64, error) {
+	return dbGetSize(ctx, b.getDB())
+}
+
+func (b DBBackend) Vacuum(ctx context.Context) error {
+	return dbVacuum(ctx, b.getDB())
+}
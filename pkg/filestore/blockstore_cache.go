@@ -6,10 +6,15 @@ package filestore
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
 type cacheKey struct {
@@ -18,19 +23,61 @@ type cacheKey struct {
 }
 
 type FileStore struct {
-	Lock       *sync.Mutex
-	Cache      map[cacheKey]*CacheEntry
-	IsFlushing bool
+	Lock                  *sync.Mutex
+	Cache                 map[cacheKey]*CacheEntry
+	IsFlushing            bool
+	TrackAccessTime       bool // if set, read access times are persisted on flush (without marking the file dirty, see recordAccess)
+	Validators            map[string]FileValidator
+	MetaSchemas           map[cacheKey]MetaSchema // keyed by (zoneId, name), an empty name applies to the whole zone
+	FlushBatchSize        int                     // max number of parts written per INSERT when flushing (0 means DefaultFlushBatchSize)
+	MaxInFlightFlushBytes int64                   // max part bytes written per INSERT when flushing (0 means no limit), a part larger than this is written on its own
+	MaxPartIdx            int                     // writes past this part index are rejected for files without a MaxSize (0 means DefaultMaxPartIdx)
+	OnFlush               func(FlushStats)        // optional, called at the end of every FlushCache (also when it fails)
+	MaxAppendChunk        int64                   // appends larger than this are written (and flushed) in part-aligned chunks (0 means no chunking)
+	SpillDir              string                  // opt-in, scratch dir for spilling dirty parts under memory pressure (see blockstore_spill.go)
+	SpillThreshold        int64                   // in-memory dirty part bytes allowed before spilling (only used if SpillDir is set)
+	Observers             []Observer              // see RegisterObserver
+	CircularCompactWraps  int                     // circular files are compacted (in the background) once they have wrapped more than this many times (0 disables)
+	EagerMetaFlush        bool                    // if set, WriteMeta/WriteMetaBatch write the new meta to the DB immediately (see writeMetaEager)
+	Tracer                Tracer                  // optional, see blockstore_trace.go
+	SoftDeleteGrace       time.Duration           // how long soft-deleted files can be restored (0 means DefaultSoftDeleteGrace)
+	PinLeakThreshold      time.Duration           // entries pinned this long with no operation in progress are reported as leaks (0 means DefaultPinLeakThreshold)
+	DB                    *sqlx.DB                // the (migrated) DB for this store, nil means the global DB set up by InitFilestore
+	Backend               Backend                 // optional, where files are stored (nil means a DBBackend on DB, see blockstore_backend.go)
+	ReadRegionCache       bool                    // if set, ReadAt keeps the last region read from each file in memory (see blockstore_readregion.go)
+	MaxOpenReaders        int                     // max open cursors and FollowReaders per file (0 means no limit), see ListOpenHandles
+
+	compactingCircular map[cacheKey]bool                 // files with a background CompactCircular in progress
+	writeWaiters       map[cacheKey]chan struct{}        // closed on the next write to the file, see FollowReader
+	lineBufs           map[cacheKey][]byte               // pending partial lines of line buffered files, see blockstore_linebuf.go
+	readRegions        map[cacheKey]*readRegion          // last region read from each file, see blockstore_readregion.go
+	archiveQueues      map[cacheKey]*archiveQueue        // overflow waiting to be appended to ArchiveOverflow archives (keyed by archive), see drainArchive
+	pendingAccess      map[cacheKey]int64                // access times to persist on the next flush (TrackAccessTime), see recordAccess
+	asyncQueues        []chan asyncAppend                // AppendDataAsync worker queues (nil until first use), see blockstore_async.go
+	asyncErrors        atomic.Int64                      // number of failed async appends
+	openHandles        map[cacheKey]map[int64]OpenHandle // open cursors and FollowReaders, see blockstore_cursor.go
+	handleCounter      int64
+
+	nowFn func() int64 // for tests, returns the current time in ms (nil means the real clock), must be set before use
 }
 
 type DataCacheEntry struct {
-	PartIdx int
-	Data    []byte // capacity is always ZoneDataPartSize
+	PartIdx   int
+	Data      []byte // capacity is always ZoneDataPartSize
+	ViewCount int    // outstanding ReadAtView views (synchronized with the entry lock), writes will copy-on-write
+
+	// used to flush only the modified bytes of parts that were loaded from the DB
+	FromDB     bool
+	DBLen      int64 // length of the part in the DB when it was loaded
+	DirtyStart int64 // [DirtyStart, DirtyEnd) has been modified since the part was loaded
+	DirtyEnd   int64
 }
 
-// if File or DataEntries are not nil then they are dirty (need to be flushed to disk)
+// if File is not nil then the entry is dirty (needs to be flushed to disk), DataEntries can also hold clean parts
+// (loaded from the DB, see Prefetch) which are dropped on the next flush
 type CacheEntry struct {
-	PinCount int // this is synchronzed with the FileStore lock (not the entry lock)
+	PinCount int   // this is synchronzed with the FileStore lock (not the entry lock)
+	PinnedTs int64 // when PinCount last went from 0 to 1 (also synchronized with the FileStore lock)
 
 	Lock        *sync.Mutex
 	ZoneId      string
@@ -38,6 +85,19 @@ type CacheEntry struct {
 	File        *WaveFile
 	DataEntries map[int]*DataCacheEntry
 	FlushErrors int
+	AccessTs    int64          // last read/stat of this entry (in-memory only, see FileStore.TrackAccessTime)
+	nowFn       func() int64   // the owning FileStore's clock
+	backendFn   func() Backend // the owning FileStore's backend
+	SpillPath   string         // set if DataEntries have been spilled to disk (DataEntries is then empty), see unspill
+
+	// generations of the first and last unflushed changes (0 if there are no unflushed changes)
+	FirstDirtyGen int64
+	DirtyGen      int64
+	FirstDirtyTs  int64 // when the entry first became dirty (0 if there are no unflushed changes)
+
+	hasFile       atomic.Bool  // mirrors File != nil, so it can be read without the entry lock (see getDirtyCacheKeys)
+	firstDirtyTs  atomic.Int64 // mirrors FirstDirtyTs (see getFlushOrderedCacheKeys)
+	flushPriority atomic.Int64 // FlushPriorityMetaKey as of the last markDirty (see getFlushOrderedCacheKeys)
 }
 
 //lint:ignore U1000 used for testing
@@ -65,12 +125,32 @@ func (s *FileStore) getEntryAndPin(zoneId string, name string) *CacheEntry {
 	entry := s.Cache[cacheKey{ZoneId: zoneId, Name: name}]
 	if entry == nil {
 		entry = makeCacheEntry(zoneId, name)
+		entry.nowFn = s.now
+		entry.backendFn = s.backend
 		s.Cache[cacheKey{ZoneId: zoneId, Name: name}] = entry
 	}
+	if entry.PinCount == 0 {
+		entry.PinnedTs = s.now()
+	}
 	entry.PinCount++
 	return entry
 }
 
+// current time in ms (all timestamps go through this so tests can inject a clock with nowFn)
+func (s *FileStore) now() int64 {
+	if s.nowFn != nil {
+		return s.nowFn()
+	}
+	return time.Now().UnixMilli()
+}
+
+func (entry *CacheEntry) now() int64 {
+	if entry.nowFn != nil {
+		return entry.nowFn()
+	}
+	return time.Now().UnixMilli()
+}
+
 func (s *FileStore) unpinEntryAndTryDelete(zoneId string, name string) {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
@@ -79,15 +159,38 @@ func (s *FileStore) unpinEntryAndTryDelete(zoneId string, name string) {
 		return
 	}
 	entry.PinCount--
-	if entry.PinCount <= 0 && entry.File == nil {
+	// entries with clean parts and no file are kept until the next flush (see Prefetch)
+	if entry.PinCount <= 0 && entry.File == nil && len(entry.DataEntries) == 0 {
 		delete(s.Cache, cacheKey{ZoneId: zoneId, Name: name})
 	}
 }
 
 func (entry *CacheEntry) clear() {
+	entry.removeSpillFile()
 	entry.File = nil
+	entry.hasFile.Store(false)
 	entry.DataEntries = make(map[int]*DataCacheEntry)
 	entry.FlushErrors = 0
+	entry.FirstDirtyGen = 0
+	entry.DirtyGen = 0
+	entry.FirstDirtyTs = 0
+	entry.firstDirtyTs.Store(0)
+	entry.flushPriority.Store(0)
+}
+
+// must be called (under the entry lock) whenever File or DataEntries are modified
+func (entry *CacheEntry) markDirty() {
+	gen := dirtyGenCounter.Add(1)
+	if entry.FirstDirtyGen == 0 {
+		entry.FirstDirtyGen = gen
+		entry.FirstDirtyTs = entry.now()
+		entry.firstDirtyTs.Store(entry.FirstDirtyTs)
+	}
+	entry.DirtyGen = gen
+	if entry.File != nil {
+		priority, _ := getMetaInt64(entry.File.Meta, FlushPriorityMetaKey)
+		entry.flushPriority.Store(priority)
+	}
 }
 
 func (entry *CacheEntry) getOrCreateDataCacheEntry(partIdx int) *DataCacheEntry {
@@ -106,7 +209,12 @@ func (entry *CacheEntry) loadFileIntoCache(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	err = file.validateOpts()
+	if err != nil {
+		return err
+	}
 	entry.File = file
+	entry.hasFile.Store(true)
 	return nil
 }
 
@@ -115,7 +223,7 @@ func (entry *CacheEntry) loadFileForRead(ctx context.Context) (*WaveFile, error)
 	if entry.File != nil {
 		return entry.File, nil
 	}
-	file, err := dbGetZoneFile(ctx, entry.ZoneId, entry.Name)
+	file, err := entry.backend().GetZoneFile(ctx, entry.ZoneId, entry.Name)
 	if err != nil {
 		return nil, fmt.Errorf("error getting file: %w", err)
 	}
@@ -130,6 +238,10 @@ func withLock(s *FileStore, zoneId string, name string, fn func(*CacheEntry) err
 	defer s.unpinEntryAndTryDelete(zoneId, name)
 	entry.Lock.Lock()
 	defer entry.Lock.Unlock()
+	err := entry.unspill()
+	if err != nil {
+		return err
+	}
 	return fn(entry)
 }
 
@@ -143,7 +255,43 @@ func withLockRtn[T any](s *FileStore, zoneId string, name string, fn func(*Cache
 	return rtnVal, rtnErr
 }
 
+func (dce *DataCacheEntry) clone() *DataCacheEntry {
+	newData := make([]byte, len(dce.Data), partDataSize)
+	copy(newData, dce.Data)
+	return &DataCacheEntry{
+		PartIdx:    dce.PartIdx,
+		Data:       newData,
+		FromDB:     dce.FromDB,
+		DBLen:      dce.DBLen,
+		DirtyStart: dce.DirtyStart,
+		DirtyEnd:   dce.DirtyEnd,
+	}
+}
+
+func (dce *DataCacheEntry) markDirtyRange(start int64, end int64) {
+	if dce.DirtyEnd <= dce.DirtyStart {
+		dce.DirtyStart = start
+		dce.DirtyEnd = end
+		return
+	}
+	if start < dce.DirtyStart {
+		dce.DirtyStart = start
+	}
+	if end > dce.DirtyEnd {
+		dce.DirtyEnd = end
+	}
+}
+
+// true if only the dirty range needs to be written back to the DB (see dbWriteCacheEntry)
+func (dce *DataCacheEntry) canPatch() bool {
+	return dce.FromDB && dce.DirtyStart <= dce.DBLen
+}
+
+// if there are outstanding views on dce, the write goes to a copy (the returned *DataCacheEntry)
 func (dce *DataCacheEntry) writeToPart(offset int64, data []byte) (int64, *DataCacheEntry) {
+	if dce.ViewCount > 0 {
+		dce = dce.clone()
+	}
 	leftInPart := partDataSize - offset
 	toWrite := int64(len(data))
 	if toWrite > leftInPart {
@@ -153,18 +301,32 @@ func (dce *DataCacheEntry) writeToPart(offset int64, data []byte) (int64, *DataC
 		dce.Data = dce.Data[:offset+toWrite]
 	}
 	copy(dce.Data[offset:], data[:toWrite])
+	dce.markDirtyRange(offset, offset+toWrite)
 	return toWrite, dce
 }
 
-func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
+// returns info about the work the write created (see WriteInfo)
+func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) WriteInfo {
+	oldSize := entry.File.Size
 	if replace {
 		entry.File.Size = 0
+		entry.File.StartOffset = 0
+	}
+	if entry.File.Opts.TrimFront && offset < entry.File.StartOffset {
+		if offset+int64(len(data)) <= entry.File.StartOffset {
+			// write is entirely in the trimmed region
+			return WriteInfo{NewSize: entry.File.Size}
+		}
+		// truncate data (from the front), update offset
+		truncateAmt := entry.File.StartOffset - offset
+		data = data[truncateAmt:]
+		offset += truncateAmt
 	}
 	if entry.File.Opts.Circular {
 		startCirFileOffset := entry.File.Size - entry.File.Opts.MaxSize
 		if offset+int64(len(data)) <= startCirFileOffset {
 			// write is before the start of the circular file
-			return
+			return WriteInfo{NewSize: entry.File.Size}
 		}
 		if offset < startCirFileOffset {
 			// truncate data (from the front), update offset
@@ -183,80 +345,238 @@ func (entry *CacheEntry) writeAt(offset int64, data []byte, replace bool) {
 	if replace {
 		entry.DataEntries = make(map[int]*DataCacheEntry)
 	}
+	dirtiedParts := make(map[int]bool)
 	for len(data) > 0 {
-		partIdx := int(offset / partDataSize)
-		if entry.File.Opts.Circular {
-			maxPart := int(entry.File.Opts.MaxSize / partDataSize)
-			partIdx = partIdx % maxPart
-		}
-		partOffset := offset % partDataSize
+		partIdx := entry.File.partIdxAtOffset(offset)
+		partOffset, partAvail := entry.File.partOffsetAtOffset(offset)
 		partData := entry.getOrCreateDataCacheEntry(partIdx)
-		nw, newDce := partData.writeToPart(partOffset, data)
+		nw, newDce := partData.writeToPart(partOffset, data[:minInt64(int64(len(data)), partAvail)])
 		entry.DataEntries[partIdx] = newDce
+		dirtiedParts[partIdx] = true
 		data = data[nw:]
 		offset += nw
 	}
 	if endWriteOffset > entry.File.Size || replace {
 		entry.File.Size = endWriteOffset
 	}
-	entry.File.ModTs = time.Now().UnixMilli()
+	entry.trimFront()
+	entry.File.Version++
+	entry.File.ModTs = entry.now()
+	entry.markDirty()
+	return WriteInfo{PartsDirtied: len(dirtiedParts), SizeChanged: entry.File.Size != oldSize, NewSize: entry.File.Size}
+}
+
+// for trimfront files, drops whole leading parts so that at most MaxSize bytes are kept (MaxSize is a multiple of the part size)
+// the parts are deleted from the DB on the next flush (everything before StartOffset)
+func (entry *CacheEntry) trimFront() {
+	file := entry.File
+	if !file.Opts.TrimFront || file.Size-file.StartOffset <= file.Opts.MaxSize {
+		return
+	}
+	newStartPartIdx := (file.Size - file.Opts.MaxSize + partDataSize - 1) / partDataSize
+	for partIdx := range entry.DataEntries {
+		if int64(partIdx) < newStartPartIdx {
+			delete(entry.DataEntries, partIdx)
+		}
+	}
+	file.StartOffset = newStartPartIdx * partDataSize
+}
+
+func (entry *CacheEntry) writeMeta(meta FileMeta, merge bool) {
+	if merge {
+		for k, v := range meta {
+			if v == nil {
+				delete(entry.File.Meta, k)
+				continue
+			}
+			entry.File.Meta[k] = v
+		}
+	} else {
+		entry.File.Meta = meta
+	}
+	entry.File.Version++
+	entry.File.ModTs = entry.now()
+	entry.markDirty()
 }
 
 // returns (realOffset, data, error)
 func (entry *CacheEntry) readAt(ctx context.Context, offset int64, size int64, readFull bool) (int64, []byte, error) {
+	rtnOffset, data, _, err := entry.readAtWithHoles(ctx, offset, size, readFull)
+	return rtnOffset, data, err
+}
+
+// like readAt, but also returns the ranges that came from absent parts (see copyFromParts)
+func (entry *CacheEntry) readAtWithHoles(ctx context.Context, offset int64, size int64, readFull bool) (int64, []byte, []Range, error) {
 	if offset < 0 {
-		return 0, nil, fmt.Errorf("offset cannot be negative")
+		return 0, nil, nil, fmt.Errorf("offset cannot be negative")
 	}
 	file, err := entry.loadFileForRead(ctx)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, err
+	}
+	err = file.validateOpts()
+	if err != nil {
+		return 0, nil, nil, err
 	}
 	if readFull {
 		size = file.Size - offset
 	}
-	if offset+size > file.Size {
-		size = file.Size - offset
+	offset, size = file.clampReadRange(offset, size)
+	if (file.Opts.Circular || file.Opts.TrimFront) && size <= 0 {
+		return file.DataStartIdx(), []byte{}, nil, nil
 	}
-	if file.Opts.Circular {
-		realDataOffset := int64(0)
-		if file.Size > file.Opts.MaxSize {
-			realDataOffset = file.Size - file.Opts.MaxSize
+	partMap := file.computePartMap(offset, size)
+	dataEntryMap, err := entry.loadDataPartsForRead(ctx, getPartIdxsFromMap(partMap))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	data := make([]byte, max(size, 0))
+	holes := file.copyFromParts(dataEntryMap, offset, data)
+	return offset, data, holes, nil
+}
+
+// reads into buf (no allocation for the returned data), returns (n, error)
+// returns io.EOF if offset is at or past the end of the file
+// for circular and trimfront files, offsets before DataStartIdx are an error (the data is gone)
+func (entry *CacheEntry) readAtBuf(ctx context.Context, offset int64, buf []byte) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("offset cannot be negative")
+	}
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = file.validateOpts()
+	if err != nil {
+		return 0, err
+	}
+	if offset >= file.Size {
+		return 0, io.EOF
+	}
+	if offset < file.DataStartIdx() {
+		return 0, fmt.Errorf("offset %d is before the start of the file data (%d)", offset, file.DataStartIdx())
+	}
+	_, size := file.clampReadRange(offset, int64(len(buf)))
+	if size <= 0 {
+		return 0, nil
+	}
+	partMap := file.computePartMap(offset, size)
+	dataEntryMap, err := entry.loadDataPartsForRead(ctx, getPartIdxsFromMap(partMap))
+	if err != nil {
+		return 0, err
+	}
+	file.copyFromParts(dataEntryMap, offset, buf[:size])
+	return int(size), nil
+}
+
+// returns (realOffset, dce, data, error)
+// if dce is not nil, data is a view into dce.Data (caller must increment dce.ViewCount)
+// otherwise data is a copy (falls back to readAt)
+func (entry *CacheEntry) readAtView(ctx context.Context, offset int64, size int64) (int64, *DataCacheEntry, []byte, error) {
+	if offset < 0 {
+		return 0, nil, nil, fmt.Errorf("offset cannot be negative")
+	}
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	err = file.validateOpts()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	viewOffset, viewSize := file.clampReadRange(offset, size)
+	if viewSize > 0 {
+		partOffset, partAvail := file.partOffsetAtOffset(viewOffset)
+		dce := entry.DataEntries[file.partIdxAtOffset(viewOffset)]
+		if dce != nil && viewSize <= partAvail && partOffset+viewSize <= int64(len(dce.Data)) {
+			return viewOffset, dce, dce.Data[partOffset : partOffset+viewSize : partOffset+viewSize], nil
 		}
-		if offset < realDataOffset {
-			truncateAmt := realDataOffset - offset
-			offset += truncateAmt
-			size -= truncateAmt
+	}
+	rtnOffset, data, err := entry.readAt(ctx, offset, size, false)
+	return rtnOffset, nil, data, err
+}
+
+// returns [][]byte (one slice per range, in order)
+// all of the parts needed for all of the ranges are fetched with a single call to loadDataPartsForRead
+func (entry *CacheEntry) readRanges(ctx context.Context, ranges []Range) ([][]byte, error) {
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = file.validateOpts()
+	if err != nil {
+		return nil, err
+	}
+	clampedRanges := make([]Range, len(ranges))
+	partSet := make(map[int]bool)
+	for idx, r := range ranges {
+		if r.Offset < 0 {
+			return nil, fmt.Errorf("offset cannot be negative (range %d)", idx)
 		}
+		offset, size := file.clampReadRange(r.Offset, r.Size)
 		if size <= 0 {
-			return realDataOffset, nil, nil
+			continue
+		}
+		clampedRanges[idx] = Range{Offset: offset, Size: size}
+		for partIdx := range file.computePartMap(offset, size) {
+			partSet[partIdx] = true
 		}
 	}
-	partMap := file.computePartMap(offset, size)
-	dataEntryMap, err := entry.loadDataPartsForRead(ctx, getPartIdxsFromMap(partMap))
+	var partIdxs []int
+	for partIdx := range partSet {
+		partIdxs = append(partIdxs, partIdx)
+	}
+	dataEntryMap, err := entry.loadDataPartsForRead(ctx, partIdxs)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-	// combine the entries into a single byte slice
-	// note that we only want part of the first and last part depending on offset and size
-	rtnData := make([]byte, 0, size)
-	amtLeftToRead := size
+	rtn := make([][]byte, len(ranges))
+	for idx, r := range clampedRanges {
+		if r.Size <= 0 {
+			rtn[idx] = []byte{}
+			continue
+		}
+		rtn[idx] = file.readFromParts(dataEntryMap, r.Offset, r.Size)
+	}
+	return rtn, nil
+}
+
+// combine the entries into a single byte slice
+// note that we only want part of the first and last part depending on offset and size
+func (file *WaveFile) readFromParts(dataEntryMap map[int]*DataCacheEntry, offset int64, size int64) []byte {
+	rtnData := make([]byte, size)
+	file.copyFromParts(dataEntryMap, offset, rtnData)
+	return rtnData
+}
+
+// copies len(buf) bytes starting at offset from the parts into buf (missing parts read as zeros)
+// returns the ranges (file offsets, adjacent ranges merged) that were zero-filled because their part is absent
+func (file *WaveFile) copyFromParts(dataEntryMap map[int]*DataCacheEntry, offset int64, buf []byte) []Range {
+	var holes []Range
+	amtLeftToRead := int64(len(buf))
 	curReadOffset := offset
+	bufPos := int64(0)
 	for amtLeftToRead > 0 {
 		partIdx := file.partIdxAtOffset(curReadOffset)
+		partOffset, partAvail := file.partOffsetAtOffset(curReadOffset)
+		amtToRead := minInt64(partAvail, amtLeftToRead)
 		partDataEntry := dataEntryMap[partIdx]
-		var partData []byte
 		if partDataEntry == nil {
-			partData = make([]byte, partDataSize)
+			clear(buf[bufPos : bufPos+amtToRead])
+			if len(holes) > 0 && holes[len(holes)-1].Offset+holes[len(holes)-1].Size == curReadOffset {
+				holes[len(holes)-1].Size += amtToRead
+			} else {
+				holes = append(holes, Range{Offset: curReadOffset, Size: amtToRead})
+			}
 		} else {
-			partData = partDataEntry.Data[0:partDataSize]
+			partData := partDataEntry.Data[0:partDataSize]
+			copy(buf[bufPos:bufPos+amtToRead], partData[partOffset:partOffset+amtToRead])
 		}
-		partOffset := curReadOffset % partDataSize
-		amtToRead := minInt64(partDataSize-partOffset, amtLeftToRead)
-		rtnData = append(rtnData, partData[partOffset:partOffset+amtToRead]...)
 		amtLeftToRead -= amtToRead
 		curReadOffset += amtToRead
+		bufPos += amtToRead
 	}
-	return offset, rtnData, nil
+	return holes
 }
 
 func prunePartsWithCache(dataEntries map[int]*DataCacheEntry, parts []int) []int {
@@ -276,7 +596,7 @@ func (entry *CacheEntry) loadDataPartsIntoCache(ctx context.Context, parts []int
 		// parts are already loaded
 		return nil
 	}
-	dbDataParts, err := dbGetFileParts(ctx, entry.ZoneId, entry.Name, parts)
+	dbDataParts, err := entry.backend().GetFileParts(ctx, entry.ZoneId, entry.Name, parts)
 	if err != nil {
 		return fmt.Errorf("error getting data parts: %w", err)
 	}
@@ -286,6 +606,11 @@ func (entry *CacheEntry) loadDataPartsIntoCache(ctx context.Context, parts []int
 	return nil
 }
 
+// returns the requested parts without adding them to the cache
+// a part in the cache is always at least as new as the DB version (all writes go through the cache), so:
+//   - if a part is in the cache, the cache version is used (the DB is not queried for it)
+//   - the DB version is only used when the part is not in the cache
+//   - parts in neither are left out of the returned map (callers treat them as zero-filled holes)
 func (entry *CacheEntry) loadDataPartsForRead(ctx context.Context, parts []int) (map[int]*DataCacheEntry, error) {
 	if len(parts) == 0 {
 		return nil, nil
@@ -294,19 +619,19 @@ func (entry *CacheEntry) loadDataPartsForRead(ctx context.Context, parts []int)
 	var dbDataParts map[int]*DataCacheEntry
 	if len(dbParts) > 0 {
 		var err error
-		dbDataParts, err = dbGetFileParts(ctx, entry.ZoneId, entry.Name, dbParts)
+		dbDataParts, err = entry.backend().GetFileParts(ctx, entry.ZoneId, entry.Name, dbParts)
 		if err != nil {
 			return nil, fmt.Errorf("error getting data parts: %w", err)
 		}
 	}
 	rtn := make(map[int]*DataCacheEntry)
 	for _, partIdx := range parts {
-		if entry.DataEntries[partIdx] != nil {
-			rtn[partIdx] = entry.DataEntries[partIdx]
+		if cachePart := entry.DataEntries[partIdx]; cachePart != nil {
+			rtn[partIdx] = cachePart
 			continue
 		}
-		if dbDataParts[partIdx] != nil {
-			rtn[partIdx] = dbDataParts[partIdx]
+		if dbPart := dbDataParts[partIdx]; dbPart != nil {
+			rtn[partIdx] = dbPart
 			continue
 		}
 		// part not found
@@ -326,25 +651,33 @@ func makeCacheEntry(zoneId string, name string) *CacheEntry {
 	}
 }
 
-func (entry *CacheEntry) flushToDB(ctx context.Context, replace bool) error {
+// returns the number of part bytes written
+func (entry *CacheEntry) flushToDB(ctx context.Context, replace bool, batch FlushBatch) (int64, error) {
 	if entry.File == nil {
-		return nil
+		// nothing to write, drop any clean parts (see Prefetch) since the caller is about to change the file
+		entry.clear()
+		return 0, nil
 	}
-	err := dbWriteCacheEntry(ctx, entry.File, entry.DataEntries, replace)
+	bytesWritten, err := entry.backend().WriteCacheEntry(ctx, entry.File, entry.DataEntries, replace, batch)
 	if ctx.Err() != nil {
 		// transient error
-		return ctx.Err()
+		return 0, ctx.Err()
 	}
 	if err != nil {
 		flushErrorCount.Add(1)
 		entry.FlushErrors++
+		if errors.Is(err, ErrFileChanged) {
+			// retrying cannot help, the changes were made to a file that is gone
+			entry.clear()
+			return 0, err
+		}
 		if entry.FlushErrors > 3 {
 			entry.clear()
-			return fmt.Errorf("too many flush errors (clearing entry): %w", err)
+			return 0, fmt.Errorf("too many flush errors (clearing entry): %w", err)
 		}
-		return err
+		return 0, err
 	}
 	// clear cache entry (data is now in db)
 	entry.clear()
-	return nil
+	return bytesWritten, nil
 }
@@ -0,0 +1,159 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// checksum index
+// every part row stores the SHA-256 of its data (computed from the cache when the part is flushed), and every
+// file row stores a rollup: the SHA-256 of the part checksums concatenated in part index order.  the rollup is
+// recomputed on every flush from the stored part checksums, so only the dirty parts are ever re-hashed.
+// HashFile returns the rollup (see the notes there).
+
+// returned (wrapped) by VerifyFile when stored and recomputed checksums do not match
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func partChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func rollupChecksums(checksums [][]byte) []byte {
+	hasher := sha256.New()
+	for _, checksum := range checksums {
+		hasher.Write(checksum)
+	}
+	return hasher.Sum(nil)
+}
+
+// returns partidx => checksum of the file's current part data: the stored part checksums, with the dirty cached
+// parts hashed.  parts written before checksums were tracked have a nil checksum.  must be called with the entry lock held
+func (entry *CacheEntry) getCurrentPartChecksums(ctx context.Context) (map[int][]byte, error) {
+	partSums, err := entry.backend().GetPartChecksums(ctx, entry.ZoneId, entry.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting part checksums: %w", err)
+	}
+	if partSums == nil {
+		partSums = make(map[int][]byte)
+	}
+	for partIdx, dce := range entry.DataEntries {
+		if !dce.canPatch() || dce.DirtyEnd > dce.DirtyStart {
+			partSums[partIdx] = partChecksum(dce.Data)
+		}
+	}
+	return partSums, nil
+}
+
+// returns the file's hash: the rolled-up checksum (the SHA-256 of the part checksums, in part order), not the
+// SHA-256 of the data.  for a clean file this is the stored rollup (nothing is hashed), otherwise only the dirty
+// cached parts are hashed and combined with the stored part checksums, so the result is the hash the file will
+// have once it is flushed.  the parts of a regular file are fixed slices of its data, so for those the hash only
+// depends on the data (and the part size).  circular files are hashed in physical part order, so the hash changes
+// whenever the data does, but two circular files with the same window can hash differently
+func (s *FileStore) HashFile(ctx context.Context, zoneId string, name string) ([]byte, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]byte, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if entry.DirtyGen == 0 {
+			stored, err := s.backend().GetFileChecksum(ctx, zoneId, name)
+			if err != nil {
+				return nil, err
+			}
+			if stored != nil {
+				return stored, nil
+			}
+		}
+		partSums, err := entry.getCurrentPartChecksums(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var missingParts []int
+		for partIdx, checksum := range partSums {
+			if checksum == nil {
+				missingParts = append(missingParts, partIdx)
+			}
+		}
+		if len(missingParts) > 0 {
+			// parts written before checksums were tracked
+			dbParts, err := s.backend().GetFileParts(ctx, zoneId, name, missingParts)
+			if err != nil {
+				return nil, fmt.Errorf("error getting data parts: %w", err)
+			}
+			for partIdx, dce := range dbParts {
+				partSums[partIdx] = partChecksum(dce.Data)
+			}
+		}
+		partIdxs := make([]int, 0, len(partSums))
+		for partIdx := range partSums {
+			if file.Opts.TrimFront && int64(partIdx) < file.StartOffset/partDataSize {
+				// trimmed, will be removed on the next flush
+				continue
+			}
+			partIdxs = append(partIdxs, partIdx)
+		}
+		sort.Ints(partIdxs)
+		checksums := make([][]byte, 0, len(partIdxs))
+		for _, partIdx := range partIdxs {
+			checksums = append(checksums, partSums[partIdx])
+		}
+		return rollupChecksums(checksums), nil
+	})
+}
+
+// checks the data stored in the DB against the stored checksums (un-flushed cache changes are not checked)
+// parts are read and hashed one at a time, parts without a stored checksum (written before checksums were
+// tracked) are skipped.  returns an error wrapping ErrChecksumMismatch listing the parts that do not match
+func (s *FileStore) VerifyFile(ctx context.Context, zoneId string, name string) error {
+	return withLock(s, zoneId, name, func(entry *CacheEntry) error {
+		storedRollup, err := s.backend().GetFileChecksum(ctx, zoneId, name)
+		if err != nil {
+			return err
+		}
+		partSums, err := s.backend().GetPartChecksums(ctx, zoneId, name)
+		if err != nil {
+			return fmt.Errorf("error getting part checksums: %w", err)
+		}
+		partIdxs := make([]int, 0, len(partSums))
+		for partIdx := range partSums {
+			partIdxs = append(partIdxs, partIdx)
+		}
+		sort.Ints(partIdxs)
+		var badParts []int
+		rollupValid := true
+		checksums := make([][]byte, 0, len(partIdxs))
+		for _, partIdx := range partIdxs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			stored := partSums[partIdx]
+			checksums = append(checksums, stored)
+			if stored == nil {
+				rollupValid = false
+				continue
+			}
+			dbParts, err := s.backend().GetFileParts(ctx, zoneId, name, []int{partIdx})
+			if err != nil {
+				return fmt.Errorf("error getting data part %d: %w", partIdx, err)
+			}
+			if dce := dbParts[partIdx]; dce == nil || string(partChecksum(dce.Data)) != string(stored) {
+				badParts = append(badParts, partIdx)
+			}
+		}
+		if len(badParts) > 0 {
+			return fmt.Errorf("%w: file %s:%s parts %v", ErrChecksumMismatch, zoneId, name, badParts)
+		}
+		if storedRollup != nil && rollupValid && string(rollupChecksums(checksums)) != string(storedRollup) {
+			return fmt.Errorf("%w: file %s:%s rollup", ErrChecksumMismatch, zoneId, name)
+		}
+		return nil
+	})
+}
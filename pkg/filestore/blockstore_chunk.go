@@ -0,0 +1,126 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"crypto/sha256"
+)
+
+// content-defined chunking (see ChunkFile)
+// parts are stored at fixed partDataSize boundaries (circular files, trimfront, part patching and the checksum
+// index all depend on that), so a one byte insert shifts every following part.  for delta-sync, files can
+// instead be split at content-defined boundaries chosen by a rolling (gear) hash over the data.  boundaries only
+// depend on the nearby bytes, so an edit only changes the chunks around it and the two sides can compare chunk
+// hashes to find the ranges that actually differ.  the chunk index is computed on demand, it is not stored.
+
+const ContentChunkMinSize = 2 * 1024
+const ContentChunkMaxSize = 32 * 1024
+
+// a boundary is placed where the low 13 bits of the hash are 0, so chunks average ~8k (plus the min size)
+const contentChunkMask = 1<<13 - 1
+
+type ContentChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Hash   []byte `json:"hash"` // SHA-256 of the chunk's data
+}
+
+// random values for each byte value, generated with splitmix64 from a fixed seed so that every store
+// (and every version) computes the same boundaries
+var gearTable = makeGearTable()
+
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6a09e667f3bcc908)
+	for idx := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[idx] = z ^ (z >> 31)
+	}
+	return table
+}
+
+type contentChunker struct {
+	hash uint64
+	size int64
+}
+
+// returns the length of data up to (and including) the next chunk boundary, or -1 if there is no boundary in data
+// (the chunker state carries over to the next call)
+func (c *contentChunker) next(data []byte) int {
+	for idx, b := range data {
+		c.size++
+		c.hash = (c.hash << 1) + gearTable[b]
+		if c.size >= ContentChunkMaxSize || (c.size >= ContentChunkMinSize && c.hash&contentChunkMask == 0) {
+			c.hash = 0
+			c.size = 0
+			return idx + 1
+		}
+	}
+	return -1
+}
+
+// splits data into content-defined chunks (offsets start at 0)
+func ChunkData(data []byte) []ContentChunk {
+	var chunks []ContentChunk
+	var chunker contentChunker
+	var offset int64
+	for len(data) > 0 {
+		cut := chunker.next(data)
+		if cut < 0 {
+			cut = len(data)
+		}
+		sum := sha256.Sum256(data[:cut])
+		chunks = append(chunks, ContentChunk{Offset: offset, Size: int64(cut), Hash: sum[:]})
+		offset += int64(cut)
+		data = data[cut:]
+	}
+	return chunks
+}
+
+// returns the content-defined chunks of the file's data (including un-flushed cache changes).  the file is read
+// one part at a time, offsets are file offsets (for circular and trimfront files the first chunk starts at DataStartIdx).
+// returns the same chunks as ChunkData for the same data
+func (s *FileStore) ChunkFile(ctx context.Context, zoneId string, name string) ([]ContentChunk, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) ([]ContentChunk, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var chunks []ContentChunk
+		var chunker contentChunker
+		hasher := sha256.New()
+		chunkStart := file.DataStartIdx()
+		buf := make([]byte, partDataSize)
+		for offset := file.DataStartIdx(); offset < file.Size; {
+			n, err := entry.readAtBuf(ctx, offset, buf)
+			if err != nil {
+				return nil, err
+			}
+			data := buf[:n]
+			offset += int64(n)
+			for len(data) > 0 {
+				cut := chunker.next(data)
+				if cut < 0 {
+					hasher.Write(data)
+					break
+				}
+				hasher.Write(data[:cut])
+				chunkEnd := offset - int64(len(data)-cut)
+				chunks = append(chunks, ContentChunk{Offset: chunkStart, Size: chunkEnd - chunkStart, Hash: hasher.Sum(nil)})
+				hasher.Reset()
+				chunkStart = chunkEnd
+				data = data[cut:]
+			}
+		}
+		if chunkStart < file.Size {
+			chunks = append(chunks, ContentChunk{Offset: chunkStart, Size: file.Size - chunkStart, Hash: hasher.Sum(nil)})
+		}
+		s.recordAccess(ctx, entry)
+		return chunks, nil
+	})
+}
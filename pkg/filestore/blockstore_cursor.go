@@ -0,0 +1,203 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// FileCursor is a stateful reader over a file (implements io.ReadSeekCloser)
+// positions are absolute file offsets (the same offsets used by ReadAt).  for circular and trimfront files,
+// reading from a position whose data is gone skips ahead to the start of the data (DataStartIdx).  when the file
+// is rebased (CompactCircular/FreezeCircular, see RebaseMetaKey) the position moves down with the data.
+// the cache entry stays pinned until Close is called.
+type FileCursor struct {
+	s         *FileStore
+	ctx       context.Context // used for all reads through the cursor
+	entry     *CacheEntry
+	handleKey cacheKey // the key the handle was registered under
+	handleId  int64
+	lock      *sync.Mutex
+	pos       int64
+	rebase    int64 // RebaseMetaKey as of the last read
+	closed    bool
+	closeOnce sync.Once
+}
+
+var _ io.ReadSeekCloser = (*FileCursor)(nil)
+
+// open cursors and FollowReaders are tracked per file (see ListOpenHandles), so a leaked handle (never closed) can
+// be found, and FileStore.MaxOpenReaders caps how many can be open at once so a leak cannot pin a file without bound
+
+const (
+	HandleKind_Cursor = "cursor"
+	HandleKind_Follow = "follow"
+)
+
+type OpenHandle struct {
+	Id       int64  `json:"id"`
+	Kind     string `json:"kind"`     // one of the HandleKind_* constants
+	OpenedTs int64  `json:"openedts"` // ms
+}
+
+// returns the handle id, or an error wrapping ErrTooManyReaders if the file already has MaxOpenReaders open
+func (s *FileStore) registerHandle(key cacheKey, kind string) (int64, error) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.MaxOpenReaders > 0 && len(s.openHandles[key]) >= s.MaxOpenReaders {
+		return 0, fmt.Errorf("cannot open %s:%s (%d open): %w", key.ZoneId, key.Name, len(s.openHandles[key]), ErrTooManyReaders)
+	}
+	if s.openHandles == nil {
+		s.openHandles = make(map[cacheKey]map[int64]OpenHandle)
+	}
+	if s.openHandles[key] == nil {
+		s.openHandles[key] = make(map[int64]OpenHandle)
+	}
+	s.handleCounter++
+	s.openHandles[key][s.handleCounter] = OpenHandle{Id: s.handleCounter, Kind: kind, OpenedTs: s.now()}
+	return s.handleCounter, nil
+}
+
+func (s *FileStore) unregisterHandle(key cacheKey, handleId int64) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	delete(s.openHandles[key], handleId)
+	if len(s.openHandles[key]) == 0 {
+		delete(s.openHandles, key)
+	}
+}
+
+// returns the file's open cursors and FollowReaders (sorted by id, the order they were opened in)
+func (s *FileStore) ListOpenHandles(zoneId string, name string) []OpenHandle {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	var rtn []OpenHandle
+	for _, handle := range s.openHandles[cacheKey{ZoneId: zoneId, Name: name}] {
+		rtn = append(rtn, handle)
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		return rtn[i].Id < rtn[j].Id
+	})
+	return rtn
+}
+
+// returns fs.ErrNotExist if the file does not exist, the caller must Close the cursor
+// returns an error wrapping ErrTooManyReaders if the file already has MaxOpenReaders cursors and FollowReaders open
+func (s *FileStore) OpenCursor(ctx context.Context, zoneId string, name string) (*FileCursor, error) {
+	return s.openCursor(ctx, zoneId, name, HandleKind_Cursor)
+}
+
+func (s *FileStore) openCursor(ctx context.Context, zoneId string, name string, kind string) (*FileCursor, error) {
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	handleId, err := s.registerHandle(key, kind)
+	if err != nil {
+		return nil, err
+	}
+	entry := s.getEntryAndPin(zoneId, name)
+	entry.Lock.Lock()
+	file, err := entry.loadFileForRead(ctx)
+	entry.Lock.Unlock()
+	if err != nil {
+		s.unpinEntryAndTryDelete(zoneId, name)
+		s.unregisterHandle(key, handleId)
+		return nil, err
+	}
+	rebase, _ := getMetaInt64(file.Meta, RebaseMetaKey)
+	return &FileCursor{s: s, ctx: ctx, entry: entry, handleKey: key, handleId: handleId, lock: &sync.Mutex{}, rebase: rebase}, nil
+}
+
+// moves pos down by the bytes the file has been rebased by since the last read (c.lock and the entry lock must be held)
+func (c *FileCursor) applyRebase(file *WaveFile) {
+	rebase, _ := getMetaInt64(file.Meta, RebaseMetaKey)
+	if rebase == c.rebase {
+		return
+	}
+	c.pos = max(c.pos-(rebase-c.rebase), 0)
+	c.rebase = rebase
+}
+
+func (c *FileCursor) Read(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, fs.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	entry := c.entry
+	entry.Lock.Lock()
+	defer entry.Lock.Unlock()
+	err := entry.unspill()
+	if err != nil {
+		return 0, err
+	}
+	file, err := entry.loadFileForRead(c.ctx)
+	if err != nil {
+		return 0, err
+	}
+	c.applyRebase(file)
+	if c.pos < file.DataStartIdx() {
+		c.pos = file.DataStartIdx()
+	}
+	n, err := entry.readAtBuf(c.ctx, c.pos, p)
+	if err != nil {
+		return n, err
+	}
+	c.s.recordAccess(c.ctx, entry)
+	c.pos += int64(n)
+	return n, nil
+}
+
+// io.SeekEnd is relative to the current file size.  seeking past the end is allowed (Read returns io.EOF)
+func (c *FileCursor) Seek(offset int64, whence int) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, fs.ErrClosed
+	}
+	entry := c.entry
+	entry.Lock.Lock()
+	file, err := entry.loadFileForRead(c.ctx)
+	if err == nil {
+		c.applyRebase(file)
+	}
+	entry.Lock.Unlock()
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = c.pos + offset
+	case io.SeekEnd:
+		if err != nil {
+			return 0, err
+		}
+		newPos = file.Size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if newPos < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", newPos)
+	}
+	c.pos = newPos
+	return newPos, nil
+}
+
+// unpins the cache entry, safe to call more than once
+func (c *FileCursor) Close() error {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.closed = true
+		c.lock.Unlock()
+		c.s.unpinEntryAndTryDelete(c.entry.ZoneId, c.entry.Name)
+		c.s.unregisterHandle(c.handleKey, c.handleId)
+	})
+	return nil
+}
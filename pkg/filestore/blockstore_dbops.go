@@ -8,14 +8,19 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/sawka/txwrap"
 	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
 )
 
 // can return fs.ErrExist
-func dbInsertFile(ctx context.Context, file *WaveFile) error {
+func dbInsertFile(ctx context.Context, db *sqlx.DB, file *WaveFile) error {
 	// will fail if file already exists
-	return WithTx(ctx, func(tx *TxWrap) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
 		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
 		if tx.Exists(query, file.ZoneId, file.Name) {
 			return fs.ErrExist
@@ -26,9 +31,14 @@ func dbInsertFile(ctx context.Context, file *WaveFile) error {
 	})
 }
 
-func dbDeleteFile(ctx context.Context, zoneId string, name string) error {
-	return WithTx(ctx, func(tx *TxWrap) error {
-		query := "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
+// returns fs.ErrNotExist if the file does not exist
+func dbDeleteFile(ctx context.Context, db *sqlx.DB, zoneId string, name string) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		if !tx.Exists(query, zoneId, name) {
+			return fs.ErrNotExist
+		}
+		query = "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
 		tx.Exec(query, zoneId, name)
 		query = "DELETE FROM db_file_data WHERE zoneid = ? AND name = ?"
 		tx.Exec(query, zoneId, name)
@@ -36,8 +46,102 @@ func dbDeleteFile(ctx context.Context, zoneId string, name string) error {
 	})
 }
 
-func dbGetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
+// returns the keys that were deleted (files that no longer exist are skipped)
+func dbDeleteFiles(ctx context.Context, db *sqlx.DB, keys []cacheKey) ([]cacheKey, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]cacheKey, error) {
+		var deleted []cacheKey
+		for _, key := range keys {
+			query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+			if !tx.Exists(query, key.ZoneId, key.Name) {
+				continue
+			}
+			query = "DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?"
+			tx.Exec(query, key.ZoneId, key.Name)
+			query = "DELETE FROM db_file_data WHERE zoneid = ? AND name = ?"
+			tx.Exec(query, key.ZoneId, key.Name)
+			deleted = append(deleted, key)
+		}
+		return deleted, nil
+	})
+}
+
+// expectedNames must match the files in oldZoneId (sorted), otherwise the move fails (the zone changed underneath us)
+func dbMoveZone(ctx context.Context, db *sqlx.DB, oldZoneId string, newZoneId string, expectedNames []string) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ?"
+		if tx.Exists(query, newZoneId) {
+			return fs.ErrExist
+		}
+		query = "SELECT name FROM db_wave_file WHERE zoneid = ? ORDER BY name"
+		curNames := tx.SelectStrings(query, oldZoneId)
+		if !slices.Equal(curNames, expectedNames) {
+			return fmt.Errorf("files in zone %s changed during move", oldZoneId)
+		}
+		query = "UPDATE db_wave_file SET zoneid = ? WHERE zoneid = ?"
+		tx.Exec(query, newZoneId, oldZoneId)
+		query = "UPDATE db_file_data SET zoneid = ? WHERE zoneid = ?"
+		tx.Exec(query, newZoneId, oldZoneId)
+		return nil
+	})
+}
+
+// renames the file (and its data parts) within the zone and sets its meta.  if replace is set an existing
+// newName is deleted first, otherwise returns fs.ErrExist
+func dbRenameFile(ctx context.Context, db *sqlx.DB, zoneId string, oldName string, newName string, meta FileMeta, replace bool) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		if !tx.Exists(query, zoneId, oldName) {
+			return fs.ErrNotExist
+		}
+		if tx.Exists(query, zoneId, newName) {
+			if !replace {
+				return fs.ErrExist
+			}
+			tx.Exec("DELETE FROM db_wave_file WHERE zoneid = ? AND name = ?", zoneId, newName)
+			tx.Exec("DELETE FROM db_file_data WHERE zoneid = ? AND name = ?", zoneId, newName)
+		}
+		query = "UPDATE db_wave_file SET name = ?, meta = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, newName, dbutil.QuickJson(meta), zoneId, oldName)
+		query = "UPDATE db_file_data SET name = ? WHERE zoneid = ? AND name = ?"
+		tx.Exec(query, newName, zoneId, oldName)
+		return nil
+	})
+}
+
+// the files are swapped by renaming through a temporary name (so every column moves with its file), then the
+// meta is swapped back if swapMeta is false.  returns fs.ErrNotExist if either file does not exist
+func dbSwapFiles(ctx context.Context, db *sqlx.DB, zoneId string, nameA string, nameB string, swapMeta bool, modTs int64) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		var metas []string
+		query := "SELECT meta FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		for _, name := range []string{nameA, nameB} {
+			if !tx.Exists("SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?", zoneId, name) {
+				return fs.ErrNotExist
+			}
+			metas = append(metas, tx.GetString(query, zoneId, name))
+		}
+		tmpName := "~swap:" + nameA
+		renames := [][2]string{{nameA, tmpName}, {nameB, nameA}, {tmpName, nameB}}
+		for _, rename := range renames {
+			tx.Exec("UPDATE db_wave_file SET name = ? WHERE zoneid = ? AND name = ?", rename[1], zoneId, rename[0])
+			tx.Exec("UPDATE db_file_data SET name = ? WHERE zoneid = ? AND name = ?", rename[1], zoneId, rename[0])
+		}
+		// both files changed, so both get a version newer than either old version
+		query = "SELECT max(version) FROM db_wave_file WHERE zoneid = ? AND name IN (?, ?)"
+		newVersion := tx.GetInt64(query, zoneId, nameA, nameB) + 1
+		query = "UPDATE db_wave_file SET modts = ?, version = ? WHERE zoneid = ? AND name IN (?, ?)"
+		tx.Exec(query, modTs, newVersion, zoneId, nameA, nameB)
+		if !swapMeta {
+			query = "UPDATE db_wave_file SET meta = ? WHERE zoneid = ? AND name = ?"
+			tx.Exec(query, metas[0], zoneId, nameA)
+			tx.Exec(query, metas[1], zoneId, nameB)
+		}
+		return nil
+	})
+}
+
+func dbGetZoneFileNames(ctx context.Context, db *sqlx.DB, zoneId string) ([]string, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]string, error) {
 		var files []string
 		query := "SELECT name FROM db_wave_file WHERE zoneid = ?"
 		tx.Select(&files, query, zoneId)
@@ -45,16 +149,16 @@ func dbGetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
 	})
 }
 
-func dbGetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) (*WaveFile, error) {
+func dbGetZoneFile(ctx context.Context, db *sqlx.DB, zoneId string, name string) (*WaveFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (*WaveFile, error) {
 		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND name = ?"
 		file := dbutil.GetMappable[*WaveFile](tx, query, zoneId, name)
 		return file, nil
 	})
 }
 
-func dbGetAllZoneIds(ctx context.Context) ([]string, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) ([]string, error) {
+func dbGetAllZoneIds(ctx context.Context, db *sqlx.DB) ([]string, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]string, error) {
 		var ids []string
 		query := "SELECT DISTINCT zoneid FROM db_wave_file"
 		tx.Select(&ids, query)
@@ -62,14 +166,44 @@ func dbGetAllZoneIds(ctx context.Context) ([]string, error) {
 	})
 }
 
-func dbGetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+func dbGetZoneIdsPage(ctx context.Context, db *sqlx.DB, afterId string, limit int) ([]string, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]string, error) {
+		var ids []string
+		query := "SELECT DISTINCT zoneid FROM db_wave_file WHERE zoneid > ? ORDER BY zoneid LIMIT ?"
+		tx.Select(&ids, query, afterId, limit)
+		return ids, nil
+	})
+}
+
+func dbGetZoneIdsModifiedSince(ctx context.Context, db *sqlx.DB, since int64) ([]string, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]string, error) {
+		var ids []string
+		query := "SELECT zoneid FROM db_wave_file GROUP BY zoneid HAVING max(modts) >= ?"
+		tx.Select(&ids, query, since)
+		return ids, nil
+	})
+}
+
+func dbGetFileParts(ctx context.Context, db *sqlx.DB, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
 	if len(parts) == 0 {
 		return nil, nil
 	}
-	return WithTxRtn(ctx, func(tx *TxWrap) (map[int]*DataCacheEntry, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (map[int]*DataCacheEntry, error) {
 		var data []*DataCacheEntry
-		query := "SELECT partidx, data FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx IN (SELECT value FROM json_each(?))"
-		tx.Select(&data, query, zoneId, name, dbutil.QuickJsonArr(parts))
+		// always a single query, contiguous parts (sequential reads) use a range scan of the primary key
+		if firstPart, lastPart, ok := contiguousPartRange(parts); ok {
+			query := "SELECT partidx, data FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx BETWEEN ? AND ?"
+			tx.Select(&data, query, zoneId, name, firstPart, lastPart)
+		} else {
+			query := "SELECT partidx, data FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx IN (SELECT value FROM json_each(?))"
+			tx.Select(&data, query, zoneId, name, dbutil.QuickJsonArr(parts))
+		}
+		partReadQueries.Add(1)
+		if slices.Contains(parts, 0) {
+			if inlineData := getInlineData(tx, zoneId, name); inlineData != nil {
+				data = append(data, &DataCacheEntry{PartIdx: 0, Data: inlineData})
+			}
+		}
 		rtn := make(map[int]*DataCacheEntry)
 		for _, d := range data {
 			if cap(d.Data) != int(partDataSize) {
@@ -77,41 +211,404 @@ func dbGetFileParts(ctx context.Context, zoneId string, name string, parts []int
 				copy(newData, d.Data)
 				d.Data = newData
 			}
+			d.FromDB = true
+			d.DBLen = int64(len(d.Data))
 			rtn[d.PartIdx] = d
 		}
 		return rtn, nil
 	})
 }
 
-func dbGetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
-	return WithTxRtn(ctx, func(tx *TxWrap) ([]*WaveFile, error) {
+// returns (first, last, true) if parts (in any order, no duplicates) is every part index from first to last
+func contiguousPartRange(parts []int) (int, int, bool) {
+	firstPart, lastPart := slices.Min(parts), slices.Max(parts)
+	return firstPart, lastPart, lastPart-firstPart+1 == len(parts)
+}
+
+// returns partidx => length of the stored data (without reading the data)
+func dbGetPartSizes(ctx context.Context, db *sqlx.DB, zoneId string, name string) (map[int]int, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (map[int]int, error) {
+		var rows []struct {
+			PartIdx int `db:"partidx"`
+			Size    int `db:"size"`
+		}
+		query := "SELECT partidx, length(data) AS size FROM db_file_data WHERE zoneid = ? AND name = ?"
+		tx.Select(&rows, query, zoneId, name)
+		rtn := make(map[int]int)
+		for _, row := range rows {
+			rtn[row.PartIdx] = row.Size
+		}
+		query = "SELECT length(inlinedata) FROM db_wave_file WHERE zoneid = ? AND name = ? AND inlinedata IS NOT NULL"
+		var inlineSize int
+		if tx.Get(&inlineSize, query, zoneId, name) {
+			rtn[0] = inlineSize
+		}
+		return rtn, nil
+	})
+}
+
+func dbGetZoneFilesByName(ctx context.Context, db *sqlx.DB, zoneId string, names []string) ([]*WaveFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := "SELECT * FROM db_wave_file WHERE zoneid = ? AND name IN (SELECT value FROM json_each(?))"
+		files := dbutil.SelectMappable[*WaveFile](tx, query, zoneId, dbutil.QuickJsonArr(names))
+		return files, nil
+	})
+}
+
+// fetches the given parts (name => partidxs) of several files in the zone with a single query
+// returns name => partidx => part, parts that are not in the DB are left out
+func dbGetZoneFilesParts(ctx context.Context, db *sqlx.DB, zoneId string, parts map[string][]int) (map[string]map[int]*DataCacheEntry, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	var keys [][]any
+	for name, partIdxs := range parts {
+		for _, partIdx := range partIdxs {
+			keys = append(keys, []any{name, partIdx})
+		}
+	}
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (map[string]map[int]*DataCacheEntry, error) {
+		var rows []struct {
+			Name    string `db:"name"`
+			PartIdx int    `db:"partidx"`
+			Data    []byte `db:"data"`
+		}
+		query := `SELECT name, partidx, data FROM db_file_data WHERE zoneid = ? AND (name, partidx) IN
+		            (SELECT json_extract(value, '$[0]'), json_extract(value, '$[1]') FROM json_each(?))`
+		tx.Select(&rows, query, zoneId, dbutil.QuickJsonArr(keys))
+		for name, partIdxs := range parts {
+			if !slices.Contains(partIdxs, 0) {
+				continue
+			}
+			if inlineData := getInlineData(tx, zoneId, name); inlineData != nil {
+				rows = append(rows, struct {
+					Name    string `db:"name"`
+					PartIdx int    `db:"partidx"`
+					Data    []byte `db:"data"`
+				}{Name: name, PartIdx: 0, Data: inlineData})
+			}
+		}
+		rtn := make(map[string]map[int]*DataCacheEntry)
+		for _, row := range rows {
+			if rtn[row.Name] == nil {
+				rtn[row.Name] = make(map[int]*DataCacheEntry)
+			}
+			data := row.Data
+			if cap(data) != int(partDataSize) {
+				data = make([]byte, len(row.Data), partDataSize)
+				copy(data, row.Data)
+			}
+			rtn[row.Name][row.PartIdx] = &DataCacheEntry{PartIdx: row.PartIdx, Data: data, FromDB: true, DBLen: int64(len(data))}
+		}
+		return rtn, nil
+	})
+}
+
+// small files (see canStoreInline) keep their data in db_wave_file.inlinedata instead of a db_file_data row.
+// the inline data is always part 0, the read helpers above return it as part 0 so callers can't tell the difference
+func canStoreInline(file *WaveFile, dataEntries map[int]*DataCacheEntry) bool {
+	if file.Size <= 0 || file.Size > min(InlineDataThreshold, partDataSize) {
+		return false
+	}
+	if file.Opts.Circular || file.StartOffset > 0 {
+		return false
+	}
+	for partIdx := range dataEntries {
+		if partIdx != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// returns nil if the file's data is not stored inline
+func getInlineData(tx *TxWrap, zoneId string, name string) []byte {
+	query := "SELECT inlinedata FROM db_wave_file WHERE zoneid = ? AND name = ? AND inlinedata IS NOT NULL"
+	return tx.GetByteArr(query, zoneId, name)
+}
+
+// reads only the meta column, returns fs.ErrNotExist if the file does not exist
+func dbGetFileMeta(ctx context.Context, db *sqlx.DB, zoneId string, name string) (FileMeta, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (FileMeta, error) {
+		query := "SELECT meta FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		m := tx.GetMap(query, zoneId, name)
+		if m == nil {
+			return nil, fs.ErrNotExist
+		}
+		meta := make(FileMeta)
+		dbutil.QuickSetJson(&meta, m, "meta")
+		return meta, nil
+	})
+}
+
+// only updates the meta column (size/modts are left for the full flush since they must match the flushed data parts)
+func dbWriteFileMeta(ctx context.Context, db *sqlx.DB, zoneId string, name string, meta FileMeta) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		query := `UPDATE db_wave_file SET meta = ? WHERE zoneid = ? AND name = ?`
+		tx.Exec(query, dbutil.QuickJson(meta), zoneId, name)
+		return nil
+	})
+}
+
+// returns up to limit files ordered by (zoneid, name), starting after (afterZoneId, afterName) (keyset paging)
+func dbGetFilesPage(ctx context.Context, db *sqlx.DB, afterZoneId string, afterName string, limit int) ([]*WaveFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := "SELECT * FROM db_wave_file WHERE zoneid > ? OR (zoneid = ? AND name > ?) ORDER BY zoneid, name LIMIT ?"
+		files := dbutil.SelectMappable[*WaveFile](tx, query, afterZoneId, afterZoneId, afterName, limit)
+		return files, nil
+	})
+}
+
+// access times only move forward, missing files are ignored
+func dbWriteAccessTimes(ctx context.Context, db *sqlx.DB, accessTimes map[FileKey]int64) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		// the createdts check skips files that were deleted and re-created after the access
+		query := "UPDATE db_wave_file SET accessts = ? WHERE zoneid = ? AND name = ? AND accessts < ? AND createdts <= ?"
+		for key, accessTs := range accessTimes {
+			tx.Exec(query, accessTs, key.ZoneId, key.Name, accessTs, accessTs)
+		}
+		return nil
+	})
+}
+
+// returns the files (in all zones) whose name starts with namePrefix
+func dbGetFilesWithNamePrefix(ctx context.Context, db *sqlx.DB, namePrefix string) ([]*WaveFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := `SELECT * FROM db_wave_file WHERE name LIKE ? ESCAPE '\' ORDER BY zoneid, name`
+		files := dbutil.SelectMappable[*WaveFile](tx, query, likeEscaper.Replace(namePrefix)+"%")
+		return files, nil
+	})
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func dbGetZoneFiles(ctx context.Context, db *sqlx.DB, zoneId string) ([]*WaveFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]*WaveFile, error) {
 		query := "SELECT * FROM db_wave_file WHERE zoneid = ?"
 		files := dbutil.SelectMappable[*WaveFile](tx, query, zoneId)
 		return files, nil
 	})
 }
 
-func dbWriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool) error {
-	return WithTx(ctx, func(tx *TxWrap) error {
-		query := `SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?`
-		if !tx.Exists(query, file.ZoneId, file.Name) {
+// whole parts are written with multi-row REPLACE statements of up to batch.MaxParts parts and batch.MaxBytes bytes
+// (fewer round trips than one statement per part, without building one giant statement for huge files)
+// returns the number of part bytes written
+func dbWriteCacheEntry(ctx context.Context, db *sqlx.DB, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (int64, error) {
+		query := `SELECT * FROM db_wave_file WHERE zoneid = ? AND name = ?`
+		dbFile := dbutil.GetMappable[*WaveFile](tx, query, file.ZoneId, file.Name)
+		if dbFile == nil {
 			// since deletion is synchronous this stops us from writing to a deleted file
-			return os.ErrNotExist
+			return 0, os.ErrNotExist
+		}
+		// a different row (deleted and recreated) or different opts, the cached offsets may not apply to it.
+		// replace writes the opts, so only the row is checked
+		if dbFile.CreatedTs != file.CreatedTs || (!replace && dbFile.Opts != file.Opts) {
+			return 0, fmt.Errorf("%w: %s:%s", ErrFileChanged, file.ZoneId, file.Name)
+		}
+		var bytesWritten int64
+		// we don't update CreatedTs, Opts are only updated when the whole file is replaced
+		query = `UPDATE db_wave_file SET size = ?, modts = ?, accessts = MAX(accessts, ?), startoffset = ?, version = ?, meta = ? WHERE zoneid = ? AND name = ?`
+		tx.Exec(query, file.Size, file.ModTs, file.AccessTs, file.StartOffset, file.Version, dbutil.QuickJson(file.Meta), file.ZoneId, file.Name)
+		inlineData := getInlineData(tx, file.ZoneId, file.Name)
+		if inlineData != nil && !canStoreInline(file, dataEntries) {
+			// the file outgrew inline storage, move the data to part 0 (before the parts are trimmed/written as usual)
+			query = `REPLACE INTO db_file_data (zoneid, name, partidx, data, checksum) VALUES (?, ?, 0, ?, ?)`
+			tx.Exec(query, file.ZoneId, file.Name, inlineData, partChecksum(inlineData))
+			query = `UPDATE db_wave_file SET inlinedata = NULL WHERE zoneid = ? AND name = ?`
+			tx.Exec(query, file.ZoneId, file.Name)
+		}
+		if file.StartOffset > 0 {
+			// trimfront files, remove the parts that have been trimmed
+			query = `DELETE FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx < ?`
+			tx.Exec(query, file.ZoneId, file.Name, file.StartOffset/partDataSize)
+		}
+		if !file.Opts.Circular {
+			// parts past the end of the file (left by a rolled back append, see rollbackAppend)
+			query = `DELETE FROM db_file_data WHERE zoneid = ? AND name = ? AND partidx > ?`
+			tx.Exec(query, file.ZoneId, file.Name, file.lastPartIdx())
 		}
-		// we don't update CreatedTs or Opts
-		query = `UPDATE db_wave_file SET size = ?, modts = ?, meta = ? WHERE zoneid = ? AND name = ?`
-		tx.Exec(query, file.Size, file.ModTs, dbutil.QuickJson(file.Meta), file.ZoneId, file.Name)
 		if replace {
+			query = `UPDATE db_wave_file SET opts = ?, inlinedata = NULL WHERE zoneid = ? AND name = ?`
+			tx.Exec(query, dbutil.QuickJson(file.Opts), file.ZoneId, file.Name)
 			query = `DELETE FROM db_file_data WHERE zoneid = ? AND name = ?`
 			tx.Exec(query, file.ZoneId, file.Name)
 		}
-		dataPartQuery := `REPLACE INTO db_file_data (zoneid, name, partidx, data) VALUES (?, ?, ?, ?)`
+		if canStoreInline(file, dataEntries) {
+			if part0 := dataEntries[0]; part0 != nil {
+				query = `UPDATE db_wave_file SET inlinedata = ? WHERE zoneid = ? AND name = ?`
+				tx.Exec(query, part0.Data, file.ZoneId, file.Name)
+				query = `DELETE FROM db_file_data WHERE zoneid = ? AND name = ?`
+				tx.Exec(query, file.ZoneId, file.Name)
+				bytesWritten += int64(len(part0.Data))
+			}
+			updateFileChecksum(tx, file.ZoneId, file.Name)
+			partBytesWritten.Add(bytesWritten)
+			return bytesWritten, nil
+		}
+		// sqlite has no blob splice, || returns text so we need to cast back to a blob
+		patchPartQuery := `UPDATE db_file_data SET data = CAST(substr(data, 1, ?) || ? || substr(data, ?) AS BLOB), checksum = ? WHERE zoneid = ? AND name = ? AND partidx = ?`
+		var fullParts []*DataCacheEntry
 		for partIdx, dataEntry := range dataEntries {
 			if partIdx != dataEntry.PartIdx {
 				panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
 			}
-			tx.Exec(dataPartQuery, file.ZoneId, file.Name, dataEntry.PartIdx, dataEntry.Data)
+			if !replace && dataEntry.canPatch() {
+				if dataEntry.DirtyEnd <= dataEntry.DirtyStart {
+					// loaded from the DB but never modified
+					continue
+				}
+				dirtyData := dataEntry.Data[dataEntry.DirtyStart:dataEntry.DirtyEnd]
+				// cached parts always hold the whole part, so the checksum can be computed without reading the DB
+				tx.Exec(patchPartQuery, dataEntry.DirtyStart, dirtyData, dataEntry.DirtyEnd+1, partChecksum(dataEntry.Data), file.ZoneId, file.Name, dataEntry.PartIdx)
+				bytesWritten += int64(len(dirtyData))
+				continue
+			}
+			fullParts = append(fullParts, dataEntry)
+		}
+		sort.Slice(fullParts, func(i, j int) bool {
+			return fullParts[i].PartIdx < fullParts[j].PartIdx
+		})
+		for len(fullParts) > 0 {
+			batchParts := fullParts[:batch.numParts(fullParts)]
+			fullParts = fullParts[len(batchParts):]
+			query = `REPLACE INTO db_file_data (zoneid, name, partidx, data, checksum) VALUES ` + strings.Repeat("(?, ?, ?, ?, ?), ", len(batchParts)-1) + "(?, ?, ?, ?, ?)"
+			args := make([]any, 0, len(batchParts)*5)
+			for _, dataEntry := range batchParts {
+				args = append(args, file.ZoneId, file.Name, dataEntry.PartIdx, dataEntry.Data, partChecksum(dataEntry.Data))
+				bytesWritten += int64(len(dataEntry.Data))
+			}
+			tx.Exec(query, args...)
+			partWriteStatements.Add(1)
+		}
+		updateFileChecksum(tx, file.ZoneId, file.Name)
+		partBytesWritten.Add(bytesWritten)
+		return bytesWritten, nil
+	})
+}
+
+// backfills missing part checksums (parts written before checksums were tracked) and then stores the
+// rolled-up file checksum.  only the part checksums are read, not the part data (except for backfills)
+func updateFileChecksum(tx *TxWrap, zoneId string, name string) {
+	var missing []*DataCacheEntry
+	query := "SELECT partidx, data FROM db_file_data WHERE zoneid = ? AND name = ? AND checksum IS NULL"
+	tx.Select(&missing, query, zoneId, name)
+	for _, part := range missing {
+		query = "UPDATE db_file_data SET checksum = ? WHERE zoneid = ? AND name = ? AND partidx = ?"
+		tx.Exec(query, partChecksum(part.Data), zoneId, name, part.PartIdx)
+	}
+	var checksums [][]byte
+	query = "SELECT checksum FROM db_file_data WHERE zoneid = ? AND name = ? ORDER BY partidx"
+	tx.Select(&checksums, query, zoneId, name)
+	if inlineData := getInlineData(tx, zoneId, name); inlineData != nil {
+		checksums = [][]byte{partChecksum(inlineData)}
+	}
+	query = "UPDATE db_wave_file SET checksum = ? WHERE zoneid = ? AND name = ?"
+	tx.Exec(query, rollupChecksums(checksums), zoneId, name)
+}
+
+// returns the stored file checksum, nil if the file has not been flushed since checksums were tracked
+func dbGetFileChecksum(ctx context.Context, db *sqlx.DB, zoneId string, name string) ([]byte, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]byte, error) {
+		query := "SELECT zoneid FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		if !tx.Exists(query, zoneId, name) {
+			return nil, fs.ErrNotExist
+		}
+		query = "SELECT checksum FROM db_wave_file WHERE zoneid = ? AND name = ?"
+		return tx.GetByteArr(query, zoneId, name), nil
+	})
+}
+
+// returns partidx => stored checksum (nil for parts written before checksums were tracked)
+func dbGetPartChecksums(ctx context.Context, db *sqlx.DB, zoneId string, name string) (map[int][]byte, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) (map[int][]byte, error) {
+		var rows []struct {
+			PartIdx  int    `db:"partidx"`
+			Checksum []byte `db:"checksum"`
+		}
+		query := "SELECT partidx, checksum FROM db_file_data WHERE zoneid = ? AND name = ?"
+		tx.Select(&rows, query, zoneId, name)
+		rtn := make(map[int][]byte)
+		for _, row := range rows {
+			rtn[row.PartIdx] = row.Checksum
+		}
+		if inlineData := getInlineData(tx, zoneId, name); inlineData != nil {
+			// inline data has no stored part checksum, it is small enough to hash on every call
+			rtn[0] = partChecksum(inlineData)
+		}
+		return rtn, nil
+	})
+}
+
+// fsck queries (see Fsck)
+const orphanPartsWhere = "NOT EXISTS (SELECT 1 FROM db_wave_file f WHERE f.zoneid = d.zoneid AND f.name = d.name)"
+
+func dbGetOrphanParts(ctx context.Context, db *sqlx.DB) ([]FsckFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]FsckFile, error) {
+		var rows []struct {
+			ZoneId   string `db:"zoneid"`
+			Name     string `db:"name"`
+			NumParts int    `db:"numparts"`
+		}
+		query := "SELECT d.zoneid, d.name, count(*) AS numparts FROM db_file_data d WHERE " + orphanPartsWhere + " GROUP BY d.zoneid, d.name ORDER BY d.zoneid, d.name"
+		tx.Select(&rows, query)
+		var rtn []FsckFile
+		for _, row := range rows {
+			rtn = append(rtn, FsckFile{ZoneId: row.ZoneId, Name: row.Name, NumParts: row.NumParts})
 		}
+		return rtn, nil
+	})
+}
+
+func dbDeleteOrphanParts(ctx context.Context, db *sqlx.DB) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		tx.Exec("DELETE FROM db_file_data AS d WHERE " + orphanPartsWhere)
 		return nil
 	})
 }
+
+func dbGetFilesWithoutParts(ctx context.Context, db *sqlx.DB) ([]*WaveFile, error) {
+	return txwrap.WithTxRtn(ctx, db, func(tx *TxWrap) ([]*WaveFile, error) {
+		query := `SELECT * FROM db_wave_file f WHERE size > 0 AND inlinedata IS NULL AND
+		            NOT EXISTS (SELECT 1 FROM db_file_data d WHERE d.zoneid = f.zoneid AND d.name = f.name) ORDER BY zoneid, name`
+		return dbutil.SelectMappable[*WaveFile](tx, query), nil
+	})
+}
+
+// only resets the file if it still has the given size and still has no parts
+func dbResetPhantomFile(ctx context.Context, db *sqlx.DB, zoneId string, name string, size int64) error {
+	return txwrap.WithTx(ctx, db, func(tx *TxWrap) error {
+		query := "SELECT zoneid FROM db_file_data WHERE zoneid = ? AND name = ?"
+		if tx.Exists(query, zoneId, name) {
+			return nil
+		}
+		query = "UPDATE db_wave_file SET size = 0, startoffset = 0, checksum = NULL WHERE zoneid = ? AND name = ? AND size = ? AND inlinedata IS NULL"
+		tx.Exec(query, zoneId, name, size)
+		return nil
+	})
+}
+
+// returns the size of the DB (page_count * page_size)
+func dbGetSize(ctx context.Context, db *sqlx.DB) (int64, error) {
+	var pageCount, pageSize int64
+	err := db.GetContext(ctx, &pageCount, "PRAGMA page_count")
+	if err != nil {
+		return 0, err
+	}
+	err = db.GetContext(ctx, &pageSize, "PRAGMA page_size")
+	if err != nil {
+		return 0, err
+	}
+	return pageCount * pageSize, nil
+}
+
+// VACUUM can't run inside of a transaction, so this does not use txwrap
+func dbVacuum(ctx context.Context, db *sqlx.DB) error {
+	_, err := db.ExecContext(ctx, "VACUUM")
+	if err != nil {
+		return err
+	}
+	// with WAL journaling the vacuumed pages go through the WAL, truncate it so the space is actually returned
+	_, err = db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
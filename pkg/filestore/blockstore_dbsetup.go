@@ -38,17 +38,31 @@ func InitFilestore() error {
 	if err != nil {
 		return err
 	}
-	err = migrateutil.Migrate("filestore", globalDB.DB, dbfs.FilestoreMigrationFS, "migrations-filestore")
+	err = MigrateDB(globalDB)
 	if err != nil {
 		return err
 	}
-	if !stopFlush.Load() {
-		go WFS.runFlusher()
-	}
+	WFS.StartBackground()
 	log.Printf("filestore initialized\n")
 	return nil
 }
 
+// runs the filestore migrations, for DBs passed to NewFileStore (InitFilestore migrates the global DB)
+func MigrateDB(db *sqlx.DB) error {
+	return migrateutil.Migrate("filestore", db.DB, dbfs.FilestoreMigrationFS, "migrations-filestore")
+}
+
+// starts the background flusher, spiller, tombstone sweeper and pin auditor for the store (InitFilestore starts them for WFS)
+func (s *FileStore) StartBackground() {
+	if stopFlush.Load() {
+		return
+	}
+	go s.runFlusher()
+	go s.runSpiller()
+	go s.runTombstoneSweeper()
+	go s.runPinAuditor()
+}
+
 func GetDBName() string {
 	waveHome := wavebase.GetWaveDataDir()
 	return filepath.Join(waveHome, wavebase.WaveDBDir, FilestoreDBName)
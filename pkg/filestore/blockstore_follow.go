@@ -0,0 +1,96 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// FollowReader reads a file like `tail -f`: at the end of the file, Read blocks until more data is written
+// (it is woken by the same notifications as Observers, so every write path is covered).  Read returns an error
+// once ctx is canceled or the file is deleted, and io.EOF once Close has been called.  reading starts at the
+// beginning of the data (DataStartIdx), for circular files data overwritten before it was read is skipped.
+type FollowReader struct {
+	ctx       context.Context
+	cursor    *FileCursor
+	key       cacheKey
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+var _ io.ReadCloser = (*FollowReader)(nil)
+
+// returns fs.ErrNotExist if the file does not exist, the caller must Close the reader
+// the reader counts against MaxOpenReaders (see OpenCursor)
+func (s *FileStore) FollowReader(ctx context.Context, zoneId string, name string) (*FollowReader, error) {
+	cursor, err := s.openCursor(ctx, zoneId, name, HandleKind_Follow)
+	if err != nil {
+		return nil, err
+	}
+	return &FollowReader{
+		ctx:     ctx,
+		cursor:  cursor,
+		key:     cacheKey{ZoneId: zoneId, Name: name},
+		closeCh: make(chan struct{}),
+	}, nil
+}
+
+func (r *FollowReader) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-r.closeCh:
+			return 0, io.EOF
+		default:
+		}
+		// get the wait channel before reading so a write between the read and the wait is not missed
+		waitCh := r.cursor.s.getWriteWaitCh(r.key)
+		n, err := r.cursor.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		select {
+		case <-waitCh:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		case <-r.closeCh:
+			return 0, io.EOF
+		}
+	}
+}
+
+// ends the follow (a blocked Read returns io.EOF), safe to call more than once
+func (r *FollowReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeCh)
+		r.cursor.Close()
+	})
+	return nil
+}
+
+// the returned channel is closed on the next write to (or delete of) the file
+func (s *FileStore) getWriteWaitCh(key cacheKey) chan struct{} {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.writeWaiters == nil {
+		s.writeWaiters = make(map[cacheKey]chan struct{})
+	}
+	ch := s.writeWaiters[key]
+	if ch == nil {
+		ch = make(chan struct{})
+		s.writeWaiters[key] = ch
+	}
+	return ch
+}
+
+func (s *FileStore) signalWriteWaiters(zoneId string, name string) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	key := cacheKey{ZoneId: zoneId, Name: name}
+	if ch := s.writeWaiters[key]; ch != nil {
+		close(ch)
+		delete(s.writeWaiters, key)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+)
+
+type FsckFile struct {
+	ZoneId   string
+	Name     string
+	NumParts int   // orphans, number of parts left behind
+	Size     int64 // phantoms, the size recorded in the file row
+}
+
+// returned by Fsck
+// OrphanFiles are (zoneid, name) pairs that have parts but no file row, PhantomFiles are files whose row
+// has data (DataLength > 0) but no parts.  Repaired is set if repair was requested and succeeded
+// (phantom files with un-flushed cache changes are never repaired, the next flush rewrites them)
+type FsckReport struct {
+	OrphanFiles  []FsckFile
+	PhantomFiles []FsckFile
+	Repaired     bool
+}
+
+func (r FsckReport) Clean() bool {
+	return len(r.OrphanFiles) == 0 && len(r.PhantomFiles) == 0
+}
+
+// scans the DB for leftovers from a crash (see FsckReport), with repair=false nothing is modified
+// repairs delete the orphan parts and reset phantom files to empty.  each repair re-checks its condition
+// in the same transaction, so it is safe to run while the store is in use (but it is meant for startup)
+func (s *FileStore) Fsck(ctx context.Context, repair bool) (FsckReport, error) {
+	var report FsckReport
+	orphans, err := s.backend().GetOrphanParts(ctx)
+	if err != nil {
+		return report, fmt.Errorf("error scanning for orphan parts: %w", err)
+	}
+	report.OrphanFiles = orphans
+	phantoms, err := s.backend().GetFilesWithoutParts(ctx)
+	if err != nil {
+		return report, fmt.Errorf("error scanning for phantom files: %w", err)
+	}
+	for _, file := range phantoms {
+		if file.DataLength() > 0 {
+			report.PhantomFiles = append(report.PhantomFiles, FsckFile{ZoneId: file.ZoneId, Name: file.Name, Size: file.Size})
+		}
+	}
+	if !repair {
+		return report, nil
+	}
+	if len(report.OrphanFiles) > 0 {
+		err = s.backend().DeleteOrphanParts(ctx)
+		if err != nil {
+			return report, fmt.Errorf("error deleting orphan parts: %w", err)
+		}
+	}
+	for _, phantom := range report.PhantomFiles {
+		err = withLock(s, phantom.ZoneId, phantom.Name, func(entry *CacheEntry) error {
+			if entry.DirtyGen != 0 {
+				return nil
+			}
+			s.dropReadRegion(cacheKey{ZoneId: phantom.ZoneId, Name: phantom.Name})
+			return s.backend().ResetPhantomFile(ctx, phantom.ZoneId, phantom.Name, phantom.Size)
+		})
+		if err != nil {
+			return report, fmt.Errorf("error repairing file %s:%s: %w", phantom.ZoneId, phantom.Name, err)
+		}
+	}
+	report.Repaired = true
+	return report, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// hybrid storage (see HybridBackend)
+// file rows, small parts and all metadata stay in the wrapped backend (normally the DB), parts larger than
+// Threshold are stored in a BlobStore keyed by the SHA-256 of their data.  the wrapped backend stores a fixed
+// size blob ref in place of the part data (blobRefPrefix + hash + size), the hybrid backend swaps refs for the
+// blob data on read and part data for refs on write.  part data that happens to start with blobRefPrefix is
+// always stored as a blob, so anything in the wrapped backend that starts with the prefix is a ref.
+// parts loaded from a blob are not patchable (FromDB is false), so any change rewrites the whole part as a new blob.
+// checksums and part sizes are reported for the blob data (the hash in the ref is the part checksum).
+// blobs are content-addressed and may be shared between parts and files, so they are never deleted here.
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+type BlobStore interface {
+	// stores data under hash (the hex SHA-256 of data), storing an existing hash again is a no-op
+	PutBlob(ctx context.Context, hash string, data []byte) error
+	// returns an error wrapping ErrBlobNotFound if there is no blob for hash
+	GetBlob(ctx context.Context, hash string) ([]byte, error)
+}
+
+type HybridBackend struct {
+	Backend             // file rows, metadata and small parts
+	Blobs     BlobStore // parts larger than Threshold
+	Threshold int
+}
+
+// refs must fit in a part (44 bytes)
+const blobRefPrefix = "\x00wfblob\x00"
+const blobRefLen = len(blobRefPrefix) + sha256.Size + 4
+
+type blobRef struct {
+	hash []byte
+	size int
+}
+
+func makeBlobRef(data []byte) ([]byte, blobRef) {
+	ref := blobRef{hash: partChecksum(data), size: len(data)}
+	rtn := make([]byte, 0, blobRefLen)
+	rtn = append(rtn, blobRefPrefix...)
+	rtn = append(rtn, ref.hash...)
+	rtn = binary.BigEndian.AppendUint32(rtn, uint32(ref.size))
+	return rtn, ref
+}
+
+func parseBlobRef(data []byte) (blobRef, bool) {
+	if len(data) != blobRefLen || !bytes.HasPrefix(data, []byte(blobRefPrefix)) {
+		return blobRef{}, false
+	}
+	hash := data[len(blobRefPrefix) : len(blobRefPrefix)+sha256.Size]
+	size := binary.BigEndian.Uint32(data[len(blobRefPrefix)+sha256.Size:])
+	return blobRef{hash: bytes.Clone(hash), size: int(size)}, true
+}
+
+func (ref blobRef) key() string {
+	return hex.EncodeToString(ref.hash)
+}
+
+func (b *HybridBackend) isExternal(data []byte) bool {
+	return len(data) > b.Threshold || bytes.HasPrefix(data, []byte(blobRefPrefix))
+}
+
+// swaps blob refs in parts for the blob data (in place)
+func (b *HybridBackend) resolveParts(ctx context.Context, parts map[int]*DataCacheEntry) error {
+	for partIdx, dce := range parts {
+		ref, ok := parseBlobRef(dce.Data)
+		if !ok {
+			continue
+		}
+		blobData, err := b.Blobs.GetBlob(ctx, ref.key())
+		if err != nil {
+			return fmt.Errorf("error getting blob for part %d: %w", partIdx, err)
+		}
+		if len(blobData) != ref.size || !bytes.Equal(partChecksum(blobData), ref.hash) {
+			return fmt.Errorf("%w: blob %s for part %d", ErrChecksumMismatch, ref.key(), partIdx)
+		}
+		data := make([]byte, len(blobData), max(int64(len(blobData)), partDataSize))
+		copy(data, blobData)
+		dce.Data = data
+		dce.FromDB = false
+		dce.DBLen = 0
+	}
+	return nil
+}
+
+// returns partidx => blob ref for the file's externally stored parts.  refs have a fixed size, so only the
+// parts with that size are read from the wrapped backend
+func (b *HybridBackend) getBlobRefs(ctx context.Context, zoneId string, name string) (map[int]blobRef, error) {
+	sizes, err := b.Backend.GetPartSizes(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []int
+	for partIdx, size := range sizes {
+		if size == blobRefLen {
+			candidates = append(candidates, partIdx)
+		}
+	}
+	parts, err := b.Backend.GetFileParts(ctx, zoneId, name, candidates)
+	if err != nil {
+		return nil, err
+	}
+	rtn := make(map[int]blobRef)
+	for partIdx, dce := range parts {
+		if ref, ok := parseBlobRef(dce.Data); ok {
+			rtn[partIdx] = ref
+		}
+	}
+	return rtn, nil
+}
+
+func (b *HybridBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	rtn, err := b.Backend.GetFileParts(ctx, zoneId, name, parts)
+	if err != nil {
+		return nil, err
+	}
+	err = b.resolveParts(ctx, rtn)
+	if err != nil {
+		return nil, fmt.Errorf("file %s:%s: %w", zoneId, name, err)
+	}
+	return rtn, nil
+}
+
+func (b *HybridBackend) GetZoneFilesParts(ctx context.Context, zoneId string, parts map[string][]int) (map[string]map[int]*DataCacheEntry, error) {
+	rtn, err := b.Backend.GetZoneFilesParts(ctx, zoneId, parts)
+	if err != nil {
+		return nil, err
+	}
+	for name, fileParts := range rtn {
+		err = b.resolveParts(ctx, fileParts)
+		if err != nil {
+			return nil, fmt.Errorf("file %s:%s: %w", zoneId, name, err)
+		}
+	}
+	return rtn, nil
+}
+
+func (b *HybridBackend) GetPartSizes(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	sizes, err := b.Backend.GetPartSizes(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := b.getBlobRefs(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	for partIdx, ref := range refs {
+		sizes[partIdx] = ref.size
+	}
+	return sizes, nil
+}
+
+// the blob data is never patched, parts that are (or were) stored as blobs are always written whole
+func (b *HybridBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	var blobBytes int64
+	backendEntries := make(map[int]*DataCacheEntry, len(dataEntries))
+	for partIdx, dce := range dataEntries {
+		if !b.isExternal(dce.Data) || (dce.canPatch() && dce.DirtyEnd <= dce.DirtyStart) {
+			// small parts, and parts stored in the wrapped backend (before the hybrid backend was used) that were
+			// never modified, are left to the wrapped backend
+			backendEntries[partIdx] = dce
+			continue
+		}
+		refData, ref := makeBlobRef(dce.Data)
+		err := b.Blobs.PutBlob(ctx, ref.key(), dce.Data)
+		if err != nil {
+			return 0, fmt.Errorf("error storing blob for %s:%s part %d: %w", file.ZoneId, file.Name, partIdx, err)
+		}
+		blobBytes += int64(len(dce.Data))
+		backendEntries[partIdx] = &DataCacheEntry{PartIdx: partIdx, Data: refData}
+	}
+	bytesWritten, err := b.Backend.WriteCacheEntry(ctx, file, backendEntries, replace, batch)
+	return bytesWritten + blobBytes, err
+}
+
+func (b *HybridBackend) GetPartChecksums(ctx context.Context, zoneId string, name string) (map[int][]byte, error) {
+	checksums, err := b.Backend.GetPartChecksums(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := b.getBlobRefs(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	for partIdx, ref := range refs {
+		checksums[partIdx] = ref.hash
+	}
+	return checksums, nil
+}
+
+// the wrapped backend's rollup covers the refs, so for files with blobs it is recomputed from the part checksums
+func (b *HybridBackend) GetFileChecksum(ctx context.Context, zoneId string, name string) ([]byte, error) {
+	stored, err := b.Backend.GetFileChecksum(ctx, zoneId, name)
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	refs, err := b.getBlobRefs(ctx, zoneId, name)
+	if err != nil || len(refs) == 0 {
+		return stored, err
+	}
+	checksums, err := b.Backend.GetPartChecksums(ctx, zoneId, name)
+	if err != nil {
+		return nil, err
+	}
+	for partIdx, ref := range refs {
+		checksums[partIdx] = ref.hash
+	}
+	partIdxs := make([]int, 0, len(checksums))
+	for partIdx := range checksums {
+		partIdxs = append(partIdxs, partIdx)
+	}
+	sort.Ints(partIdxs)
+	rollup := make([][]byte, 0, len(partIdxs))
+	for _, partIdx := range partIdxs {
+		rollup = append(rollup, checksums[partIdx])
+	}
+	return rollupChecksums(rollup), nil
+}
+
+// a BlobStore that keeps each blob in its own file, Dir/<hash[:2]>/<hash>
+type DirBlobStore struct {
+	Dir string
+}
+
+func (d DirBlobStore) blobPath(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(d.Dir, hash)
+	}
+	return filepath.Join(d.Dir, hash[:2], hash)
+}
+
+func (d DirBlobStore) PutBlob(ctx context.Context, hash string, data []byte) error {
+	blobPath := d.blobPath(hash)
+	if _, err := os.Stat(blobPath); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(blobPath), 0700)
+	if err != nil {
+		return err
+	}
+	// write to a temp file and rename, so a partially written blob is never visible under its hash
+	tmpFile, err := os.CreateTemp(filepath.Dir(blobPath), hash+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), blobPath)
+}
+
+func (d DirBlobStore) GetBlob(ctx context.Context, hash string) ([]byte, error) {
+	data, err := os.ReadFile(d.blobPath(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, hash)
+	}
+	return data, err
+}
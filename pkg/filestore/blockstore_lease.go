@@ -0,0 +1,83 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// cooperative leases (advisory, writes are not blocked)
+// the holder and expiry (ms) are stored in the file's meta.  each lease operation is a compare-and-swap on the
+// meta done under the entry lock, and the meta is written to the DB before the call returns so a lease survives
+// a restart.  an expired lease can be acquired by any holder, the current holder can renew it until then.
+
+const LeaseHolderMetaKey = "filestore:leaseholder"
+const LeaseExpiresMetaKey = "filestore:leaseexpts"
+
+// returns true if holderId now holds the lease (it was free, expired, or already held by holderId)
+func (s *FileStore) AcquireLease(ctx context.Context, zoneId string, name string, holderId string, ttl time.Duration) (bool, error) {
+	if holderId == "" {
+		return false, fmt.Errorf("lease holder id cannot be empty")
+	}
+	return s.updateLease(ctx, zoneId, name, func(holder string, expired bool) (FileMeta, bool) {
+		if holder != "" && holder != holderId && !expired {
+			return nil, false
+		}
+		return FileMeta{LeaseHolderMetaKey: holderId, LeaseExpiresMetaKey: s.now() + ttl.Milliseconds()}, true
+	})
+}
+
+// extends the lease to ttl from now, returns false if holderId does not hold the lease (or it has expired)
+func (s *FileStore) RenewLease(ctx context.Context, zoneId string, name string, holderId string, ttl time.Duration) (bool, error) {
+	return s.updateLease(ctx, zoneId, name, func(holder string, expired bool) (FileMeta, bool) {
+		if holder != holderId || expired {
+			return nil, false
+		}
+		return FileMeta{LeaseExpiresMetaKey: s.now() + ttl.Milliseconds()}, true
+	})
+}
+
+// returns false if holderId does not hold the lease (an expired lease can still be released by its holder)
+func (s *FileStore) ReleaseLease(ctx context.Context, zoneId string, name string, holderId string) (bool, error) {
+	return s.updateLease(ctx, zoneId, name, func(holder string, expired bool) (FileMeta, bool) {
+		if holder != holderId {
+			return nil, false
+		}
+		return FileMeta{LeaseHolderMetaKey: nil, LeaseExpiresMetaKey: nil}, true
+	})
+}
+
+// updateFn gets the current holder ("" if none) and returns the meta to merge, or false to leave the lease alone
+func (s *FileStore) updateLease(ctx context.Context, zoneId string, name string, updateFn func(holder string, expired bool) (FileMeta, bool)) (bool, error) {
+	updated, err := withLockRtn(s, zoneId, name, func(entry *CacheEntry) (bool, error) {
+		err := entry.loadFileIntoCache(ctx)
+		if err != nil {
+			return false, err
+		}
+		holder, _ := entry.File.Meta[LeaseHolderMetaKey].(string)
+		expiresTs, _ := getMetaInt64(entry.File.Meta, LeaseExpiresMetaKey)
+		metaUpdate, ok := updateFn(holder, s.now() >= expiresTs)
+		if !ok {
+			return false, nil
+		}
+		oldMeta := copyMeta(entry.File.Meta)
+		entry.writeMeta(metaUpdate, true)
+		err = s.backend().WriteFileMeta(ctx, zoneId, name, entry.File.Meta)
+		if err != nil {
+			// the lease was not stored, so it must not be visible
+			entry.File.Meta = oldMeta
+			return false, fmt.Errorf("error writing lease for %s:%s: %w", zoneId, name, err)
+		}
+		return true, s.flushWriteThrough(ctx, entry)
+	})
+	if err != nil {
+		return false, err
+	}
+	if updated {
+		s.notifyMeta(zoneId, name)
+	}
+	return updated, nil
+}
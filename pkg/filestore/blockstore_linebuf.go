@@ -0,0 +1,82 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"slices"
+)
+
+// line buffered files (FileOptsType.LineBuffered)
+// AppendData only commits complete lines (through the last '\n'), a trailing partial line is held in memory
+// until a later append completes it or FlushLineBuffer is called (e.g. when the writer is closed).  readers
+// only ever see committed bytes, so they never see a partial line, and Size does not include the pending bytes.
+// edge cases:
+//   - a line longer than a part is held in memory in full and committed (spanning parts) once its newline arrives
+//   - to bound memory, a pending line that grows past MaxLineBufferSize is committed without a newline
+//   - pending bytes are not persisted (they are lost on a crash) and are not flushed by FlushCache
+//   - WriteAt and WriteFile bypass the buffer, WriteFile and DeleteFile discard it
+
+const MaxLineBufferSize = 1024 * 1024
+
+// returns (commit, rest), commit is the part of pending+data to write now, rest is the new pending tail
+func splitLines(pending []byte, data []byte, force bool) ([]byte, []byte) {
+	combined := make([]byte, 0, len(pending)+len(data))
+	combined = append(combined, pending...)
+	combined = append(combined, data...)
+	if force {
+		return combined, nil
+	}
+	idx := bytes.LastIndexByte(combined, '\n')
+	if len(combined)-(idx+1) > MaxLineBufferSize {
+		return combined, nil
+	}
+	return combined[:idx+1], slices.Clone(combined[idx+1:])
+}
+
+// commits the pending partial line (if any) of a line buffered file
+func (s *FileStore) FlushLineBuffer(ctx context.Context, zoneId string, name string) error {
+	_, err := s.appendData(ctx, zoneId, name, nil, true)
+	return err
+}
+
+// returns the number of bytes waiting for a newline
+func (s *FileStore) LineBufferSize(zoneId string, name string) int {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return len(s.lineBufs[cacheKey{ZoneId: zoneId, Name: name}])
+}
+
+// line buffers are kept in the store (not the cache entry) so they survive the entry being dropped from the cache
+// they are only modified while holding the file's entry lock
+func (s *FileStore) getLineBuf(key cacheKey) []byte {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.lineBufs[key]
+}
+
+func (s *FileStore) setLineBuf(key cacheKey, buf []byte) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if len(buf) == 0 {
+		delete(s.lineBufs, key)
+		return
+	}
+	if s.lineBufs == nil {
+		s.lineBufs = make(map[cacheKey][]byte)
+	}
+	s.lineBufs[key] = buf
+}
+
+func (s *FileStore) moveZoneLineBufs(oldZoneId string, newZoneId string) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for key, buf := range s.lineBufs {
+		if key.ZoneId == oldZoneId {
+			delete(s.lineBufs, key)
+			s.lineBufs[cacheKey{ZoneId: newZoneId, Name: key.Name}] = buf
+		}
+	}
+}
@@ -0,0 +1,553 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// in-memory storage (see MemBackend and NewMemStore)
+// a Backend that keeps file rows and parts in maps, for tests of the cache logic and for embedding the store
+// where there is no DB.  it follows the DB backend's semantics (patches of FromDB parts, trimfront trims,
+// checksums, ErrFileChanged), but there is no inline storage and parts can't be orphaned, so the fsck queries
+// never find anything.  every call holds the backend lock, so calls are atomic like DB transactions.
+
+type memFile struct {
+	file      *WaveFile
+	parts     map[int][]byte
+	partSums  map[int][]byte
+	checksum  []byte // the rolled-up checksum, nil until the first WriteCacheEntry
+	partBytes int64
+}
+
+type MemBackend struct {
+	lock  *sync.Mutex
+	files map[FileKey]*memFile
+}
+
+func NewMemBackend() *MemBackend {
+	return &MemBackend{
+		lock:  &sync.Mutex{},
+		files: make(map[FileKey]*memFile),
+	}
+}
+
+// returns a store backed by its own MemBackend (nothing is written to disk and no DB is used), for tests of a
+// single store or for embedding the store where there is no data dir.  opts.DB and opts.Backend are ignored.
+// background tasks are not started (see StartBackground)
+func NewMemStore(opts FileStoreOpts) *FileStore {
+	opts.DB = nil
+	opts.Backend = NewMemBackend()
+	return NewFileStore(opts)
+}
+
+func (b *MemBackend) getFile(zoneId string, name string) *memFile {
+	return b.files[FileKey{ZoneId: zoneId, Name: name}]
+}
+
+// returns the keys in (zoneid, name) order
+func (b *MemBackend) sortedKeys() []FileKey {
+	keys := make([]FileKey, 0, len(b.files))
+	for key := range b.files {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ZoneId != keys[j].ZoneId {
+			return keys[i].ZoneId < keys[j].ZoneId
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
+
+func (b *MemBackend) selectFiles(filterFn func(key FileKey, mf *memFile) bool) []*WaveFile {
+	var rtn []*WaveFile
+	for _, key := range b.sortedKeys() {
+		if filterFn(key, b.files[key]) {
+			rtn = append(rtn, b.files[key].file.DeepCopy())
+		}
+	}
+	return rtn
+}
+
+func (mf *memFile) setPart(partIdx int, data []byte) {
+	mf.deletePart(partIdx)
+	mf.parts[partIdx] = data
+	mf.partSums[partIdx] = partChecksum(data)
+	mf.partBytes += int64(len(data))
+}
+
+func (mf *memFile) deletePart(partIdx int) {
+	mf.partBytes -= int64(len(mf.parts[partIdx]))
+	delete(mf.parts, partIdx)
+	delete(mf.partSums, partIdx)
+}
+
+func (mf *memFile) updateChecksum() {
+	partIdxs := make([]int, 0, len(mf.partSums))
+	for partIdx := range mf.partSums {
+		partIdxs = append(partIdxs, partIdx)
+	}
+	sort.Ints(partIdxs)
+	checksums := make([][]byte, 0, len(partIdxs))
+	for _, partIdx := range partIdxs {
+		checksums = append(checksums, mf.partSums[partIdx])
+	}
+	mf.checksum = rollupChecksums(checksums)
+}
+
+// meta goes through JSON like it does in the DB, so readers get the same value types (e.g. float64 for numbers)
+func storedMeta(meta FileMeta) FileMeta {
+	rtn := make(FileMeta)
+	barr, err := json.Marshal(meta)
+	if err == nil {
+		json.Unmarshal(barr, &rtn)
+	}
+	return rtn
+}
+
+// returns a copy of the part (with a full part capacity), marked as loaded from storage
+func makeMemPartEntry(partIdx int, data []byte) *DataCacheEntry {
+	newData := make([]byte, len(data), max(int64(len(data)), partDataSize))
+	copy(newData, data)
+	return &DataCacheEntry{PartIdx: partIdx, Data: newData, FromDB: true, DBLen: int64(len(data))}
+}
+
+func (b *MemBackend) InsertFile(ctx context.Context, file *WaveFile) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := FileKey{ZoneId: file.ZoneId, Name: file.Name}
+	if b.files[key] != nil {
+		return fs.ErrExist
+	}
+	// only the columns the DB backend inserts
+	newFile := &WaveFile{
+		ZoneId:    file.ZoneId,
+		Name:      file.Name,
+		Opts:      file.Opts,
+		CreatedTs: file.CreatedTs,
+		Size:      file.Size,
+		ModTs:     file.ModTs,
+		Meta:      storedMeta(file.Meta),
+	}
+	b.files[key] = &memFile{file: newFile, parts: make(map[int][]byte), partSums: make(map[int][]byte)}
+	return nil
+}
+
+func (b *MemBackend) DeleteFile(ctx context.Context, zoneId string, name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := FileKey{ZoneId: zoneId, Name: name}
+	if b.files[key] == nil {
+		return fs.ErrNotExist
+	}
+	delete(b.files, key)
+	return nil
+}
+
+func (b *MemBackend) DeleteFiles(ctx context.Context, keys []FileKey) ([]FileKey, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var deleted []FileKey
+	for _, key := range keys {
+		if b.files[key] == nil {
+			continue
+		}
+		delete(b.files, key)
+		deleted = append(deleted, key)
+	}
+	return deleted, nil
+}
+
+func (b *MemBackend) zoneNames(zoneId string) []string {
+	var names []string
+	for key := range b.files {
+		if key.ZoneId == zoneId {
+			names = append(names, key.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *MemBackend) MoveZone(ctx context.Context, oldZoneId string, newZoneId string, expectedNames []string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.zoneNames(newZoneId)) > 0 {
+		return fs.ErrExist
+	}
+	curNames := b.zoneNames(oldZoneId)
+	if !slices.Equal(curNames, expectedNames) {
+		return fmt.Errorf("files in zone %s changed during move", oldZoneId)
+	}
+	for _, name := range curNames {
+		mf := b.files[FileKey{ZoneId: oldZoneId, Name: name}]
+		delete(b.files, FileKey{ZoneId: oldZoneId, Name: name})
+		mf.file.ZoneId = newZoneId
+		b.files[FileKey{ZoneId: newZoneId, Name: name}] = mf
+	}
+	return nil
+}
+
+func (b *MemBackend) RenameFile(ctx context.Context, zoneId string, oldName string, newName string, meta FileMeta, replace bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mf := b.getFile(zoneId, oldName)
+	if mf == nil {
+		return fs.ErrNotExist
+	}
+	if b.getFile(zoneId, newName) != nil && !replace {
+		return fs.ErrExist
+	}
+	delete(b.files, FileKey{ZoneId: zoneId, Name: oldName})
+	mf.file.Name = newName
+	mf.file.Meta = storedMeta(meta)
+	b.files[FileKey{ZoneId: zoneId, Name: newName}] = mf
+	return nil
+}
+
+func (b *MemBackend) SwapFiles(ctx context.Context, zoneId string, nameA string, nameB string, swapMeta bool, modTs int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mfA, mfB := b.getFile(zoneId, nameA), b.getFile(zoneId, nameB)
+	if mfA == nil || mfB == nil {
+		return fs.ErrNotExist
+	}
+	mfA.file.Name, mfB.file.Name = nameB, nameA
+	if !swapMeta {
+		mfA.file.Meta, mfB.file.Meta = mfB.file.Meta, mfA.file.Meta
+	}
+	newVersion := max(mfA.file.Version, mfB.file.Version) + 1
+	for _, mf := range []*memFile{mfA, mfB} {
+		mf.file.ModTs = modTs
+		mf.file.Version = newVersion
+	}
+	b.files[FileKey{ZoneId: zoneId, Name: nameA}] = mfB
+	b.files[FileKey{ZoneId: zoneId, Name: nameB}] = mfA
+	return nil
+}
+
+func (b *MemBackend) GetZoneFile(ctx context.Context, zoneId string, name string) (*WaveFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mf := b.getFile(zoneId, name)
+	if mf == nil {
+		return nil, nil
+	}
+	return mf.file.DeepCopy(), nil
+}
+
+func (b *MemBackend) GetZoneFiles(ctx context.Context, zoneId string) ([]*WaveFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.selectFiles(func(key FileKey, mf *memFile) bool {
+		return key.ZoneId == zoneId
+	}), nil
+}
+
+func (b *MemBackend) GetZoneFilesByName(ctx context.Context, zoneId string, names []string) ([]*WaveFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.selectFiles(func(key FileKey, mf *memFile) bool {
+		return key.ZoneId == zoneId && slices.Contains(names, key.Name)
+	}), nil
+}
+
+func (b *MemBackend) GetZoneFileNames(ctx context.Context, zoneId string) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.zoneNames(zoneId), nil
+}
+
+func (b *MemBackend) GetFilesPage(ctx context.Context, afterZoneId string, afterName string, limit int) ([]*WaveFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var rtn []*WaveFile
+	for _, key := range b.sortedKeys() {
+		if key.ZoneId < afterZoneId || (key.ZoneId == afterZoneId && key.Name <= afterName) {
+			continue
+		}
+		if len(rtn) >= limit {
+			break
+		}
+		rtn = append(rtn, b.files[key].file.DeepCopy())
+	}
+	return rtn, nil
+}
+
+func (b *MemBackend) GetFilesWithNamePrefix(ctx context.Context, namePrefix string) ([]*WaveFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.selectFiles(func(key FileKey, mf *memFile) bool {
+		return strings.HasPrefix(key.Name, namePrefix)
+	}), nil
+}
+
+func (b *MemBackend) GetFileMeta(ctx context.Context, zoneId string, name string) (FileMeta, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mf := b.getFile(zoneId, name)
+	if mf == nil {
+		return nil, fs.ErrNotExist
+	}
+	return storedMeta(mf.file.Meta), nil
+}
+
+func (b *MemBackend) WriteFileMeta(ctx context.Context, zoneId string, name string, meta FileMeta) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if mf := b.getFile(zoneId, name); mf != nil {
+		mf.file.Meta = storedMeta(meta)
+	}
+	return nil
+}
+
+func (b *MemBackend) WriteAccessTimes(ctx context.Context, accessTimes map[FileKey]int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for key, accessTs := range accessTimes {
+		mf := b.files[key]
+		if mf != nil && mf.file.AccessTs < accessTs && mf.file.CreatedTs <= accessTs {
+			mf.file.AccessTs = accessTs
+		}
+	}
+	return nil
+}
+
+func (b *MemBackend) GetAllZoneIds(ctx context.Context) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var ids []string
+	for _, key := range b.sortedKeys() {
+		if len(ids) == 0 || ids[len(ids)-1] != key.ZoneId {
+			ids = append(ids, key.ZoneId)
+		}
+	}
+	return ids, nil
+}
+
+func (b *MemBackend) GetZoneIdsPage(ctx context.Context, afterId string, limit int) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var ids []string
+	for _, key := range b.sortedKeys() {
+		if key.ZoneId <= afterId || (len(ids) > 0 && ids[len(ids)-1] == key.ZoneId) {
+			continue
+		}
+		if len(ids) >= limit {
+			break
+		}
+		ids = append(ids, key.ZoneId)
+	}
+	return ids, nil
+}
+
+func (b *MemBackend) GetZoneIdsModifiedSince(ctx context.Context, since int64) ([]string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var ids []string
+	for _, key := range b.sortedKeys() {
+		if b.files[key].file.ModTs >= since && !slices.Contains(ids, key.ZoneId) {
+			ids = append(ids, key.ZoneId)
+		}
+	}
+	return ids, nil
+}
+
+func (b *MemBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	partReadQueries.Add(1)
+	rtn := make(map[int]*DataCacheEntry)
+	mf := b.getFile(zoneId, name)
+	if mf == nil {
+		return rtn, nil
+	}
+	for _, partIdx := range parts {
+		if data, ok := mf.parts[partIdx]; ok {
+			rtn[partIdx] = makeMemPartEntry(partIdx, data)
+		}
+	}
+	return rtn, nil
+}
+
+func (b *MemBackend) GetZoneFilesParts(ctx context.Context, zoneId string, parts map[string][]int) (map[string]map[int]*DataCacheEntry, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rtn := make(map[string]map[int]*DataCacheEntry)
+	for name, partIdxs := range parts {
+		mf := b.getFile(zoneId, name)
+		if mf == nil {
+			continue
+		}
+		for _, partIdx := range partIdxs {
+			data, ok := mf.parts[partIdx]
+			if !ok {
+				continue
+			}
+			if rtn[name] == nil {
+				rtn[name] = make(map[int]*DataCacheEntry)
+			}
+			rtn[name][partIdx] = makeMemPartEntry(partIdx, data)
+		}
+	}
+	return rtn, nil
+}
+
+func (b *MemBackend) GetPartSizes(ctx context.Context, zoneId string, name string) (map[int]int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rtn := make(map[int]int)
+	if mf := b.getFile(zoneId, name); mf != nil {
+		for partIdx, data := range mf.parts {
+			rtn[partIdx] = len(data)
+		}
+	}
+	return rtn, nil
+}
+
+// same rules as dbWriteCacheEntry, patchable parts only replace their dirty range
+func (b *MemBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mf := b.getFile(file.ZoneId, file.Name)
+	if mf == nil {
+		return 0, os.ErrNotExist
+	}
+	if mf.file.CreatedTs != file.CreatedTs || (!replace && mf.file.Opts != file.Opts) {
+		return 0, fmt.Errorf("%w: %s:%s", ErrFileChanged, file.ZoneId, file.Name)
+	}
+	mf.file.Size = file.Size
+	mf.file.ModTs = file.ModTs
+	mf.file.AccessTs = max(mf.file.AccessTs, file.AccessTs)
+	mf.file.StartOffset = file.StartOffset
+	mf.file.Version = file.Version
+	mf.file.Meta = storedMeta(file.Meta)
+	if file.StartOffset > 0 {
+		for partIdx := range mf.parts {
+			if int64(partIdx) < file.StartOffset/partDataSize {
+				mf.deletePart(partIdx)
+			}
+		}
+	}
+	if !file.Opts.Circular {
+		for partIdx := range mf.parts {
+			if int64(partIdx) > file.lastPartIdx() {
+				mf.deletePart(partIdx)
+			}
+		}
+	}
+	if replace {
+		mf.file.Opts = file.Opts
+		for partIdx := range mf.parts {
+			mf.deletePart(partIdx)
+		}
+	}
+	var bytesWritten int64
+	for partIdx, dataEntry := range dataEntries {
+		if partIdx != dataEntry.PartIdx {
+			panic(fmt.Sprintf("partIdx:%d and dataEntry.PartIdx:%d do not match", partIdx, dataEntry.PartIdx))
+		}
+		if !replace && dataEntry.canPatch() {
+			if dataEntry.DirtyEnd <= dataEntry.DirtyStart {
+				continue
+			}
+			oldData := mf.parts[partIdx]
+			newData := slices.Clone(oldData[:min(dataEntry.DirtyStart, int64(len(oldData)))])
+			newData = append(newData, dataEntry.Data[dataEntry.DirtyStart:dataEntry.DirtyEnd]...)
+			if dataEntry.DirtyEnd < int64(len(oldData)) {
+				newData = append(newData, oldData[dataEntry.DirtyEnd:]...)
+			}
+			mf.setPart(partIdx, newData)
+			bytesWritten += dataEntry.DirtyEnd - dataEntry.DirtyStart
+			continue
+		}
+		mf.setPart(partIdx, slices.Clone(dataEntry.Data))
+		bytesWritten += int64(len(dataEntry.Data))
+	}
+	mf.updateChecksum()
+	partBytesWritten.Add(bytesWritten)
+	return bytesWritten, nil
+}
+
+func (b *MemBackend) GetFileChecksum(ctx context.Context, zoneId string, name string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mf := b.getFile(zoneId, name)
+	if mf == nil {
+		return nil, fs.ErrNotExist
+	}
+	return slices.Clone(mf.checksum), nil
+}
+
+func (b *MemBackend) GetPartChecksums(ctx context.Context, zoneId string, name string) (map[int][]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rtn := make(map[int][]byte)
+	if mf := b.getFile(zoneId, name); mf != nil {
+		for partIdx, checksum := range mf.partSums {
+			rtn[partIdx] = slices.Clone(checksum)
+		}
+	}
+	return rtn, nil
+}
+
+// parts are stored with their file, so they can't be orphaned
+func (b *MemBackend) GetOrphanParts(ctx context.Context) ([]FsckFile, error) {
+	return nil, nil
+}
+
+func (b *MemBackend) DeleteOrphanParts(ctx context.Context) error {
+	return nil
+}
+
+func (b *MemBackend) GetFilesWithoutParts(ctx context.Context) ([]*WaveFile, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.selectFiles(func(key FileKey, mf *memFile) bool {
+		return mf.file.Size > 0 && len(mf.parts) == 0
+	}), nil
+}
+
+func (b *MemBackend) ResetPhantomFile(ctx context.Context, zoneId string, name string, size int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	mf := b.getFile(zoneId, name)
+	if mf == nil || len(mf.parts) > 0 || mf.file.Size != size {
+		return nil
+	}
+	mf.file.Size = 0
+	mf.file.StartOffset = 0
+	mf.checksum = nil
+	return nil
+}
+
+// the total size of the stored part data
+func (b *MemBackend) GetSize(ctx context.Context) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var size int64
+	for _, mf := range b.files {
+		size += mf.partBytes
+	}
+	return size, nil
+}
+
+func (b *MemBackend) Vacuum(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"github.com/wavetermdev/waveterm/pkg/panichandler"
+)
+
+// Observer is notified after each successful mutation of a file in the cache
+// observers are called synchronously (in registration order) after the store and entry locks have been released,
+// so they may call back into the FileStore.  not reported: MakeFile and MoveZone (archive writes of ArchiveOverflow
+// files are reported as appends to the archive).
+type Observer interface {
+	// data in [offset, offset+n) was written (WriteFile, CompactIJson, CompactCircular, FreezeCircular and
+	// PutPartSnapshots report the whole new file as written at offset 0)
+	OnWrite(zoneId string, name string, offset int64, n int)
+	// the file's meta (or ModTs, for Touch) changed
+	OnMeta(zoneId string, name string)
+	OnDelete(zoneId string, name string)
+}
+
+func (s *FileStore) RegisterObserver(observer Observer) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.Observers = append(s.Observers, observer)
+}
+
+func (s *FileStore) getObservers() []Observer {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if len(s.Observers) == 0 {
+		return nil
+	}
+	rtn := make([]Observer, len(s.Observers))
+	copy(rtn, s.Observers)
+	return rtn
+}
+
+// a panicking observer does not stop the other observers (or the caller)
+func (s *FileStore) notifyObservers(fn func(Observer)) {
+	for _, observer := range s.getObservers() {
+		func() {
+			defer func() {
+				panichandler.PanicHandler("filestore observer", recover())
+			}()
+			fn(observer)
+		}()
+	}
+}
+
+func (s *FileStore) notifyWrite(zoneId string, name string, offset int64, n int) {
+	s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: name})
+	s.signalWriteWaiters(zoneId, name)
+	s.notifyObservers(func(observer Observer) {
+		observer.OnWrite(zoneId, name, offset, n)
+	})
+}
+
+func (s *FileStore) notifyMeta(zoneId string, name string) {
+	s.notifyObservers(func(observer Observer) {
+		observer.OnMeta(zoneId, name)
+	})
+}
+
+func (s *FileStore) notifyDelete(zoneId string, name string) {
+	s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: name})
+	s.signalWriteWaiters(zoneId, name)
+	s.notifyObservers(func(observer Observer) {
+		observer.OnDelete(zoneId, name)
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/panichandler"
+)
+
+// pin leak detection
+// every call pins its cache entry for the length of the call, and cursors, FollowReaders and ReadAtViews keep a pin
+// until they are closed.  a missing unpin keeps the entry in the cache forever, so the auditor periodically reports
+// entries that have been pinned for longer than PinLeakThreshold while no operation holds their lock.  an open
+// cursor (or view) that is held longer than the threshold is reported as well, which is usually a missing Close.
+
+const DefaultPinLeakThreshold = 10 * time.Minute
+const PinAuditInterval = time.Minute
+
+type PinLeak struct {
+	ZoneId    string
+	Name      string
+	PinCount  int
+	PinnedFor time.Duration
+}
+
+// returned by GetPinStats
+type PinStats struct {
+	NumPinned   int // cache entries with a non-zero PinCount
+	MaxPinCount int
+}
+
+func (s *FileStore) getPinLeakThreshold() time.Duration {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.PinLeakThreshold <= 0 {
+		return DefaultPinLeakThreshold
+	}
+	return s.PinLeakThreshold
+}
+
+func (s *FileStore) GetPinStats() PinStats {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	var stats PinStats
+	for _, entry := range s.Cache {
+		if entry.PinCount > 0 {
+			stats.NumPinned++
+		}
+		stats.MaxPinCount = max(stats.MaxPinCount, entry.PinCount)
+	}
+	return stats
+}
+
+// returns (sorted by zoneid, name) the entries pinned for longer than the PinLeakThreshold with no operation in progress
+func (s *FileStore) AuditPins() []PinLeak {
+	threshold := s.getPinLeakThreshold()
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	now := s.now()
+	var leaks []PinLeak
+	for key, entry := range s.Cache {
+		if entry.PinCount <= 0 || now-entry.PinnedTs < threshold.Milliseconds() {
+			continue
+		}
+		// TryLock never blocks, so this is safe while holding the FileStore lock
+		if !entry.Lock.TryLock() {
+			// an operation is in progress (it may legitimately be long, e.g. a large flush)
+			continue
+		}
+		entry.Lock.Unlock()
+		leaks = append(leaks, PinLeak{
+			ZoneId:    key.ZoneId,
+			Name:      key.Name,
+			PinCount:  entry.PinCount,
+			PinnedFor: time.Duration(now-entry.PinnedTs) * time.Millisecond,
+		})
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		if leaks[i].ZoneId != leaks[j].ZoneId {
+			return leaks[i].ZoneId < leaks[j].ZoneId
+		}
+		return leaks[i].Name < leaks[j].Name
+	})
+	return leaks
+}
+
+func (s *FileStore) runPinAuditor() {
+	defer func() {
+		panichandler.PanicHandler("filestore pin auditor", recover())
+	}()
+	for {
+		if stopFlush.Load() {
+			return
+		}
+		for _, leak := range s.AuditPins() {
+			log.Printf("filestore possible pin leak: %s:%s pincount:%d pinned for %v\n", leak.ZoneId, leak.Name, leak.PinCount, leak.PinnedFor)
+		}
+		time.Sleep(PinAuditInterval)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+)
+
+// read region cache (opt-in, FileStore.ReadRegionCache)
+// a pager re-reads overlapping windows around the scroll position, so for each file the store keeps the last region
+// read by ReadAt (the request widened to whole parts, since those parts are loaded anyway).  a ReadAt that falls
+// inside the region is served from memory without loading the file or its parts.  this is separate from the write
+// cache (clean files are not kept in the cache at all).
+// the region is dropped on any write to the file (see notifyWrite), and with the line buffer when the file is
+// replaced, deleted, renamed or moved.  regions are only stored and used while holding the file's entry lock.
+
+const ReadRegionMaxSize = 256 * 1024
+const ReadRegionMaxFiles = 64
+
+type readRegion struct {
+	offset int64
+	data   []byte
+	atEOF  bool // the region ends at the end of the file (reads past it are clamped)
+	usedTs int64
+}
+
+// returns (offset, data, true) if [offset, offset+size) can be served from the region
+func (r *readRegion) read(offset int64, size int64) (int64, []byte, bool) {
+	end := r.offset + int64(len(r.data))
+	if offset < r.offset || offset >= end || size <= 0 {
+		return 0, nil, false
+	}
+	if offset+size > end {
+		if !r.atEOF {
+			return 0, nil, false
+		}
+		size = end - offset
+	}
+	start := offset - r.offset
+	rtn := make([]byte, size)
+	copy(rtn, r.data[start:start+size])
+	return offset, rtn, true
+}
+
+// like entry.readAt, but served from (and stores) the file's read region when ReadRegionCache is set
+// must be called with the entry lock held
+func (s *FileStore) readAtWithRegion(ctx context.Context, entry *CacheEntry, offset int64, size int64) (int64, []byte, error) {
+	if !s.ReadRegionCache || offset < 0 {
+		return entry.readAt(ctx, offset, size, false)
+	}
+	key := cacheKey{ZoneId: entry.ZoneId, Name: entry.Name}
+	if region := s.getReadRegion(key); region != nil {
+		if rtnOffset, data, ok := region.read(offset, size); ok {
+			return rtnOffset, data, nil
+		}
+	}
+	file, err := entry.loadFileForRead(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	clampedOffset, clampedSize := file.clampReadRange(offset, size)
+	regionStart := clampedOffset / partDataSize * partDataSize
+	regionEnd := (clampedOffset + max(clampedSize, 0) + partDataSize - 1) / partDataSize * partDataSize
+	regionStart, regionSize := file.clampReadRange(regionStart, regionEnd-regionStart)
+	if clampedSize <= 0 || regionSize > ReadRegionMaxSize {
+		return entry.readAt(ctx, offset, size, false)
+	}
+	_, regionData, err := entry.readAt(ctx, regionStart, regionSize, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	region := &readRegion{offset: regionStart, data: regionData, atEOF: regionStart+regionSize >= file.Size}
+	rtnOffset, data, ok := region.read(clampedOffset, clampedSize)
+	if !ok {
+		return entry.readAt(ctx, offset, size, false)
+	}
+	s.setReadRegion(key, region)
+	return rtnOffset, data, nil
+}
+
+func (s *FileStore) getReadRegion(key cacheKey) *readRegion {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	region := s.readRegions[key]
+	if region != nil {
+		region.usedTs = s.now()
+	}
+	return region
+}
+
+// evicts the least recently used region when there are already ReadRegionMaxFiles regions
+func (s *FileStore) setReadRegion(key cacheKey, region *readRegion) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.readRegions == nil {
+		s.readRegions = make(map[cacheKey]*readRegion)
+	}
+	if _, found := s.readRegions[key]; !found && len(s.readRegions) >= ReadRegionMaxFiles {
+		var lruKey cacheKey
+		var lruTs int64 = -1
+		for regionKey, r := range s.readRegions {
+			if lruTs == -1 || r.usedTs < lruTs {
+				lruKey, lruTs = regionKey, r.usedTs
+			}
+		}
+		delete(s.readRegions, lruKey)
+	}
+	region.usedTs = s.now()
+	s.readRegions[key] = region
+}
+
+func (s *FileStore) dropReadRegion(key cacheKey) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	delete(s.readRegions, key)
+}
+
+func (s *FileStore) dropZoneReadRegions(zoneId string) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for key := range s.readRegions {
+		if key.ZoneId == zoneId {
+			delete(s.readRegions, key)
+		}
+	}
+}
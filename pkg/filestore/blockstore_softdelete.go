@@ -0,0 +1,207 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/panichandler"
+)
+
+// soft deletes (see SoftDeleteFile)
+// a soft-deleted file is renamed (in the same zone) to TombstonePrefix + name and the delete time is recorded in
+// its meta (TombstoneMetaKey).  tombstones are regular files (ListFiles returns them, use IsTombstoneName to filter),
+// they can be restored with UndeleteFile until the grace period (FileStore.SoftDeleteGrace) has passed, after which
+// the sweeper (see SweepTombstones) hard-deletes them.
+
+const TombstonePrefix = "~deleted:"
+const TombstoneMetaKey = "filestore:deletets"
+const DefaultSoftDeleteGrace = 24 * time.Hour
+const TombstoneSweepInterval = 10 * time.Minute
+
+// returned (wrapped) by UndeleteFile when the tombstone is past the grace period
+var ErrTombstoneExpired = errors.New("soft delete grace period has expired")
+
+func IsTombstoneName(name string) bool {
+	return strings.HasPrefix(name, TombstonePrefix)
+}
+
+func TombstoneName(name string) string {
+	return TombstonePrefix + name
+}
+
+func (s *FileStore) getSoftDeleteGrace() time.Duration {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.SoftDeleteGrace <= 0 {
+		return DefaultSoftDeleteGrace
+	}
+	return s.SoftDeleteGrace
+}
+
+func getTombstoneDeleteTs(meta FileMeta) (int64, bool) {
+	return getMetaInt64(meta, TombstoneMetaKey)
+}
+
+// renames the file to its tombstone (replacing an older tombstone of the same name), returns fs.ErrNotExist if the file does not exist
+func (s *FileStore) SoftDeleteFile(ctx context.Context, zoneId string, name string) error {
+	if IsTombstoneName(name) {
+		return fmt.Errorf("cannot soft delete tombstone %q", name)
+	}
+	err := s.renameFile(ctx, zoneId, name, TombstoneName(name), true, func(meta FileMeta) error {
+		meta[TombstoneMetaKey] = s.now()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyDelete(zoneId, name)
+	return nil
+}
+
+// restores a soft-deleted file.  returns fs.ErrNotExist if there is no tombstone for name, fs.ErrExist if
+// name has been re-created since the delete, and ErrTombstoneExpired if the grace period has passed
+func (s *FileStore) UndeleteFile(ctx context.Context, zoneId string, name string) error {
+	grace := s.getSoftDeleteGrace()
+	err := s.renameFile(ctx, zoneId, TombstoneName(name), name, false, func(meta FileMeta) error {
+		deleteTs, _ := getTombstoneDeleteTs(meta)
+		if s.now()-deleteTs > grace.Milliseconds() {
+			return fmt.Errorf("cannot undelete %s:%s: %w", zoneId, name, ErrTombstoneExpired)
+		}
+		delete(meta, TombstoneMetaKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.notifyMeta(zoneId, name)
+	return nil
+}
+
+// hard-deletes every tombstone past the grace period, returns the number of tombstones deleted
+func (s *FileStore) SweepTombstones(ctx context.Context) (int, error) {
+	cutoffTs := s.now() - s.getSoftDeleteGrace().Milliseconds()
+	tombstones, err := s.backend().GetFilesWithNamePrefix(ctx, TombstonePrefix)
+	if err != nil {
+		return 0, fmt.Errorf("error getting tombstones: %w", err)
+	}
+	var expired []*WaveFile
+	for _, file := range tombstones {
+		deleteTs, ok := getTombstoneDeleteTs(file.Meta)
+		if ok && deleteTs < cutoffTs {
+			expired = append(expired, file)
+		}
+	}
+	var numDeleted int
+	for _, file := range expired {
+		deleted, err := s.deleteExpiredTombstone(ctx, file.ZoneId, file.Name, cutoffTs)
+		if err != nil {
+			return numDeleted, err
+		}
+		if deleted {
+			s.notifyDelete(file.ZoneId, file.Name)
+			numDeleted++
+		}
+	}
+	return numDeleted, nil
+}
+
+// the delete ts is re-checked under the entry lock, the tombstone may have been restored or replaced (by a newer
+// soft delete of the same name) since the scan
+func (s *FileStore) deleteExpiredTombstone(ctx context.Context, zoneId string, name string, cutoffTs int64) (bool, error) {
+	return withLockRtn(s, zoneId, name, func(entry *CacheEntry) (bool, error) {
+		file, err := entry.loadFileForRead(ctx)
+		if err == fs.ErrNotExist {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		deleteTs, ok := getTombstoneDeleteTs(file.Meta)
+		if !ok || deleteTs >= cutoffTs {
+			return false, nil
+		}
+		err = s.backend().DeleteFile(ctx, zoneId, name)
+		if err != nil {
+			return false, fmt.Errorf("error deleting tombstone: %v", err)
+		}
+		entry.clear()
+		s.setLineBuf(cacheKey{ZoneId: zoneId, Name: name}, nil)
+		s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: name})
+		return true, nil
+	})
+}
+
+// the file is flushed and then renamed in the DB (a pending partial line is discarded), both cache entries are locked (in sorted order, like MoveZone)
+// so nothing can touch either name while the rename is in progress.  updateMetaFn can modify the meta (the meta
+// that is written with the rename) or return an error to abort.  if replace is false and newName exists, returns fs.ErrExist
+func (s *FileStore) renameFile(ctx context.Context, zoneId string, oldName string, newName string, replace bool, updateMetaFn func(FileMeta) error) error {
+	names := []string{oldName, newName}
+	sort.Strings(names)
+	entries := make(map[string]*CacheEntry)
+	for _, name := range names {
+		entry := s.getEntryAndPin(zoneId, name)
+		defer s.unpinEntryAndTryDelete(zoneId, name)
+		entry.Lock.Lock()
+		defer entry.Lock.Unlock()
+		err := entry.unspill()
+		if err != nil {
+			return err
+		}
+		entries[name] = entry
+	}
+	oldEntry, newEntry := entries[oldName], entries[newName]
+	file, err := oldEntry.loadFileForRead(ctx)
+	if err != nil {
+		return err
+	}
+	meta := file.DeepCopy().Meta
+	if meta == nil {
+		meta = make(FileMeta)
+	}
+	err = updateMetaFn(meta)
+	if err != nil {
+		return err
+	}
+	_, err = oldEntry.flushToDB(ctx, false, s.getFlushBatch())
+	if err != nil {
+		return fmt.Errorf("error flushing file %q: %w", oldName, err)
+	}
+	err = s.backend().RenameFile(ctx, zoneId, oldName, newName, meta, replace)
+	if err != nil {
+		return err
+	}
+	oldEntry.clear()
+	newEntry.clear()
+	s.setLineBuf(cacheKey{ZoneId: zoneId, Name: oldName}, nil)
+	s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: oldName})
+	s.setLineBuf(cacheKey{ZoneId: zoneId, Name: newName}, nil)
+	s.dropReadRegion(cacheKey{ZoneId: zoneId, Name: newName})
+	return nil
+}
+
+func (s *FileStore) runTombstoneSweeper() {
+	defer func() {
+		panichandler.PanicHandler("filestore tombstone sweeper", recover())
+	}()
+	for {
+		if stopFlush.Load() {
+			return
+		}
+		ctx, cancelFn := context.WithTimeout(context.Background(), time.Minute)
+		numDeleted, err := s.SweepTombstones(ctx)
+		cancelFn()
+		if err != nil || numDeleted > 0 {
+			log.Printf("filestore tombstone sweep: %d tombstones deleted, err:%v\n", numDeleted, err)
+		}
+		time.Sleep(TombstoneSweepInterval)
+	}
+}
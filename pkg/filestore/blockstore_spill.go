@@ -0,0 +1,193 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/wavetermdev/waveterm/pkg/panichandler"
+)
+
+// opt-in on-disk overflow for the write cache (see FileStore.SpillDir)
+// when the dirty part data held in memory goes over SpillThreshold, the data parts of the oldest dirty
+// entries are written to scratch files in SpillDir (not the main DB) and dropped from memory.  a spilled
+// entry is reloaded the next time it is locked (for a read, a write, or the flush), so spilling is invisible
+// to callers.  this trades disk I/O for memory, and spilled data is lost on a crash just like cached data.
+
+const SpillCheckInterval = time.Second
+
+// returns the in-memory size of the entry's data parts (0 if they are spilled)
+func (entry *CacheEntry) dataSize() int64 {
+	var size int64
+	for _, dce := range entry.DataEntries {
+		size += int64(len(dce.Data))
+	}
+	return size
+}
+
+// entries with outstanding views (see ReadAtView) are never spilled
+func (entry *CacheEntry) canSpill() bool {
+	if entry.File == nil || entry.SpillPath != "" || len(entry.DataEntries) == 0 {
+		return false
+	}
+	for _, dce := range entry.DataEntries {
+		if dce.ViewCount > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// must hold the entry lock
+func (entry *CacheEntry) spill(spillDir string) error {
+	spillFile, err := os.CreateTemp(spillDir, "wavespill-*")
+	if err != nil {
+		return fmt.Errorf("error creating spill file: %w", err)
+	}
+	parts := make([]*DataCacheEntry, 0, len(entry.DataEntries))
+	for _, dce := range entry.DataEntries {
+		parts = append(parts, dce)
+	}
+	err = gob.NewEncoder(spillFile).Encode(parts)
+	closeErr := spillFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(spillFile.Name())
+		return fmt.Errorf("error writing spill file: %w", err)
+	}
+	entry.SpillPath = spillFile.Name()
+	entry.DataEntries = make(map[int]*DataCacheEntry)
+	return nil
+}
+
+// reloads spilled data parts (no-op if the entry is not spilled), must hold the entry lock
+func (entry *CacheEntry) unspill() error {
+	if entry.SpillPath == "" {
+		return nil
+	}
+	spillFile, err := os.Open(entry.SpillPath)
+	if err != nil {
+		return fmt.Errorf("error opening spill file: %w", err)
+	}
+	var parts []*DataCacheEntry
+	err = gob.NewDecoder(spillFile).Decode(&parts)
+	spillFile.Close()
+	if err != nil {
+		return fmt.Errorf("error reading spill file: %w", err)
+	}
+	for _, dce := range parts {
+		if cap(dce.Data) != int(partDataSize) {
+			newData := make([]byte, len(dce.Data), partDataSize)
+			copy(newData, dce.Data)
+			dce.Data = newData
+		}
+		entry.DataEntries[dce.PartIdx] = dce
+	}
+	entry.removeSpillFile()
+	return nil
+}
+
+func (entry *CacheEntry) removeSpillFile() {
+	if entry.SpillPath == "" {
+		return
+	}
+	err := os.Remove(entry.SpillPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing spill file %s: %v\n", entry.SpillPath, err)
+	}
+	entry.SpillPath = ""
+}
+
+func (s *FileStore) getSpillOpts() (string, int64) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.SpillDir, s.SpillThreshold
+}
+
+type spillCandidate struct {
+	key      cacheKey
+	dirtyGen int64
+	size     int64
+}
+
+// spills the oldest dirty entries until the in-memory dirty data is at or under SpillThreshold
+// entries that are locked (in use) are skipped, returns the number of entries spilled
+func (s *FileStore) spillIfNeeded() (int, error) {
+	spillDir, threshold := s.getSpillOpts()
+	if spillDir == "" {
+		return 0, nil
+	}
+	var totalSize int64
+	var candidates []spillCandidate
+	for _, key := range s.getDirtyCacheKeys() {
+		tryWithLock(s, key.ZoneId, key.Name, func(entry *CacheEntry) {
+			size := entry.dataSize()
+			totalSize += size
+			if entry.canSpill() {
+				candidates = append(candidates, spillCandidate{key: key, dirtyGen: entry.FirstDirtyGen, size: size})
+			}
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].dirtyGen < candidates[j].dirtyGen
+	})
+	var numSpilled int
+	var spillErr error
+	for _, cand := range candidates {
+		if totalSize <= threshold {
+			break
+		}
+		tryWithLock(s, cand.key.ZoneId, cand.key.Name, func(entry *CacheEntry) {
+			if !entry.canSpill() {
+				return
+			}
+			size := entry.dataSize()
+			err := entry.spill(spillDir)
+			if err != nil {
+				spillErr = err
+				return
+			}
+			totalSize -= size
+			numSpilled++
+		})
+		if spillErr != nil {
+			break
+		}
+	}
+	return numSpilled, spillErr
+}
+
+// like withLock, but skips fn if the entry is already locked
+func tryWithLock(s *FileStore, zoneId string, name string, fn func(*CacheEntry)) {
+	entry := s.getEntryAndPin(zoneId, name)
+	defer s.unpinEntryAndTryDelete(zoneId, name)
+	if !entry.Lock.TryLock() {
+		return
+	}
+	defer entry.Lock.Unlock()
+	fn(entry)
+}
+
+func (s *FileStore) runSpiller() {
+	defer func() {
+		panichandler.PanicHandler("filestore spiller", recover())
+	}()
+	for {
+		if stopFlush.Load() {
+			return
+		}
+		numSpilled, err := s.spillIfNeeded()
+		if err != nil || numSpilled > 0 {
+			log.Printf("filestore spill: %d entries spilled, err:%v\n", numSpilled, err)
+		}
+		time.Sleep(SpillCheckInterval)
+	}
+}
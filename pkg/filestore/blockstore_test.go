@@ -6,11 +6,17 @@ package filestore
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"log"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -20,7 +26,7 @@ import (
 	"github.com/wavetermdev/waveterm/pkg/ijson"
 )
 
-func initDb(t *testing.T) {
+func initDb(t testing.TB) {
 	t.Logf("initializing db for %q", t.Name())
 	useTestingDb = true
 	partDataSize = 50
@@ -32,7 +38,7 @@ func initDb(t *testing.T) {
 	}
 }
 
-func cleanupDb(t *testing.T) {
+func cleanupDb(t testing.TB) {
 	t.Logf("cleaning up db for %q", t.Name())
 	if globalDB != nil {
 		globalDB.Close()
@@ -40,6 +46,7 @@ func cleanupDb(t *testing.T) {
 	}
 	useTestingDb = false
 	partDataSize = DefaultPartDataSize
+	WFS.nowFn = nil
 	WFS.clearCache()
 	if warningCount.Load() > 0 {
 		t.Errorf("warning count: %d", warningCount.Load())
@@ -59,6 +66,7 @@ func (s *FileStore) clearCache() {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
 	s.Cache = make(map[cacheKey]*CacheEntry)
+	s.readRegions = nil
 }
 
 //lint:ignore U1000 used for testing
@@ -548,6 +556,13 @@ func TestComputePartMap(t *testing.T) {
 	testIntMapsEq(t, "map9", m, map[int]int{0: 100, 1: 10, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 100, 8: 100, 9: 100})
 	m = file.computePartMap(2005, 1105)
 	testIntMapsEq(t, "map9", m, map[int]int{0: 100, 1: 10, 2: 100, 3: 100, 4: 100, 5: 100, 6: 100, 7: 100, 8: 100, 9: 100})
+
+	// circular file smaller than a part
+	file = &WaveFile{Opts: FileOptsType{Circular: true, MaxSize: 30}}
+	m = file.computePartMap(95, 20)
+	testIntMapsEq(t, "map10", m, map[int]int{0: 20})
+	m = file.computePartMap(95, 50)
+	testIntMapsEq(t, "map11", m, map[int]int{0: 30})
 }
 
 func TestSimpleDBFlush(t *testing.T) {
@@ -748,3 +763,5206 @@ func TestIJson(t *testing.T) {
 		t.Errorf("data mismatch: expected %v, got %v", rootSet["data"], outData)
 	}
 }
+
+func TestReadRanges(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "r1"
+	data := makeText(180)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, fileName, 120, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	expectedData := data[:120] + "hello" + data[125:]
+	ranges := []Range{{Offset: 0, Size: 10}, {Offset: 45, Size: 60}, {Offset: 50, Size: 10}, {Offset: 118, Size: 10}, {Offset: 170, Size: 100}, {Offset: 200, Size: 10}}
+	rtn, err := WFS.ReadRanges(ctx, zoneId, fileName, ranges)
+	if err != nil {
+		t.Fatalf("error reading ranges: %v", err)
+	}
+	if len(rtn) != len(ranges) {
+		t.Fatalf("range count mismatch: expected %d, got %d", len(ranges), len(rtn))
+	}
+	expected := []string{expectedData[0:10], expectedData[45:105], expectedData[50:60], expectedData[118:128], expectedData[170:180], ""}
+	for idx, exp := range expected {
+		if string(rtn[idx]) != exp {
+			t.Errorf("data mismatch for range %d: expected %q, got %q", idx, exp, string(rtn[idx]))
+		}
+	}
+	_, err = WFS.ReadRanges(ctx, zoneId, fileName, []Range{{Offset: -1, Size: 10}})
+	if err == nil {
+		t.Errorf("expected error for negative offset")
+	}
+}
+
+func TestMoveZone(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	newZoneId := uuid.NewString()
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "f2", map[string]any{"a": 1}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "f1", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// leave a dirty write in the cache
+	err = WFS.WriteAt(ctx, zoneId, "f1", 60, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.MoveZone(ctx, zoneId, newZoneId)
+	if err != nil {
+		t.Fatalf("error moving zone: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch -- should have 0 entries after move")
+	}
+	files, err := WFS.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("old zone should have no files, got %d", len(files))
+	}
+	checkFileSize(t, ctx, newZoneId, "f1", 120)
+	checkFileData(t, ctx, newZoneId, "f1", data[:60]+"hello"+data[65:])
+	checkFileSize(t, ctx, newZoneId, "f2", 0)
+
+	// moving onto a zone that already has files must fail
+	err = WFS.MakeFile(ctx, zoneId, "f3", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MoveZone(ctx, zoneId, newZoneId)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist moving onto a non-empty zone, got %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "f3", 0)
+}
+
+func TestAccessTime(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "a1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.AccessTs == 0 {
+		t.Errorf("access ts should be set after stat")
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello")
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	dbFile, err := dbGetZoneFile(ctx, globalDB, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error getting file from db: %v", err)
+	}
+	if dbFile.AccessTs != 0 {
+		t.Errorf("access ts should not be persisted unless TrackAccessTime is set")
+	}
+
+	WFS.TrackAccessTime = true
+	defer func() {
+		WFS.TrackAccessTime = false
+	}()
+	genBefore := WFS.DirtyGeneration(zoneId, fileName)
+	checkFileData(t, ctx, zoneId, fileName, "hello")
+	// reads don't make the file dirty
+	if gen := WFS.DirtyGeneration(zoneId, fileName); gen != genBefore {
+		t.Errorf("read should not move the dirty generation, %d => %d", genBefore, gen)
+	}
+	if dirtyKeys := WFS.getDirtyCacheKeys(); len(dirtyKeys) != 0 {
+		t.Errorf("read should not leave dirty entries, got %v", dirtyKeys)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	dbFile, err = dbGetZoneFile(ctx, globalDB, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error getting file from db: %v", err)
+	}
+	if dbFile.AccessTs == 0 {
+		t.Errorf("access ts should be persisted when TrackAccessTime is set")
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello")
+}
+
+func TestReadAtView(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "v1"
+	data := makeText(80)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	offset, view, releaseFn, err := WFS.ReadAtView(ctx, zoneId, fileName, 10, 20)
+	if err != nil {
+		t.Fatalf("error reading view: %v", err)
+	}
+	if offset != 10 || string(view) != data[10:30] {
+		t.Fatalf("view mismatch: expected %q, got %q (offset %d)", data[10:30], string(view), offset)
+	}
+	// view must not change when the part is written
+	err = WFS.WriteAt(ctx, zoneId, fileName, 10, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	if string(view) != data[10:30] {
+		t.Errorf("view changed after write: expected %q, got %q", data[10:30], string(view))
+	}
+	checkFileDataAt(t, ctx, zoneId, fileName, 10, "hello")
+	releaseFn()
+	releaseFn()
+	if WFS.getCacheSize() != 1 {
+		t.Errorf("cache size mismatch")
+	}
+
+	// spans two parts, falls back to a copy
+	_, view, releaseFn, err = WFS.ReadAtView(ctx, zoneId, fileName, 40, 20)
+	if err != nil {
+		t.Fatalf("error reading view: %v", err)
+	}
+	if string(view) != data[40:50]+data[50:60] {
+		t.Errorf("view mismatch: expected %q, got %q", data[40:60], string(view))
+	}
+	releaseFn()
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		if entry.PinCount != 1 {
+			return fmt.Errorf("pin count mismatch: expected 1, got %d", entry.PinCount)
+		}
+		for _, dce := range entry.DataEntries {
+			if dce.ViewCount != 0 {
+				return fmt.Errorf("view count mismatch for part %d: %d", dce.PartIdx, dce.ViewCount)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error checking entry: %v", err)
+	}
+}
+
+func TestReadAtBuf(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "b1"
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	buf := make([]byte, 70)
+	n, err := WFS.ReadAtBuf(ctx, zoneId, fileName, 10, buf)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if n != 70 || string(buf[:n]) != data[10:80] {
+		t.Errorf("data mismatch: expected %q, got %q", data[10:80], string(buf[:n]))
+	}
+	n, err = WFS.ReadAtBuf(ctx, zoneId, fileName, 100, buf)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if n != 20 || string(buf[:n]) != data[100:] {
+		t.Errorf("data mismatch: expected %q, got %q", data[100:], string(buf[:n]))
+	}
+	n, err = WFS.ReadAtBuf(ctx, zoneId, fileName, 120, buf)
+	if n != 0 || err != io.EOF {
+		t.Errorf("expected (0, io.EOF) at end of file, got (%d, %v)", n, err)
+	}
+
+	circName := "c1"
+	err = WFS.MakeFile(ctx, zoneId, circName, nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, circName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.ReadAtBuf(ctx, zoneId, circName, 10, buf)
+	if err == nil {
+		t.Errorf("expected error reading before the circular window")
+	}
+	n, err = WFS.ReadAtBuf(ctx, zoneId, circName, 90, buf)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	if n != 30 || string(buf[:n]) != data[90:] {
+		t.Errorf("data mismatch: expected %q, got %q", data[90:], string(buf[:n]))
+	}
+}
+
+func TestMaxPartIdx(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "m1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, fileName, 1<<40, []byte("hello"))
+	if err == nil {
+		t.Fatalf("expected error writing at 1TB")
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 0)
+
+	WFS.MaxPartIdx = 3
+	defer func() {
+		WFS.MaxPartIdx = 0
+	}()
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(makeText(200)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("x"))
+	if err == nil {
+		t.Errorf("expected error appending past the max part index")
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 200)
+
+	// MaxSize takes precedence over MaxPartIdx
+	sizedName := "m2"
+	err = WFS.MakeFile(ctx, zoneId, sizedName, nil, FileOptsType{MaxSize: 300})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, sizedName, []byte(makeText(300)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, sizedName, []byte(makeText(301)))
+	if err == nil {
+		t.Errorf("expected error writing past MaxSize")
+	}
+	checkFileSize(t, ctx, zoneId, sizedName, 300)
+}
+
+func TestTouch(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	oldModTs := file.ModTs
+	time.Sleep(5 * time.Millisecond)
+	err = WFS.Touch(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		if len(entry.DataEntries) != 0 {
+			t.Errorf("touch should not load any data parts, got %d", len(entry.DataEntries))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error checking cache entry: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	file, err = WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.ModTs <= oldModTs {
+		t.Errorf("modts not updated: %d <= %d", file.ModTs, oldModTs)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello world")
+
+	err = WFS.Touch(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist touching a missing file, got %v", err)
+	}
+}
+
+func TestWriteMetaBatch(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	names := []string{"f1", "f2", "f3"}
+	for _, name := range names {
+		err := WFS.MakeFile(ctx, zoneId, name, FileMeta{"a": 5}, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err := WFS.WriteMetaBatch(ctx, zoneId, []string{"f1", "missing", "f3"}, FileMeta{"tag": "proj"}, true)
+	if err == nil {
+		t.Errorf("expected error for missing file")
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	checkMeta := func(name string, expected FileMeta) {
+		file, err := WFS.Stat(ctx, zoneId, name)
+		if err != nil {
+			t.Fatalf("error stating file %q: %v", name, err)
+		}
+		// compare printed values, numbers are float64 once meta has round-tripped through the db
+		if fmt.Sprint(file.Meta) != fmt.Sprint(expected) {
+			t.Errorf("meta mismatch for %q: expected %v, got %v", name, expected, file.Meta)
+		}
+	}
+	checkMeta("f1", FileMeta{"a": 5, "tag": "proj"})
+	checkMeta("f2", FileMeta{"a": 5})
+	checkMeta("f3", FileMeta{"a": 5, "tag": "proj"})
+
+	err = WFS.WriteMetaBatch(ctx, zoneId, names, FileMeta{"b": 1}, false)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"c": 2}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	checkMeta("f1", FileMeta{"b": 1, "c": 2})
+	checkMeta("f2", FileMeta{"b": 1})
+}
+
+func TestFileCursor(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	cursor, err := WFS.OpenCursor(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	if WFS.getCacheSize() != 1 {
+		t.Errorf("cursor should keep the entry pinned")
+	}
+	allData, err := io.ReadAll(cursor)
+	if err != nil {
+		t.Fatalf("error reading cursor: %v", err)
+	}
+	if string(allData) != data {
+		t.Errorf("data mismatch: expected %q, got %q", data, string(allData))
+	}
+	pos, err := cursor.Seek(-20, io.SeekEnd)
+	if err != nil || pos != 100 {
+		t.Fatalf("seek mismatch: expected 100, got %d (%v)", pos, err)
+	}
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(cursor, buf)
+	if err != nil || string(buf) != data[100:110] {
+		t.Errorf("data mismatch: expected %q, got %q (%v)", data[100:110], string(buf), err)
+	}
+	pos, err = cursor.Seek(-50, io.SeekCurrent)
+	if err != nil || pos != 60 {
+		t.Fatalf("seek mismatch: expected 60, got %d (%v)", pos, err)
+	}
+	_, err = cursor.Seek(-1, io.SeekStart)
+	if err == nil {
+		t.Errorf("expected error seeking to a negative offset")
+	}
+	cursor.Close()
+	cursor.Close()
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch after close")
+	}
+	_, err = cursor.Read(buf)
+	if !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected fs.ErrClosed reading a closed cursor, got %v", err)
+	}
+
+	// reading from before the circular window skips to the start of the window
+	circName := "c2"
+	err = WFS.MakeFile(ctx, zoneId, circName, nil, FileOptsType{Circular: true, MaxSize: 50})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, circName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	cursor, err = WFS.OpenCursor(ctx, zoneId, circName)
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	defer cursor.Close()
+	allData, err = io.ReadAll(cursor)
+	if err != nil {
+		t.Fatalf("error reading cursor: %v", err)
+	}
+	if string(allData) != data[70:] {
+		t.Errorf("data mismatch: expected %q, got %q", data[70:], string(allData))
+	}
+
+	_, err = WFS.OpenCursor(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist opening a missing file, got %v", err)
+	}
+}
+
+func TestMetaSchema(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"f1", "f2", "f3"} {
+		err := WFS.MakeFile(ctx, zoneId, name, FileMeta{}, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	WFS.RegisterMetaSchema(zoneId, "", MetaSchema{"title": MetaType_String, "count": MetaType_Number, "extra": MetaType_Any})
+	WFS.RegisterMetaSchema(zoneId, "f3", MetaSchema{"flag": MetaType_Bool})
+	defer WFS.RegisterMetaSchema(zoneId, "", nil)
+	defer WFS.RegisterMetaSchema(zoneId, "f3", nil)
+
+	err := WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"title": "hello", "count": 5, "extra": []string{"a"}}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"titel": "typo"}, true)
+	if err == nil {
+		t.Errorf("expected error writing an unknown meta key")
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"count": "five"}, true)
+	if err == nil {
+		t.Errorf("expected error writing a meta value of the wrong type")
+	}
+	// deletes are always allowed
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"junk": nil}, true)
+	if err != nil {
+		t.Errorf("error deleting meta key: %v", err)
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f3", FileMeta{"title": "hello"}, true)
+	if err == nil {
+		t.Errorf("expected error, file schema should take precedence over the zone schema")
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f3", FileMeta{"flag": true}, true)
+	if err != nil {
+		t.Errorf("error writing meta: %v", err)
+	}
+	err = WFS.WriteMetaBatch(ctx, zoneId, []string{"f1", "f2", "f3"}, FileMeta{"count": 1.5}, true)
+	if err == nil {
+		t.Errorf("expected error writing batch meta to f3")
+	}
+	file, err := WFS.Stat(ctx, zoneId, "f2")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["count"] != 1.5 {
+		t.Errorf("meta mismatch: expected count 1.5, got %v", file.Meta["count"])
+	}
+
+	// no schema, free-form
+	otherZoneId := uuid.NewString()
+	err = WFS.MakeFile(ctx, otherZoneId, "f1", FileMeta{}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteMeta(ctx, otherZoneId, "f1", FileMeta{"anything": 1}, true)
+	if err != nil {
+		t.Errorf("error writing meta: %v", err)
+	}
+}
+
+func TestInvalidCircularFile(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "bad1"
+	// MakeFile would reject this, so craft the malformed row directly
+	now := time.Now().UnixMilli()
+	err := dbInsertFile(ctx, globalDB, &WaveFile{ZoneId: zoneId, Name: fileName, Size: 20, CreatedTs: now, ModTs: now, Opts: FileOptsType{Circular: true, MaxSize: 0}})
+	if err != nil {
+		t.Fatalf("error inserting file: %v", err)
+	}
+	_, _, err = WFS.ReadFile(ctx, zoneId, fileName)
+	if err == nil {
+		t.Errorf("expected error reading invalid circular file")
+	}
+	_, _, err = WFS.ReadAt(ctx, zoneId, fileName, 12, 5)
+	if err == nil {
+		t.Errorf("expected error reading invalid circular file")
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	if err == nil {
+		t.Errorf("expected error appending to invalid circular file")
+	}
+	err = WFS.WriteAt(ctx, zoneId, fileName, 15, []byte("hello"))
+	if err == nil {
+		t.Errorf("expected error writing to invalid circular file")
+	}
+	// the file can still be stat'd and deleted
+	checkFileSize(t, ctx, zoneId, fileName, 20)
+	err = WFS.DeleteFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+}
+
+func TestSubPartCircular(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 20})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Opts.MaxSize != 20 {
+		t.Fatalf("maxsize should not be rounded up: got %d", file.Opts.MaxSize)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("123456789 123456789 "))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "123456789 123456789 ")
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("apple"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 25)
+	checkFileData(t, ctx, zoneId, fileName, "6789 123456789 apple")
+	// read across the wrap point
+	checkFileDataAt(t, ctx, zoneId, fileName, 18, "9 apple")
+	err = WFS.WriteAt(ctx, zoneId, fileName, 20, []byte("12345"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "6789 123456789 12345")
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "6789 123456789 12345")
+	// a single write larger than the window keeps only the tail
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("abcdefghijklmnopqrstuvwxyz"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 51)
+	checkFileData(t, ctx, zoneId, fileName, "ghijklmnopqrstuvwxyz")
+	offset, _, _ := WFS.ReadFile(ctx, zoneId, fileName)
+	if offset != 31 {
+		t.Errorf("offset mismatch: expected 31, got %d", offset)
+	}
+	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "hello")
+}
+
+func TestFlushGeneration(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "g1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	startGen := WFS.FlushGeneration(zoneId, fileName)
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	gen := WFS.DirtyGeneration(zoneId, fileName)
+	if gen <= startGen {
+		t.Errorf("dirty generation should advance after a write: %d <= %d", gen, startGen)
+	}
+	flushGen := WFS.FlushGeneration(zoneId, fileName)
+	if flushGen >= gen {
+		t.Errorf("flush generation should be behind before flushing: %d >= %d", flushGen, gen)
+	}
+	if flushGen < startGen {
+		t.Errorf("flush generation went backwards: %d < %d", flushGen, startGen)
+	}
+	err = WFS.WriteMeta(ctx, zoneId, fileName, FileMeta{"a": 1}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	if WFS.FlushGeneration(zoneId, fileName) != flushGen {
+		t.Errorf("flush generation should not change until flushed")
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	flushGen = WFS.FlushGeneration(zoneId, fileName)
+	if flushGen < gen {
+		t.Errorf("flush generation should cover the write after flushing: %d < %d", flushGen, gen)
+	}
+	if WFS.DirtyGeneration(zoneId, fileName) != flushGen {
+		t.Errorf("dirty and flush generations should match when clean")
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if WFS.FlushGeneration(zoneId, fileName) < flushGen {
+		t.Errorf("flush generation went backwards")
+	}
+	if WFS.DirtyGeneration(zoneId, fileName) <= flushGen {
+		t.Errorf("dirty generation should be ahead of flush generation")
+	}
+}
+
+func TestPartialPartFlush(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "p1"
+	data := makeText(70)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	startBytes := partBytesWritten.Load()
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if written := partBytesWritten.Load() - startBytes; written != 70 {
+		t.Errorf("bytes written mismatch for initial flush: expected 70, got %d", written)
+	}
+
+	// a 1-byte append to a partial part should only write 1 byte
+	startBytes = partBytesWritten.Load()
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("x"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if written := partBytesWritten.Load() - startBytes; written != 1 {
+		t.Errorf("bytes written mismatch for 1-byte append: expected 1, got %d", written)
+	}
+	data += "x"
+	checkFileData(t, ctx, zoneId, fileName, data)
+
+	// overwrite in the middle of a full part (including a zero byte)
+	startBytes = partBytesWritten.Load()
+	err = WFS.WriteAt(ctx, zoneId, fileName, 10, []byte("ab\x00c"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if written := partBytesWritten.Load() - startBytes; written != 4 {
+		t.Errorf("bytes written mismatch for overwrite: expected 4, got %d", written)
+	}
+	data = data[:10] + "ab\x00c" + data[14:]
+	checkFileData(t, ctx, zoneId, fileName, data)
+	checkFileSize(t, ctx, zoneId, fileName, 71)
+}
+
+func TestValidator(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	var lastOp string
+	WFS.RegisterValidator("noxyz", func(existing *WaveFile, op string, data []byte) error {
+		lastOp = op
+		if bytes.Contains(data, []byte("xyz")) {
+			return fmt.Errorf("data contains xyz")
+		}
+		return nil
+	})
+	defer WFS.RegisterValidator("noxyz", nil)
+	err := WFS.MakeFile(ctx, zoneId, "v1", FileMeta{ValidatorMetaKey: "noxyz"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "v1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	if lastOp != WriteOp_WriteFile {
+		t.Errorf("validator op mismatch: expected %q, got %q", WriteOp_WriteFile, lastOp)
+	}
+	err = WFS.AppendData(ctx, zoneId, "v1", []byte(" xyz"))
+	if err == nil {
+		t.Errorf("expected validator to reject append")
+	}
+	err = WFS.WriteAt(ctx, zoneId, "v1", 0, []byte("xyz"))
+	if err == nil {
+		t.Errorf("expected validator to reject writeat")
+	}
+	err = WFS.AppendData(ctx, zoneId, "v1", []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "v1", "hello world")
+
+	err = WFS.MakeFile(ctx, zoneId, "v2", FileMeta{ValidatorMetaKey: "notregistered"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "v2", []byte("hello"))
+	if err == nil {
+		t.Errorf("expected error for unknown validator")
+	}
+
+	// ijson files are validated automatically
+	err = WFS.MakeFile(ctx, zoneId, "ij1", nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "ij1", []byte("{\"type\":\"set\",\"data\":1}\n"))
+	if err != nil {
+		t.Fatalf("error appending ijson data: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "ij1", []byte("{\"type\":\"set\""))
+	if err == nil {
+		t.Errorf("expected error appending partial ijson command")
+	}
+	err = WFS.AppendData(ctx, zoneId, "ij1", []byte("not json\n"))
+	if err == nil {
+		t.Errorf("expected error appending invalid json")
+	}
+	err = WFS.WriteAt(ctx, zoneId, "ij1", 0, []byte("{}"))
+	if err == nil {
+		t.Errorf("expected error writing at an offset in an ijson file")
+	}
+	checkFileData(t, ctx, zoneId, "ij1", "{\"type\":\"set\",\"data\":1}\n")
+}
+
+func TestPartSnapshots(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(120)
+	err := WFS.MakeFile(ctx, zoneId, "src", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "src", []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "src", 55, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	data = data[:55] + "hello" + data[60:]
+	snaps, err := WFS.GetPartSnapshots(ctx, zoneId, "src", []int{0, 1, 2, 3})
+	if err != nil {
+		t.Fatalf("error getting part snapshots: %v", err)
+	}
+	if len(snaps) != 3 {
+		t.Fatalf("snapshot count mismatch: expected 3, got %d", len(snaps))
+	}
+	if string(snaps[1].Data) != data[50:100] {
+		t.Errorf("snapshot data mismatch: expected %q, got %q", data[50:100], string(snaps[1].Data))
+	}
+	err = WFS.MakeFile(ctx, zoneId, "dest", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	badSnaps := []PartSnapshot{{PartIdx: 0, Data: snaps[0].Data, Checksum: snaps[0].Checksum + 1}}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "dest", 120, badSnaps)
+	if err == nil {
+		t.Errorf("expected checksum error")
+	}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "dest", 100, snaps)
+	if err == nil {
+		t.Errorf("expected error for part past the end of the file")
+	}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "dest", 120, snaps)
+	if err != nil {
+		t.Fatalf("error putting part snapshots: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "dest", 120)
+	checkFileData(t, ctx, zoneId, "dest", data)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "dest", data)
+
+	// cached parts past the new size are dropped (and the part spanning it is truncated)
+	err = WFS.AppendData(ctx, zoneId, "dest", []byte(makeText(80)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "dest", 70, snaps[:1])
+	if err != nil {
+		t.Fatalf("error putting part snapshots: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "dest", data[:70])
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	layout, err := WFS.GetPartLayout(ctx, zoneId, "dest")
+	if err != nil {
+		t.Fatalf("error getting part layout: %v", err)
+	}
+	if expected := map[int]int{0: 50, 1: 20}; !reflect.DeepEqual(layout, expected) {
+		t.Errorf("expected layout %v, got %v", expected, layout)
+	}
+	checkFileData(t, ctx, zoneId, "dest", data[:70])
+
+	// circular files: parts must lie in the ring (MaxSize/partDataSize parts) and within fileSize before it wraps
+	circOpts := FileOptsType{Circular: true, MaxSize: 100}
+	err = WFS.MakeFile(ctx, zoneId, "csrc", nil, circOpts)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	circData := makeText(130)
+	err = WFS.AppendData(ctx, zoneId, "csrc", []byte(circData))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	circSnaps, err := WFS.GetPartSnapshots(ctx, zoneId, "csrc", []int{0, 1, 2})
+	if err != nil {
+		t.Fatalf("error getting part snapshots: %v", err)
+	}
+	if len(circSnaps) != 2 {
+		t.Fatalf("snapshot count mismatch: expected 2, got %d", len(circSnaps))
+	}
+	err = WFS.MakeFile(ctx, zoneId, "cdest", nil, circOpts)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	pastRing := []PartSnapshot{{PartIdx: 2, Data: []byte("x"), Checksum: crc32.ChecksumIEEE([]byte("x"))}}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "cdest", 130, pastRing)
+	if err == nil {
+		t.Errorf("expected error for a part past the circular window")
+	}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "cdest", 60, circSnaps)
+	if err == nil {
+		t.Errorf("expected error for parts past the end of an unwrapped circular file")
+	}
+	err = WFS.PutPartSnapshots(ctx, zoneId, "cdest", 130, circSnaps)
+	if err != nil {
+		t.Fatalf("error putting part snapshots: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "cdest", circData[30:])
+}
+
+func TestArchiveOverflow(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	archiveName := fileName + ArchiveSuffix
+	data := makeText(260)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 100, ArchiveOverflow: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data[:80]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, archiveName)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("archive file should not exist before the first wrap, got %v", err)
+	}
+	for offset := 80; offset < 230; offset += 30 {
+		err = WFS.AppendData(ctx, zoneId, fileName, []byte(data[offset:offset+30]))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	checkFileData(t, ctx, zoneId, fileName, data[130:230])
+	checkFileData(t, ctx, zoneId, archiveName, data[:130])
+
+	// a write past the window that is longer than MaxSize
+	err = WFS.WriteAt(ctx, zoneId, fileName, 200, []byte(data[200:]))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, data[160:])
+	checkFileData(t, ctx, zoneId, archiveName, data[:160])
+
+	err = WFS.MakeFile(ctx, zoneId, "bad", nil, FileOptsType{ArchiveOverflow: true})
+	if err == nil {
+		t.Errorf("expected error creating a non-circular archive overflow file")
+	}
+
+	// concurrent appends: the archive followed by the window holds every chunk exactly once, in write order
+	err = WFS.MakeFile(ctx, zoneId, "c2", nil, FileOptsType{Circular: true, MaxSize: 100, ArchiveOverflow: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	const numWriters, numChunks = 4, 25
+	var wg sync.WaitGroup
+	for writer := 0; writer < numWriters; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := 0; idx < numChunks; idx++ {
+				err := WFS.AppendData(ctx, zoneId, "c2", []byte(fmt.Sprintf("%d:%07d\n", writer, idx)))
+				if err != nil {
+					t.Errorf("error appending data: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	_, archiveData, err := WFS.ReadFile(ctx, zoneId, "c2"+ArchiveSuffix)
+	if err != nil {
+		t.Fatalf("error reading archive: %v", err)
+	}
+	_, windowData, err := WFS.ReadFile(ctx, zoneId, "c2")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	allData := append(archiveData, windowData...)
+	if len(allData) != numWriters*numChunks*10 {
+		t.Fatalf("expected %d bytes in the archive and window, got %d", numWriters*numChunks*10, len(allData))
+	}
+	nextChunk := make([]int, numWriters)
+	for offset := 0; offset < len(allData); offset += 10 {
+		var writer, idx int
+		_, err := fmt.Sscanf(string(allData[offset:offset+10]), "%d:%d\n", &writer, &idx)
+		if err != nil || writer < 0 || writer >= numWriters || idx != nextChunk[writer] {
+			t.Fatalf("unexpected chunk %q at offset %d", allData[offset:offset+10], offset)
+		}
+		nextChunk[writer]++
+	}
+
+	// a failed archive append doesn't fail the write (which has already been applied), the overflow stays queued
+	// and is appended by the next flush
+	backend := &failInsertBackend{failName: "c3" + ArchiveSuffix}
+	store := NewFileStore(FileStoreOpts{Backend: backend})
+	obs := &testObserver{lock: &sync.Mutex{}}
+	store.RegisterObserver(obs)
+	err = store.MakeFile(ctx, zoneId, "c3", nil, FileOptsType{Circular: true, MaxSize: 100, ArchiveOverflow: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.AppendData(ctx, zoneId, "c3", []byte(data[:80]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = store.AppendData(ctx, zoneId, "c3", []byte(data[80:150]))
+	if err != nil {
+		t.Fatalf("archive error should not fail the append: %v", err)
+	}
+	if expected := []string{"write:c3:0:80", "write:c3:80:70"}; !reflect.DeepEqual(obs.events, expected) {
+		t.Errorf("observer events mismatch: expected %v, got %v", expected, obs.events)
+	}
+	_, err = store.Stat(ctx, zoneId, "c3"+ArchiveSuffix)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("archive file should not exist after the failed archive append, got %v", err)
+	}
+	backend.failName = ""
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, archiveData, err = store.ReadFile(ctx, zoneId, "c3"+ArchiveSuffix)
+	if err != nil {
+		t.Fatalf("error reading archive: %v", err)
+	}
+	if string(archiveData) != data[:50] {
+		t.Errorf("archive data mismatch: expected %q, got %q", data[:50], archiveData)
+	}
+	if len(store.archiveQueues) != 0 {
+		t.Errorf("expected the archive queue to be drained, got %d queues", len(store.archiveQueues))
+	}
+}
+
+type failInsertBackend struct {
+	DBBackend
+	failName string
+}
+
+func (b *failInsertBackend) InsertFile(ctx context.Context, file *WaveFile) error {
+	if file.Name == b.failName {
+		return fmt.Errorf("injected insert error")
+	}
+	return b.DBBackend.InsertFile(ctx, file)
+}
+
+func TestFreezeCircular(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	data := makeText(230)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.FreezeCircular(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error freezing file: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch")
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Opts.Circular || file.Opts.MaxSize != 0 {
+		t.Errorf("opts mismatch: %v", file.Opts)
+	}
+	checkFileSize(t, ctx, zoneId, fileName, 100)
+	checkFileData(t, ctx, zoneId, fileName, data[130:])
+
+	// no longer wraps
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, data[130:]+"hello")
+
+	err = WFS.FreezeCircular(ctx, zoneId, fileName)
+	if err == nil {
+		t.Errorf("expected error freezing a non-circular file")
+	}
+}
+
+func TestTrimFront(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	data := makeText(230)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{TrimFront: true, MaxSize: 90})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Opts.MaxSize != 100 {
+		t.Errorf("maxsize should be rounded up to a multiple of the part size, got %d", file.Opts.MaxSize)
+	}
+	for offset := 0; offset < 230; offset += 23 {
+		err = WFS.AppendData(ctx, zoneId, fileName, []byte(data[offset:offset+23]))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	file, err = WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Size != 230 || file.StartOffset != 150 || file.DataLength() != 80 {
+		t.Errorf("file mismatch: size %d, startoffset %d, datalength %d", file.Size, file.StartOffset, file.DataLength())
+	}
+	dbParts, err := dbGetFileParts(ctx, globalDB, zoneId, fileName, []int{0, 1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("error getting db parts: %v", err)
+	}
+	if len(dbParts) != 2 || dbParts[3] == nil || dbParts[4] == nil {
+		t.Errorf("trimmed parts should be deleted from the db, got %d parts", len(dbParts))
+	}
+	offset, rdata, err := WFS.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if offset != 150 || string(rdata) != data[150:] {
+		t.Errorf("data mismatch: expected %q at 150, got %q at %d", data[150:], string(rdata), offset)
+	}
+	checkFileDataAt(t, ctx, zoneId, fileName, 160, data[160:170])
+
+	// writes into the trimmed region are truncated
+	err = WFS.WriteAt(ctx, zoneId, fileName, 140, []byte("abcdefghijklmnopqrst"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "klmnopqrst"+data[160:])
+
+	// WriteFile resets the start offset
+	err = WFS.WriteFile(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	offset, rdata, err = WFS.ReadFile(ctx, zoneId, fileName)
+	if err != nil || offset != 0 || string(rdata) != "hello" {
+		t.Errorf("data mismatch after WriteFile: got %q at %d (%v)", string(rdata), offset, err)
+	}
+
+	err = WFS.MakeFile(ctx, zoneId, "bad", nil, FileOptsType{TrimFront: true})
+	if err == nil {
+		t.Errorf("expected error creating a trimfront file without a max size")
+	}
+}
+
+func TestCircularAppendWrap(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// appends of 7 bytes don't line up with the part size, flush every few appends so partial parts come from the DB
+	var allData []byte
+	for i := 0; len(allData) < 200; i++ {
+		chunk := []byte(fmt.Sprintf("%06d|", i))
+		if len(allData)+len(chunk) > 200 {
+			chunk = chunk[:200-len(allData)]
+		}
+		err = WFS.AppendData(ctx, zoneId, fileName, chunk)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		allData = append(allData, chunk...)
+		if i%3 == 0 {
+			_, err = WFS.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing cache: %v", err)
+			}
+		}
+	}
+	// exactly one full wrap
+	checkFileSize(t, ctx, zoneId, fileName, 200)
+	checkFileData(t, ctx, zoneId, fileName, string(allData[100:]))
+	offset, _, _ := WFS.ReadFile(ctx, zoneId, fileName)
+	if offset != 100 {
+		t.Errorf("offset mismatch: expected 100, got %d", offset)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("abc"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	allData = append(allData, "abc"...)
+	checkFileData(t, ctx, zoneId, fileName, string(allData[103:]))
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, string(allData[103:]))
+	checkFileDataAt(t, ctx, zoneId, fileName, 150, string(allData[150:170]))
+}
+
+func TestReadPrefersCachePart(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "r1"
+	data := makeText(100)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// part 1 is now dirty in the cache, with an older version in the DB
+	err = WFS.WriteAt(ctx, zoneId, fileName, 60, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	dbParts, err := dbGetFileParts(ctx, globalDB, zoneId, fileName, []int{1})
+	if err != nil {
+		t.Fatalf("error getting db parts: %v", err)
+	}
+	if string(dbParts[1].Data) != data[50:100] {
+		t.Fatalf("db part should still have the old data")
+	}
+	expected := data[:60] + "hello" + data[65:]
+	checkFileData(t, ctx, zoneId, fileName, expected)
+	checkFileDataAt(t, ctx, zoneId, fileName, 55, expected[55:75])
+	rtn, err := WFS.ReadRanges(ctx, zoneId, fileName, []Range{{Offset: 40, Size: 30}})
+	if err != nil {
+		t.Fatalf("error reading ranges: %v", err)
+	}
+	if string(rtn[0]) != expected[40:70] {
+		t.Errorf("data mismatch: expected %q, got %q", expected[40:70], string(rtn[0]))
+	}
+}
+
+func TestListZonesModifiedSince(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId1 := uuid.NewString()
+	zoneId2 := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId1, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId2, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now().UnixMilli()
+	zoneIds, err := WFS.ListZonesModifiedSince(ctx, since)
+	if err != nil {
+		t.Fatalf("error listing modified zones: %v", err)
+	}
+	if len(zoneIds) != 0 {
+		t.Errorf("expected no modified zones, got %v", zoneIds)
+	}
+	// un-flushed write
+	err = WFS.AppendData(ctx, zoneId2, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	zoneIds, err = WFS.ListZonesModifiedSince(ctx, since)
+	if err != nil {
+		t.Fatalf("error listing modified zones: %v", err)
+	}
+	if len(zoneIds) != 1 || zoneIds[0] != zoneId2 {
+		t.Errorf("expected [%s], got %v", zoneId2, zoneIds)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	zoneIds, err = WFS.ListZonesModifiedSince(ctx, since)
+	if err != nil {
+		t.Fatalf("error listing modified zones: %v", err)
+	}
+	if len(zoneIds) != 1 || zoneIds[0] != zoneId2 {
+		t.Errorf("expected [%s] after flush, got %v", zoneId2, zoneIds)
+	}
+	zoneIds, err = WFS.ListZonesModifiedSince(ctx, 0)
+	if err != nil {
+		t.Fatalf("error listing modified zones: %v", err)
+	}
+	if len(zoneIds) != 2 {
+		t.Errorf("expected 2 zones, got %v", zoneIds)
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(120)
+	for _, name := range []string{"a", "b"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = WFS.WriteFile(ctx, zoneId, name, []byte(data))
+		if err != nil {
+			t.Fatalf("error writing data: %v", err)
+		}
+	}
+	diffs, err := WFS.DiffFiles(ctx, zoneId, "a", zoneId, "b")
+	if err != nil {
+		t.Fatalf("error diffing files: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diffs, got %v", diffs)
+	}
+	// the second write spans a part boundary, so its range must be merged
+	err = WFS.WriteAt(ctx, zoneId, "b", 10, []byte("xx"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "b", 48, []byte("abcd"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "b", []byte("tail"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	diffs, err = WFS.DiffFiles(ctx, zoneId, "a", zoneId, "b")
+	if err != nil {
+		t.Fatalf("error diffing files: %v", err)
+	}
+	expected := []Range{{Offset: 10, Size: 2}, {Offset: 48, Size: 4}, {Offset: 120, Size: 4}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("diff mismatch: expected %v, got %v", expected, diffs)
+	}
+
+	// parts with matching checksums are not read, and the diff does not record access
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	WFS.TrackAccessTime = true
+	defer func() {
+		WFS.TrackAccessTime = false
+	}()
+	queriesBefore := partReadQueries.Load()
+	diffs, err = WFS.DiffFiles(ctx, zoneId, "a", zoneId, "b")
+	if err != nil {
+		t.Fatalf("error diffing files: %v", err)
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("diff mismatch after flush: expected %v, got %v", expected, diffs)
+	}
+	// one query per file for the differing parts (0, 1 and 2), the checksum lookups do not read part data
+	if numQueries := partReadQueries.Load() - queriesBefore; numQueries != 2 {
+		t.Errorf("expected 2 part read queries, got %d", numQueries)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "a", 10, []byte("xx"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "a", 48, []byte("abcd"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	stats, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	queriesBefore = partReadQueries.Load()
+	diffs, err = WFS.DiffFiles(ctx, zoneId, "a", zoneId, "b")
+	if err != nil {
+		t.Fatalf("error diffing files: %v", err)
+	}
+	expected = []Range{{Offset: 120, Size: 4}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("diff mismatch: expected %v, got %v", expected, diffs)
+	}
+	// only the last part (the tail) is read
+	if numQueries := partReadQueries.Load() - queriesBefore; numQueries != 2 {
+		t.Errorf("expected 2 part read queries, got %d", numQueries)
+	}
+	if stats.NumDirtyEntries != 1 {
+		t.Errorf("expected only the written file to be dirty, got %d dirty entries", stats.NumDirtyEntries)
+	}
+	stats, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDirtyEntries != 0 {
+		t.Errorf("diff should not dirty the files, got %d dirty entries", stats.NumDirtyEntries)
+	}
+	diffs, err = WFS.DiffFiles(ctx, zoneId, "a", zoneId, "a")
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("expected no diffs for the same file, got %v %v", diffs, err)
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var flushStats []FlushStats
+	WFS.OnFlush = func(stats FlushStats) {
+		flushStats = append(flushStats, stats)
+	}
+	defer func() {
+		WFS.OnFlush = nil
+	}()
+	zoneId := uuid.NewString()
+	fileName := "f1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	stats, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if len(flushStats) != 1 {
+		t.Fatalf("expected 1 flush callback, got %d", len(flushStats))
+	}
+	if flushStats[0] != stats {
+		t.Errorf("callback stats mismatch: %+v vs %+v", flushStats[0], stats)
+	}
+	if stats.NumCommitted != 1 || stats.BytesWritten != 120 || stats.NumErrors != 0 {
+		t.Errorf("stats mismatch: %+v", stats)
+	}
+}
+
+func TestFlushBatchSize(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	WFS.FlushBatchSize = 3
+	defer func() {
+		WFS.FlushBatchSize = 0
+	}()
+	zoneId := uuid.NewString()
+	fileName := "b1"
+	data := makeText(520)
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte(data))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("cache size mismatch")
+	}
+	dbParts, err := dbGetFileParts(ctx, globalDB, zoneId, fileName, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	if err != nil {
+		t.Fatalf("error getting db parts: %v", err)
+	}
+	if len(dbParts) != 11 {
+		t.Errorf("db part count mismatch: expected 11, got %d", len(dbParts))
+	}
+	checkFileData(t, ctx, zoneId, fileName, data)
+}
+
+func TestMaxInFlightFlushBytes(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := makeText(330)
+	flushFile := func(store *FileStore, fileName string) int64 {
+		err := store.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.AppendData(ctx, zoneId, fileName, []byte(data))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+		statementsBefore := partWriteStatements.Load()
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		checkFileData(t, ctx, zoneId, fileName, data)
+		return partWriteStatements.Load() - statementsBefore
+	}
+	// 7 parts (6 full, 30 bytes in the last)
+	numStatements := flushFile(NewFileStore(FileStoreOpts{}), "f1")
+	if numStatements != 1 {
+		t.Errorf("expected the parts to be written in 1 statement without a byte limit, got %d", numStatements)
+	}
+	numStatements = flushFile(NewFileStore(FileStoreOpts{MaxInFlightFlushBytes: 120}), "f2")
+	if numStatements != 4 {
+		t.Errorf("expected the parts to be written in 4 statements of at most 120 bytes, got %d", numStatements)
+	}
+	// parts larger than the limit are still written (one per statement)
+	numStatements = flushFile(NewFileStore(FileStoreOpts{MaxInFlightFlushBytes: 10}), "f3")
+	if numStatements != 7 {
+		t.Errorf("expected one statement per part, got %d", numStatements)
+	}
+	batch := FlushBatch{MaxParts: 2, MaxBytes: 120}
+	parts := []*DataCacheEntry{{Data: make([]byte, 50)}, {Data: make([]byte, 50)}, {Data: make([]byte, 50)}}
+	if numParts := batch.numParts(parts); numParts != 2 {
+		t.Errorf("expected MaxParts to limit the batch to 2 parts, got %d", numParts)
+	}
+}
+
+func TestWriteAtInfo(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// 120 bytes at offset 0 spans parts 0, 1, 2
+	info, err := WFS.WriteAtInfo(ctx, zoneId, fileName, 0, bytes.Repeat([]byte("a"), 120))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if info != (WriteInfo{PartsDirtied: 3, SizeChanged: true, NewSize: 120}) {
+		t.Errorf("unexpected write info: %+v", info)
+	}
+	// overwrite within part 1
+	info, err = WFS.WriteAtInfo(ctx, zoneId, fileName, 60, []byte("bbbb"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if info != (WriteInfo{PartsDirtied: 1, SizeChanged: false, NewSize: 120}) {
+		t.Errorf("unexpected write info: %+v", info)
+	}
+	// crosses from part 1 into part 2 and extends the file
+	info, err = WFS.WriteAtInfo(ctx, zoneId, fileName, 95, bytes.Repeat([]byte("c"), 30))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if info != (WriteInfo{PartsDirtied: 2, SizeChanged: true, NewSize: 125}) {
+		t.Errorf("unexpected write info: %+v", info)
+	}
+}
+
+func TestNowFn(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var clock atomic.Int64
+	clock.Store(1000)
+	WFS.nowFn = clock.Load
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	clock.Store(2000)
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.CreatedTs != 1000 || file.ModTs != 2000 {
+		t.Errorf("unexpected timestamps: created %d, mod %d", file.CreatedTs, file.ModTs)
+	}
+	clock.Store(3000)
+	err = WFS.Touch(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error touching file: %v", err)
+	}
+	file, err = WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.ModTs != 3000 {
+		t.Errorf("unexpected modts after touch: %d", file.ModTs)
+	}
+}
+
+func TestReadIJsonRange(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "ij1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{IJson: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendIJson(ctx, zoneId, fileName, ijson.MakeSetCommand(nil, map[string]any{"tag": "div", "class": "root"}))
+	if err != nil {
+		t.Fatalf("error appending ijson: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		err = WFS.AppendIJson(ctx, zoneId, fileName, ijson.MakeAppendCommand(ijson.Path{"children"}, map[string]any{"tag": "span", "idx": i}))
+		if err != nil {
+			t.Fatalf("error appending ijson: %v", err)
+		}
+	}
+	_, fullData, err := WFS.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(fullData, []byte("\n")), []byte("\n"))
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(lines))
+	}
+	// simulate a partially written trailing record
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		entry.writeAt(entry.File.Size, []byte(`{"type":"append","path":["chil`), false)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error writing partial record: %v", err)
+	}
+	checkRange := func(startRec int, count int, expected [][]byte) {
+		t.Helper()
+		recs, err := WFS.ReadIJsonRange(ctx, zoneId, fileName, startRec, count)
+		if err != nil {
+			t.Fatalf("error reading ijson range: %v", err)
+		}
+		if len(recs) != len(expected) {
+			t.Fatalf("range [%d, +%d): expected %d records, got %d", startRec, count, len(expected), len(recs))
+		}
+		for idx, rec := range recs {
+			if !bytes.Equal(rec, expected[idx]) {
+				t.Errorf("range [%d, +%d): record %d mismatch: expected %q, got %q", startRec, count, idx, expected[idx], rec)
+			}
+		}
+	}
+	checkRange(0, 5, lines)
+	checkRange(1, 2, lines[1:3])
+	checkRange(3, 10, lines[3:])
+	checkRange(5, 1, nil)
+	checkRange(0, 0, nil)
+
+	err = WFS.MakeFile(ctx, zoneId, "plain", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.ReadIJsonRange(ctx, zoneId, "plain", 0, 1)
+	if err == nil {
+		t.Errorf("expected error reading ijson range from a non-ijson file")
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := []byte(makeText(170))
+	err = WFS.WriteFile(ctx, zoneId, "f1", data)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// regular files hash their data one part at a time
+	expected := rollupChecksums([][]byte{partChecksum(data[0:50]), partChecksum(data[50:100]), partChecksum(data[100:150]), partChecksum(data[150:])})
+	WFS.clearCache()
+	queriesBefore := partReadQueries.Load()
+	hash, err := WFS.HashFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	if !bytes.Equal(hash, expected) {
+		t.Errorf("hash mismatch")
+	}
+	// a clean file returns the stored rollup without reading any parts
+	if numQueries := partReadQueries.Load() - queriesBefore; numQueries != 0 {
+		t.Errorf("expected no part reads for a clean file, got %d", numQueries)
+	}
+	// circular files are hashed in physical part order: part 0 holds [100, 150), part 1 holds [150, 170) and then [70, 100)
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "c1", data)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	part1 := append(append([]byte{}, data[150:]...), data[70:100]...)
+	expected = rollupChecksums([][]byte{partChecksum(data[100:150]), partChecksum(part1)})
+	hash, err = WFS.HashFile(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	if !bytes.Equal(hash, expected) {
+		t.Errorf("circular hash mismatch (dirty)")
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	hash, err = WFS.HashFile(ctx, zoneId, "c1")
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	if !bytes.Equal(hash, expected) {
+		t.Errorf("circular hash mismatch (flushed)")
+	}
+	_, err = WFS.HashFile(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestListFilesConsistent(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"c", "a", "b"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	// un-flushed (cache only) change
+	err := WFS.AppendData(ctx, zoneId, "b", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, "c")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	files, err := WFS.ListFilesConsistent(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 2 || files[0].Name != "a" || files[1].Name != "b" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+	if files[1].Size != 5 {
+		t.Errorf("expected cached size 5, got %d", files[1].Size)
+	}
+
+	// files created and deleted concurrently never show up as partial entries
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprintf("tmp-%d-%d", i, j)
+				WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+				WFS.AppendData(ctx, zoneId, name, []byte("x"))
+				WFS.DeleteFile(ctx, zoneId, name)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		files, err := WFS.ListFilesConsistent(ctx, zoneId)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file == nil || file.ZoneId != zoneId {
+				t.Fatalf("invalid file in listing: %v", file)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestWriteAtIfSize(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAtIfSize(ctx, zoneId, fileName, 0, []byte("HELLO"), 11)
+	if err != nil {
+		t.Fatalf("error writing with matching size: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAtIfSize(ctx, zoneId, fileName, 6, []byte("WORLD"), 11)
+	if !errors.Is(err, ErrSizeChanged) {
+		t.Fatalf("expected ErrSizeChanged, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, "HELLO world!")
+}
+
+func TestPrefetch(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 20)
+	err = WFS.WriteFile(ctx, zoneId, fileName, data)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	// [60, 140) covers parts 1 and 2
+	err = WFS.Prefetch(ctx, zoneId, fileName, 60, 80)
+	if err != nil {
+		t.Fatalf("error prefetching: %v", err)
+	}
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		if len(entry.DataEntries) != 2 || entry.DataEntries[1] == nil || entry.DataEntries[2] == nil {
+			t.Errorf("expected parts 1 and 2 to be cached, got %s", entry.dump())
+		}
+		if entry.File != nil {
+			t.Errorf("expected the file not to be cached")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error checking cache: %v", err)
+	}
+	checkFileDataAt(t, ctx, zoneId, fileName, 60, string(data[60:140]))
+	// external edit of the file row, the flush must not overwrite it
+	err = WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec("UPDATE db_wave_file SET meta = ? WHERE zoneid = ? AND name = ?", `{"ext":1}`, zoneId, fileName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error editing db: %v", err)
+	}
+	// prefetched parts are clean, so the flush does not rewrite them (or the file row)
+	stats, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if stats.NumDirtyEntries != 0 || stats.BytesWritten != 0 {
+		t.Errorf("expected nothing to be flushed, got %d entries, %d bytes", stats.NumDirtyEntries, stats.BytesWritten)
+	}
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	checkMapsEqual(t, map[string]any{"ext": float64(1)}, file.Meta, "meta")
+	// the flush drops the prefetched parts
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected the prefetched parts to be dropped, cache size %d", WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, fileName, string(data))
+}
+
+func TestMaxAppendChunk(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.MaxAppendChunk = 60
+	defer func() {
+		WFS.MaxAppendChunk = 0
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("01234567890123456789"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	bigData := bytes.Repeat([]byte("abcdefghij"), 23)
+	err = WFS.AppendData(ctx, zoneId, fileName, bigData)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// earlier chunks were flushed, only the parts of the last chunk are dirty
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		if len(entry.DataEntries) > 2 {
+			t.Errorf("expected at most 2 dirty parts, got %d", len(entry.DataEntries))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error checking cache: %v", err)
+	}
+	expected := "01234567890123456789" + string(bigData)
+	checkFileSize(t, ctx, zoneId, fileName, int64(len(expected)))
+	checkFileData(t, ctx, zoneId, fileName, expected)
+	WFS.FlushCache(ctx)
+	checkFileData(t, ctx, zoneId, fileName, expected)
+
+	// a failed chunk flush rolls the whole append back, including the chunks that were already flushed.  the
+	// writes are: the flush of the pending "xyz" before the chunks, two chunks (the second fails) and the rollback
+	backend := &failOnceBackend{failName: fileName, failWrite: 3}
+	store := NewFileStore(FileStoreOpts{Backend: backend, MaxAppendChunk: 60})
+	err = store.AppendData(ctx, zoneId, fileName, []byte("xyz"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	expected += "xyz"
+	hashBefore, err := store.HashFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	err = store.AppendData(ctx, zoneId, fileName, bigData)
+	if err == nil || !strings.Contains(err.Error(), "injected write error") {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+	flushErrorCount.Add(-1)
+	_, data, err := store.ReadFile(ctx, zoneId, fileName)
+	if err != nil || string(data) != expected {
+		t.Errorf("expected the file to be rolled back, got %d bytes (err:%v)", len(data), err)
+	}
+	store.clearCache()
+	hashAfter, err := store.HashFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error hashing file: %v", err)
+	}
+	if !bytes.Equal(hashBefore, hashAfter) {
+		t.Errorf("the stored file changed after the rollback")
+	}
+	partSizes, err := backend.GetPartSizes(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error getting part sizes: %v", err)
+	}
+	if expectedSizes := map[int]int{0: 50, 1: 50, 2: 50, 3: 50, 4: 50, 5: 3}; !reflect.DeepEqual(partSizes, expectedSizes) {
+		t.Errorf("expected the parts written by the append to be dropped, got %v", partSizes)
+	}
+}
+
+// wraps the DB backend, failing the failWrite'th (1-based) WriteCacheEntry of failName
+type failOnceBackend struct {
+	DBBackend
+	failName  string
+	failWrite int
+	numWrites int
+}
+
+func (b *failOnceBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	if file.Name == b.failName {
+		b.numWrites++
+		if b.numWrites == b.failWrite {
+			return 0, fmt.Errorf("injected write error")
+		}
+	}
+	return b.DBBackend.WriteCacheEntry(ctx, file, dataEntries, replace, batch)
+}
+
+func TestSpill(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	spillDir := t.TempDir()
+	WFS.SpillDir = spillDir
+	WFS.SpillThreshold = 150
+	defer func() {
+		WFS.SpillDir = ""
+		WFS.SpillThreshold = 0
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	dataA := bytes.Repeat([]byte("a"), 100)
+	dataB := bytes.Repeat([]byte("b"), 100)
+	for _, name := range []string{"fa", "fb"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	err := WFS.AppendData(ctx, zoneId, "fa", dataA)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "fb", dataB)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	numSpilled, err := WFS.spillIfNeeded()
+	if err != nil {
+		t.Fatalf("error spilling: %v", err)
+	}
+	// only the oldest entry needs to be spilled to get under the threshold
+	if numSpilled != 1 {
+		t.Fatalf("expected 1 entry spilled, got %d", numSpilled)
+	}
+	getSpillPath := func(name string) string {
+		WFS.Lock.Lock()
+		defer WFS.Lock.Unlock()
+		return WFS.Cache[cacheKey{ZoneId: zoneId, Name: name}].SpillPath
+	}
+	spillPath := getSpillPath("fa")
+	if spillPath == "" || getSpillPath("fb") != "" {
+		t.Fatalf("expected fa (and only fa) to be spilled")
+	}
+	// reading reloads the spilled parts
+	checkFileData(t, ctx, zoneId, "fa", string(dataA))
+	if getSpillPath("fa") != "" {
+		t.Errorf("expected fa to be reloaded")
+	}
+	if _, err := os.Stat(spillPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected spill file to be removed, got %v", err)
+	}
+
+	WFS.SpillThreshold = 0
+	numSpilled, err = WFS.spillIfNeeded()
+	if err != nil || numSpilled != 2 {
+		t.Fatalf("expected 2 entries spilled, got %d (err:%v)", numSpilled, err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "fa", string(dataA))
+	checkFileData(t, ctx, zoneId, "fb", string(dataB))
+	dirEntries, err := os.ReadDir(spillDir)
+	if err != nil {
+		t.Fatalf("error reading spill dir: %v", err)
+	}
+	if len(dirEntries) != 0 {
+		t.Errorf("expected spill dir to be empty after flush, got %d files", len(dirEntries))
+	}
+}
+
+func TestInvalidateFile(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"f1", "f2"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = WFS.WriteFile(ctx, zoneId, name, []byte("hello"))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	// f1 has clean (prefetched) parts cached, f2 has an unflushed change
+	err := WFS.Prefetch(ctx, zoneId, "f1", 0, 5)
+	if err != nil {
+		t.Fatalf("error prefetching: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "f2", []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// external edit (the data is either inline or in part 0)
+	newData := []byte("HELLO")
+	err = WithTx(ctx, func(tx *TxWrap) error {
+		tx.Exec("UPDATE db_wave_file SET inlinedata = ? WHERE zoneid = ? AND name = ? AND inlinedata IS NOT NULL", newData, zoneId, "f1")
+		tx.Exec("UPDATE db_file_data SET data = ?, checksum = ? WHERE zoneid = ? AND name = ? AND partidx = 0", newData, partChecksum(newData), zoneId, "f1")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error editing db: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+	skipped := WFS.InvalidateZone(zoneId)
+	if !reflect.DeepEqual(skipped, []string{"f2"}) {
+		t.Errorf("expected f2 to be skipped, got %v", skipped)
+	}
+	checkFileData(t, ctx, zoneId, "f1", "HELLO")
+	checkFileData(t, ctx, zoneId, "f2", "hello world")
+	if WFS.InvalidateFile(zoneId, "f2") {
+		t.Errorf("dirty file should not be invalidated")
+	}
+	if !WFS.InvalidateFile(zoneId, "missing") {
+		t.Errorf("uncached file should be reported as invalidated")
+	}
+}
+
+type testObserver struct {
+	lock   *sync.Mutex
+	events []string
+}
+
+func (o *testObserver) record(event string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *testObserver) OnWrite(zoneId string, name string, offset int64, n int) {
+	// observers run outside the locks, so calling back into the store must not deadlock
+	WFS.Stat(context.Background(), zoneId, name)
+	o.record(fmt.Sprintf("write:%s:%d:%d", name, offset, n))
+}
+
+func (o *testObserver) OnMeta(zoneId string, name string) {
+	o.record("meta:" + name)
+}
+
+func (o *testObserver) OnDelete(zoneId string, name string) {
+	o.record("delete:" + name)
+}
+
+func TestObserver(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	defer func() {
+		WFS.Observers = nil
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	obs1 := &testObserver{lock: &sync.Mutex{}}
+	obs2 := &testObserver{lock: &sync.Mutex{}}
+	WFS.RegisterObserver(obs1)
+	WFS.RegisterObserver(obs2)
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "f1", []byte(" world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "f1", 1, []byte("EL"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "f1", 100, []byte("x"))
+	if err == nil {
+		t.Fatalf("expected error writing past the end of the file")
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"a": 1}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	expected := []string{"write:f1:0:5", "write:f1:5:6", "write:f1:1:2", "meta:f1", "delete:f1"}
+	for _, obs := range []*testObserver{obs1, obs2} {
+		if !reflect.DeepEqual(obs.events, expected) {
+			t.Errorf("observer events mismatch: expected %v, got %v", expected, obs.events)
+		}
+	}
+}
+
+func TestReadAtWithHoles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "sparse"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// parts 1 and 2 are holes, part 0 has real zeros
+	part0 := make([]byte, 50)
+	part3 := bytes.Repeat([]byte("x"), 50)
+	snaps := []PartSnapshot{
+		{PartIdx: 0, Data: part0, Checksum: crc32.ChecksumIEEE(part0)},
+		{PartIdx: 3, Data: part3, Checksum: crc32.ChecksumIEEE(part3)},
+	}
+	err = WFS.PutPartSnapshots(ctx, zoneId, fileName, 200, snaps)
+	if err != nil {
+		t.Fatalf("error putting part snapshots: %v", err)
+	}
+	checkHoles := func(offset int64, size int64, expected []Range) {
+		t.Helper()
+		_, data, holes, err := WFS.ReadAtWithHoles(ctx, zoneId, fileName, offset, size)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if int64(len(data)) != size {
+			t.Errorf("expected %d bytes, got %d", size, len(data))
+		}
+		if !reflect.DeepEqual(holes, expected) {
+			t.Errorf("holes mismatch for [%d, +%d): expected %v, got %v", offset, size, expected, holes)
+		}
+	}
+	checkHoles(0, 200, []Range{{Offset: 50, Size: 100}})
+	checkHoles(60, 20, []Range{{Offset: 60, Size: 20}})
+	checkHoles(0, 50, nil)
+	WFS.FlushCache(ctx)
+	checkHoles(40, 120, []Range{{Offset: 50, Size: 100}})
+}
+
+func TestCompactCircular(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	WFS.CircularCompactWraps = 2
+	defer func() {
+		WFS.CircularCompactWraps = 0
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var allData []byte
+	for i := 0; i < 25; i++ {
+		chunk := []byte(fmt.Sprintf("line-%04d\n", i))
+		allData = append(allData, chunk...)
+		err = WFS.AppendData(ctx, zoneId, fileName, chunk)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// 250 bytes is 2 wraps (not more than 2), so no compaction yet
+	checkFileSize(t, ctx, zoneId, fileName, 250)
+	cursor, err := WFS.OpenCursor(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	defer cursor.Close()
+	_, err = io.ReadAll(cursor)
+	if err != nil {
+		t.Fatalf("error reading cursor: %v", err)
+	}
+	beforeCompact, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	for i := 25; i < 35; i++ {
+		chunk := []byte(fmt.Sprintf("line-%04d\n", i))
+		allData = append(allData, chunk...)
+		err = WFS.AppendData(ctx, zoneId, fileName, chunk)
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	// the compaction runs in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		file, err := WFS.Stat(ctx, zoneId, fileName)
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		if file.Size <= 100 {
+			if !file.Opts.Circular || file.Opts.MaxSize != 100 {
+				t.Errorf("compaction should keep the circular opts, got %+v", file.Opts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("circular file was not compacted, size %d", file.Size)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	offset, data, err := WFS.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if offset != 0 || !bytes.Equal(data, allData[len(allData)-100:]) {
+		t.Errorf("data mismatch after compaction: offset %d, data %q", offset, data)
+	}
+	// the offsets moved down by the old window start (350 - 100), and the version moved past the appends
+	file, err := WFS.Stat(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if rebase, _ := getMetaInt64(file.Meta, RebaseMetaKey); rebase != 250 {
+		t.Errorf("expected rebase 250, got %v", file.Meta[RebaseMetaKey])
+	}
+	if file.Version <= beforeCompact.Version+10 {
+		t.Errorf("expected the compaction to bump the version past %d, got %d", beforeCompact.Version+10, file.Version)
+	}
+	// writes continue normally after compaction
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("more\n"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	allData = append(allData, []byte("more\n")...)
+	_, data, err = WFS.ReadFile(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if !bytes.Equal(data, allData[len(allData)-100:]) {
+		t.Errorf("data mismatch after append: %q", data)
+	}
+	// the cursor (at the old end of file) follows the rebase and picks up where it left off (minus the bytes
+	// overwritten by the last append)
+	cursorData, err := io.ReadAll(cursor)
+	if err != nil {
+		t.Fatalf("error reading cursor: %v", err)
+	}
+	if !bytes.Equal(cursorData, allData[len(allData)-100:]) {
+		t.Errorf("cursor data mismatch after compaction: %q", cursorData)
+	}
+}
+
+func TestReadFileLimit(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	data := bytes.Repeat([]byte("0123456789"), 12)
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "f1", data)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkLimit := func(name string, maxBytes int64, expectedOffset int64, expected []byte, expectedTruncated bool) {
+		t.Helper()
+		offset, rtnData, truncated, err := WFS.ReadFileLimit(ctx, zoneId, name, maxBytes)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if offset != expectedOffset || !bytes.Equal(rtnData, expected) || truncated != expectedTruncated {
+			t.Errorf("%s limit %d: expected (%d, %q, %v), got (%d, %q, %v)", name, maxBytes, expectedOffset, expected, expectedTruncated, offset, rtnData, truncated)
+		}
+	}
+	checkLimit("f1", 55, 0, data[:55], true)
+	checkLimit("f1", 120, 0, data, false)
+	checkLimit("f1", 1000, 0, data, false)
+	// circular files are limited from the start of the live window
+	err = WFS.MakeFile(ctx, zoneId, "c1", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "c1", data)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkLimit("c1", 30, 20, data[20:50], true)
+	_, _, _, err = WFS.ReadFileLimit(ctx, zoneId, "missing", 10)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "big", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "big", bytes.Repeat([]byte("x"), 200*1024))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, "big")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	stats, err := WFS.Vacuum(ctx)
+	if err != nil {
+		t.Fatalf("error vacuuming: %v", err)
+	}
+	if stats.BytesFreed <= 0 || stats.SizeAfter >= stats.SizeBefore {
+		t.Errorf("expected vacuum to free space, got %+v", stats)
+	}
+	// vacuum is refused while a flush is in progress
+	WFS.setIsFlushing(true)
+	_, err = WFS.Vacuum(ctx)
+	WFS.setIsFlushing(false)
+	if err == nil {
+		t.Errorf("expected error vacuuming during a flush")
+	}
+}
+
+func TestEagerMetaFlush(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	defer func() {
+		WFS.EagerMetaFlush = false
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "f1", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	getDBMeta := func() FileMeta {
+		file, err := dbGetZoneFile(ctx, globalDB, zoneId, "f1")
+		if err != nil {
+			t.Fatalf("error getting file: %v", err)
+		}
+		return file.Meta
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"lazy": "a"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	if _, ok := getDBMeta()["lazy"]; ok {
+		t.Errorf("meta should not be in the db before the flush")
+	}
+	WFS.EagerMetaFlush = true
+	err = WFS.AppendData(ctx, zoneId, "f1", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "f1", FileMeta{"eager": "b"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	dbMeta := getDBMeta()
+	if dbMeta["lazy"] != "a" || dbMeta["eager"] != "b" {
+		t.Errorf("expected meta to be written eagerly, got %v", dbMeta)
+	}
+	// only the meta is written, the data is still waiting for the flush
+	dbFile, err := dbGetZoneFile(ctx, globalDB, zoneId, "f1")
+	if err != nil {
+		t.Fatalf("error getting file: %v", err)
+	}
+	if dbFile.Size != 0 {
+		t.Errorf("expected db size 0 before the flush, got %d", dbFile.Size)
+	}
+	WFS.FlushCache(ctx)
+	checkFileData(t, ctx, zoneId, "f1", "hello")
+}
+
+func TestCircularWrapGuard(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "c1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// an unaligned write of exactly MaxSize wraps into part 0 twice without overlapping, so it is allowed
+	err = WFS.AppendData(ctx, zoneId, fileName, []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	window := bytes.Repeat([]byte("abcdefghij"), 10)
+	err = WFS.AppendData(ctx, zoneId, fileName, window)
+	if err != nil {
+		t.Fatalf("error appending full window: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, string(window))
+	// corrupt the cached maxsize so it no longer fits the parts (100 bytes in 2 parts)
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		entry.File.Opts.MaxSize = 120
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error updating cached opts: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, fileName, bytes.Repeat([]byte("x"), 120))
+	if err == nil || !strings.Contains(err.Error(), "wraps onto itself") {
+		t.Errorf("expected wrap error, got %v", err)
+	}
+	err = withLock(WFS, zoneId, fileName, func(entry *CacheEntry) error {
+		entry.File.Opts.MaxSize = 100
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error updating cached opts: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, fileName, string(window))
+}
+
+func TestStatExt(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	fileName := "t1"
+	err := WFS.MakeFile(ctx, zoneId, fileName, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, fileName, bytes.Repeat([]byte("x"), 120))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkExt := func(partCount int, cachedParts int, dirtyParts int, pinned bool) {
+		t.Helper()
+		ext, err := WFS.StatExt(ctx, zoneId, fileName)
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		if ext.PartCount != partCount || ext.CachedParts != cachedParts || ext.DirtyParts != dirtyParts || ext.Pinned != pinned {
+			t.Errorf("expected (parts %d, cached %d, dirty %d, pinned %v), got (%d, %d, %d, %v)", partCount, cachedParts, dirtyParts, pinned, ext.PartCount, ext.CachedParts, ext.DirtyParts, ext.Pinned)
+		}
+	}
+	checkExt(3, 0, 0, false)
+	// appending to the partial last part loads it from the db and dirties it, part 3 is new
+	err = WFS.AppendData(ctx, zoneId, fileName, bytes.Repeat([]byte("y"), 40))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.Prefetch(ctx, zoneId, fileName, 0, 50)
+	if err != nil {
+		t.Fatalf("error prefetching: %v", err)
+	}
+	checkExt(4, 3, 2, false)
+	cursor, err := WFS.OpenCursor(ctx, zoneId, fileName)
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	checkExt(4, 3, 2, true)
+	cursor.Close()
+	WFS.FlushCache(ctx)
+	checkExt(4, 0, 0, false)
+}
+
+func TestForEachFileGlobal(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneIds := []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}
+	numFiles := 0
+	for _, zoneId := range zoneIds {
+		for i := 0; i < ForEachFilePageSize*3/4; i++ {
+			err := WFS.MakeFile(ctx, zoneId, fmt.Sprintf("f%03d", i), nil, FileOptsType{})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			numFiles++
+		}
+	}
+	err := WFS.AppendData(ctx, zoneIds[1], "f005", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	seen := make(map[string]bool)
+	var sawCachedSize bool
+	err = WFS.ForEachFileGlobal(ctx, func(file *WaveFile) error {
+		key := file.ZoneId + "/" + file.Name
+		if seen[key] {
+			t.Errorf("file %s visited twice", key)
+		}
+		seen[key] = true
+		if file.ZoneId == zoneIds[1] && file.Name == "f005" {
+			sawCachedSize = file.Size == 5
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error iterating files: %v", err)
+	}
+	if len(seen) != numFiles {
+		t.Errorf("expected %d files, got %d", numFiles, len(seen))
+	}
+	if !sawCachedSize {
+		t.Errorf("expected un-flushed size to be applied")
+	}
+	stopErr := errors.New("stop")
+	count := 0
+	err = WFS.ForEachFileGlobal(ctx, func(file *WaveFile) error {
+		count++
+		if count == 10 {
+			return stopErr
+		}
+		return nil
+	})
+	if err != stopErr || count != 10 {
+		t.Errorf("expected to stop after 10 files with stopErr, got %d (err:%v)", count, err)
+	}
+	cancelCtx, cancelIterFn := context.WithCancel(ctx)
+	count = 0
+	err = WFS.ForEachFileGlobal(cancelCtx, func(file *WaveFile) error {
+		count++
+		if count == 5 {
+			cancelIterFn()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || count != 5 {
+		t.Errorf("expected to stop after cancel, got %d (err:%v)", count, err)
+	}
+}
+
+func TestNewFileStore(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var flushStats []FlushStats
+	store := NewFileStore(FileStoreOpts{FlushBatchSize: 1, OnFlush: func(stats FlushStats) {
+		flushStats = append(flushStats, stats)
+	}})
+	if store == WFS || store.getFlushBatch().MaxParts != 1 {
+		t.Fatalf("expected a new store with FlushBatchSize 1")
+	}
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	if len(WFS.Cache) != 0 {
+		t.Errorf("expected WFS cache to be untouched, got %d entries", len(WFS.Cache))
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if len(flushStats) != 1 {
+		t.Errorf("expected OnFlush to be called once, got %d", len(flushStats))
+	}
+	// both stores share the DB
+	checkFileData(t, ctx, zoneId, "testfile", "hello world")
+}
+
+func TestFileStoreDB(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	otherDB, err := MakeDB(ctx)
+	if err != nil {
+		t.Fatalf("error making db: %v", err)
+	}
+	defer otherDB.Close()
+	err = MigrateDB(otherDB)
+	if err != nil {
+		t.Fatalf("error migrating db: %v", err)
+	}
+	store := NewFileStore(FileStoreOpts{DB: otherDB})
+	zoneId := uuid.NewString()
+	err = store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	_, data, err := store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("expected data from the store's own db, got %q (err:%v)", data, err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, "testfile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected file to not exist in the global db, got err:%v", err)
+	}
+	// the same zone/name can exist independently in both stores
+	err = WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file in WFS: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "testfile", 0)
+	file, err := store.Stat(ctx, zoneId, "testfile")
+	if err != nil || file.Size != 11 {
+		t.Errorf("expected size 11 in the other store, got %v (err:%v)", file, err)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var curTime int64 = 1000000
+	WFS.nowFn = func() int64 { return curTime }
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", FileMeta{"a": "b"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte("hello world, this is longer than a single part of data"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.SoftDeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error soft deleting file: %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, "testfile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected file to be gone, got err:%v", err)
+	}
+	tombFile, err := WFS.Stat(ctx, zoneId, TombstoneName("testfile"))
+	if err != nil {
+		t.Fatalf("error stating tombstone: %v", err)
+	}
+	if deleteTs, _ := getTombstoneDeleteTs(tombFile.Meta); deleteTs != curTime {
+		t.Errorf("expected delete ts %d, got %v", curTime, tombFile.Meta[TombstoneMetaKey])
+	}
+	curTime += 1000
+	err = WFS.UndeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error undeleting file: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", "hello world, this is longer than a single part of data")
+	file, err := WFS.Stat(ctx, zoneId, "testfile")
+	if err != nil || file.Meta["a"] != "b" || file.Meta[TombstoneMetaKey] != nil {
+		t.Errorf("expected meta to be restored without the delete ts, got %v (err:%v)", file, err)
+	}
+	err = WFS.UndeleteFile(ctx, zoneId, "testfile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist undeleting a live file, got %v", err)
+	}
+
+	// re-created files block the undelete
+	err = WFS.SoftDeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error soft deleting file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error re-creating file: %v", err)
+	}
+	err = WFS.UndeleteFile(ctx, zoneId, "testfile")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected ErrExist, got %v", err)
+	}
+
+	// past the grace period the tombstone can't be restored and is swept
+	err = WFS.MakeFile(ctx, zoneId, "other", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.SoftDeleteFile(ctx, zoneId, "other")
+	if err != nil {
+		t.Fatalf("error soft deleting file: %v", err)
+	}
+	curTime += DefaultSoftDeleteGrace.Milliseconds() / 2
+	err = WFS.SoftDeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error soft deleting file: %v", err)
+	}
+	curTime += DefaultSoftDeleteGrace.Milliseconds()/2 + 1
+	err = WFS.UndeleteFile(ctx, zoneId, "other")
+	if !errors.Is(err, ErrTombstoneExpired) {
+		t.Errorf("expected ErrTombstoneExpired, got %v", err)
+	}
+	numDeleted, err := WFS.SweepTombstones(ctx)
+	if err != nil || numDeleted != 1 {
+		t.Errorf("expected 1 tombstone swept, got %d (err:%v)", numDeleted, err)
+	}
+	files, err := WFS.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	if len(files) != 1 || files[0].Name != TombstoneName("testfile") {
+		t.Errorf("expected only the newer tombstone to remain, got %v", files)
+	}
+	err = WFS.UndeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error undeleting file: %v", err)
+	}
+	checkFileSize(t, ctx, zoneId, "testfile", 0)
+}
+
+func TestGetFilesWithNamePrefix(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"a_b", "axb", "a%c", "ab", `a\d`} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file %q: %v", name, err)
+		}
+	}
+	for prefix, expected := range map[string][]string{"a_": {"a_b"}, "a%": {"a%c"}, `a\`: {`a\d`}, "a": {"a%c", `a\d`, "a_b", "ab", "axb"}} {
+		files, err := WFS.backend().GetFilesWithNamePrefix(ctx, prefix)
+		if err != nil {
+			t.Fatalf("error getting files: %v", err)
+		}
+		var names []string
+		for _, file := range files {
+			if file.ZoneId == zoneId {
+				names = append(names, file.Name)
+			}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("prefix %q: expected %v, got %v", prefix, expected, names)
+		}
+	}
+}
+
+func TestGetPartLayout(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 0, bytes.Repeat([]byte("a"), 60))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// part 0 is only in the DB, part 1 is in both (the cache wins), part 2 is only in the cache
+	err = WFS.AppendData(ctx, zoneId, "testfile", bytes.Repeat([]byte("b"), 50))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	layout, err := WFS.GetPartLayout(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting part layout: %v", err)
+	}
+	expected := map[int]int{0: 50, 1: 50, 2: 10}
+	if !reflect.DeepEqual(layout, expected) {
+		t.Errorf("expected layout %v, got %v", expected, layout)
+	}
+	fileExt, err := WFS.StatExt(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting file ext: %v", err)
+	}
+	if fileExt.StoredBytes != 110 {
+		t.Errorf("expected 110 stored bytes, got %d", fileExt.StoredBytes)
+	}
+	_, err = WFS.GetPartLayout(ctx, zoneId, "nofile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestMakeDeleteRace(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.DeleteFileStrict(ctx, zoneId, "testfile")
+	if err != fs.ErrNotExist {
+		t.Fatalf("expected ErrNotExist deleting a missing file, got %v", err)
+	}
+	err = WFS.DeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("expected no error deleting a missing file with DeleteFile, got %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		var makeErr, deleteErr error
+		wg := &sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			makeErr = WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+		}()
+		go func() {
+			defer wg.Done()
+			deleteErr = WFS.DeleteFileStrict(ctx, zoneId, "testfile")
+		}()
+		wg.Wait()
+		if makeErr != nil {
+			t.Fatalf("iteration %d: unexpected MakeFile error: %v", i, makeErr)
+		}
+		_, statErr := WFS.Stat(ctx, zoneId, "testfile")
+		switch deleteErr {
+		case nil:
+			// make won, then delete
+			if !errors.Is(statErr, fs.ErrNotExist) {
+				t.Fatalf("iteration %d: expected file to be deleted, got stat err:%v", i, statErr)
+			}
+		case fs.ErrNotExist:
+			// delete won (nothing to delete), then make
+			if statErr != nil {
+				t.Fatalf("iteration %d: expected file to exist, got stat err:%v", i, statErr)
+			}
+			err = WFS.DeleteFile(ctx, zoneId, "testfile")
+			if err != nil {
+				t.Fatalf("iteration %d: error deleting file: %v", i, err)
+			}
+		default:
+			t.Fatalf("iteration %d: unexpected DeleteFileStrict error: %v", i, deleteErr)
+		}
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected no leftover cache entries, got %d", WFS.getCacheSize())
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 12)
+	err = WFS.WriteFile(ctx, zoneId, "testfile", data)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	expectedChecksum := func(data []byte) []byte {
+		var checksums [][]byte
+		for start := 0; start < len(data); start += int(partDataSize) {
+			checksums = append(checksums, partChecksum(data[start:min(start+int(partDataSize), len(data))]))
+		}
+		return rollupChecksums(checksums)
+	}
+	checksum, err := WFS.HashFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting checksum: %v", err)
+	}
+	if !bytes.Equal(checksum, expectedChecksum(data)) {
+		t.Errorf("checksum mismatch after WriteFile")
+	}
+	// dirty (un-flushed) changes are included
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 55, []byte("xyz"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	copy(data[55:], "xyz")
+	data = append(data, "hello"...)
+	checksum, err = WFS.HashFile(ctx, zoneId, "testfile")
+	if err != nil || !bytes.Equal(checksum, expectedChecksum(data)) {
+		t.Errorf("checksum mismatch with dirty parts (err:%v)", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	stored, err := dbGetFileChecksum(ctx, globalDB, zoneId, "testfile")
+	if err != nil || !bytes.Equal(stored, expectedChecksum(data)) {
+		t.Errorf("stored checksum mismatch after flush (err:%v)", err)
+	}
+	err = WFS.VerifyFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Errorf("error verifying file: %v", err)
+	}
+
+	// parts written before checksums were tracked are backfilled on the next flush
+	_, err = globalDB.ExecContext(ctx, "UPDATE db_file_data SET checksum = NULL WHERE zoneid = ? AND partidx = 0", zoneId)
+	if err != nil {
+		t.Fatalf("error clearing checksum: %v", err)
+	}
+	checksum, err = WFS.HashFile(ctx, zoneId, "testfile")
+	if err != nil || !bytes.Equal(checksum, expectedChecksum(data)) {
+		t.Errorf("checksum mismatch with a missing part checksum (err:%v)", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("!"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	data = append(data, '!')
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	partSums, err := dbGetPartChecksums(ctx, globalDB, zoneId, "testfile")
+	if err != nil || partSums[0] == nil {
+		t.Errorf("expected part 0 checksum to be backfilled (err:%v)", err)
+	}
+	checksum, err = WFS.HashFile(ctx, zoneId, "testfile")
+	if err != nil || !bytes.Equal(checksum, expectedChecksum(data)) {
+		t.Errorf("checksum mismatch after backfill (err:%v)", err)
+	}
+
+	// corruption in the DB is detected
+	_, err = globalDB.ExecContext(ctx, "UPDATE db_file_data SET data = CAST('corrupt' AS BLOB) WHERE zoneid = ? AND partidx = 1", zoneId)
+	if err != nil {
+		t.Fatalf("error corrupting data: %v", err)
+	}
+	err = WFS.VerifyFile(ctx, zoneId, "testfile")
+	if !errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), "[1]") {
+		t.Errorf("expected checksum mismatch for part 1, got %v", err)
+	}
+	_, err = WFS.HashFile(ctx, zoneId, "nofile")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestAppendDataReturnSize(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	const numAppends = 40
+	sizes := make([]int64, numAppends)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numAppends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			size, err := WFS.AppendDataReturnSize(ctx, zoneId, "testfile", []byte("0123456"))
+			if err != nil {
+				t.Errorf("error appending data: %v", err)
+			}
+			sizes[i] = size
+		}()
+	}
+	wg.Wait()
+	// every append sees a distinct size
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	for i, size := range sizes {
+		if size != int64(i+1)*7 {
+			t.Fatalf("expected sizes to be multiples of 7 with no repeats, got %v", sizes)
+		}
+	}
+	checkFileSize(t, ctx, zoneId, "testfile", numAppends*7)
+}
+
+func TestReadFiles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	contents := map[string]string{
+		"a": strings.Repeat("a", 120),
+		"b": "hello",
+		"c": "",
+	}
+	for name, content := range contents {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = WFS.AppendData(ctx, zoneId, name, []byte(content))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	_, err := WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// un-flushed changes are reconciled with the DB parts
+	err = WFS.WriteAt(ctx, zoneId, "a", 60, []byte("XYZ"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	contents["a"] = contents["a"][:60] + "XYZ" + contents["a"][63:]
+	err = WFS.MakeFile(ctx, zoneId, "circ", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	circData := bytes.Repeat([]byte("0123456789"), 13)
+	err = WFS.AppendData(ctx, zoneId, "circ", circData)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	contents["circ"] = string(circData[30:])
+	rtn, err := WFS.ReadFiles(ctx, zoneId, []string{"circ", "b", "a", "c", "missing", "a"})
+	if err != nil {
+		t.Fatalf("error reading files: %v", err)
+	}
+	if len(rtn) != len(contents) {
+		t.Errorf("expected %d files, got %d", len(contents), len(rtn))
+	}
+	for name, content := range contents {
+		data, ok := rtn[name]
+		if !ok || string(data) != content {
+			t.Errorf("file %q: expected %q, got %q (found:%v)", name, content, data, ok)
+		}
+	}
+}
+
+func TestPartsToLoadForWrite(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	file := &WaveFile{Size: 110}
+	tests := []struct {
+		offset   int64
+		size     int64
+		expected []int
+	}{
+		{100, 30, nil},      // aligned, overwrites all of part 2's data
+		{110, 30, []int{2}}, // append into the middle of part 2
+		{100, 5, []int{2}},  // keeps the tail of part 2
+		{60, 60, []int{1}},  // keeps the head of part 1, part 2 is fully overwritten
+		{0, 110, nil},       // whole file
+		{20, 10, []int{0}},  // inside a single part
+		{50, 50, nil},       // exactly one part
+		{100, 0, nil},       // empty write
+	}
+	for _, test := range tests {
+		parts := file.partsToLoadForWrite(test.offset, test.size)
+		sort.Ints(parts)
+		if !reflect.DeepEqual(parts, test.expected) {
+			t.Errorf("write [%d, +%d): expected %v, got %v", test.offset, test.size, test.expected, parts)
+		}
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	data := bytes.Repeat([]byte("a"), 110)
+	err = WFS.WriteFile(ctx, zoneId, "testfile", data)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 100, bytes.Repeat([]byte("b"), 30))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	expected := string(data[:100]) + strings.Repeat("b", 30)
+	checkFileData(t, ctx, zoneId, "testfile", expected)
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	checkFileData(t, ctx, zoneId, "testfile", expected)
+}
+
+func TestFollowReader(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("hello "))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	reader, err := WFS.FollowReader(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening follow reader: %v", err)
+	}
+	defer reader.Close()
+	writerDoneCh := make(chan struct{})
+	go func() {
+		defer close(writerDoneCh)
+		for _, chunk := range []string{"world", strings.Repeat("x", 60), "!"} {
+			time.Sleep(10 * time.Millisecond)
+			WFS.AppendData(ctx, zoneId, "testfile", []byte(chunk))
+		}
+	}()
+	expected := "hello world" + strings.Repeat("x", 60) + "!"
+	var got []byte
+	buf := make([]byte, 16)
+	for len(got) < len(expected) {
+		n, err := reader.Read(buf)
+		if err != nil {
+			t.Fatalf("error reading: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	// the last append can still be running after its data is readable
+	<-writerDoneCh
+	if string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// Close unblocks a waiting Read
+	readErrCh := make(chan error, 1)
+	go func() {
+		_, err := reader.Read(buf)
+		readErrCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	reader.Close()
+	select {
+	case err := <-readErrCh:
+		if err != io.EOF {
+			t.Errorf("expected io.EOF after Close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Read did not return after Close")
+	}
+
+	// canceling ctx ends the follow, and so does deleting the file
+	cancelCtx, cancelFollowFn := context.WithCancel(ctx)
+	reader2, err := WFS.FollowReader(cancelCtx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening follow reader: %v", err)
+	}
+	defer reader2.Close()
+	io.ReadFull(reader2, make([]byte, len(expected)))
+	time.AfterFunc(10*time.Millisecond, cancelFollowFn)
+	_, err = reader2.Read(buf)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	reader3, err := WFS.FollowReader(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening follow reader: %v", err)
+	}
+	defer reader3.Close()
+	io.ReadFull(reader3, make([]byte, len(expected)))
+	time.AfterFunc(10*time.Millisecond, func() { WFS.DeleteFile(ctx, zoneId, "testfile") })
+	_, err = reader3.Read(buf)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist after delete, got %v", err)
+	}
+}
+
+type testSpan struct {
+	op    string
+	attrs map[string]any
+	err   error
+	ended bool
+}
+
+func (span *testSpan) SetAttribute(key string, value any) { span.attrs[key] = value }
+func (span *testSpan) RecordError(err error)              { span.err = err }
+func (span *testSpan) End()                               { span.ended = true }
+
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) StartSpan(ctx context.Context, op string) (context.Context, Span) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	span := &testSpan{op: op, attrs: make(map[string]any)}
+	tr.spans = append(tr.spans, span)
+	return ctx, span
+}
+
+func TestTracer(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	tracer := &testTracer{}
+	WFS.Tracer = tracer
+	defer func() {
+		WFS.Tracer = nil
+	}()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", bytes.Repeat([]byte("a"), 60))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 10, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, _, err = WFS.ReadAt(ctx, zoneId, "testfile", 40, 20)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 100, []byte("x"))
+	if err == nil {
+		t.Fatalf("expected error writing past the end of the file")
+	}
+	expected := []struct {
+		op       string
+		numBytes int64
+		numParts int
+		isErr    bool
+	}{
+		{TraceOp_AppendData, 60, 2, false},
+		{TraceOp_WriteAt, 5, 1, false},
+		{TraceOp_ReadAt, 20, 2, false},
+		{TraceOp_FlushEntry, 60, 2, false},
+		{TraceOp_WriteAt, 1, 0, true},
+	}
+	if len(tracer.spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(tracer.spans))
+	}
+	for idx, exp := range expected {
+		span := tracer.spans[idx]
+		if span.op != exp.op || !span.ended || (span.err != nil) != exp.isErr {
+			t.Errorf("span %d: expected op %s (err:%v), got %s (ended:%v, err:%v)", idx, exp.op, exp.isErr, span.op, span.ended, span.err)
+		}
+		if span.attrs[TraceAttr_ZoneId] != zoneId || span.attrs[TraceAttr_Name] != "testfile" {
+			t.Errorf("span %d: wrong zoneid/name attributes %v", idx, span.attrs)
+		}
+		if span.attrs[TraceAttr_Bytes] != exp.numBytes || span.attrs[TraceAttr_Parts] != exp.numParts {
+			t.Errorf("span %d (%s): expected bytes:%d parts:%d, got %v", idx, span.op, exp.numBytes, exp.numParts, span.attrs)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, name := range []string{"good", "phantom", "orphan"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = WFS.WriteFile(ctx, zoneId, name, []byte(makeText(120)))
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	// simulate crash leftovers
+	_, err := globalDB.ExecContext(ctx, "DELETE FROM db_file_data WHERE zoneid = ? AND name = 'phantom'", zoneId)
+	if err != nil {
+		t.Fatalf("error deleting parts: %v", err)
+	}
+	_, err = globalDB.ExecContext(ctx, "DELETE FROM db_wave_file WHERE zoneid = ? AND name = 'orphan'", zoneId)
+	if err != nil {
+		t.Fatalf("error deleting file row: %v", err)
+	}
+	WFS.clearCache()
+	report, err := WFS.Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("error running fsck: %v", err)
+	}
+	expected := FsckReport{
+		OrphanFiles:  []FsckFile{{ZoneId: zoneId, Name: "orphan", NumParts: 3}},
+		PhantomFiles: []FsckFile{{ZoneId: zoneId, Name: "phantom", Size: 120}},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+	// diagnostic only, running it again finds the same problems
+	report, err = WFS.Fsck(ctx, true)
+	if err != nil {
+		t.Fatalf("error running fsck: %v", err)
+	}
+	expected.Repaired = true
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+	checkFileSize(t, ctx, zoneId, "phantom", 0)
+	checkFileData(t, ctx, zoneId, "good", makeText(120))
+	report, err = WFS.Fsck(ctx, false)
+	if err != nil || !report.Clean() {
+		t.Errorf("expected a clean report after repair, got %+v (err:%v)", report, err)
+	}
+}
+
+func TestLineBuffered(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "ijson", nil, FileOptsType{IJson: true, LineBuffered: true})
+	if err == nil {
+		t.Fatalf("expected error creating line buffered ijson file")
+	}
+	err = WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{LineBuffered: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	appendFn := func(data string) {
+		t.Helper()
+		err := WFS.AppendData(ctx, zoneId, "testfile", []byte(data))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	appendFn("hello")
+	checkFileSize(t, ctx, zoneId, "testfile", 0)
+	appendFn(" world\nsecond")
+	checkFileData(t, ctx, zoneId, "testfile", "hello world\n")
+	if WFS.LineBufferSize(zoneId, "testfile") != 6 {
+		t.Errorf("expected 6 pending bytes, got %d", WFS.LineBufferSize(zoneId, "testfile"))
+	}
+	// pending bytes survive the cache entry being dropped
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	checkFileData(t, ctx, zoneId, "testfile", "hello world\n")
+	// a line longer than a part is held until it is complete
+	longLine := makeText(3 * int(partDataSize))
+	appendFn(" line\n" + longLine)
+	checkFileData(t, ctx, zoneId, "testfile", "hello world\nsecond line\n")
+	appendFn("\n")
+	checkFileData(t, ctx, zoneId, "testfile", "hello world\nsecond line\n"+longLine+"\n")
+	appendFn("partial")
+	err = WFS.FlushLineBuffer(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error flushing line buffer: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", "hello world\nsecond line\n"+longLine+"\npartial")
+	if WFS.LineBufferSize(zoneId, "testfile") != 0 {
+		t.Errorf("expected no pending bytes after flush")
+	}
+	// WriteFile discards the pending line
+	appendFn("\ndropped")
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte("new\n"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	appendFn("next\n")
+	checkFileData(t, ctx, zoneId, "testfile", "new\nnext\n")
+}
+
+func TestSwapFiles(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "front", FileMeta{"role": "front"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "back", FileMeta{"role": "back"}, FileOptsType{MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	frontData := makeText(120)
+	backData := "back buffer"
+	err = WFS.WriteFile(ctx, zoneId, "front", []byte(frontData))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "back", []byte(backData))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.SwapFiles(ctx, zoneId, "front", "back", false)
+	if !errors.Is(err, ErrPendingWrites) {
+		t.Fatalf("expected ErrPendingWrites, got %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	err = WFS.SwapFiles(ctx, zoneId, "front", "back", false)
+	if err != nil {
+		t.Fatalf("error swapping files: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "front", backData)
+	checkFileData(t, ctx, zoneId, "back", frontData)
+	file, err := WFS.Stat(ctx, zoneId, "front")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["role"] != "front" || file.Opts.MaxSize != 1000 {
+		t.Errorf("expected meta to stay and opts to move, got meta:%v opts:%+v", file.Meta, file.Opts)
+	}
+	err = WFS.SwapFiles(ctx, zoneId, "front", "back", true)
+	if err != nil {
+		t.Fatalf("error swapping files: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "front", frontData)
+	file, err = WFS.Stat(ctx, zoneId, "front")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["role"] != "back" {
+		t.Errorf("expected meta to be swapped, got %v", file.Meta)
+	}
+	err = WFS.SwapFiles(ctx, zoneId, "front", "missing", false)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestReadAtEmptyAndDeleted(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	for _, opts := range []FileOptsType{{}, {Circular: true, MaxSize: 200}} {
+		err := WFS.MakeFile(ctx, zoneId, "empty", nil, opts)
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		_, data, err := WFS.ReadAt(ctx, zoneId, "empty", 0, 100)
+		if err != nil {
+			t.Fatalf("error reading empty file: %v", err)
+		}
+		if data == nil || len(data) != 0 {
+			t.Errorf("expected non-nil empty data for %+v, got %#v", opts, data)
+		}
+		err = WFS.DeleteFile(ctx, zoneId, "empty")
+		if err != nil {
+			t.Fatalf("error deleting file: %v", err)
+		}
+	}
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	// deleted between the Stat and the ReadAt
+	err = WFS.DeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	_, data, err := WFS.ReadAt(ctx, zoneId, "testfile", 0, 5)
+	if err != fs.ErrNotExist {
+		t.Errorf("expected fs.ErrNotExist, got data:%q err:%v", data, err)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "state", nil, FileOptsType{WriteThrough: true})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "state", []byte("hello "))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "state", 6, []byte("world"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.WriteMeta(ctx, zoneId, "state", FileMeta{"a": "b"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	// everything is in the DB without a flush
+	dbFile, err := dbGetZoneFile(ctx, globalDB, zoneId, "state")
+	if err != nil {
+		t.Fatalf("error getting file from db: %v", err)
+	}
+	if dbFile.Size != 11 || dbFile.Meta["a"] != "b" {
+		t.Errorf("expected size 11 and meta in the db, got size:%d meta:%v", dbFile.Size, dbFile.Meta)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected no cache entries, got %d", WFS.getCacheSize())
+	}
+	checkFileData(t, ctx, zoneId, "state", "hello world")
+}
+
+func TestDeleteZones(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneIds := []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}
+	for _, zoneId := range zoneIds {
+		for _, name := range []string{"a", "b"} {
+			err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			// leave unflushed changes in the cache
+			err = WFS.AppendData(ctx, zoneId, name, []byte(makeText(120)))
+			if err != nil {
+				t.Fatalf("error appending data: %v", err)
+			}
+		}
+	}
+	numDeleted, err := WFS.DeleteZones(ctx, []string{zoneIds[0], zoneIds[1], zoneIds[0], uuid.NewString()})
+	if err != nil {
+		t.Fatalf("error deleting zones: %v", err)
+	}
+	if numDeleted != 4 {
+		t.Errorf("expected 4 files deleted, got %d", numDeleted)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	for idx, zoneId := range zoneIds {
+		files, err := WFS.ListFiles(ctx, zoneId)
+		if err != nil {
+			t.Fatalf("error listing files: %v", err)
+		}
+		expected := 0
+		if idx == 2 {
+			expected = 2
+		}
+		if len(files) != expected {
+			t.Errorf("zone %d: expected %d files, got %d", idx, expected, len(files))
+		}
+	}
+	var numParts int
+	err = globalDB.Get(&numParts, "SELECT count(*) FROM db_file_data WHERE zoneid IN (?, ?)", zoneIds[0], zoneIds[1])
+	if err != nil {
+		t.Fatalf("error counting parts: %v", err)
+	}
+	if numParts != 0 {
+		t.Errorf("expected no parts left, got %d", numParts)
+	}
+	checkFileData(t, ctx, zoneIds[2], "a", makeText(120))
+}
+
+func TestLease(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	curTime := time.Now().UnixMilli()
+	WFS.nowFn = func() int64 { return curTime }
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkLease := func(fn func() (bool, error), expected bool, desc string) {
+		t.Helper()
+		ok, err := fn()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", desc, err)
+		}
+		if ok != expected {
+			t.Errorf("%s: expected %v, got %v", desc, expected, ok)
+		}
+	}
+	acquire := func(holderId string) func() (bool, error) {
+		return func() (bool, error) { return WFS.AcquireLease(ctx, zoneId, "testfile", holderId, time.Minute) }
+	}
+	checkLease(acquire("p1"), true, "acquire free lease")
+	checkLease(acquire("p1"), true, "re-acquire own lease")
+	checkLease(acquire("p2"), false, "acquire held lease")
+	// the lease is in the DB without a flush
+	dbFile, err := dbGetZoneFile(ctx, globalDB, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting file from db: %v", err)
+	}
+	if dbFile.Meta[LeaseHolderMetaKey] != "p1" {
+		t.Errorf("expected lease holder p1 in the db, got %v", dbFile.Meta)
+	}
+	curTime += 50 * 1000
+	checkLease(func() (bool, error) { return WFS.RenewLease(ctx, zoneId, "testfile", "p1", time.Minute) }, true, "renew")
+	checkLease(func() (bool, error) { return WFS.RenewLease(ctx, zoneId, "testfile", "p2", time.Minute) }, false, "renew by non-holder")
+	curTime += 50 * 1000
+	checkLease(acquire("p2"), false, "acquire renewed lease")
+	curTime += 20 * 1000
+	checkLease(acquire("p2"), true, "reclaim expired lease")
+	checkLease(func() (bool, error) { return WFS.ReleaseLease(ctx, zoneId, "testfile", "p1") }, false, "release by old holder")
+	checkLease(func() (bool, error) { return WFS.ReleaseLease(ctx, zoneId, "testfile", "p2") }, true, "release")
+	checkLease(acquire("p3"), true, "acquire released lease")
+	_, err = WFS.AcquireLease(ctx, zoneId, "nofile", "p1", time.Minute)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestReadPart(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(150)
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte(text[:120]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	// part 0 now holds the wrapped bytes 100-149 (cached), part 1 holds bytes 50-99 (db only)
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte(text[120:]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	part0, err := WFS.ReadPart(ctx, zoneId, "testfile", 0)
+	if err != nil {
+		t.Fatalf("error reading part: %v", err)
+	}
+	if string(part0) != text[100:150] {
+		t.Errorf("expected part 0 to be %q, got %q", text[100:150], part0)
+	}
+	part1, err := WFS.ReadPart(ctx, zoneId, "testfile", 1)
+	if err != nil {
+		t.Fatalf("error reading part: %v", err)
+	}
+	if string(part1) != text[50:100] {
+		t.Errorf("expected part 1 to be %q, got %q", text[50:100], part1)
+	}
+	part2, err := WFS.ReadPart(ctx, zoneId, "testfile", 2)
+	if err != nil || part2 != nil {
+		t.Errorf("expected nil for a missing part, got %q (err:%v)", part2, err)
+	}
+}
+
+func TestAuditPins(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	curTime := time.Now().UnixMilli()
+	WFS.nowFn = func() int64 { return curTime }
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	cursor1, err := WFS.OpenCursor(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	cursor2, err := WFS.OpenCursor(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	if stats := WFS.GetPinStats(); stats.NumPinned != 1 || stats.MaxPinCount != 2 {
+		t.Errorf("expected 1 pinned entry with 2 pins, got %+v", stats)
+	}
+	if leaks := WFS.AuditPins(); len(leaks) != 0 {
+		t.Errorf("expected no leaks before the threshold, got %+v", leaks)
+	}
+	curTime += DefaultPinLeakThreshold.Milliseconds()
+	expected := []PinLeak{{ZoneId: zoneId, Name: "testfile", PinCount: 2, PinnedFor: DefaultPinLeakThreshold}}
+	if leaks := WFS.AuditPins(); !reflect.DeepEqual(leaks, expected) {
+		t.Errorf("expected leaks %+v, got %+v", expected, leaks)
+	}
+	// an entry whose lock is held has an operation in progress
+	entry := WFS.getEntryAndPin(zoneId, "testfile")
+	entry.Lock.Lock()
+	if leaks := WFS.AuditPins(); len(leaks) != 0 {
+		t.Errorf("expected no leaks while locked, got %+v", leaks)
+	}
+	entry.Lock.Unlock()
+	WFS.unpinEntryAndTryDelete(zoneId, "testfile")
+	cursor1.Close()
+	cursor2.Close()
+	if leaks := WFS.AuditPins(); len(leaks) != 0 {
+		t.Errorf("expected no leaks after close, got %+v", leaks)
+	}
+	if stats := WFS.GetPinStats(); stats.NumPinned != 0 || stats.MaxPinCount != 0 {
+		t.Errorf("expected no pins, got %+v", stats)
+	}
+}
+
+// flushes happen under the entry lock (there is no separate flushing state that readers could observe), so a read
+// concurrent with a flush must see either the pre-flush or the post-flush bytes, which are the same.  each writer owns
+// a slot (spanning part boundaries) and writes increasing versions, so a reader must never see a torn slot or a
+// slot go back to an older version (stale bytes), including after the entry is dropped and re-read from the DB
+func TestConcurrentFlushReadWrite(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	const numSlots = 8
+	const slotSize = 37
+	const numVersions = 100
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "testfile", make([]byte, numSlots*slotSize))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	var writersDone atomic.Bool
+	var writerWg, otherWg sync.WaitGroup
+	for slot := 0; slot < numSlots; slot++ {
+		writerWg.Add(1)
+		go func() {
+			defer writerWg.Done()
+			for version := 1; version <= numVersions; version++ {
+				err := WFS.WriteAt(ctx, zoneId, "testfile", int64(slot*slotSize), bytes.Repeat([]byte{byte(version)}, slotSize))
+				if err != nil {
+					t.Errorf("error writing slot %d: %v", slot, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		otherWg.Add(1)
+		go func() {
+			defer otherWg.Done()
+			lastSeen := make([]byte, numSlots)
+			for !writersDone.Load() {
+				_, data, err := WFS.ReadAt(ctx, zoneId, "testfile", 0, numSlots*slotSize)
+				if err != nil {
+					t.Errorf("error reading file: %v", err)
+					return
+				}
+				for slot := 0; slot < numSlots; slot++ {
+					slotData := data[slot*slotSize : (slot+1)*slotSize]
+					if !bytes.Equal(slotData, bytes.Repeat(slotData[:1], slotSize)) {
+						t.Errorf("torn read in slot %d: %v", slot, slotData)
+						return
+					}
+					if slotData[0] < lastSeen[slot] {
+						t.Errorf("stale read in slot %d: version %d after %d", slot, slotData[0], lastSeen[slot])
+						return
+					}
+					lastSeen[slot] = slotData[0]
+				}
+			}
+		}()
+	}
+	otherWg.Add(1)
+	go func() {
+		defer otherWg.Done()
+		for !writersDone.Load() {
+			// errors are expected here (flush already in progress)
+			WFS.FlushCache(ctx)
+			WFS.InvalidateFile(zoneId, "testfile")
+		}
+	}()
+	writerWg.Wait()
+	writersDone.Store(true)
+	otherWg.Wait()
+	expected := bytes.Repeat([]byte{numVersions}, numSlots*slotSize)
+	checkFileData(t, ctx, zoneId, "testfile", string(expected))
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	checkFileData(t, ctx, zoneId, "testfile", string(expected))
+}
+
+func TestInlineData(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkStorage := func(expectInline bool, expectParts int) {
+		t.Helper()
+		_, err := WFS.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		var numInline, numParts int
+		err = globalDB.Get(&numInline, "SELECT count(*) FROM db_wave_file WHERE zoneid = ? AND inlinedata IS NOT NULL", zoneId)
+		if err != nil {
+			t.Fatalf("error counting inline files: %v", err)
+		}
+		err = globalDB.Get(&numParts, "SELECT count(*) FROM db_file_data WHERE zoneid = ?", zoneId)
+		if err != nil {
+			t.Fatalf("error counting parts: %v", err)
+		}
+		if (numInline == 1) != expectInline || numParts != expectParts {
+			t.Errorf("expected inline:%v parts:%d, got inline:%v parts:%d", expectInline, expectParts, numInline == 1, numParts)
+		}
+		err = WFS.VerifyFile(ctx, zoneId, "testfile")
+		if err != nil {
+			t.Errorf("error verifying file: %v", err)
+		}
+		WFS.clearCache()
+	}
+	text := makeText(120)
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte(text[:10]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkStorage(true, 0)
+	checkFileData(t, ctx, zoneId, "testfile", text[:10])
+	// patched in place, still inline
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte(text[10:40]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 0, []byte(text[:5]))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkStorage(true, 0)
+	checkFileData(t, ctx, zoneId, "testfile", text[:40])
+	layout, err := WFS.GetPartLayout(ctx, zoneId, "testfile")
+	if err != nil || !reflect.DeepEqual(layout, map[int]int{0: 40}) {
+		t.Errorf("expected layout {0:40}, got %v (err:%v)", layout, err)
+	}
+	fileData, err := WFS.ReadFiles(ctx, zoneId, []string{"testfile"})
+	if err != nil || string(fileData["testfile"]) != text[:40] {
+		t.Errorf("expected ReadFiles to return the inline data, got %q (err:%v)", fileData["testfile"], err)
+	}
+	// grows past the part size, moves to part storage
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte(text[40:120]))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	checkStorage(false, 3)
+	checkFileData(t, ctx, zoneId, "testfile", text)
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte("small"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkStorage(true, 0)
+	checkFileData(t, ctx, zoneId, "testfile", "small")
+	report, err := WFS.Fsck(ctx, false)
+	if err != nil || !report.Clean() {
+		t.Errorf("expected inline files to pass fsck, got %+v (err:%v)", report, err)
+	}
+}
+
+func writeSequentialFile(t testing.TB, ctx context.Context, zoneId string, name string, numParts int) string {
+	err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	text := makeText(numParts * int(partDataSize))
+	err = WFS.WriteFile(ctx, zoneId, name, []byte(text))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	WFS.clearCache()
+	return text
+}
+
+func TestSequentialReadSingleQuery(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	text := writeSequentialFile(t, ctx, zoneId, "testfile", 200)
+	startQueries := partReadQueries.Load()
+	_, data, err := WFS.ReadAt(ctx, zoneId, "testfile", 0, int64(len(text)))
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if string(data) != text {
+		t.Errorf("data mismatch")
+	}
+	if numQueries := partReadQueries.Load() - startQueries; numQueries != 1 {
+		t.Errorf("expected 1 part query for 200 parts, got %d", numQueries)
+	}
+	// non-contiguous parts are still a single query
+	startQueries = partReadQueries.Load()
+	parts, err := dbGetFileParts(ctx, globalDB, zoneId, "testfile", []int{7, 3, 150})
+	if err != nil {
+		t.Fatalf("error getting parts: %v", err)
+	}
+	if len(parts) != 3 || string(parts[150].Data) != text[150*50:151*50] {
+		t.Errorf("unexpected parts: %v", parts)
+	}
+	if numQueries := partReadQueries.Load() - startQueries; numQueries != 1 {
+		t.Errorf("expected 1 part query, got %d", numQueries)
+	}
+}
+
+func BenchmarkSequentialRead(b *testing.B) {
+	initDb(b)
+	defer cleanupDb(b)
+
+	ctx := context.Background()
+	zoneId := uuid.NewString()
+	text := writeSequentialFile(b, ctx, zoneId, "testfile", 200)
+	startQueries := partReadQueries.Load()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := WFS.ReadAt(ctx, zoneId, "testfile", 0, int64(len(text)))
+		if err != nil {
+			b.Fatalf("error reading file: %v", err)
+		}
+	}
+	b.StopTimer()
+	if numQueries := partReadQueries.Load() - startQueries; numQueries != int64(b.N) {
+		b.Errorf("expected 1 part query per read, got %d for %d reads", numQueries, b.N)
+	}
+}
+
+func TestGetFileMeta(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", FileMeta{"a": "b"}, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	meta, err := WFS.GetFileMeta(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting meta: %v", err)
+	}
+	if !reflect.DeepEqual(meta, FileMeta{"a": "b"}) {
+		t.Errorf("expected meta {a:b}, got %v", meta)
+	}
+	if WFS.getCacheSize() != 0 {
+		t.Errorf("expected the file not to be cached, got %d entries", WFS.getCacheSize())
+	}
+	// unflushed meta comes from the cache, the result is a copy
+	err = WFS.WriteMeta(ctx, zoneId, "testfile", FileMeta{"c": "d"}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	meta, err = WFS.GetFileMeta(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting meta: %v", err)
+	}
+	if !reflect.DeepEqual(meta, FileMeta{"a": "b", "c": "d"}) {
+		t.Errorf("expected meta {a:b c:d}, got %v", meta)
+	}
+	meta["a"] = "changed"
+	file, err := WFS.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Meta["a"] != "b" {
+		t.Errorf("expected GetFileMeta to return a copy")
+	}
+	_, err = WFS.GetFileMeta(ctx, zoneId, "nofile")
+	if err != fs.ErrNotExist {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestFileVersion(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	checkVersion := func(expected int64) {
+		t.Helper()
+		file, err := WFS.Stat(ctx, zoneId, "testfile")
+		if err != nil {
+			t.Fatalf("error stating file: %v", err)
+		}
+		if file.Version != expected {
+			t.Errorf("expected version %d, got %d", expected, file.Version)
+		}
+	}
+	checkVersion(0)
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = WFS.WriteAtIfVersion(ctx, zoneId, "testfile", 0, []byte("j"), 1)
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	checkVersion(2)
+	err = WFS.WriteAtIfVersion(ctx, zoneId, "testfile", 0, []byte("x"), 1)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+	err = WFS.WriteMetaIfVersion(ctx, zoneId, "testfile", FileMeta{"a": "b"}, true, 1)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+	err = WFS.WriteMetaIfVersion(ctx, zoneId, "testfile", FileMeta{"a": "b"}, true, 2)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", "jello")
+	// the version is persisted on flush
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	WFS.clearCache()
+	checkVersion(3)
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte("new"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	checkVersion(4)
+}
+
+func TestFlushPriority(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	curTime := time.Now().UnixMilli()
+	WFS.nowFn = func() int64 { return curTime }
+	zoneId := uuid.NewString()
+	for _, name := range []string{"old", "new", "urgent"} {
+		err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	// dirtied in order: old, new, urgent (urgent has a priority so it is flushed first)
+	err := WFS.AppendData(ctx, zoneId, "old", []byte("a"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	curTime += 1000
+	err = WFS.AppendData(ctx, zoneId, "new", []byte("b"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	curTime += 1000
+	err = WFS.WriteMeta(ctx, zoneId, "urgent", FileMeta{FlushPriorityMetaKey: 10}, true)
+	if err != nil {
+		t.Fatalf("error writing meta: %v", err)
+	}
+	// re-dirtying does not change an entry's age
+	err = WFS.AppendData(ctx, zoneId, "old", []byte("c"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	var names []string
+	for _, key := range WFS.getFlushOrderedCacheKeys() {
+		names = append(names, key.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"urgent", "old", "new"}) {
+		t.Errorf("unexpected flush order: %v", names)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if keys := WFS.getFlushOrderedCacheKeys(); len(keys) != 0 {
+		t.Errorf("expected no dirty entries after flush, got %v", keys)
+	}
+}
+
+func TestMakeFileIdempotent(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	opts := FileOptsType{MaxSize: 120, Circular: true}
+	err := WFS.MakeFileIdempotent(ctx, zoneId, "testfile", FileMeta{"a": "b"}, opts)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	// a retry with the same opts (MaxSize is rounded up to whole parts either way) succeeds and keeps the file
+	err = WFS.MakeFileIdempotent(ctx, zoneId, "testfile", FileMeta{"a": "c"}, opts)
+	if err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", "hello")
+	meta, err := WFS.GetFileMeta(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting meta: %v", err)
+	}
+	if meta["a"] != "b" {
+		t.Errorf("expected meta to be unchanged, got %v", meta)
+	}
+	err = WFS.MakeFileIdempotent(ctx, zoneId, "testfile", nil, FileOptsType{MaxSize: 200, Circular: true})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected fs.ErrExist for different opts, got %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "testfile", nil, opts)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected MakeFile to return fs.ErrExist, got %v", err)
+	}
+}
+
+func TestChunkFile(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	// pseudo-random (incompressible, no repeats) data
+	var data []byte
+	sum := sha256.Sum256([]byte("seed"))
+	for len(data) < 100*1024 {
+		sum = sha256.Sum256(sum[:])
+		data = append(data, sum[:]...)
+	}
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "testfile", data)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	chunks, err := WFS.ChunkFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error chunking file: %v", err)
+	}
+	if !reflect.DeepEqual(chunks, ChunkData(data)) {
+		t.Fatalf("ChunkFile and ChunkData do not match")
+	}
+	var offset int64
+	for _, chunk := range chunks {
+		if chunk.Offset != offset || chunk.Size > ContentChunkMaxSize {
+			t.Fatalf("bad chunk %d:%d (expected offset %d)", chunk.Offset, chunk.Size, offset)
+		}
+		offset += chunk.Size
+	}
+	if offset != int64(len(data)) || len(chunks) < 3 {
+		t.Fatalf("expected several chunks covering %d bytes, got %d chunks covering %d", len(data), len(chunks), offset)
+	}
+	// an insert in the middle only changes the chunk around it
+	edited := append(append(append([]byte{}, data[:50000]...), 'x'), data[50000:]...)
+	oldHashes := make(map[string]bool)
+	for _, chunk := range chunks {
+		oldHashes[string(chunk.Hash)] = true
+	}
+	var numChanged int
+	for _, chunk := range ChunkData(edited) {
+		if !oldHashes[string(chunk.Hash)] {
+			numChanged++
+		}
+	}
+	if numChanged < 1 || numChanged > 2 {
+		t.Errorf("expected 1 or 2 changed chunks, got %d (of %d)", numChanged, len(chunks))
+	}
+}
+
+func TestReadRegionCache(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	WFS.ReadRegionCache = true
+	defer func() {
+		WFS.ReadRegionCache = false
+	}()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte(makeText(500)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	text := makeText(500)
+	checkRead := func(offset int64, size int64, expected string, expectedQueries int64) {
+		t.Helper()
+		startQueries := partReadQueries.Load()
+		_, data, err := WFS.ReadAt(ctx, zoneId, "testfile", offset, size)
+		if err != nil {
+			t.Fatalf("error reading data: %v", err)
+		}
+		if string(data) != expected {
+			t.Errorf("read at %d:%d: expected %q, got %q", offset, size, expected, string(data))
+		}
+		if numQueries := partReadQueries.Load() - startQueries; numQueries != expectedQueries {
+			t.Errorf("read at %d:%d: expected %d part queries, got %d", offset, size, expectedQueries, numQueries)
+		}
+	}
+	// the first read loads parts 1-2 (offsets 50-150), overlapping reads inside them are served from memory
+	checkRead(60, 80, text[60:140], 1)
+	checkRead(50, 100, text[50:150], 0)
+	checkRead(70, 20, text[70:90], 0)
+	checkRead(140, 20, text[140:160], 1)
+	// any write drops the region
+	err = WFS.WriteAt(ctx, zoneId, "testfile", 145, []byte("xx"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	text = text[:145] + "xx" + text[147:]
+	checkRead(140, 10, text[140:150], 1)
+	// reads past the end of the file are clamped (the last region ends at the end of the file)
+	checkRead(460, 100, text[460:], 1)
+	checkRead(480, 100, text[480:], 0)
+}
+
+func TestAppendDataAsync(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	var expected strings.Builder
+	for i := 0; i < 100; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		expected.WriteString(line)
+		err = WFS.AppendDataAsync(zoneId, "testfile", []byte(line))
+		if err != nil {
+			t.Fatalf("error queueing append: %v", err)
+		}
+	}
+	err = WFS.DrainAsync(ctx)
+	if err != nil {
+		t.Fatalf("error draining async appends: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", expected.String())
+
+	// hold the entry lock so the worker blocks on the first append, the queue then fills up
+	entry := WFS.getEntryAndPin(zoneId, "testfile")
+	entry.Lock.Lock()
+	var numQueued int
+	for {
+		err = WFS.AppendDataAsync(zoneId, "testfile", []byte("x"))
+		if err != nil {
+			break
+		}
+		numQueued++
+	}
+	if !errors.Is(err, ErrAsyncQueueFull) {
+		t.Errorf("expected ErrAsyncQueueFull, got %v", err)
+	}
+	if numQueued < AsyncAppendQueueSize {
+		t.Errorf("expected at least %d queued appends, got %d", AsyncAppendQueueSize, numQueued)
+	}
+	entry.Lock.Unlock()
+	WFS.unpinEntryAndTryDelete(zoneId, "testfile")
+	err = WFS.DrainAsync(ctx)
+	if err != nil {
+		t.Fatalf("error draining async appends: %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", expected.String()+strings.Repeat("x", numQueued))
+	if numErrors := WFS.AsyncAppendErrors(); numErrors != 0 {
+		t.Errorf("expected no async append errors, got %d", numErrors)
+	}
+}
+
+func TestGetAllZoneIdsPage(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	var expected []string
+	for i := 0; i < 7; i++ {
+		zoneId := uuid.NewString()
+		expected = append(expected, zoneId)
+		for _, name := range []string{"file1", "file2"} {
+			err := WFS.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+		}
+	}
+	sort.Strings(expected)
+	var zoneIds []string
+	var numPages int
+	cursor := ""
+	for {
+		page, next, err := WFS.GetAllZoneIdsPage(ctx, cursor, 3)
+		if err != nil {
+			t.Fatalf("error getting zone ids: %v", err)
+		}
+		numPages++
+		zoneIds = append(zoneIds, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(zoneIds, expected) {
+		t.Errorf("zone ids mismatch: %v, expected %v", zoneIds, expected)
+	}
+	if numPages != 3 {
+		t.Errorf("expected 3 pages, got %d", numPages)
+	}
+	_, _, err := WFS.GetAllZoneIdsPage(ctx, "", 0)
+	if err == nil {
+		t.Errorf("expected error for zero limit")
+	}
+}
+
+func TestWriteAtInBounds(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte("hello world"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.WriteAtInBounds(ctx, zoneId, "testfile", 6, []byte("WORLD"))
+	if err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+	err = WFS.WriteAtInBounds(ctx, zoneId, "testfile", 9, []byte("LD!"))
+	if !errors.Is(err, ErrWriteOutOfBounds) {
+		t.Errorf("expected ErrWriteOutOfBounds, got %v", err)
+	}
+	err = WFS.WriteAtInBounds(ctx, zoneId, "testfile", 11, []byte("!"))
+	if !errors.Is(err, ErrWriteOutOfBounds) {
+		t.Errorf("expected ErrWriteOutOfBounds for a write at the end, got %v", err)
+	}
+	checkFileData(t, ctx, zoneId, "testfile", "hello WORLD")
+}
+
+func TestNewMemStore(t *testing.T) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	stores := make([]*FileStore, 2)
+	for idx := range stores {
+		stores[idx] = NewMemStore(FileStoreOpts{})
+	}
+	zoneId := uuid.NewString()
+	err := stores[0].MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = stores[0].AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = stores[0].FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	_, data, err := stores[0].ReadFile(ctx, zoneId, "testfile")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected data %q, got %q (err %v)", "hello", string(data), err)
+	}
+	// the stores do not share storage (and neither uses the global DB)
+	_, err = stores[1].Stat(ctx, zoneId, "testfile")
+	if err != fs.ErrNotExist {
+		t.Errorf("expected fs.ErrNotExist from the other store, got %v", err)
+	}
+}
+
+// runs the same operations against the DB backend and a MemBackend, the files must end up the same
+func TestMemBackend(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	runOps := func(store *FileStore) {
+		files := map[string]FileOptsType{
+			"plain":     {},
+			"circular":  {Circular: true, MaxSize: 100},
+			"trimfront": {TrimFront: true, MaxSize: 100},
+			"other":     {},
+		}
+		for name, opts := range files {
+			err := store.MakeFile(ctx, zoneId, name, FileMeta{"name": name}, opts)
+			if err != nil {
+				t.Fatalf("error creating file %q: %v", name, err)
+			}
+		}
+		for round := 0; round < 4; round++ {
+			for name := range files {
+				err := store.AppendData(ctx, zoneId, name, []byte(makeText(70+round)))
+				if err != nil {
+					t.Fatalf("error appending to %q: %v", name, err)
+				}
+			}
+			// patches parts that were loaded from the backend
+			err := store.WriteAt(ctx, zoneId, "plain", int64(round*30), []byte("XYZ"))
+			if err != nil {
+				t.Fatalf("error writing data: %v", err)
+			}
+			_, err = store.FlushCache(ctx)
+			if err != nil {
+				t.Fatalf("error flushing cache: %v", err)
+			}
+			store.clearCache()
+		}
+		err := store.SwapFiles(ctx, zoneId, "plain", "other", false)
+		if err != nil {
+			t.Fatalf("error swapping files: %v", err)
+		}
+		err = store.WriteMeta(ctx, zoneId, "other", FileMeta{"x": 1}, true)
+		if err != nil {
+			t.Fatalf("error writing meta: %v", err)
+		}
+		_, err = store.FlushCache(ctx)
+		if err != nil {
+			t.Fatalf("error flushing cache: %v", err)
+		}
+		store.clearCache()
+	}
+	memStore := NewMemStore(FileStoreOpts{})
+	memStore.nowFn = func() int64 { return 1000 }
+	WFS.nowFn = memStore.nowFn
+	runOps(WFS)
+	runOps(memStore)
+	dbFiles, err := WFS.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	memFiles, err := memStore.ListFiles(ctx, zoneId)
+	if err != nil {
+		t.Fatalf("error listing files: %v", err)
+	}
+	sortFiles := func(files []*WaveFile) {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	}
+	sortFiles(dbFiles)
+	sortFiles(memFiles)
+	if len(dbFiles) != len(memFiles) {
+		t.Fatalf("expected %d files, got %d", len(dbFiles), len(memFiles))
+	}
+	for idx := range dbFiles {
+		if !reflect.DeepEqual(dbFiles[idx], memFiles[idx]) {
+			t.Errorf("files differ:\n db: %+v\nmem: %+v", *dbFiles[idx], *memFiles[idx])
+		}
+	}
+	for _, file := range dbFiles {
+		_, dbData, err := WFS.ReadFile(ctx, zoneId, file.Name)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		_, memData, err := memStore.ReadFile(ctx, zoneId, file.Name)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if !bytes.Equal(dbData, memData) {
+			t.Errorf("%s: data differs:\n db: %q\nmem: %q", file.Name, dbData, memData)
+		}
+		dbHash, err := WFS.HashFile(ctx, zoneId, file.Name)
+		if err != nil {
+			t.Fatalf("error hashing file: %v", err)
+		}
+		memHash, err := memStore.HashFile(ctx, zoneId, file.Name)
+		if err != nil {
+			t.Fatalf("error hashing file: %v", err)
+		}
+		if !bytes.Equal(dbHash, memHash) {
+			t.Errorf("%s: hash differs", file.Name)
+		}
+	}
+}
+
+// wraps the DB backend, counting the parts written and read
+type countingBackend struct {
+	DBBackend
+	partsWritten atomic.Int64
+	partsRead    atomic.Int64
+}
+
+func (b *countingBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	b.partsWritten.Add(int64(len(dataEntries)))
+	return b.DBBackend.WriteCacheEntry(ctx, file, dataEntries, replace, batch)
+}
+
+func (b *countingBackend) GetFileParts(ctx context.Context, zoneId string, name string, parts []int) (map[int]*DataCacheEntry, error) {
+	b.partsRead.Add(int64(len(parts)))
+	return b.DBBackend.GetFileParts(ctx, zoneId, name, parts)
+}
+
+func TestBackend(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	backend := &countingBackend{}
+	store := NewFileStore(FileStoreOpts{Backend: backend})
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	if numWritten := backend.partsWritten.Load(); numWritten != 3 {
+		t.Errorf("expected 3 parts written through the backend, got %d", numWritten)
+	}
+	_, data, err := store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if string(data) != makeText(120) {
+		t.Errorf("data mismatch: %q", string(data))
+	}
+	if numRead := backend.partsRead.Load(); numRead != 3 {
+		t.Errorf("expected 3 parts read through the backend, got %d", numRead)
+	}
+}
+
+func TestHybridBackend(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	blobs := DirBlobStore{Dir: t.TempDir()}
+	store := NewFileStore(FileStoreOpts{Backend: &HybridBackend{Backend: DBBackend{}, Blobs: blobs, Threshold: 30}})
+	zoneId := uuid.NewString()
+	err := store.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	// parts 0 and 1 (50 bytes) go to the blob store, part 2 (20 bytes) stays in the DB
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	dirtySum, err := store.HashFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting checksum: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	dbParts, err := dbGetFileParts(ctx, globalDB, zoneId, "testfile", []int{0, 1, 2})
+	if err != nil {
+		t.Fatalf("error getting db parts: %v", err)
+	}
+	for partIdx, dce := range dbParts {
+		_, isRef := parseBlobRef(dce.Data)
+		if isRef != (partIdx < 2) {
+			t.Errorf("part %d: expected blob ref %v, got %q", partIdx, partIdx < 2, string(dce.Data))
+		}
+	}
+	storedSum, err := store.HashFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error getting checksum: %v", err)
+	}
+	if string(storedSum) != string(dirtySum) {
+		t.Errorf("checksum changed after flush")
+	}
+	err = store.VerifyFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Errorf("error verifying file: %v", err)
+	}
+	store.clearCache()
+	_, data, err := store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if string(data) != makeText(120) {
+		t.Errorf("data mismatch: %q", string(data))
+	}
+
+	// overwrite inside a blob part, the part is rewritten as a new blob
+	err = store.WriteAt(ctx, zoneId, "testfile", 60, []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	expected := makeText(60) + "hello" + makeText(120)[65:]
+	_, data, err = store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("data mismatch: %q", string(data))
+	}
+	err = store.VerifyFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Errorf("error verifying file: %v", err)
+	}
+
+	// small data that looks like a blob ref is stored as a blob
+	err = store.WriteFile(ctx, zoneId, "testfile", []byte(blobRefPrefix+"x"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	_, err = store.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	store.clearCache()
+	_, data, err = store.ReadFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if string(data) != blobRefPrefix+"x" {
+		t.Errorf("data mismatch: %q", string(data))
+	}
+
+	// a missing blob is an error, not a silent read of the ref
+	os.RemoveAll(blobs.Dir)
+	store.clearCache()
+	_, _, err = store.ReadFile(ctx, zoneId, "testfile")
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestReadAtZeroFill(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.WriteFile(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	err = WFS.MakeFile(ctx, zoneId, "circ", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "circ", []byte(makeText(150)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	zeroFill := ReadAtOpts{ZeroFillPastEOF: true}
+	checkRead := func(name string, offset int64, size int64, opts ReadAtOpts, expectedOffset int64, expected string) {
+		t.Helper()
+		rtnOffset, data, err := WFS.ReadAtWithOpts(ctx, zoneId, name, offset, size, opts)
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if rtnOffset != expectedOffset || string(data) != expected {
+			t.Errorf("read %s [%d, +%d): expected %d:%q, got %d:%q", name, offset, size, expectedOffset, expected, rtnOffset, string(data))
+		}
+	}
+	checkRead("testfile", 2, 10, ReadAtOpts{}, 2, "llo")
+	checkRead("testfile", 2, 10, zeroFill, 2, "llo\x00\x00\x00\x00\x00\x00\x00")
+	checkRead("testfile", 20, 5, zeroFill, 20, "\x00\x00\x00\x00\x00")
+	checkRead("testfile", 0, 0, zeroFill, 0, "")
+	checkRead("circ", 140, 20, zeroFill, 140, makeText(150)[140:]+strings.Repeat("\x00", 10))
+	checkRead("circ", 160, 10, zeroFill, 160, strings.Repeat("\x00", 10))
+	// the data before DataStartIdx is gone, the offset still moves forward
+	checkRead("circ", 0, 60, zeroFill, 50, makeText(150)[50:60])
+}
+
+func TestMaxOpenReaders(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	store := NewFileStore(FileStoreOpts{MaxOpenReaders: 2})
+	zoneId := uuid.NewString()
+	for _, name := range []string{"testfile", "other"} {
+		err := store.MakeFile(ctx, zoneId, name, nil, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+	}
+	cursor, err := store.OpenCursor(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	follow, err := store.FollowReader(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening follow reader: %v", err)
+	}
+	handles := store.ListOpenHandles(zoneId, "testfile")
+	if len(handles) != 2 || handles[0].Kind != HandleKind_Cursor || handles[1].Kind != HandleKind_Follow {
+		t.Errorf("unexpected open handles: %v", handles)
+	}
+	_, err = store.OpenCursor(ctx, zoneId, "testfile")
+	if !errors.Is(err, ErrTooManyReaders) {
+		t.Errorf("expected ErrTooManyReaders, got %v", err)
+	}
+	_, err = store.FollowReader(ctx, zoneId, "testfile")
+	if !errors.Is(err, ErrTooManyReaders) {
+		t.Errorf("expected ErrTooManyReaders, got %v", err)
+	}
+	// the limit is per file
+	otherCursor, err := store.OpenCursor(ctx, zoneId, "other")
+	if err != nil {
+		t.Fatalf("error opening cursor: %v", err)
+	}
+	otherCursor.Close()
+	// a failed open does not leave a handle behind
+	_, err = store.OpenCursor(ctx, zoneId, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	if handles := store.ListOpenHandles(zoneId, "missing"); len(handles) != 0 {
+		t.Errorf("expected no handles for a missing file, got %v", handles)
+	}
+	cursor.Close()
+	cursor.Close()
+	handles = store.ListOpenHandles(zoneId, "testfile")
+	if len(handles) != 1 || handles[0].Kind != HandleKind_Follow {
+		t.Errorf("unexpected open handles after close: %v", handles)
+	}
+	cursor, err = store.OpenCursor(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error opening cursor after close: %v", err)
+	}
+	cursor.Close()
+	follow.Close()
+	if handles := store.ListOpenHandles(zoneId, "testfile"); len(handles) != 0 {
+		t.Errorf("expected no open handles, got %v", handles)
+	}
+}
+
+type failingBackend struct {
+	DBBackend
+	failName string
+}
+
+func (b *failingBackend) WriteCacheEntry(ctx context.Context, file *WaveFile, dataEntries map[int]*DataCacheEntry, replace bool, batch FlushBatch) (int64, error) {
+	if file.Name == b.failName {
+		return 0, fmt.Errorf("injected write error")
+	}
+	return b.DBBackend.WriteCacheEntry(ctx, file, dataEntries, replace, batch)
+}
+
+func TestFlushCacheWithProgress(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	backend := &failingBackend{}
+	store := NewFileStore(FileStoreOpts{Backend: backend})
+	zoneId := uuid.NewString()
+	for idx := 0; idx < 3; idx++ {
+		// higher priority files are flushed first, so "file2" is flushed last
+		name := fmt.Sprintf("file%d", idx)
+		err := store.MakeFile(ctx, zoneId, name, FileMeta{FlushPriorityMetaKey: 10 - idx}, FileOptsType{})
+		if err != nil {
+			t.Fatalf("error creating file: %v", err)
+		}
+		err = store.AppendData(ctx, zoneId, name, []byte("hello"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	var calls [][2]int
+	progressFn := func(done int, total int) {
+		calls = append(calls, [2]int{done, total})
+	}
+	_, err := store.FlushCacheWithProgress(ctx, progressFn)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	expected := [][2]int{{0, 3}, {1, 3}, {2, 3}, {3, 3}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected progress %v, got %v", expected, calls)
+	}
+
+	// a failed entry is still reported (and ends the flush)
+	for idx := 0; idx < 3; idx++ {
+		err = store.AppendData(ctx, zoneId, fmt.Sprintf("file%d", idx), []byte("!"))
+		if err != nil {
+			t.Fatalf("error appending data: %v", err)
+		}
+	}
+	backend.failName = "file1"
+	calls = nil
+	_, err = store.FlushCacheWithProgress(ctx, progressFn)
+	if err == nil {
+		t.Fatalf("expected flush error")
+	}
+	flushErrorCount.Add(-1)
+	expected = [][2]int{{0, 3}, {1, 3}, {2, 3}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected progress %v, got %v", expected, calls)
+	}
+	backend.failName = ""
+	_, err = store.FlushCacheWithProgress(ctx, nil)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+}
+
+func TestFileChanged(t *testing.T) {
+	initDb(t)
+	defer cleanupDb(t)
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	// a second store on the same DB deletes and recreates the file (as circular) while WFS has cached writes
+	other := NewFileStore(FileStoreOpts{})
+	zoneId := uuid.NewString()
+	err := WFS.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte(makeText(120)))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = other.DeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	// a fixed clock (ahead of the original CreatedTs), so the second recreate below has the same CreatedTs
+	recreateTs := time.Now().UnixMilli() + 1000
+	WFS.nowFn = func() int64 { return recreateTs }
+	other.nowFn = WFS.nowFn
+	err = other.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{Circular: true, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if !errors.Is(err, ErrFileChanged) {
+		t.Fatalf("expected ErrFileChanged, got %v", err)
+	}
+	flushErrorCount.Add(-1)
+	file, err := other.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Size != 0 || !file.Opts.Circular {
+		t.Errorf("recreated file was modified: %+v", file)
+	}
+	// the stale changes were dropped, WFS now sees the recreated file
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("hello"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if err != nil {
+		t.Fatalf("error flushing cache: %v", err)
+	}
+	file, err = other.Stat(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error stating file: %v", err)
+	}
+	if file.Size != 5 || !file.Opts.Circular {
+		t.Errorf("unexpected file after append: %+v", file)
+	}
+
+	// same CreatedTs, but different opts
+	err = WFS.AppendData(ctx, zoneId, "testfile", []byte("world"))
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	err = other.DeleteFile(ctx, zoneId, "testfile")
+	if err != nil {
+		t.Fatalf("error deleting file: %v", err)
+	}
+	err = other.MakeFile(ctx, zoneId, "testfile", nil, FileOptsType{})
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	_, err = WFS.FlushCache(ctx)
+	if !errors.Is(err, ErrFileChanged) {
+		t.Fatalf("expected ErrFileChanged, got %v", err)
+	}
+	flushErrorCount.Add(-1)
+}
@@ -0,0 +1,78 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filestore
+
+import (
+	"context"
+)
+
+// optional tracing (see FileStore.Tracer), the interfaces are small enough to be adapted to OpenTelemetry
+// (or anything else) by the caller, so this package does not depend on a tracing library.
+// spans are started for ReadAt, WriteAt (also WriteAtInfo and WriteAtIfSize), AppendData (and AppendDataReturnSize)
+// and for each cache entry written by FlushCache.  every span gets the TraceAttr_* attributes.
+
+const (
+	TraceOp_ReadAt     = "filestore.ReadAt"
+	TraceOp_WriteAt    = "filestore.WriteAt"
+	TraceOp_AppendData = "filestore.AppendData"
+	TraceOp_FlushEntry = "filestore.FlushEntry"
+)
+
+const (
+	TraceAttr_ZoneId = "zoneid"
+	TraceAttr_Name   = "name"
+	TraceAttr_Bytes  = "bytes" // bytes read, written, or flushed
+	TraceAttr_Parts  = "parts" // number of parts touched
+)
+
+type Tracer interface {
+	// the returned context is passed down to the operation (so nested spans can be parented)
+	StartSpan(ctx context.Context, op string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) RecordError(err error)              {}
+func (noopSpan) End()                               {}
+
+func (s *FileStore) getTracer() Tracer {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.Tracer
+}
+
+func (s *FileStore) startSpan(ctx context.Context, op string, zoneId string, name string) (context.Context, Span) {
+	tracer := s.getTracer()
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := tracer.StartSpan(ctx, op)
+	span.SetAttribute(TraceAttr_ZoneId, zoneId)
+	span.SetAttribute(TraceAttr_Name, name)
+	return ctx, span
+}
+
+func endSpan(span Span, numBytes int64, numParts int, err error) {
+	span.SetAttribute(TraceAttr_Bytes, numBytes)
+	span.SetAttribute(TraceAttr_Parts, numParts)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// number of parts spanned by [offset, offset+size) in logical file offsets (circular files may wrap onto fewer)
+func spannedParts(offset int64, size int64) int {
+	if size <= 0 {
+		return 0
+	}
+	return int((offset+size-1)/partDataSize - offset/partDataSize + 1)
+}
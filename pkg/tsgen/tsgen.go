@@ -35,6 +35,7 @@ var ExtraTypes = []any{
 	waveobj.UIContext{},
 	eventbus.WSEventType{},
 	wps.WSFileEventData{},
+	wps.WSBlockStoreFlushData{},
 	waveobj.LayoutActionData{},
 	filestore.WaveFile{},
 	wconfig.FullConfigType{},
@@ -5,6 +5,12 @@
 package wps
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 
@@ -22,10 +28,48 @@ type Client interface {
 	SendEvent(routeId string, event WaveEvent)
 }
 
+// optional, used by PublishSync to find out if an event could not be delivered
+type SyncClient interface {
+	SendEventSync(routeId string, event WaveEvent) error
+}
+
+type senderContextKey struct{}
+
+// the sender id is carried in the ctx (under an unexported key, set it with WithSender) so that code publishing
+// events on behalf of a request, e.g. the blockfile events emitted after a write, can fill in WaveEvent.Sender
+// and subscribers can skip their own writes
+func WithSender(ctx context.Context, sender string) context.Context {
+	return context.WithValue(ctx, senderContextKey{}, sender)
+}
+
+// returns "" if no sender is set
+func GetSenderFromContext(ctx context.Context) string {
+	sender, _ := ctx.Value(senderContextKey{}).(string)
+	return sender
+}
+
 type BrokerSubscription struct {
-	AllSubs   []string            // routeids subscribed to "all" events
-	ScopeSubs map[string][]string // routeids subscribed to specific scopes
-	StarSubs  map[string][]string // routeids subscribed to star scope (scopes with "*" or "**" in them)
+	AllSubs   []string              // routeids subscribed to "all" events
+	ScopeSubs map[string][]string   // routeids subscribed to specific scopes
+	StarSubs  map[string][]string   // routeids subscribed to star scope (scopes with "*" or "**" in them)
+	Filters   map[string]*subFilter // routeid => filter (only for subscriptions with a filter)
+}
+
+type subFilter struct {
+	DataFilter map[string]any // normalized through json so it compares equal to the json form of event data
+	Filter     func(WaveEvent) bool
+}
+
+// returned by ListSubscribers (for debugging delivery)
+type SubscriberInfo struct {
+	RouteId   string   `json:"routeid"`
+	AllScopes bool     `json:"allscopes,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"` // all scopes (including star scopes) the route is subscribed to for the event
+	HasFilter bool     `json:"hasfilter,omitempty"`
+
+	// only for in-process subscribers (SubscribeChan)
+	BufferDepth int `json:"bufferdepth,omitempty"`
+	DropCount   int `json:"dropcount,omitempty"`
 }
 
 type persistKey struct {
@@ -38,17 +82,30 @@ type persistEventWrap struct {
 	Events       []*WaveEvent
 }
 
+type scopeLock struct {
+	Lock     *sync.Mutex
+	RefCount int
+}
+
 type BrokerType struct {
 	Lock       *sync.Mutex
 	Client     Client
 	SubMap     map[string]*BrokerSubscription
 	PersistMap map[persistKey]*persistEventWrap
+	ScopeLocks map[string]*scopeLock // serializes delivery per scope, see Publish
+	LocalSubs  map[string]*localSub  // in-process subscribers, see SubscribeChan
+
+	DeadLetterCh chan DeadLetter             // optional, see SetDeadLetterCh
+	FileSeqs     map[string]map[string]int64 // last WSFileEventData.Seq per file (zoneid => filename => seq), see ClearFileSeqs
 }
 
 var Broker = &BrokerType{
 	Lock:       &sync.Mutex{},
 	SubMap:     make(map[string]*BrokerSubscription),
 	PersistMap: make(map[persistKey]*persistEventWrap),
+	ScopeLocks: make(map[string]*scopeLock),
+	LocalSubs:  make(map[string]*localSub),
+	FileSeqs:   make(map[string]map[string]int64),
 }
 
 func scopeHasStarMatch(scope string) bool {
@@ -79,6 +136,17 @@ func (b *BrokerType) Subscribe(subRouteId string, sub SubscriptionRequest) {
 	if sub.Event == "" {
 		return
 	}
+	var filter *subFilter
+	if len(sub.DataFilter) > 0 || sub.Filter != nil {
+		filter = &subFilter{Filter: sub.Filter}
+		if len(sub.DataFilter) > 0 {
+			err := utilfn.ReUnmarshal(&filter.DataFilter, sub.DataFilter)
+			if err != nil {
+				log.Printf("[wps] invalid datafilter for %s %s: %v\n", subRouteId, sub.Event, err)
+				return
+			}
+		}
+	}
 	b.Lock.Lock()
 	defer b.Lock.Unlock()
 	b.unsubscribe_nolock(subRouteId, sub.Event)
@@ -88,9 +156,13 @@ func (b *BrokerType) Subscribe(subRouteId string, sub SubscriptionRequest) {
 			AllSubs:   []string{},
 			ScopeSubs: make(map[string][]string),
 			StarSubs:  make(map[string][]string),
+			Filters:   make(map[string]*subFilter),
 		}
 		b.SubMap[sub.Event] = bs
 	}
+	if filter != nil {
+		bs.Filters[subRouteId] = filter
+	}
 	if sub.AllScopes {
 		bs.AllSubs = utilfn.AddElemToSliceUniq(bs.AllSubs, subRouteId)
 		return
@@ -149,6 +221,7 @@ func (b *BrokerType) unsubscribe_nolock(subRouteId string, eventName string) {
 		return
 	}
 	bs.AllSubs = utilfn.RemoveElemFromSlice(bs.AllSubs, subRouteId)
+	delete(bs.Filters, subRouteId)
 	for scope := range bs.ScopeSubs {
 		removeStrFromScopeMap(bs.ScopeSubs, scope, subRouteId)
 	}
@@ -165,6 +238,7 @@ func (b *BrokerType) UnsubscribeAll(subRouteId string) {
 	defer b.Lock.Unlock()
 	for eventType, bs := range b.SubMap {
 		bs.AllSubs = utilfn.RemoveElemFromSlice(bs.AllSubs, subRouteId)
+		delete(bs.Filters, subRouteId)
 		removeStrFromScopeMapAll(bs.StarSubs, subRouteId)
 		removeStrFromScopeMapAll(bs.ScopeSubs, subRouteId)
 		if bs.IsEmpty() {
@@ -173,6 +247,72 @@ func (b *BrokerType) UnsubscribeAll(subRouteId string) {
 	}
 }
 
+// lists the routes that would receive event with the given scope (use "" to list every subscriber to event)
+// results are sorted by routeid.  note that delivery is a direct SendEvent to the client, so there is no
+// per-subscriber buffer or drop count at this level.
+func (b *BrokerType) ListSubscribers(event string, scope string) []SubscriberInfo {
+	rtn, localSubs := b.listSubscribers(event, scope)
+	// stats are read after releasing the broker lock (never take a localSub lock while holding the broker lock)
+	for idx, ls := range localSubs {
+		if ls != nil {
+			rtn[idx].BufferDepth, rtn[idx].DropCount = ls.getStats()
+		}
+	}
+	return rtn
+}
+
+// returns the subscriber infos and the matching localSubs (nil for routes that are not local)
+func (b *BrokerType) listSubscribers(event string, scope string) ([]SubscriberInfo, []*localSub) {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	bs := b.SubMap[event]
+	if bs == nil {
+		return nil, nil
+	}
+	var routeIds []string
+	if scope == "" {
+		routeIds = bs.getAllRouteIds()
+	} else {
+		routeIds = bs.getMatchingRouteIds([]string{scope})
+	}
+	sort.Strings(routeIds)
+	var rtn []SubscriberInfo
+	var localSubs []*localSub
+	for _, routeId := range routeIds {
+		info := SubscriberInfo{RouteId: routeId, AllScopes: utilfn.ContainsStr(bs.AllSubs, routeId), HasFilter: bs.Filters[routeId] != nil}
+		for _, scopeMap := range []map[string][]string{bs.ScopeSubs, bs.StarSubs} {
+			for subScope, subRouteIds := range scopeMap {
+				if utilfn.ContainsStr(subRouteIds, routeId) {
+					info.Scopes = append(info.Scopes, subScope)
+				}
+			}
+		}
+		sort.Strings(info.Scopes)
+		rtn = append(rtn, info)
+		localSubs = append(localSubs, b.LocalSubs[routeId])
+	}
+	return rtn, localSubs
+}
+
+func (bs *BrokerSubscription) getAllRouteIds() []string {
+	routeIds := make(map[string]bool)
+	for _, routeId := range bs.AllSubs {
+		routeIds[routeId] = true
+	}
+	for _, scopeMap := range []map[string][]string{bs.ScopeSubs, bs.StarSubs} {
+		for _, subRouteIds := range scopeMap {
+			for _, routeId := range subRouteIds {
+				routeIds[routeId] = true
+			}
+		}
+	}
+	var rtn []string
+	for routeId := range routeIds {
+		rtn = append(rtn, routeId)
+	}
+	return rtn
+}
+
 // does not take wildcards, use "" for all
 func (b *BrokerType) ReadEventHistory(eventType string, scope string, maxItems int) []*WaveEvent {
 	if maxItems <= 0 {
@@ -228,18 +368,162 @@ func (b *BrokerType) persistEvent(event WaveEvent) {
 	}
 }
 
+// delivery is FIFO per scope: events that share a scope are delivered to every subscriber in the same order
+// (the order Publish was called in, for publishes that are not concurrent).  there is no ordering guarantee
+// across different scopes.  events without scopes are ordered with respect to each other.
 func (b *BrokerType) Publish(event WaveEvent) {
 	// log.Printf("BrokerType.Publish: %v\n", event)
+	b.publish(event, false)
+}
+
+// like Publish, but returns an error (joined, one per route) if the event could not be handed off to a subscriber
+// (e.g. the subscriber's route is gone).  only clients that implement SyncClient can report errors.
+// returns once every subscriber has the event queued, not when it has been processed.
+//
+// delivery holds the per-scope locks (see Publish), so calling PublishSync (or Publish) for the same scope
+// synchronously from inside the client's SendEvent will deadlock.
+func (b *BrokerType) PublishSync(event WaveEvent) error {
+	return b.publish(event, true)
+}
+
+func (b *BrokerType) publish(event WaveEvent, reportErrs bool) error {
+	event = addFileZoneScope(event)
+	unlockFn := b.lockScopes(event.Scopes)
+	defer unlockFn()
+	event = b.setFileEventSeq(event)
 	if event.Persist > 0 {
 		b.persistEvent(event)
 	}
+	routeIds := b.filterRouteIds(event, b.getMatchingRouteIds(event))
 	client := b.GetClient()
-	if client == nil {
-		return
-	}
-	routeIds := b.getMatchingRouteIds(event)
+	syncClient, _ := client.(SyncClient)
+	var errs []error
 	for _, routeId := range routeIds {
-		client.SendEvent(routeId, event)
+		if strings.HasPrefix(routeId, LocalSubRoutePrefix) {
+			if ls := b.getLocalSub(routeId); ls != nil {
+				ls.deliver(event)
+			}
+			continue
+		}
+		if client == nil {
+			continue
+		}
+		if !reportErrs || syncClient == nil {
+			client.SendEvent(routeId, event)
+			continue
+		}
+		err := syncClient.SendEventSync(routeId, event)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error sending %s event to %q: %w", event.Event, routeId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// assigns the next per-file sequence number to blockfile events (called with the scope locks held,
+// so sequence order matches delivery order for subscribers of the file's scope).  the seq is set on a copy
+// of the event data, the caller's WSFileEventData is not modified.  a delete event ends the file's sequence
+func (b *BrokerType) setFileEventSeq(event WaveEvent) WaveEvent {
+	if event.Event != Event_BlockFile {
+		return event
+	}
+	var fileData WSFileEventData
+	switch data := event.Data.(type) {
+	case *WSFileEventData:
+		if data == nil {
+			return event
+		}
+		fileData = *data
+	case WSFileEventData:
+		fileData = data
+	default:
+		return event
+	}
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	zoneSeqs := b.FileSeqs[fileData.ZoneId]
+	if zoneSeqs == nil {
+		zoneSeqs = make(map[string]int64)
+		b.FileSeqs[fileData.ZoneId] = zoneSeqs
+	}
+	zoneSeqs[fileData.FileName]++
+	fileData.Seq = zoneSeqs[fileData.FileName]
+	if fileData.FileOp == FileOp_Delete {
+		delete(zoneSeqs, fileData.FileName)
+		if len(zoneSeqs) == 0 {
+			delete(b.FileSeqs, fileData.ZoneId)
+		}
+	}
+	event.Data = &fileData
+	return event
+}
+
+// drops the sequence numbers of every file in the zone, called when the zone is deleted (files deleted with the
+// zone don't get delete events).  the next event for a file in the zone starts a new sequence at 1
+func (b *BrokerType) ClearFileSeqs(zoneId string) {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	delete(b.FileSeqs, zoneId)
+}
+
+// adds the zone scope (see ZoneScope) to blockfile events, the caller's Scopes slice is not modified
+func addFileZoneScope(event WaveEvent) WaveEvent {
+	if event.Event != Event_BlockFile {
+		return event
+	}
+	var zoneId string
+	switch data := event.Data.(type) {
+	case *WSFileEventData:
+		if data != nil {
+			zoneId = data.ZoneId
+		}
+	case WSFileEventData:
+		zoneId = data.ZoneId
+	}
+	if zoneId == "" || event.HasScope(ZoneScope(zoneId)) {
+		return event
+	}
+	event.Scopes = append(append([]string{}, event.Scopes...), ZoneScope(zoneId))
+	return event
+}
+
+// locks the scopes (in sorted order, to avoid deadlocks), returns the unlock func
+func (b *BrokerType) lockScopes(scopes []string) func() {
+	lockKeys := []string{""}
+	if len(scopes) > 0 {
+		lockKeys = nil
+		for _, scope := range scopes {
+			lockKeys = utilfn.AddElemToSliceUniq(lockKeys, scope)
+		}
+		sort.Strings(lockKeys)
+	}
+	locks := make([]*scopeLock, len(lockKeys))
+	b.Lock.Lock()
+	for idx, key := range lockKeys {
+		sl := b.ScopeLocks[key]
+		if sl == nil {
+			sl = &scopeLock{Lock: &sync.Mutex{}}
+			b.ScopeLocks[key] = sl
+		}
+		sl.RefCount++
+		locks[idx] = sl
+	}
+	b.Lock.Unlock()
+	for _, sl := range locks {
+		sl.Lock.Lock()
+	}
+	return func() {
+		for idx := len(locks) - 1; idx >= 0; idx-- {
+			locks[idx].Lock.Unlock()
+		}
+		b.Lock.Lock()
+		defer b.Lock.Unlock()
+		for idx, key := range lockKeys {
+			locks[idx].RefCount--
+			if locks[idx].RefCount == 0 {
+				delete(b.ScopeLocks, key)
+			}
+		}
 	}
 }
 
@@ -260,11 +544,70 @@ func (b *BrokerType) getMatchingRouteIds(event WaveEvent) []string {
 	if bs == nil {
 		return nil
 	}
+	rtn := bs.getMatchingRouteIds(event.Scopes)
+	// log.Printf("getMatchingRouteIds %v %v\n", event, rtn)
+	return rtn
+}
+
+// removes the routes whose subscription filter rejects the event
+// filters are run without holding the broker lock
+func (b *BrokerType) filterRouteIds(event WaveEvent, routeIds []string) []string {
+	filters := make(map[string]*subFilter)
+	b.Lock.Lock()
+	if bs := b.SubMap[event.Event]; bs != nil {
+		for _, routeId := range routeIds {
+			if filter := bs.Filters[routeId]; filter != nil {
+				filters[routeId] = filter
+			}
+		}
+	}
+	b.Lock.Unlock()
+	if len(filters) == 0 {
+		return routeIds
+	}
+	var dataMap map[string]any
+	var dataMapErr error
+	dataMapDone := false
+	rtn := make([]string, 0, len(routeIds))
+	for _, routeId := range routeIds {
+		filter := filters[routeId]
+		if filter == nil {
+			rtn = append(rtn, routeId)
+			continue
+		}
+		if len(filter.DataFilter) > 0 {
+			if !dataMapDone {
+				dataMap, dataMapErr = utilfn.StructToJsonMap(event.Data)
+				dataMapDone = true
+			}
+			if dataMapErr != nil || !dataMatchesFilter(dataMap, filter.DataFilter) {
+				continue
+			}
+		}
+		if filter.Filter != nil && !filter.Filter(event) {
+			continue
+		}
+		rtn = append(rtn, routeId)
+	}
+	return rtn
+}
+
+func dataMatchesFilter(dataMap map[string]any, dataFilter map[string]any) bool {
+	for key, val := range dataFilter {
+		dataVal, ok := dataMap[key]
+		if !ok || !reflect.DeepEqual(dataVal, val) {
+			return false
+		}
+	}
+	return true
+}
+
+func (bs *BrokerSubscription) getMatchingRouteIds(scopes []string) []string {
 	routeIds := make(map[string]bool)
 	for _, routeId := range bs.AllSubs {
 		routeIds[routeId] = true
 	}
-	for _, scope := range event.Scopes {
+	for _, scope := range scopes {
 		for _, routeId := range bs.ScopeSubs[scope] {
 			routeIds[routeId] = true
 		}
@@ -280,6 +623,5 @@ func (b *BrokerType) getMatchingRouteIds(event WaveEvent) []string {
 	for routeId := range routeIds {
 		rtn = append(rtn, routeId)
 	}
-	// log.Printf("getMatchingRouteIds %v %v\n", event, rtn)
 	return rtn
 }
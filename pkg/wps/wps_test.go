@@ -0,0 +1,426 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package wps
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeTestBroker() *BrokerType {
+	return &BrokerType{
+		Lock:       &sync.Mutex{},
+		SubMap:     make(map[string]*BrokerSubscription),
+		PersistMap: make(map[persistKey]*persistEventWrap),
+		ScopeLocks: make(map[string]*scopeLock),
+		LocalSubs:  make(map[string]*localSub),
+		FileSeqs:   make(map[string]map[string]int64),
+	}
+}
+
+// records the events sent to each route
+type testClient struct {
+	Lock   *sync.Mutex
+	Events map[string][]WaveEvent
+}
+
+func makeTestClient() *testClient {
+	return &testClient{Lock: &sync.Mutex{}, Events: make(map[string][]WaveEvent)}
+}
+
+func (c *testClient) SendEvent(routeId string, event WaveEvent) {
+	// yield to make interleaving between concurrent publishers more likely
+	runtime.Gosched()
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.Events[routeId] = append(c.Events[routeId], event)
+}
+
+func (c *testClient) SendEventSync(routeId string, event WaveEvent) error {
+	if routeId == "gone" {
+		return fmt.Errorf("route is gone")
+	}
+	c.SendEvent(routeId, event)
+	return nil
+}
+
+func (c *testClient) getEvents(routeId string) []WaveEvent {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return append([]WaveEvent{}, c.Events[routeId]...)
+}
+
+func TestListSubscribers(t *testing.T) {
+	b := makeTestBroker()
+	b.Subscribe("route1", SubscriptionRequest{Event: Event_BlockFile, Scopes: []string{"block:1", "block:2"}})
+	b.Subscribe("route2", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true})
+	b.Subscribe("route3", SubscriptionRequest{Event: Event_BlockFile, Scopes: []string{"block:*"}})
+	b.Subscribe("route4", SubscriptionRequest{Event: Event_Config, AllScopes: true})
+
+	subs := b.ListSubscribers(Event_BlockFile, "block:2")
+	expected := []SubscriberInfo{
+		{RouteId: "route1", Scopes: []string{"block:1", "block:2"}},
+		{RouteId: "route2", AllScopes: true},
+		{RouteId: "route3", Scopes: []string{"block:*"}},
+	}
+	if !reflect.DeepEqual(subs, expected) {
+		t.Errorf("subscribers mismatch:\n  expected %v\n  got %v", expected, subs)
+	}
+	subs = b.ListSubscribers(Event_BlockFile, "tab:1")
+	if len(subs) != 1 || subs[0].RouteId != "route2" {
+		t.Errorf("expected only route2 for tab:1, got %v", subs)
+	}
+	subs = b.ListSubscribers(Event_BlockFile, "")
+	if len(subs) != 3 {
+		t.Errorf("expected 3 subscribers, got %v", subs)
+	}
+	b.UnsubscribeAll("route1")
+	subs = b.ListSubscribers(Event_BlockFile, "block:1")
+	if len(subs) != 2 {
+		t.Errorf("expected 2 subscribers after unsubscribe, got %v", subs)
+	}
+	if subs := b.ListSubscribers(Event_SysInfo, ""); subs != nil {
+		t.Errorf("expected no subscribers, got %v", subs)
+	}
+}
+
+func TestScopeOrdering(t *testing.T) {
+	b := makeTestBroker()
+	client := makeTestClient()
+	b.SetClient(client)
+	const numSubs = 5
+	const numObjs = 200
+	scope := "block:1"
+	for i := 0; i < numSubs; i++ {
+		b.Subscribe(fmt.Sprintf("route%d", i), SubscriptionRequest{Event: Event_WaveObjUpdate, Scopes: []string{scope}})
+	}
+	// concurrent publishers on the same scope, each publishing update-then-delete
+	var wg sync.WaitGroup
+	for i := 0; i < numObjs; i++ {
+		wg.Add(1)
+		go func(objIdx int) {
+			defer wg.Done()
+			b.Publish(WaveEvent{Event: Event_WaveObjUpdate, Scopes: []string{scope}, Data: fmt.Sprintf("update:%d", objIdx)})
+			b.Publish(WaveEvent{Event: Event_WaveObjUpdate, Scopes: []string{scope}, Data: fmt.Sprintf("delete:%d", objIdx)})
+		}(i)
+	}
+	wg.Wait()
+	firstEvents := client.getEvents("route0")
+	if len(firstEvents) != numObjs*2 {
+		t.Fatalf("expected %d events, got %d", numObjs*2, len(firstEvents))
+	}
+	for i := 0; i < numSubs; i++ {
+		routeId := fmt.Sprintf("route%d", i)
+		events := client.getEvents(routeId)
+		// every subscriber sees the same order
+		if !reflect.DeepEqual(events, firstEvents) {
+			t.Errorf("%s received events in a different order than route0", routeId)
+		}
+		seenUpdate := make(map[int]bool)
+		for _, event := range events {
+			var op string
+			var objIdx int
+			fmt.Sscanf(event.Data.(string), "%6s:%d", &op, &objIdx)
+			if op == "update" {
+				seenUpdate[objIdx] = true
+			} else if !seenUpdate[objIdx] {
+				t.Errorf("%s received delete:%d before update:%d", routeId, objIdx, objIdx)
+			}
+		}
+	}
+	if len(b.ScopeLocks) != 0 {
+		t.Errorf("scope locks should be cleaned up, got %d", len(b.ScopeLocks))
+	}
+}
+
+func TestPublishSync(t *testing.T) {
+	b := makeTestBroker()
+	client := makeTestClient()
+	b.SetClient(client)
+	b.Subscribe("route1", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true})
+	err := b.PublishSync(WaveEvent{Event: Event_BlockFile, Scopes: []string{"block:1"}, Data: "a"})
+	if err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	// no sleep needed, the event is already delivered
+	if events := client.getEvents("route1"); len(events) != 1 {
+		t.Errorf("expected 1 event, got %d", len(events))
+	}
+	b.Subscribe("gone", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true})
+	err = b.PublishSync(WaveEvent{Event: Event_BlockFile, Scopes: []string{"block:1"}, Data: "b"})
+	if err == nil {
+		t.Errorf("expected error publishing to a disconnected subscriber")
+	}
+	if events := client.getEvents("route1"); len(events) != 2 {
+		t.Errorf("other subscribers should still get the event, got %d events", len(events))
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	b := makeTestBroker()
+	client := makeTestClient()
+	b.SetClient(client)
+	b.Subscribe("appends", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true, DataFilter: map[string]any{"fileop": FileOp_Append}})
+	b.Subscribe("term", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true, Filter: func(event WaveEvent) bool {
+		data, ok := event.Data.(*WSFileEventData)
+		return ok && data.FileName == "term"
+	}})
+	b.Subscribe("all", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true})
+	publishFileEvent := func(fileName string, fileOp string) {
+		b.Publish(WaveEvent{Event: Event_BlockFile, Scopes: []string{"block:1"}, Data: &WSFileEventData{ZoneId: "1", FileName: fileName, FileOp: fileOp}})
+	}
+	publishFileEvent("term", FileOp_Append)
+	publishFileEvent("term", FileOp_Truncate)
+	publishFileEvent("other", FileOp_Append)
+	publishFileEvent("other", FileOp_Invalidate)
+	if n := len(client.getEvents("appends")); n != 2 {
+		t.Errorf("expected 2 append events, got %d", n)
+	}
+	if n := len(client.getEvents("term")); n != 2 {
+		t.Errorf("expected 2 term events, got %d", n)
+	}
+	if n := len(client.getEvents("all")); n != 4 {
+		t.Errorf("expected 4 events, got %d", n)
+	}
+	subs := b.ListSubscribers(Event_BlockFile, "")
+	if len(subs) != 3 || subs[0].HasFilter || !subs[1].HasFilter || !subs[2].HasFilter {
+		t.Errorf("subscriber info mismatch: %v", subs)
+	}
+	// resubscribing without a filter removes the filter
+	b.Subscribe("appends", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true})
+	publishFileEvent("term", FileOp_Truncate)
+	if n := len(client.getEvents("appends")); n != 3 {
+		t.Errorf("expected 3 events after resubscribe, got %d", n)
+	}
+}
+
+func TestSubscribeChanBatch(t *testing.T) {
+	b := makeTestBroker()
+	ch, unsubFn := b.SubscribeChan(SubscriptionRequest{Event: Event_SysInfo, AllScopes: true, Batch: &BatchOpts{MaxEvents: 4, Window: 20 * time.Millisecond}})
+	defer unsubFn()
+	for i := 0; i < 10; i++ {
+		b.Publish(WaveEvent{Event: Event_SysInfo, Data: i})
+	}
+	var batchSizes []int
+	var received []int
+	timeoutCh := time.After(2 * time.Second)
+	for len(received) < 10 {
+		select {
+		case batch := <-ch:
+			batchSizes = append(batchSizes, len(batch))
+			for _, event := range batch {
+				received = append(received, event.Data.(int))
+			}
+		case <-timeoutCh:
+			t.Fatalf("timeout waiting for events, got %v", received)
+		}
+	}
+	// two full batches, the last 2 events are delivered when the window expires
+	if !reflect.DeepEqual(batchSizes, []int{4, 4, 2}) {
+		t.Errorf("batch sizes mismatch: %v", batchSizes)
+	}
+	if !reflect.DeepEqual(received, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("events mismatch: %v", received)
+	}
+
+	// unbatched subscribers get one event per slice, and are dropped (not blocked on) when full
+	unbatchedCh, unbatchedUnsubFn := b.SubscribeChan(SubscriptionRequest{Event: Event_SysInfo, AllScopes: true})
+	for i := 0; i < LocalSubChSize+5; i++ {
+		b.Publish(WaveEvent{Event: Event_SysInfo, Data: i})
+	}
+	subs := b.ListSubscribers(Event_SysInfo, "")
+	var unbatchedInfo *SubscriberInfo
+	for idx := range subs {
+		if subs[idx].BufferDepth == LocalSubChSize {
+			unbatchedInfo = &subs[idx]
+		}
+	}
+	if unbatchedInfo == nil || unbatchedInfo.DropCount != 5 {
+		t.Errorf("expected a full subscriber with 5 drops, got %v", subs)
+	}
+	batch := <-unbatchedCh
+	if len(batch) != 1 || batch[0].Data.(int) != 0 {
+		t.Errorf("unexpected first batch: %v", batch)
+	}
+	unbatchedUnsubFn()
+	unbatchedUnsubFn()
+	if subs := b.ListSubscribers(Event_SysInfo, ""); len(subs) != 1 {
+		t.Errorf("expected 1 subscriber after unsubscribe, got %v", subs)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := makeTestBroker()
+	deadLetterCh := make(chan DeadLetter, 10)
+	b.SetDeadLetterCh(deadLetterCh)
+	_, unsubFn := b.SubscribeChan(SubscriptionRequest{Event: Event_SysInfo, AllScopes: true})
+	defer unsubFn()
+	for i := 0; i < LocalSubChSize+3; i++ {
+		b.Publish(WaveEvent{Event: Event_SysInfo, Data: i})
+	}
+	subs := b.ListSubscribers(Event_SysInfo, "")
+	if len(subs) != 1 || subs[0].DropCount != 3 {
+		t.Fatalf("expected 3 dropped events, got %v", subs)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case dl := <-deadLetterCh:
+			if dl.RouteId != subs[0].RouteId || dl.Event.Data.(int) != LocalSubChSize+i {
+				t.Errorf("dead letter mismatch: %v", dl)
+			}
+		default:
+			t.Fatalf("expected dead letter %d", i)
+		}
+	}
+	if len(deadLetterCh) != 0 {
+		t.Errorf("unexpected extra dead letters")
+	}
+}
+
+func TestFileEventSeq(t *testing.T) {
+	b := makeTestBroker()
+	client := makeTestClient()
+	b.SetClient(client)
+	b.Subscribe("route1", SubscriptionRequest{Event: Event_BlockFile, AllScopes: true})
+	for _, fileName := range []string{"term", "term", "other", "term"} {
+		b.Publish(WaveEvent{Event: Event_BlockFile, Scopes: []string{"block:1"}, Data: &WSFileEventData{ZoneId: "1", FileName: fileName, FileOp: FileOp_Append}})
+	}
+	b.Publish(WaveEvent{Event: Event_BlockFile, Scopes: []string{"block:2"}, Data: WSFileEventData{ZoneId: "2", FileName: "term", FileOp: FileOp_Append}})
+	var seqs []int64
+	for _, event := range client.getEvents("route1") {
+		seqs = append(seqs, event.Data.(*WSFileEventData).Seq)
+	}
+	if !reflect.DeepEqual(seqs, []int64{1, 2, 1, 3, 1}) {
+		t.Errorf("seq mismatch: %v", seqs)
+	}
+
+	// the seq is set on a copy, a reused event data struct is not modified
+	fileData := &WSFileEventData{ZoneId: "1", FileName: "term", FileOp: FileOp_Append}
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: fileData})
+	if fileData.Seq != 0 {
+		t.Errorf("expected the caller's event data to be unchanged, got seq %d", fileData.Seq)
+	}
+	// delete events and zone deletes drop the file's sequence
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: &WSFileEventData{ZoneId: "1", FileName: "term", FileOp: FileOp_Delete}})
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: &WSFileEventData{ZoneId: "1", FileName: "term", FileOp: FileOp_Create}})
+	b.ClearFileSeqs("2")
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: &WSFileEventData{ZoneId: "2", FileName: "term", FileOp: FileOp_Append}})
+	events := client.getEvents("route1")
+	seqs = nil
+	for _, event := range events[5:] {
+		seqs = append(seqs, event.Data.(*WSFileEventData).Seq)
+	}
+	if !reflect.DeepEqual(seqs, []int64{4, 5, 1, 1}) {
+		t.Errorf("seq mismatch after deletes: %v", seqs)
+	}
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: &WSFileEventData{ZoneId: "1", FileName: "other", FileOp: FileOp_Delete}})
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: &WSFileEventData{ZoneId: "1", FileName: "term", FileOp: FileOp_Delete}})
+	b.ClearFileSeqs("2")
+	if len(b.FileSeqs) != 0 {
+		t.Errorf("expected no file seqs after deleting every file, got %v", b.FileSeqs)
+	}
+}
+
+func TestSubscribeChanUnsubscribe(t *testing.T) {
+	b := makeTestBroker()
+	// pending batch is delivered (not dropped) on unsubscribe
+	ch, unsubFn := b.SubscribeChan(SubscriptionRequest{Event: Event_SysInfo, AllScopes: true, Batch: &BatchOpts{MaxEvents: 10, Window: time.Hour}})
+	b.Publish(WaveEvent{Event: Event_SysInfo, Data: 1})
+	b.Publish(WaveEvent{Event: Event_SysInfo, Data: 2})
+	unsubFn()
+	unsubFn()
+	var batches [][]WaveEvent
+	for batch := range ch {
+		batches = append(batches, batch)
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected pending batch on unsubscribe, got %v", batches)
+	}
+
+	// stress: subscribe/unsubscribe while publishing (must not send on a closed channel)
+	stopCh := make(chan struct{})
+	pubWg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		pubWg.Add(1)
+		go func() {
+			defer pubWg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				b.Publish(WaveEvent{Event: Event_SysInfo, Data: i})
+			}
+		}()
+	}
+	subWg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		subWg.Add(1)
+		go func() {
+			defer subWg.Done()
+			for j := 0; j < 50; j++ {
+				sub := SubscriptionRequest{Event: Event_SysInfo, AllScopes: true}
+				if j%2 == 0 {
+					sub.Batch = &BatchOpts{MaxEvents: 5, Window: time.Millisecond}
+				}
+				ch, unsubFn := b.SubscribeChan(sub)
+				<-ch
+				unsubFn()
+				for range ch {
+				}
+			}
+		}()
+	}
+	subWg.Wait()
+	close(stopCh)
+	pubWg.Wait()
+	if subs := b.ListSubscribers(Event_SysInfo, ""); len(subs) != 0 {
+		t.Errorf("expected no subscribers left, got %v", subs)
+	}
+}
+
+func TestZoneScope(t *testing.T) {
+	b := makeTestBroker()
+	client := makeTestClient()
+	b.SetClient(client)
+	b.Subscribe("route1", SubscriptionRequest{Event: Event_BlockFile, Scopes: []string{ZoneScope("1")}})
+	b.Subscribe("route2", SubscriptionRequest{Event: Event_BlockFile, Scopes: []string{"zone:*"}})
+	scopes := []string{"block:1"}
+	b.Publish(WaveEvent{Event: Event_BlockFile, Scopes: scopes, Data: &WSFileEventData{ZoneId: "1", FileName: "term", FileOp: FileOp_Append}})
+	b.Publish(WaveEvent{Event: Event_BlockFile, Data: WSFileEventData{ZoneId: "2", FileName: "term", FileOp: FileOp_Append}})
+	b.Publish(WaveEvent{Event: Event_BlockFile, Scopes: []string{ZoneScope("1")}, Data: &WSFileEventData{ZoneId: "1", FileName: "other", FileOp: FileOp_Create}})
+	if !reflect.DeepEqual(scopes, []string{"block:1"}) {
+		t.Errorf("publish modified the caller's scopes: %v", scopes)
+	}
+	var fileNames []string
+	for _, event := range client.getEvents("route1") {
+		fileNames = append(fileNames, event.Data.(*WSFileEventData).FileName)
+		if !event.HasScope(ZoneScope("1")) {
+			t.Errorf("expected event to have the zone scope, got %v", event.Scopes)
+		}
+	}
+	if !reflect.DeepEqual(fileNames, []string{"term", "other"}) {
+		t.Errorf("unexpected zone 1 events: %v", fileNames)
+	}
+	if events := client.getEvents("route2"); len(events) != 3 {
+		t.Errorf("expected 3 events for the zone star scope, got %d", len(events))
+	}
+}
+
+func TestSenderContext(t *testing.T) {
+	ctx := context.Background()
+	if sender := GetSenderFromContext(ctx); sender != "" {
+		t.Errorf("expected no sender, got %q", sender)
+	}
+	ctx = WithSender(ctx, "route1")
+	if sender := GetSenderFromContext(ctx); sender != "route1" {
+		t.Errorf("expected sender route1, got %q", sender)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2025, Command Line Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package wps
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// in-process subscribers (SubscribeChan), these receive events on a channel instead of through the Client
+
+const LocalSubRoutePrefix = "wpslocal:"
+const LocalSubChSize = 64
+
+// events are delivered once MaxEvents are pending or Window has passed since the first pending event
+type BatchOpts struct {
+	MaxEvents int
+	Window    time.Duration
+}
+
+// sent to the dead letter channel (see SetDeadLetterCh) for every event dropped by an in-process subscriber
+type DeadLetter struct {
+	RouteId string
+	Event   WaveEvent
+}
+
+// lock order: a localSub lock may be held while taking the broker lock, never the other way around
+type localSub struct {
+	Lock      *sync.Mutex
+	Broker    *BrokerType
+	RouteId   string
+	Ch        chan []WaveEvent
+	Batch     *BatchOpts
+	Pending   []WaveEvent
+	Timer     *time.Timer
+	DropCount int
+	Closed    bool
+}
+
+// subscribes an in-process listener, events are delivered as slices on the returned channel
+// (a single event per slice unless sub.Batch is set).  the channel is never blocked on, if it is full
+// the events are dropped (see SubscriberInfo.DropCount).  call the returned func to unsubscribe, it stops
+// routing to the subscriber first, then delivers any pending batch and closes the channel (so the
+// channel can be drained with range).  events still in flight when it is called are discarded.
+func (b *BrokerType) SubscribeChan(sub SubscriptionRequest) (<-chan []WaveEvent, func()) {
+	ls := &localSub{
+		Lock:    &sync.Mutex{},
+		Broker:  b,
+		RouteId: LocalSubRoutePrefix + uuid.NewString(),
+		Ch:      make(chan []WaveEvent, LocalSubChSize),
+		Batch:   sub.Batch,
+	}
+	if ls.Batch != nil && ls.Batch.MaxEvents <= 0 {
+		ls.Batch = &BatchOpts{MaxEvents: 1, Window: ls.Batch.Window}
+	}
+	b.Lock.Lock()
+	b.LocalSubs[ls.RouteId] = ls
+	b.Lock.Unlock()
+	b.Subscribe(ls.RouteId, sub)
+	var unsubOnce sync.Once
+	unsubFn := func() {
+		unsubOnce.Do(func() {
+			b.UnsubscribeAll(ls.RouteId)
+			b.Lock.Lock()
+			delete(b.LocalSubs, ls.RouteId)
+			b.Lock.Unlock()
+			ls.close()
+		})
+	}
+	return ls.Ch, unsubFn
+}
+
+func (b *BrokerType) getLocalSub(routeId string) *localSub {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	return b.LocalSubs[routeId]
+}
+
+func (ls *localSub) deliver(event WaveEvent) {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	if ls.Closed {
+		return
+	}
+	ls.Pending = append(ls.Pending, event)
+	if ls.Batch == nil || len(ls.Pending) >= ls.Batch.MaxEvents {
+		ls.flush_nolock()
+		return
+	}
+	if ls.Timer == nil {
+		ls.Timer = time.AfterFunc(ls.Batch.Window, ls.flushFromTimer)
+	}
+}
+
+func (ls *localSub) flushFromTimer() {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	ls.Timer = nil
+	if ls.Closed {
+		return
+	}
+	ls.flush_nolock()
+}
+
+func (ls *localSub) flush_nolock() {
+	if ls.Timer != nil {
+		ls.Timer.Stop()
+		ls.Timer = nil
+	}
+	if len(ls.Pending) == 0 {
+		return
+	}
+	select {
+	case ls.Ch <- ls.Pending:
+	default:
+		ls.DropCount += len(ls.Pending)
+		log.Printf("[wps] local subscriber %s is not keeping up, dropped %d events\n", ls.RouteId, len(ls.Pending))
+		ls.Broker.sendDeadLetters(ls.RouteId, ls.Pending)
+	}
+	ls.Pending = nil
+}
+
+// sets the (global) dead letter channel, nil to disable.  sends are non-blocking, if ch is full
+// the dead letters are discarded (so ch should be buffered and drained promptly)
+func (b *BrokerType) SetDeadLetterCh(ch chan DeadLetter) {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	b.DeadLetterCh = ch
+}
+
+func (b *BrokerType) sendDeadLetters(routeId string, events []WaveEvent) {
+	b.Lock.Lock()
+	ch := b.DeadLetterCh
+	b.Lock.Unlock()
+	if ch == nil {
+		return
+	}
+	for _, event := range events {
+		select {
+		case ch <- DeadLetter{RouteId: routeId, Event: event}:
+		default:
+		}
+	}
+}
+
+func (ls *localSub) close() {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	if ls.Closed {
+		return
+	}
+	// deliver (not drop) the pending batch, once Closed is set deliver is a no-op, so nothing can send after close
+	ls.flush_nolock()
+	ls.Closed = true
+	close(ls.Ch)
+}
+
+// returns (bufferDepth, dropCount), bufferDepth is the number of batches waiting on the channel
+func (ls *localSub) getStats() (int, int) {
+	ls.Lock.Lock()
+	defer ls.Lock.Unlock()
+	return len(ls.Ch), ls.DropCount
+}
@@ -13,6 +13,7 @@ const (
 	Event_UserInput        = "userinput"
 	Event_RouteGone        = "route:gone"
 	Event_WorkspaceUpdate  = "workspace:update"
+	Event_BlockStoreFlush  = "blockstore:flush"
 )
 
 type WaveEvent struct {
@@ -28,9 +29,12 @@ func (e WaveEvent) HasScope(scope string) bool {
 }
 
 type SubscriptionRequest struct {
-	Event     string   `json:"event"`
-	Scopes    []string `json:"scopes,omitempty"`
-	AllScopes bool     `json:"allscopes,omitempty"`
+	Event      string               `json:"event"`
+	Scopes     []string             `json:"scopes,omitempty"`
+	AllScopes  bool                 `json:"allscopes,omitempty"`
+	DataFilter map[string]any       `json:"datafilter,omitempty"` // only deliver events whose (json) data has these top-level key/values
+	Filter     func(WaveEvent) bool `json:"-"`                    // in-process only, only deliver events where Filter returns true
+	Batch      *BatchOpts           `json:"-"`                    // SubscribeChan only, deliver events in batches
 }
 
 const (
@@ -41,9 +45,29 @@ const (
 	FileOp_Invalidate = "invalidate"
 )
 
+// Seq is set by the broker when the event is published (callers should leave it 0).  it increases by 1 for each
+// event on the same file, so subscribers can drop events they have already applied (seq <= last seen) and detect
+// missed events (seq > last seen + 1, which requires a full re-read of the file).  a delete event (or deleting the
+// zone) ends the file's sequence, subscribers should forget the last seen seq, events for a recreated file start at 1
 type WSFileEventData struct {
 	ZoneId   string `json:"zoneid"`
 	FileName string `json:"filename"`
 	FileOp   string `json:"fileop"`
 	Data64   string `json:"data64"`
+	Seq      int64  `json:"seq,omitempty"`
+}
+
+// blockfile events are also published to the zone scope of their file ("zone:<zoneid>", see ZoneScope), so a
+// subscription to Event_BlockFile with Scopes: []string{ZoneScope(zoneId)} only receives that zone's file events
+const ZoneScopePrefix = "zone:"
+
+func ZoneScope(zoneId string) string {
+	return ZoneScopePrefix + zoneId
+}
+
+type WSBlockStoreFlushData struct {
+	NumFlushed   int   `json:"numflushed"`
+	BytesWritten int64 `json:"byteswritten"`
+	DurationMs   int64 `json:"durationms"`
+	NumErrors    int   `json:"numerrors"`
 }
@@ -272,6 +272,7 @@ func (ws *WshServer) FileCreateCommand(ctx context.Context, data wshrpc.CommandF
 	wps.Broker.Publish(wps.WaveEvent{
 		Event:  wps.Event_BlockFile,
 		Scopes: []string{waveobj.MakeORef(waveobj.OType_Block, data.ZoneId).String()},
+		Sender: wps.GetSenderFromContext(ctx),
 		Data: &wps.WSFileEventData{
 			ZoneId:   data.ZoneId,
 			FileName: data.FileName,
@@ -282,13 +283,18 @@ func (ws *WshServer) FileCreateCommand(ctx context.Context, data wshrpc.CommandF
 }
 
 func (ws *WshServer) FileDeleteCommand(ctx context.Context, data wshrpc.CommandFileData) error {
-	err := filestore.WFS.DeleteFile(ctx, data.ZoneId, data.FileName)
+	err := filestore.WFS.DeleteFileStrict(ctx, data.ZoneId, data.FileName)
+	if err == fs.ErrNotExist {
+		// already deleted
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("error deleting blockfile: %w", err)
 	}
 	wps.Broker.Publish(wps.WaveEvent{
 		Event:  wps.Event_BlockFile,
 		Scopes: []string{waveobj.MakeORef(waveobj.OType_Block, data.ZoneId).String()},
+		Sender: wps.GetSenderFromContext(ctx),
 		Data: &wps.WSFileEventData{
 			ZoneId:   data.ZoneId,
 			FileName: data.FileName,
@@ -410,6 +416,7 @@ func (ws *WshServer) FileWriteCommand(ctx context.Context, data wshrpc.CommandFi
 	wps.Broker.Publish(wps.WaveEvent{
 		Event:  wps.Event_BlockFile,
 		Scopes: []string{waveobj.MakeORef(waveobj.OType_Block, data.ZoneId).String()},
+		Sender: wps.GetSenderFromContext(ctx),
 		Data: &wps.WSFileEventData{
 			ZoneId:   data.ZoneId,
 			FileName: data.FileName,
@@ -456,6 +463,7 @@ func (ws *WshServer) FileAppendCommand(ctx context.Context, data wshrpc.CommandF
 	wps.Broker.Publish(wps.WaveEvent{
 		Event:  wps.Event_BlockFile,
 		Scopes: []string{waveobj.MakeORef(waveobj.OType_Block, data.ZoneId).String()},
+		Sender: wps.GetSenderFromContext(ctx),
 		Data: &wps.WSFileEventData{
 			ZoneId:   data.ZoneId,
 			FileName: data.FileName,
@@ -481,6 +489,7 @@ func (ws *WshServer) FileAppendIJsonCommand(ctx context.Context, data wshrpc.Com
 	wps.Broker.Publish(wps.WaveEvent{
 		Event:  wps.Event_BlockFile,
 		Scopes: []string{waveobj.MakeORef(waveobj.OType_Block, data.ZoneId).String()},
+		Sender: wps.GetSenderFromContext(ctx),
 		Data: &wps.WSFileEventData{
 			ZoneId:   data.ZoneId,
 			FileName: data.FileName,
@@ -92,12 +92,21 @@ func noRouteErr(routeId string) error {
 }
 
 func (router *WshRouter) SendEvent(routeId string, event wps.WaveEvent) {
+	router.SendEventSync(routeId, event)
+}
+
+// returns an error if the route is gone or the event cannot be sent
+// (returns once the message has been queued to the route)
+func (router *WshRouter) SendEventSync(routeId string, event wps.WaveEvent) (rtnErr error) {
 	defer func() {
-		panichandler.PanicHandler("WshRouter.SendEvent", recover())
+		panicErr := panichandler.PanicHandler("WshRouter.SendEvent", recover())
+		if panicErr != nil {
+			rtnErr = panicErr
+		}
 	}()
 	rpc := router.GetRpc(routeId)
 	if rpc == nil {
-		return
+		return noRouteErr(routeId)
 	}
 	msg := RpcMessage{
 		Command: wshrpc.Command_EventRecv,
@@ -106,10 +115,10 @@ func (router *WshRouter) SendEvent(routeId string, event wps.WaveEvent) {
 	}
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
-		// nothing to do
-		return
+		return fmt.Errorf("error marshaling event: %w", err)
 	}
 	rpc.SendRpcMessage(msgBytes)
+	return nil
 }
 
 func (router *WshRouter) handleNoRoute(msg RpcMessage) {
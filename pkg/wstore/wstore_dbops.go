@@ -15,6 +15,7 @@ import (
 	"github.com/wavetermdev/waveterm/pkg/panichandler"
 	"github.com/wavetermdev/waveterm/pkg/util/dbutil"
 	"github.com/wavetermdev/waveterm/pkg/waveobj"
+	"github.com/wavetermdev/waveterm/pkg/wps"
 )
 
 var ErrNotFound = fmt.Errorf("not found")
@@ -295,7 +296,9 @@ func DBDelete(ctx context.Context, otype string, id string) error {
 		err := filestore.WFS.DeleteZone(deleteCtx, id)
 		if err != nil {
 			log.Printf("error deleting filestore zone (after deleting block): %v", err)
+			return
 		}
+		wps.Broker.ClearFileSeqs(id)
 	}()
 	return nil
 }